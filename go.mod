@@ -3,8 +3,15 @@ module github.com/cryptopatron/koen-backend
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/ethereum/go-ethereum v1.10.4
 	github.com/go-chi/chi/v5 v5.0.3
+	github.com/google/uuid v1.1.5
+	github.com/lib/pq v1.9.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	go.mongodb.org/mongo-driver v1.5.3
+	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
+	golang.org/x/text v0.3.6
+	gopkg.in/yaml.v2 v2.4.0
 )
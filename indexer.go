@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/indexer"
+)
+
+// Entry point for the 'indexer' subcommand. Follows every chain with an RPC endpoint
+// until interrupted, takes the same flags as the server
+func runIndexer(args []string) error {
+	cfg, err := config.Load(args)
+	if err != nil {
+		return err
+	}
+	nodes := newNodes(cfg.Chains)
+	if len(nodes) == 0 {
+		return fmt.Errorf("no chain has an RPC endpoint, set KOEN_POLYGON_RPC_URL or KOEN_ETHEREUM_RPC_URL")
+	}
+
+	conn := newDBConn(cfg)
+	conn.Open()
+	defer conn.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	rates := newPrices(cfg.Prices)
+	var wg sync.WaitGroup
+	for name, node := range nodes {
+		c, _ := chain.Lookup(name)
+		chainCfg, _ := cfg.Chains.ByName(name)
+		ix := &indexer.Indexer{
+			DB:            conn,
+			Chain:         c,
+			Client:        node.Client,
+			Confirmations: node.Confirmations,
+			StartBlock:    chainCfg.StartBlock,
+			MaxBlockRange: cfg.Indexer.MaxBlockRange,
+			Prices:        rates,
+		}
+		log.Printf("Indexing %s", name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ix.Run(ctx, cfg.Indexer.PollInterval)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/signer"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const keystoreUsage = `Usage: koen keystore new|import [config flags]
+
+new     generates a hot wallet key
+import  reads a hex private key from stdin
+
+Keys go in the configured keystore directory, encrypted with the KEK`
+
+// Entry point for the 'keystore' subcommand. Prints the address of the stored key,
+// which is what withdrawals.hotWallet has to be set to
+func runKeystore(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("missing keystore command\n%s", keystoreUsage)
+	}
+	cfg, err := config.Load(args[1:])
+	if err != nil {
+		return err
+	}
+	if cfg.Withdrawals.KeystoreDir == "" {
+		return fmt.Errorf("no keystore directory, set KOEN_KEYSTORE_DIR")
+	}
+	keys := signer.NewKeystore(cfg.Withdrawals)
+
+	var address common.Address
+	switch args[0] {
+	case "new":
+		address, err = keys.Generate()
+	case "import":
+		line, readErr := bufio.NewReader(os.Stdin).ReadString('\n')
+		if readErr != nil && line == "" {
+			return readErr
+		}
+		key, keyErr := crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(line), "0x"))
+		if keyErr != nil {
+			return keyErr
+		}
+		address, err = keys.Import(key)
+	default:
+		return fmt.Errorf("unknown keystore command %q\n%s", args[0], keystoreUsage)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(address.Hex())
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/db"
+	"github.com/cryptopatron/koen-backend/pkg/migrations"
+)
+
+const migrateUsage = `Usage: koen migrate [-dry-run] [-to version] [-steps n] up|down|status [config flags]`
+
+// Entry point for the 'migrate' subcommand
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "Print the migrations that would run without applying them")
+	to := fs.Int("to", 0, "Migrate up to and including this version (default: latest)")
+	steps := fs.Int("steps", 1, "Number of migrations to revert with 'down'")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), migrateUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return fmt.Errorf("missing migrate command")
+	}
+	action := fs.Arg(0)
+
+	cfg, err := config.Load(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	if cfg.Storage != config.StorageMongo {
+		return fmt.Errorf("koen migrate only manages Mongo, %s schemas are migrated on startup", cfg.Storage)
+	}
+
+	conn := &db.MongoInstance{
+		URI:            string(cfg.Mongo.URI),
+		Database:       cfg.Mongo.Database,
+		ConnectTimeout: cfg.Mongo.ConnectTimeout,
+		Timeout:        cfg.Mongo.Timeout,
+	}
+	// Indexes go on after the migrations, which may have to fix data they'd turn down
+	conn.Connect()
+	defer conn.Close()
+
+	ctx := context.Background()
+	migrator := migrations.NewMigrator(conn.DB())
+	migrator.DryRun = *dryRun
+
+	var done []migrations.Migration
+	switch action {
+	case "status":
+		pending, err := migrator.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d pending migration(s)\n", len(pending))
+		for _, m := range pending {
+			fmt.Println("  ", m)
+		}
+		return nil
+	case "up":
+		done, err = migrator.Up(ctx, *to)
+	case "down":
+		done, err = migrator.Down(ctx, *steps)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown migrate command %q", action)
+	}
+
+	verb := "Applied"
+	if *dryRun {
+		verb = "Would apply"
+	}
+	if action == "down" {
+		verb = "Reverted"
+		if *dryRun {
+			verb = "Would revert"
+		}
+	}
+	for _, m := range done {
+		log.Printf("%s %s", verb, m)
+	}
+	if err == nil && action == "up" && !*dryRun {
+		conn.EnsureIndexes()
+	}
+	return err
+}
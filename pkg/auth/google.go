@@ -11,6 +11,9 @@ import (
 	"github.com/dgrijalva/jwt-go"
 )
 
+// OAuth client ID our Google JWTs have to be issued for
+var googleAudience = "116852492535-37n739s732ui71hkfm19n5r3agv6g9c5.apps.googleusercontent.com"
+
 // GoogleClaims -
 type GoogleClaims struct {
 	Email         string `json:"email"`
@@ -49,7 +52,7 @@ func (gc *GoogleClaims) ValidateJWT(tokenString string) error {
 		return errors.New("iss is invalid")
 	}
 
-	if claims.Audience != "116852492535-37n739s732ui71hkfm19n5r3agv6g9c5.apps.googleusercontent.com" {
+	if claims.Audience != googleAudience {
 		return errors.New("aud is invalid")
 	}
 
@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
+	"github.com/cryptopatron/koen-backend/pkg/config"
 	"github.com/cryptopatron/koen-backend/pkg/utils"
 )
 
@@ -33,32 +35,47 @@ func (c *Claims) ValidateJWT(token string) error {
 	return nil
 }
 
+// Bearer token from the Authorization header, if there is one
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	if h := r.Header.Get("Authorization"); len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+		return strings.TrimSpace(h[len(prefix):])
+	}
+	return ""
+}
+
 // Middleware
+// The JWT is taken from the Authorization header when set, which is how GET and
+// DELETE requests send it. Otherwise it's expected as idToken in the JSON body
 func HandleJWT(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		if r.Body == nil {
-			utils.Respond(http.StatusBadRequest, "Empty body").ServeHTTP(w, r)
-			return
-		}
-		//Read request body into a copy buffer
-		copyBuf, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			utils.Respond(http.StatusInternalServerError, err.Error()).ServeHTTP(w, r)
-		}
+		jwt := &JWT{IdToken: bearerToken(r)}
+		if jwt.IdToken == "" {
+			if r.Body == nil {
+				utils.Respond(http.StatusBadRequest, "Empty body").ServeHTTP(w, r)
+				return
+			}
+			//Read request body into a copy buffer
+			copyBuf, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				utils.Respond(http.StatusInternalServerError, err.Error()).ServeHTTP(w, r)
+			}
 
-		jwt := &JWT{}
-		// Passing in copy of request body to decode
-		err = utils.DecodeJSON(bytes.NewReader(copyBuf), jwt, true)
-		if err != nil {
-			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
-			return
+			// Passing in copy of request body to decode
+			err = utils.DecodeJSON(bytes.NewReader(copyBuf), jwt, true)
+			if err != nil {
+				utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+				return
+			}
+			// Regenerate request body from copyBuffer
+			r.Body = ioutil.NopCloser(bytes.NewBuffer(copyBuf))
 		}
 
 		// Validate the JWT
 		claims := &Claims{}
-		err = claims.ValidateJWT(jwt.IdToken)
+		err := claims.ValidateJWT(jwt.IdToken)
 		if err != nil {
 			fmt.Println(err)
 			utils.Respond(http.StatusUnauthorized, "Invalid google auth").ServeHTTP(w, r)
@@ -67,10 +84,34 @@ func HandleJWT(next http.Handler) http.Handler {
 
 		// Create user data context from validated JWT claims
 		ctx := context.WithValue(r.Context(), "userData", *claims)
-		// Regenerate request body from copyBuffer
-		r.Body = ioutil.NopCloser(bytes.NewBuffer(copyBuf))
 		// Pass request with regenerated body and user data context to next HTTP Handler
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 
 }
+
+// OptionalJWT is HandleJWT for routes anyone can see, where signed in users might see more.
+// Only the Authorization header is looked at, requests without one go through as they are
+func OptionalJWT(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims := &Claims{}
+		if err := claims.ValidateJWT(token); err != nil {
+			// Better than quietly showing less, the client would never know to sign in again
+			utils.Respond(http.StatusUnauthorized, "Invalid token").ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "userData", *claims)))
+	})
+}
+
+// Configure sets up JWT signing and validation from the app config
+func Configure(c config.AuthConfig) {
+	jwtKey = string(c.JWTSecret)
+	jwtExpiry = c.JWTExpiry
+	googleAudience = c.GoogleAudience
+}
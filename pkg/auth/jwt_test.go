@@ -154,5 +154,61 @@ func TestHandleJWT(t *testing.T) {
 		}
 	})
 
+	t.Run("HTTP 200 on JWT in the Authorization header", func(t *testing.T) {
+		jwt, err := generateTestJWT()
+		if err != nil {
+			t.Error(err)
+		}
+
+		req, err := http.NewRequest("GET", "/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+jwt.IdToken)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		got := rr.Code
+		want := http.StatusOK
+
+		if got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
 	// TODOL HTTP 200 on Google-based JWT
 }
+
+func TestOptionalJWT(t *testing.T) {
+	handler := OptionalJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value("userData").(Claims); ok {
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	jwt, err := generateTestJWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"Anonymous requests go through", "", http.StatusOK},
+		{"Signed in requests carry their claims", "Bearer " + jwt.IdToken, http.StatusAccepted},
+		{"Bad tokens are rejected", "Bearer fakeasstoken", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, rr.Code, c.want)
+		}
+	}
+}
@@ -13,8 +13,21 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
-// Create the JWT key used to create the signature
-const jwtKey = "my_secret_key"
+// Key used to sign wallet JWTs and how long they stay valid.
+// Set from config by Configure, there's no default key to fall back on
+var (
+	jwtKey    string
+	jwtExpiry = 50 * time.Minute
+)
+
+var ErrNotConfigured = errors.New("auth: no JWT secret, auth.Configure hasn't been called")
+
+func signingKey() ([]byte, error) {
+	if jwtKey == "" {
+		return nil, ErrNotConfigured
+	}
+	return []byte(jwtKey), nil
+}
 
 type Payload struct {
 	Nonce               string `json:"nonce"`
@@ -70,8 +83,12 @@ func verifySignature(payload Payload) (bool, error) {
 func createJWT(c WalletClaims) (string, error) {
 	// Declare the token with the algorithm used for signing, and the claims
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, c)
+	key, err := signingKey()
+	if err != nil {
+		return "", err
+	}
 	// Create the JWT string
-	tokenString, err := token.SignedString([]byte(jwtKey))
+	tokenString, err := token.SignedString(key)
 	if err != nil {
 		return "", err
 	}
@@ -85,7 +102,7 @@ func (wc *WalletClaims) ValidateJWT(tokenString string) error {
 	// if the token is invalid (if it has expired according to the expiry time we set on sign in),
 	// or if the signature does not match
 	tkn, err := jwt.ParseWithClaims(tokenString, wc, func(token *jwt.Token) (interface{}, error) {
-		return []byte(jwtKey), nil
+		return signingKey()
 	})
 	if err != nil {
 		return err
@@ -123,7 +140,7 @@ func HandleWalletAuthentication() http.HandlerFunc {
 			return
 		}
 		// Declare the expiration time of the token
-		expirationTime := time.Now().Add(50 * time.Minute)
+		expirationTime := time.Now().Add(jwtExpiry)
 		// Create the JWT claims, which includes the username and expiry time
 		claims := &WalletClaims{
 			WalletPublicAddress: payload.WalletPublicAddress,
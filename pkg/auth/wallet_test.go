@@ -8,13 +8,21 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/cryptopatron/koen-backend/pkg/config"
 	"github.com/cryptopatron/koen-backend/pkg/utils"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
+func TestMain(m *testing.M) {
+	Configure(config.AuthConfig{JWTSecret: "test_secret_key", JWTExpiry: 50 * time.Minute, GoogleAudience: googleAudience})
+	os.Exit(m.Run())
+}
+
 func generateTestPayload(nonce string) Payload {
 	privateKey, err := crypto.GenerateKey()
 	if err != nil {
@@ -188,3 +196,20 @@ func TestHandleWalletAuthentication(t *testing.T) {
 		}
 	})
 }
+
+func TestJWTWithoutConfigure(t *testing.T) {
+	token, err := createJWT(WalletClaims{WalletPublicAddress: "0x1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := jwtKey
+	jwtKey = ""
+	defer func() { jwtKey = key }()
+
+	if _, err := createJWT(WalletClaims{WalletPublicAddress: "0x1"}); err != ErrNotConfigured {
+		t.Errorf("got %v, want %v", err, ErrNotConfigured)
+	}
+	if err := (&WalletClaims{}).ValidateJWT(token); err == nil {
+		t.Error("got nil, want tokens turned down without a key")
+	}
+}
@@ -0,0 +1,33 @@
+// Package blob stores uploaded files somewhere they can be served from
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+)
+
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// Store keeps files under slash separated keys, like avatars/<user>/<id>/large.jpg
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	// Deleting a key that doesn't exist isn't an error
+	Delete(ctx context.Context, key string) error
+	// Public URL a stored key is served at
+	URL(key string) string
+}
+
+// Keys are relative and can't climb out of wherever the store keeps them
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	return path.Clean(key) == key && key != "." && !strings.HasPrefix(key, "../") && key != ".."
+}
+
+func joinURL(base, key string) string {
+	return strings.TrimSuffix(base, "/") + "/" + key
+}
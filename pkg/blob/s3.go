@@ -0,0 +1,150 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Store keeps files in a bucket of any S3 compatible service. Requests use
+// path style addressing (endpoint/bucket/key) so MinIO and friends work too
+type S3Store struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Defaults to the object's URL on the endpoint
+	PublicURL string
+	// Defaults to http.DefaultClient
+	Client *http.Client
+}
+
+func (s *S3Store) objectURL(key string) string {
+	return joinURL(strings.TrimSuffix(s.Endpoint, "/")+"/"+s.Bucket, escapePath(key))
+}
+
+func (s *S3Store) do(ctx context.Context, method, key string, body []byte, contentType string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), s.AccessKey, s.SecretKey, s.Region, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("s3 %s %s: %s: %s", method, key, res.Status, msg)
+	}
+	return nil
+}
+
+// Put reads all of r, the payload has to be hashed before it's sent
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.do(ctx, http.MethodPut, key, body, contentType)
+}
+
+// S3 answers deletes of missing keys with a 204 as well
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	return s.do(ctx, http.MethodDelete, key, nil, "")
+}
+
+func (s *S3Store) URL(key string) string {
+	if s.PublicURL != "" {
+		return joinURL(s.PublicURL, escapePath(key))
+	}
+	return s.objectURL(key)
+}
+
+// Percent encodes everything but unreserved characters and slashes, the way SigV4 wants paths
+func escapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Signs req with AWS Signature Version 4 for the s3 service. Every header already on
+// the request gets signed, along with the host. There's no query string support, we never need one
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, uri, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
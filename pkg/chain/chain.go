@@ -0,0 +1,106 @@
+// Package chain knows which chains and tokens creators can get paid in
+package chain
+
+import (
+	"errors"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+type Token struct {
+	Symbol   string
+	Decimals int
+	// ERC-20 contract address, empty for the chain's native token
+	Contract string
+}
+
+func (t Token) Native() bool {
+	return t.Contract == ""
+}
+
+type Chain struct {
+	// What the API calls it
+	Name string
+	// EIP-155 chain ID
+	ID     int64
+	Tokens []Token
+}
+
+var Chains = []Chain{
+	{Name: "polygon", ID: 137, Tokens: []Token{
+		{Symbol: "MATIC", Decimals: 18},
+		{Symbol: "USDC", Decimals: 6, Contract: "0x2791Bca1f2de4661ED88A30C99A7a9449Aa84174"},
+		{Symbol: "USDT", Decimals: 6, Contract: "0xc2132D05D31c914a87C6611C10748AEb04B58e8F"},
+		{Symbol: "DAI", Decimals: 18, Contract: "0x8f3Cf7ad23Cd3CaDbD9735AFf958023239c6A063"},
+	}},
+	{Name: "ethereum", ID: 1, Tokens: []Token{
+		{Symbol: "ETH", Decimals: 18},
+		{Symbol: "USDC", Decimals: 6, Contract: "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"},
+		{Symbol: "USDT", Decimals: 6, Contract: "0xdAC17F958D2ee523a2206206994597C13D831ec7"},
+		{Symbol: "DAI", Decimals: 18, Contract: "0x6B175474E89094C44Da98b954EedeAC495271d0F"},
+	}},
+}
+
+// Lookup finds a chain by name, ignoring case
+func Lookup(name string) (Chain, bool) {
+	for _, c := range Chains {
+		if strings.EqualFold(c.Name, name) {
+			return c, true
+		}
+	}
+	return Chain{}, false
+}
+
+// Token finds a token on c by symbol, ignoring case
+func (c Chain) Token(symbol string) (Token, bool) {
+	for _, t := range c.Tokens {
+		if strings.EqualFold(t.Symbol, symbol) {
+			return t, true
+		}
+	}
+	return Token{}, false
+}
+
+var (
+	ErrInvalidAmount = errors.New("amount must be a positive decimal number")
+	ErrTooPrecise    = errors.New("amount has more decimals than the token")
+)
+
+var decimalAmount = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// ParseAmount turns a decimal amount like "2.5" into the token's base units.
+// Amounts are strings all the way so nothing is lost to floating point
+func ParseAmount(s string, decimals int) (*big.Int, error) {
+	if !decimalAmount.MatchString(s) {
+		return nil, ErrInvalidAmount
+	}
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], strings.TrimRight(s[i+1:], "0")
+	}
+	if len(frac) > decimals {
+		return nil, ErrTooPrecise
+	}
+	units, _ := new(big.Int).SetString(whole+frac+strings.Repeat("0", decimals-len(frac)), 10)
+	if units.Sign() <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	return units, nil
+}
+
+// FormatAmount turns base units back into a decimal amount, without trailing zeros
+func FormatAmount(units *big.Int, decimals int) string {
+	s := units.String()
+	if decimals == 0 {
+		return s
+	}
+	if len(s) <= decimals {
+		s = strings.Repeat("0", decimals-len(s)+1) + s
+	}
+	whole, frac := s[:len(s)-decimals], strings.TrimRight(s[len(s)-decimals:], "0")
+	if frac == "" {
+		return whole
+	}
+	return whole + "." + frac
+}
@@ -0,0 +1,64 @@
+package chain
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestAmounts(t *testing.T) {
+	cases := []struct {
+		amount   string
+		decimals int
+		units    string
+		format   string
+	}{
+		{"2.5", 18, "2500000000000000000", "2.5"},
+		{"10", 6, "10000000", "10"},
+		{"0.000001", 6, "1", "0.000001"},
+		{"007.1000", 6, "7100000", "7.1"},
+	}
+	for _, c := range cases {
+		units, err := ParseAmount(c.amount, c.decimals)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if units.String() != c.units {
+			t.Errorf("got %v for %s, want %v", units, c.amount, c.units)
+		}
+		if got := FormatAmount(units, c.decimals); got != c.format {
+			t.Errorf("got %v, want %v", got, c.format)
+		}
+	}
+
+	for amount, want := range map[string]error{
+		"0":         ErrInvalidAmount,
+		"0.000":     ErrInvalidAmount,
+		"-1":        ErrInvalidAmount,
+		"1e18":      ErrInvalidAmount,
+		".5":        ErrInvalidAmount,
+		"1.0000001": ErrTooPrecise,
+	} {
+		if _, err := ParseAmount(amount, 6); err != want {
+			t.Errorf("got %v for %s, want %v", err, amount, want)
+		}
+	}
+	if got := FormatAmount(big.NewInt(5), 0); got != "5" {
+		t.Errorf("got %v, want 5", got)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	c, ok := Lookup("Polygon")
+	if !ok || c.ID != 137 {
+		t.Fatalf("got %+v, want polygon", c)
+	}
+	if token, ok := c.Token("usdc"); !ok || token.Decimals != 6 || token.Native() {
+		t.Errorf("got %+v, want USDC with 6 decimals", token)
+	}
+	if token, ok := c.Token("MATIC"); !ok || !token.Native() {
+		t.Errorf("got %+v, want native MATIC", token)
+	}
+	if _, ok := c.Token("ETH"); ok {
+		t.Error("got ETH on polygon, want it missing")
+	}
+}
@@ -0,0 +1,652 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Supported environment profiles
+const (
+	EnvDev  = "dev"
+	EnvTest = "test"
+	EnvProd = "prod"
+)
+
+// Storage backends
+const (
+	StorageMongo    = "mongo"
+	StorageSQLite   = "sqlite"
+	StoragePostgres = "postgres"
+)
+
+// Where uploaded files go
+const (
+	BlobLocal = "local"
+	BlobS3    = "s3"
+)
+
+// Secret is a string that never shows up in logs.
+// Use the plain string conversion when the actual value is needed
+type Secret string
+
+const redacted = "[REDACTED]"
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+type MongoConfig struct {
+	URI      Secret `yaml:"uri"`
+	Database string `yaml:"database"`
+	// Upper bound for connecting and pinging on startup
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	// Upper bound for a single query, on top of the request's own deadline
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type SQLConfig struct {
+	// Data source name passed to the driver, a file path for SQLite
+	// or a connection URL for PostgreSQL
+	DSN            Secret        `yaml:"dsn"`
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	Timeout        time.Duration `yaml:"timeout"`
+}
+
+type AuthConfig struct {
+	JWTSecret      Secret        `yaml:"jwtSecret"`
+	JWTExpiry      time.Duration `yaml:"jwtExpiry"`
+	GoogleAudience string        `yaml:"googleAudience"`
+}
+
+type PaginationConfig struct {
+	// Key for signing list cursors
+	CursorSecret Secret `yaml:"cursorSecret"`
+	DefaultLimit int    `yaml:"defaultLimit"`
+	MaxLimit     int    `yaml:"maxLimit"`
+}
+
+type PageNamesConfig struct {
+	// How long creators have to wait between renaming their page
+	RenameCooldown time.Duration `yaml:"renameCooldown"`
+	// How long an old page name keeps pointing at its previous owner
+	// before someone else can register it
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+}
+
+type AccountsConfig struct {
+	// How long deleted accounts are kept around before being purged for good
+	RetentionPeriod time.Duration `yaml:"retentionPeriod"`
+	// How often to look for accounts to purge
+	PurgeInterval time.Duration `yaml:"purgeInterval"`
+}
+
+type S3Config struct {
+	// Base URL of the S3 API, e.g. https://s3.eu-west-1.amazonaws.com or a MinIO server
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"accessKey"`
+	SecretKey Secret `yaml:"secretKey"`
+	// Where objects can be fetched publicly, like a CDN in front of the bucket.
+	// Defaults to the object's URL on the endpoint
+	PublicURL string `yaml:"publicUrl"`
+}
+
+type MediaConfig struct {
+	// Which blob store keeps uploads, one of the Blob constants
+	Storage string `yaml:"storage"`
+	// Directory uploads are written to by the local store, served under BaseURL
+	Dir     string   `yaml:"dir"`
+	BaseURL string   `yaml:"baseUrl"`
+	S3      S3Config `yaml:"s3"`
+	// Largest upload we accept, in bytes
+	MaxUploadSize int64 `yaml:"maxUploadSize"`
+}
+
+type ChainConfig struct {
+	// JSON-RPC endpoint of a node, payments on the chain can't be verified without one.
+	// Provider URLs tend to have an API key in them
+	RPCURL Secret `yaml:"rpcUrl"`
+	// Blocks on top of a payment's own before it counts, so it won't be reorged away
+	Confirmations int `yaml:"confirmations"`
+	// Where the indexer starts on its first run. Zero starts at the current head
+	StartBlock uint64 `yaml:"startBlock"`
+}
+
+type ChainsConfig struct {
+	Polygon  ChainConfig `yaml:"polygon"`
+	Ethereum ChainConfig `yaml:"ethereum"`
+}
+
+// ByName finds the config of a chain by the name the API uses for it
+func (c ChainsConfig) ByName(name string) (ChainConfig, bool) {
+	switch name {
+	case "polygon":
+		return c.Polygon, true
+	case "ethereum":
+		return c.Ethereum, true
+	}
+	return ChainConfig{}, false
+}
+
+type SubscriptionsConfig struct {
+	// How long past due subscriptions have to be paid before they're canceled
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+	// How often to look for lapsed subscriptions
+	CheckInterval time.Duration `yaml:"checkInterval"`
+}
+
+type IndexerConfig struct {
+	// How often to look for new blocks
+	PollInterval time.Duration `yaml:"pollInterval"`
+	// Most blocks fetched in one eth_getLogs call, providers reject larger ranges
+	MaxBlockRange uint64 `yaml:"maxBlockRange"`
+}
+
+type GatingConfig struct {
+	// How long token balances are trusted before asking the node again, zero always asks
+	BalanceCacheTTL time.Duration `yaml:"balanceCacheTtl"`
+}
+
+type WalletsConfig struct {
+	// BIP-44 account xpub, m/44'/60'/0', creators' deposit addresses are derived from.
+	// Can't spend anything, but it links every deposit address to us
+	XPub Secret `yaml:"xpub"`
+}
+
+type WithdrawalsConfig struct {
+	// Directory of the keystore V3 files withdrawals are signed with, withdrawals are off without one
+	KeystoreDir string `yaml:"keystoreDir"`
+	// Key encryption key, the passphrase keystore files are encrypted with
+	KEK Secret `yaml:"kek"`
+	// Address of the hot wallet withdrawals are paid from, its key has to be in the keystore
+	HotWallet string `yaml:"hotWallet"`
+	// Most a creator can withdraw in a day, by token symbol across chains and in token
+	// units like "250.5". Tokens without a limit can't be withdrawn
+	DailyLimits map[string]string `yaml:"dailyLimits"`
+	// Most withdrawals a creator can make in a day
+	MaxPerDay int `yaml:"maxPerDay"`
+}
+
+type EarningsConfig struct {
+	// Platform's cut of every payment in basis points, 250 is 2.5%
+	FeeBps int `yaml:"feeBps"`
+}
+
+type PricesConfig struct {
+	// CoinGecko compatible API fiat prices come from, amounts are shown in tokens only without one
+	URL    string `yaml:"url"`
+	APIKey Secret `yaml:"apiKey"`
+	// How long a current price is used before asking again, zero always asks
+	CacheTTL time.Duration `yaml:"cacheTtl"`
+}
+
+type ENSConfig struct {
+	// How long names and avatars are used before looking again, zero always looks
+	CacheTTL time.Duration `yaml:"cacheTtl"`
+	// Where ipfs:// avatars are loaded from, they're left out without one
+	IPFSGateway string `yaml:"ipfsGateway"`
+}
+
+type Config struct {
+	Env       string `yaml:"env"`
+	Port      string `yaml:"port"`
+	ServePath string `yaml:"servePath"`
+	// Which backend keeps our data, one of the Storage constants
+	Storage       string              `yaml:"storage"`
+	Mongo         MongoConfig         `yaml:"mongo"`
+	SQL           SQLConfig           `yaml:"sql"`
+	Auth          AuthConfig          `yaml:"auth"`
+	Pagination    PaginationConfig    `yaml:"pagination"`
+	PageNames     PageNamesConfig     `yaml:"pageNames"`
+	Accounts      AccountsConfig      `yaml:"accounts"`
+	Media         MediaConfig         `yaml:"media"`
+	Chains        ChainsConfig        `yaml:"chains"`
+	Indexer       IndexerConfig       `yaml:"indexer"`
+	Subscriptions SubscriptionsConfig `yaml:"subscriptions"`
+	Gating        GatingConfig        `yaml:"gating"`
+	Wallets       WalletsConfig       `yaml:"wallets"`
+	Withdrawals   WithdrawalsConfig   `yaml:"withdrawals"`
+	Earnings      EarningsConfig      `yaml:"earnings"`
+	Prices        PricesConfig        `yaml:"prices"`
+	ENS           ENSConfig           `yaml:"ens"`
+}
+
+// Account of the "abandon abandon ... about" test mnemonic, anyone can spend what's sent to it
+const testXPub = "xpub6DCoCpSuQZB2jawqnGMEPS63ePKWkwWPH4TU45Q7LPXWuNd8TMtVxRrgjtEshuqpK3mdhaWHPFsBngh5GFZaM6si3yZdUsT8ddYM3PwnATt"
+
+const defaultGoogleAudience = "116852492535-37n739s732ui71hkfm19n5r3agv6g9c5.apps.googleusercontent.com"
+
+// A fresh key for every run, so dev and test never sign with one that's public.
+// Tokens don't survive a restart, which is fine outside prod
+func randomSecret() Secret {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return Secret(hex.EncodeToString(b))
+}
+
+// Profile returns the default config for an environment.
+// Only dev and test come with usable secrets, prod has to be configured explicitly
+func Profile(env string) (Config, error) {
+	c := Config{
+		Env:       env,
+		Port:      "8008",
+		ServePath: "../front-end/dist/dropcoin/",
+		Storage:   StorageMongo,
+		Mongo: MongoConfig{
+			URI:            "mongodb://localhost:27017",
+			Database:       "koen_test",
+			ConnectTimeout: 10 * time.Second,
+			Timeout:        5 * time.Second,
+		},
+		SQL: SQLConfig{
+			DSN:            "koen.db",
+			ConnectTimeout: 10 * time.Second,
+			Timeout:        5 * time.Second,
+		},
+		Auth: AuthConfig{
+			JWTSecret:      randomSecret(),
+			JWTExpiry:      50 * time.Minute,
+			GoogleAudience: defaultGoogleAudience,
+		},
+		Pagination: PaginationConfig{
+			CursorSecret: randomSecret(),
+			DefaultLimit: 20,
+			MaxLimit:     100,
+		},
+		PageNames: PageNamesConfig{
+			RenameCooldown: 30 * 24 * time.Hour,
+			GracePeriod:    90 * 24 * time.Hour,
+		},
+		Accounts: AccountsConfig{
+			RetentionPeriod: 30 * 24 * time.Hour,
+			PurgeInterval:   time.Hour,
+		},
+		Media: MediaConfig{
+			Storage:       BlobLocal,
+			Dir:           "media",
+			BaseURL:       "/media",
+			S3:            S3Config{Region: "us-east-1"},
+			MaxUploadSize: 10 << 20,
+		},
+		Chains: ChainsConfig{
+			// Polygon checkpoints to Ethereum every few hundred blocks and reorgs deeper than Ethereum does
+			Polygon:  ChainConfig{Confirmations: 128},
+			Ethereum: ChainConfig{Confirmations: 12},
+		},
+		Indexer: IndexerConfig{
+			PollInterval:  15 * time.Second,
+			MaxBlockRange: 1000,
+		},
+		Subscriptions: SubscriptionsConfig{
+			GracePeriod:   7 * 24 * time.Hour,
+			CheckInterval: time.Hour,
+		},
+		Gating: GatingConfig{
+			BalanceCacheTTL: 30 * time.Second,
+		},
+		Wallets: WalletsConfig{XPub: testXPub},
+		Withdrawals: WithdrawalsConfig{
+			DailyLimits: map[string]string{"MATIC": "1000", "ETH": "0.5", "USDC": "1000", "USDT": "1000", "DAI": "1000"},
+			MaxPerDay:   3,
+		},
+		Earnings: EarningsConfig{FeeBps: 500},
+		Prices: PricesConfig{
+			URL:      "https://api.coingecko.com/api/v3",
+			CacheTTL: 5 * time.Minute,
+		},
+		ENS: ENSConfig{
+			CacheTTL:    time.Hour,
+			IPFSGateway: "https://ipfs.io/ipfs/",
+		},
+	}
+
+	switch env {
+	case EnvDev, EnvTest:
+	case EnvProd:
+		c.ServePath = "./webapp/build"
+		c.Mongo.URI = ""
+		c.Mongo.Database = "koen"
+		c.SQL.DSN = ""
+		c.Auth.JWTSecret = ""
+		c.Pagination.CursorSecret = ""
+		c.Wallets.XPub = ""
+	default:
+		return Config{}, fmt.Errorf("unknown environment %q", env)
+	}
+	return c, nil
+}
+
+// Load builds the config in increasing order of precedence:
+// environment profile, config file, environment variables and finally flags
+func Load(args []string) (Config, error) {
+	fs := flag.NewFlagSet("koen", flag.ContinueOnError)
+	env := fs.String("env", "", "Environment profile to use (dev, test, prod)")
+	file := fs.String("config", "", "Path to a YAML or TOML config file")
+	port := fs.String("port", "", "Port to listen on")
+	servePath := fs.String("servePath", "", "Path to serve static files from")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	// Only an -env actually passed wins over the file, the flag's default doesn't
+	envSet := false
+	fs.Visit(func(f *flag.Flag) {
+		envSet = envSet || f.Name == "env" && *env != ""
+	})
+	if !envSet {
+		*env = envProfile()
+	}
+	c, err := Profile(*env)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if *file == "" {
+		*file = os.Getenv("KOEN_CONFIG")
+	}
+	if *file != "" {
+		if err := c.loadFile(*file); err != nil {
+			return Config{}, err
+		}
+		switch {
+		case envSet:
+			// The profile picked on the command line wins over the file
+			c.Env = *env
+		case c.Env != *env:
+			// The file picked another profile, its defaults go under the file instead
+			if c, err = Profile(c.Env); err != nil {
+				return Config{}, err
+			}
+			if err := c.loadFile(*file); err != nil {
+				return Config{}, err
+			}
+		}
+	}
+
+	if err := c.loadEnv(); err != nil {
+		return Config{}, err
+	}
+
+	if *port != "" {
+		c.Port = *port
+	}
+	if *servePath != "" {
+		c.ServePath = *servePath
+	}
+
+	if err := c.Validate(); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// KOEN_ENV picks the profile. VERSION is what our docker images set,
+// so fall back on that for older deployments
+func envProfile() string {
+	if env := os.Getenv("KOEN_ENV"); env != "" {
+		return env
+	}
+	switch ver := os.Getenv("VERSION"); ver {
+	case "", EnvTest:
+		return EnvDev
+	default:
+		return EnvProd
+	}
+}
+
+func (c *Config) loadFile(path string) error {
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// TOML files go through YAML, so both share the keys, strictness and durations like 10m
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".toml" {
+		var values map[string]interface{}
+		if _, err := toml.Decode(string(dat), &values); err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+		if dat, err = yaml.Marshal(values); err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	if err := yaml.UnmarshalStrict(dat, c); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	setString(&c.Port, "PORT")
+	setString(&c.ServePath, "KOEN_SERVE_PATH")
+	setString(&c.Storage, "KOEN_STORAGE")
+	setSecret(&c.SQL.DSN, "KOEN_SQL_DSN")
+	setSecret(&c.Mongo.URI, "KOEN_MONGO_URI")
+	setString(&c.Mongo.Database, "KOEN_MONGO_DATABASE")
+	setSecret(&c.Auth.JWTSecret, "KOEN_JWT_SECRET")
+	setString(&c.Auth.GoogleAudience, "KOEN_GOOGLE_AUDIENCE")
+	setSecret(&c.Pagination.CursorSecret, "KOEN_CURSOR_SECRET")
+	setString(&c.Media.Storage, "KOEN_MEDIA_STORAGE")
+	setString(&c.Media.Dir, "KOEN_MEDIA_DIR")
+	setString(&c.Media.BaseURL, "KOEN_MEDIA_BASE_URL")
+	setString(&c.Media.S3.Endpoint, "KOEN_S3_ENDPOINT")
+	setString(&c.Media.S3.Region, "KOEN_S3_REGION")
+	setString(&c.Media.S3.Bucket, "KOEN_S3_BUCKET")
+	setString(&c.Media.S3.AccessKey, "KOEN_S3_ACCESS_KEY")
+	setSecret(&c.Media.S3.SecretKey, "KOEN_S3_SECRET_KEY")
+	setString(&c.Media.S3.PublicURL, "KOEN_S3_PUBLIC_URL")
+	setSecret(&c.Chains.Polygon.RPCURL, "KOEN_POLYGON_RPC_URL")
+	setSecret(&c.Chains.Ethereum.RPCURL, "KOEN_ETHEREUM_RPC_URL")
+	setSecret(&c.Wallets.XPub, "KOEN_WALLET_XPUB")
+	setString(&c.Withdrawals.KeystoreDir, "KOEN_KEYSTORE_DIR")
+	setSecret(&c.Withdrawals.KEK, "KOEN_KEYSTORE_KEK")
+	setString(&c.Withdrawals.HotWallet, "KOEN_HOT_WALLET")
+	setString(&c.Prices.URL, "KOEN_PRICES_URL")
+	setSecret(&c.Prices.APIKey, "KOEN_PRICES_API_KEY")
+	setString(&c.ENS.IPFSGateway, "KOEN_IPFS_GATEWAY")
+	for key, field := range map[string]*time.Duration{
+		"KOEN_MONGO_CONNECT_TIMEOUT": &c.Mongo.ConnectTimeout,
+		"KOEN_MONGO_TIMEOUT":         &c.Mongo.Timeout,
+		"KOEN_SQL_CONNECT_TIMEOUT":   &c.SQL.ConnectTimeout,
+		"KOEN_SQL_TIMEOUT":           &c.SQL.Timeout,
+		"KOEN_JWT_EXPIRY":            &c.Auth.JWTExpiry,
+		"KOEN_PAGE_NAME_COOLDOWN":    &c.PageNames.RenameCooldown,
+		"KOEN_PAGE_NAME_GRACE":       &c.PageNames.GracePeriod,
+		"KOEN_ACCOUNT_RETENTION":     &c.Accounts.RetentionPeriod,
+		"KOEN_INDEXER_POLL_INTERVAL": &c.Indexer.PollInterval,
+		"KOEN_SUBSCRIPTION_GRACE":    &c.Subscriptions.GracePeriod,
+		"KOEN_GATING_CACHE_TTL":      &c.Gating.BalanceCacheTTL,
+		"KOEN_PRICES_CACHE_TTL":      &c.Prices.CacheTTL,
+		"KOEN_ENS_CACHE_TTL":         &c.ENS.CacheTTL,
+	} {
+		if err := setDuration(field, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setString(field *string, key string) {
+	if val, ok := os.LookupEnv(key); ok && val != "" {
+		*field = val
+	}
+}
+
+func setSecret(field *Secret, key string) {
+	if val, ok := os.LookupEnv(key); ok && val != "" {
+		*field = Secret(val)
+	}
+}
+
+func setDuration(field *time.Duration, key string) error {
+	val, ok := os.LookupEnv(key)
+	if !ok || val == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*field = d
+	return nil
+}
+
+var (
+	addressPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+	decimalPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+)
+
+func (c Config) Validate() error {
+	var errs []string
+	if c.Port == "" {
+		errs = append(errs, "port is required")
+	}
+	switch c.Storage {
+	case StorageMongo:
+		if c.Mongo.URI == "" {
+			errs = append(errs, "mongo.uri is required")
+		}
+		if c.Mongo.Database == "" {
+			errs = append(errs, "mongo.database is required")
+		}
+		if c.Mongo.ConnectTimeout <= 0 || c.Mongo.Timeout <= 0 {
+			errs = append(errs, "mongo timeouts must be positive")
+		}
+	case StorageSQLite, StoragePostgres:
+		if c.SQL.DSN == "" {
+			errs = append(errs, "sql.dsn is required")
+		}
+		if c.SQL.ConnectTimeout <= 0 || c.SQL.Timeout <= 0 {
+			errs = append(errs, "sql timeouts must be positive")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown storage %q", c.Storage))
+	}
+	if c.Auth.JWTSecret == "" {
+		errs = append(errs, "auth.jwtSecret is required")
+	}
+	if c.Env == EnvProd && len(c.Auth.JWTSecret) < 32 {
+		errs = append(errs, "auth.jwtSecret must be at least 32 characters in prod")
+	}
+	if c.Auth.JWTExpiry <= 0 {
+		errs = append(errs, "auth.jwtExpiry must be positive")
+	}
+	if c.Auth.GoogleAudience == "" {
+		errs = append(errs, "auth.googleAudience is required")
+	}
+	if c.Pagination.CursorSecret == "" {
+		errs = append(errs, "pagination.cursorSecret is required")
+	}
+	if c.Env == EnvProd && len(c.Pagination.CursorSecret) < 32 {
+		errs = append(errs, "pagination.cursorSecret must be at least 32 characters in prod")
+	}
+	if c.Pagination.DefaultLimit < 1 || c.Pagination.MaxLimit < c.Pagination.DefaultLimit {
+		errs = append(errs, "pagination limits must satisfy 1 <= defaultLimit <= maxLimit")
+	}
+	if c.PageNames.RenameCooldown < 0 || c.PageNames.GracePeriod < 0 {
+		errs = append(errs, "pageNames durations can't be negative")
+	}
+	if c.Accounts.RetentionPeriod < 0 || c.Accounts.PurgeInterval <= 0 {
+		errs = append(errs, "accounts.retentionPeriod can't be negative and accounts.purgeInterval must be positive")
+	}
+	switch c.Media.Storage {
+	case BlobLocal:
+		if c.Media.Dir == "" || c.Media.BaseURL == "" {
+			errs = append(errs, "media.dir and media.baseUrl are required")
+		}
+	case BlobS3:
+		s3 := c.Media.S3
+		if s3.Endpoint == "" || s3.Region == "" || s3.Bucket == "" || s3.AccessKey == "" || s3.SecretKey == "" {
+			errs = append(errs, "media.s3 needs an endpoint, region, bucket, accessKey and secretKey")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown media storage %q", c.Media.Storage))
+	}
+	if c.Media.MaxUploadSize <= 0 {
+		errs = append(errs, "media.maxUploadSize must be positive")
+	}
+	if c.Chains.Polygon.Confirmations < 1 || c.Chains.Ethereum.Confirmations < 1 {
+		errs = append(errs, "chains need at least one confirmation")
+	}
+	if c.Indexer.PollInterval <= 0 || c.Indexer.MaxBlockRange < 1 {
+		errs = append(errs, "indexer.pollInterval and indexer.maxBlockRange must be positive")
+	}
+	if c.Subscriptions.GracePeriod < 0 || c.Subscriptions.CheckInterval <= 0 {
+		errs = append(errs, "subscriptions.gracePeriod can't be negative and subscriptions.checkInterval must be positive")
+	}
+	if c.Gating.BalanceCacheTTL < 0 {
+		errs = append(errs, "gating.balanceCacheTtl can't be negative")
+	}
+	if c.Wallets.XPub == "" {
+		errs = append(errs, "wallets.xpub is required")
+	}
+	if c.Env == EnvProd && c.Wallets.XPub == testXPub {
+		errs = append(errs, "wallets.xpub can't be the test key in prod")
+	}
+	if w := c.Withdrawals; w.KeystoreDir != "" {
+		if len(w.KEK) < 16 {
+			errs = append(errs, "withdrawals.kek must be at least 16 characters")
+		}
+		if !addressPattern.MatchString(w.HotWallet) {
+			errs = append(errs, "withdrawals.hotWallet must be an address")
+		}
+	}
+	for symbol, limit := range c.Withdrawals.DailyLimits {
+		if !decimalPattern.MatchString(limit) {
+			errs = append(errs, fmt.Sprintf("withdrawals.dailyLimits.%s must be a decimal amount", symbol))
+		}
+	}
+	if c.Earnings.FeeBps < 0 || c.Earnings.FeeBps > 10000 {
+		errs = append(errs, "earnings.feeBps must be between 0 and 10000")
+	}
+	if c.Withdrawals.MaxPerDay < 1 {
+		errs = append(errs, "withdrawals.maxPerDay must be positive")
+	}
+	if c.Prices.CacheTTL < 0 {
+		errs = append(errs, "prices.cacheTtl can't be negative")
+	}
+	if c.ENS.CacheTTL < 0 {
+		errs = append(errs, "ens.cacheTtl can't be negative")
+	}
+	if g := c.ENS.IPFSGateway; g != "" && !strings.HasPrefix(g, "https://") && !strings.HasPrefix(g, "http://") {
+		errs = append(errs, "ens.ipfsGateway must be an http(s) URL")
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// String prints the config as YAML with all secrets redacted
+func (c Config) String() string {
+	dat, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(dat)
+}
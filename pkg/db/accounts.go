@@ -0,0 +1,326 @@
+package db
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/blob"
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/pagination"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+)
+
+// Set from config by ConfigureAccounts
+var retentionPeriod = 30 * 24 * time.Hour
+
+func ConfigureAccounts(c config.AccountsConfig) {
+	retentionPeriod = c.RetentionPeriod
+}
+
+// Handlers for /users/me share how they find the signed in user
+func currentUser(w http.ResponseWriter, r *http.Request, db DBConn) (User, bool) {
+	userData, ok := r.Context().Value("userData").(auth.Claims)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+		return User{}, false
+	}
+	user, err := userFromClaims(r.Context(), db.Users(), userData)
+	if errors.Is(err, ErrNotFound) {
+		utils.Respond(http.StatusNotFound, "User not found").ServeHTTP(w, r)
+		return User{}, false
+	}
+	if err != nil {
+		respondWithDBError(err, "Couldn't get user!").ServeHTTP(w, r)
+		return User{}, false
+	}
+	return user, true
+}
+
+// HandleDeleteAccount soft deletes the signed in user. Their page disappears right away,
+// everything else stays around until PurgeDeletedUsers runs after the retention period
+func HandleDeleteAccount(db DBConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+
+		now := time.Now().UTC()
+		err := db.WithTransaction(r.Context(), func(ctx context.Context) error {
+			if err := db.Users().SoftDelete(ctx, user.ID, now); err != nil {
+				return err
+			}
+			return db.Audit().Record(ctx, AuditEvent{Type: AuditUserDeleted, UserID: user.ID, At: now})
+		})
+		if err != nil {
+			respondWithDBError(err, "Couldn't delete user!").ServeHTTP(w, r)
+			return
+		}
+		utils.RespondWithJSON(map[string]time.Time{
+			"deletedAt": now,
+			"purgeAt":   now.Add(retentionPeriod),
+		}, http.StatusOK)(w, r)
+	}
+}
+
+// The soft deleted account behind claims, if there is one. Until it's purged
+// it still holds its email and wallet
+func deletedUser(ctx context.Context, users UserRepository, claims auth.Claims) (User, bool, error) {
+	var user User
+	var err error
+	if claims.Email != "" {
+		user, err = users.GetByEmail(ctx, claims.Email)
+	} else {
+		user, err = users.GetByWallet(ctx, claims.WalletPublicAddress)
+	}
+	if errors.Is(err, ErrNotFound) {
+		return User{}, false, nil
+	}
+	return user, err == nil && !user.DeletedAt.IsZero(), err
+}
+
+// Signing up again before the purge brings the deleted account back as it was
+func restoreUser(w http.ResponseWriter, r *http.Request, db DBConn, user User) {
+	err := db.WithTransaction(r.Context(), func(ctx context.Context) error {
+		if err := db.Users().Restore(ctx, user.ID); err != nil {
+			return err
+		}
+		return db.Audit().Record(ctx, AuditEvent{Type: AuditUserRestored, UserID: user.ID, At: time.Now().UTC()})
+	})
+	if err != nil {
+		respondWithDBError(err, "Couldn't restore user!").ServeHTTP(w, r)
+		return
+	}
+	user.DeletedAt = time.Time{}
+	utils.RespondWithJSON(user, http.StatusOK)(w, r)
+}
+
+// Uploaded avatars and banners go before the user does. If that fails
+// the user is still around to try again on the next purge
+func deleteImages(ctx context.Context, store blob.Store, user User) error {
+	for _, image := range []*Image{user.Avatar, user.Banner} {
+		if image == nil {
+			continue
+		}
+		for _, key := range image.Keys {
+			if err := store.Delete(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PurgeDeletedUsers removes users that were deleted before the given time, along with
+// their uploads in store. Records we have to keep are anonymized instead of removed
+func PurgeDeletedUsers(ctx context.Context, db DBConn, store blob.Store, deletedBefore time.Time) (int, error) {
+	users, err := db.Users().ListDeletedBefore(ctx, deletedBefore)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, user := range users {
+		if err := deleteImages(ctx, store, user); err != nil {
+			return purged, fmt.Errorf("purging user %s: %w", user.ID, err)
+		}
+		subs, err := db.Subscriptions().ListByPatron(ctx, user.ID)
+		if err != nil {
+			return purged, err
+		}
+		err = db.WithTransaction(ctx, func(ctx context.Context) error {
+			// Frees up their old page names too
+			if err := db.PageNames().DeleteByUser(ctx, user.ID); err != nil {
+				return err
+			}
+			if err := db.Tiers().DeleteByCreator(ctx, user.ID); err != nil {
+				return err
+			}
+			if err := db.Posts().DeleteByCreator(ctx, user.ID); err != nil {
+				return err
+			}
+			if err := db.Audit().Anonymize(ctx, user.ID); err != nil {
+				return err
+			}
+			// Creators keep payments they received, just not who sent them
+			if err := db.Payments().AnonymizePayer(ctx, user.ID); err != nil {
+				return err
+			}
+			if err := db.Subscriptions().DeleteByUser(ctx, user.ID); err != nil {
+				return err
+			}
+			// They don't support anyone anymore
+			for _, sub := range subs {
+				if err := refreshSupporterCount(ctx, db, sub.CreatorID); err != nil {
+					return err
+				}
+			}
+			return db.Users().Delete(ctx, user.ID)
+		})
+		if err != nil {
+			return purged, fmt.Errorf("purging user %s: %w", user.ID, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// RunAccountPurger purges deleted users every purge interval until ctx is done
+func RunAccountPurger(ctx context.Context, db DBConn, store blob.Store, c config.AccountsConfig) {
+	ticker := time.NewTicker(c.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		n, err := PurgeDeletedUsers(ctx, db, store, time.Now().Add(-c.RetentionPeriod))
+		if err != nil {
+			log.Printf("Account purge failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Purged %d deleted accounts", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type exportWallet struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+}
+
+// We don't keep sessions around, JWTs are checked on every request.
+// So the only one we know about is the one asking for the export
+type exportSession struct {
+	Method    string    `json:"method"`
+	IssuedAt  time.Time `json:"issuedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func sessionFromClaims(claims auth.Claims) exportSession {
+	s := exportSession{Method: "wallet"}
+	issuedAt, expiresAt := claims.WalletClaims.IssuedAt, claims.WalletClaims.ExpiresAt
+	if claims.Email != "" {
+		s.Method = "google"
+		issuedAt, expiresAt = claims.GoogleClaims.IssuedAt, claims.GoogleClaims.ExpiresAt
+	}
+	if issuedAt > 0 {
+		s.IssuedAt = time.Unix(issuedAt, 0).UTC()
+	}
+	if expiresAt > 0 {
+		s.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	}
+	return s
+}
+
+// Everything we know about a user, as files in the export archive
+func exportFiles(ctx context.Context, db DBConn, user User, claims auth.Claims) (map[string]interface{}, error) {
+	wallets := []exportWallet{}
+	if user.MetaMaskWalletPublicAddress != "" {
+		wallets = append(wallets, exportWallet{Type: "metamask", Address: user.MetaMaskWalletPublicAddress})
+	}
+	if user.GeneratedMaticWalletPublicAddress != "" {
+		wallets = append(wallets, exportWallet{Type: "generatedMatic", Address: user.GeneratedMaticWalletPublicAddress})
+	}
+	activity, err := db.Audit().ListByUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	tiers, err := db.Tiers().ListByCreator(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	subs, err := db.Subscriptions().ListByPatron(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	withdrawals, err := db.Withdrawals().ListByCreator(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	posts := []Post{}
+	p := pagination.Params{Limit: 100}
+	for {
+		page, next, err := db.Posts().ListByCreator(ctx, user.ID, time.Time{}, p)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, page...)
+		if next == nil {
+			break
+		}
+		p.After = next
+	}
+
+	return map[string]interface{}{
+		"profile.json": struct {
+			ID string `json:"id"`
+			User
+		}{user.ID, user},
+		"wallets.json":       wallets,
+		"sessions.json":      []exportSession{sessionFromClaims(claims)},
+		"activity.json":      activity,
+		"tiers.json":         tiers,
+		"subscriptions.json": subs,
+		"posts.json":         posts,
+		"withdrawals.json":   withdrawals,
+	}, nil
+}
+
+func writeZip(files map[string]interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// HandleExportData sends the signed in user a ZIP of JSON files with all their data
+func HandleExportData(db DBConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		ctx := r.Context()
+		files, err := exportFiles(ctx, db, user, ctx.Value("userData").(auth.Claims))
+		if err != nil {
+			respondWithDBError(err, "Couldn't export user data!").ServeHTTP(w, r)
+			return
+		}
+		archive, err := writeZip(files)
+		if err != nil {
+			utils.Respond(http.StatusInternalServerError, "Couldn't export user data!").ServeHTTP(w, r)
+			return
+		}
+		err = db.Audit().Record(ctx, AuditEvent{Type: AuditDataExported, UserID: user.ID, At: time.Now().UTC()})
+		if err != nil {
+			respondWithDBError(err, "Couldn't export user data!").ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="koen-export.zip"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write(archive)
+	}
+}
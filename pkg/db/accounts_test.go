@@ -0,0 +1,190 @@
+package db
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/blob"
+	"github.com/cryptopatron/koen-backend/pkg/pagination"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+)
+
+func TestAccountDeletion(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	ctx := context.Background()
+	store := &blob.LocalStore{Dir: t.TempDir(), BaseURL: "/media"}
+	avatar := "avatars/koen-san/1/large.jpg"
+	if err := store.Put(ctx, avatar, strings.NewReader("jpeg"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Email: "test@koen.com", PageName: "koen-san", CreatedAt: time.Now().UTC()}
+	user.Avatar = &Image{URLs: map[string]string{"large": store.URL(avatar)}, Keys: []string{avatar}}
+	if err := conn.Users().Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	conn.Audit().Record(ctx, AuditEvent{Type: AuditUserCreated, UserID: user.ID, Data: map[string]string{"pageName": "koen-san"}})
+	conn.PageNames().Record(ctx, PageNameChange{UserID: user.ID, OldName: "koen-art", NewName: "koen-san", ChangedAt: time.Now()})
+	conn.Tiers().Create(ctx, &Tier{CreatorID: user.ID, Name: "Supporter"})
+	conn.Posts().Create(ctx, &Post{CreatorID: user.ID, Title: "Hello", PublishAt: time.Now()})
+	claim := auth.Claims{
+		GoogleClaims: auth.GoogleClaims{Email: "test@koen.com"},
+	}
+
+	htc := &utils.HttpTestCase{Handler: HandleDeleteAccount(conn)}
+	htc.SetRequestBody(nil)
+	htc.SetContext("userData", claim)
+	t.Run("HTTP 200 on deleting an account", htc.CheckReturnStatus(http.StatusOK))
+	t.Run("HTTP 404 on deleting it again", htc.CheckReturnStatus(http.StatusNotFound))
+
+	t.Run("Deleted users are gone from the API", func(t *testing.T) {
+		for _, handler := range []http.HandlerFunc{GetUser(conn, "koen-san"), GetUser(conn, "koen-art")} {
+			req, _ := http.NewRequest("GET", "/users/pageName/koen-san", nil)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if got := strings.TrimSpace(rr.Body.String()); got != "{}" {
+				t.Errorf("got %s, want {}", got)
+			}
+		}
+	})
+
+	t.Run("Users are only purged after the retention period", func(t *testing.T) {
+		n, err := PurgeDeletedUsers(ctx, conn, store, time.Now().Add(-time.Hour))
+		if err != nil || n != 0 {
+			t.Fatalf("got %d %v, want nothing purged", n, err)
+		}
+
+		n, err = PurgeDeletedUsers(ctx, conn, store, time.Now().Add(time.Second))
+		if err != nil || n != 1 {
+			t.Fatalf("got %d %v, want one user purged", n, err)
+		}
+		if _, err := conn.Users().GetByID(ctx, user.ID); err != ErrNotFound {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+		if _, err := os.Stat(filepath.Join(store.Dir, avatar)); !os.IsNotExist(err) {
+			t.Errorf("got %v, want the avatar deleted", err)
+		}
+		if _, err := conn.PageNames().LastByUser(ctx, user.ID); err != ErrNotFound {
+			t.Errorf("got %v, want page name history removed", err)
+		}
+		if tiers, _ := conn.Tiers().ListByCreator(ctx, user.ID); len(tiers) != 0 {
+			t.Errorf("got %+v, want tiers removed", tiers)
+		}
+		if posts, _, _ := conn.Posts().ListByCreator(ctx, user.ID, time.Time{}, pagination.Params{Limit: 10}); len(posts) != 0 {
+			t.Errorf("got %+v, want posts removed", posts)
+		}
+		events, _ := conn.Audit().ListByUser(ctx, user.ID)
+		for _, e := range events {
+			if len(e.Data) != 0 {
+				t.Errorf("got %+v, want anonymized events", e)
+			}
+		}
+		if len(events) != 2 {
+			t.Errorf("got %d events, want them kept", len(events))
+		}
+	})
+}
+
+func TestSignUpAfterDeletion(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	claim := auth.Claims{
+		GoogleClaims: auth.GoogleClaims{Email: "test@koen.com"},
+	}
+	serve := func(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/users/create", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), "userData", claim))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	var created, restored User
+	json.Unmarshal(serve(HandleCreateUser(conn, testDeposits(t), nil), `{"pageName": "koen-san"}`).Body.Bytes(), &created)
+	if rr := serve(HandleDeleteAccount(conn), ""); rr.Code != http.StatusOK {
+		t.Fatalf("got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	rr := serve(HandleCreateUser(conn, testDeposits(t), nil), `{"pageName": "someone-else"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	json.Unmarshal(rr.Body.Bytes(), &restored)
+	if restored.PageName != "koen-san" || restored.GeneratedMaticWalletPublicAddress != created.GeneratedMaticWalletPublicAddress {
+		t.Errorf("got %+v, want the deleted account back", restored)
+	}
+	user, err := activeUser(conn.Users().GetByEmail(context.Background(), "test@koen.com"))
+	if err != nil {
+		t.Fatalf("got %v, want the account active again", err)
+	}
+	events, _ := conn.Audit().ListByUser(context.Background(), user.ID)
+	if len(events) != 3 || events[2].Type != AuditUserRestored {
+		t.Errorf("got %+v, want created, deleted and restored", events)
+	}
+}
+
+func TestExportData(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	ctx := context.Background()
+	user := &User{Email: "test@koen.com", PageName: "koen-san", GeneratedMaticWalletPublicAddress: "0xmatic"}
+	if err := conn.Users().Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	conn.Audit().Record(ctx, AuditEvent{Type: AuditUserCreated, UserID: user.ID})
+
+	req, _ := http.NewRequest("GET", "/users/me/export", nil)
+	req = req.WithContext(context.WithValue(ctx, "userData", auth.Claims{
+		GoogleClaims: auth.GoogleClaims{Email: "test@koen.com"},
+	}))
+	rr := httptest.NewRecorder()
+	HandleExportData(conn).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]interface{}{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var content interface{}
+		if err := json.NewDecoder(r).Decode(&content); err != nil {
+			t.Errorf("%s: %v", f.Name, err)
+		}
+		files[f.Name] = content
+	}
+
+	for _, name := range []string{"profile.json", "wallets.json", "sessions.json", "activity.json", "tiers.json", "posts.json", "withdrawals.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("got %v, want %s in the export", files, name)
+		}
+	}
+	if profile, _ := files["profile.json"].(map[string]interface{}); profile["pageName"] != "koen-san" {
+		t.Errorf("got profile %v", profile)
+	}
+	if wallets, _ := files["wallets.json"].([]interface{}); len(wallets) != 1 {
+		t.Errorf("got wallets %v, want one", wallets)
+	}
+	if activity, _ := files["activity.json"].([]interface{}); len(activity) != 1 {
+		t.Errorf("got activity %v, want one event", activity)
+	}
+}
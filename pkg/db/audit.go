@@ -0,0 +1,31 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Kinds of audit events
+const (
+	AuditUserCreated     = "user.created"
+	AuditPageNameChanged = "user.pageName.changed"
+	AuditUserDeleted     = "user.deleted"
+	AuditUserRestored    = "user.restored"
+	AuditDataExported    = "user.exported"
+)
+
+// AuditEvent records something a user did, for support and abuse investigations
+type AuditEvent struct {
+	Type   string            `bson:"type" json:"type"`
+	UserID string            `bson:"userId" json:"userId"`
+	Data   map[string]string `bson:"data,omitempty" json:"data,omitempty"`
+	At     time.Time         `bson:"at" json:"at"`
+}
+
+type AuditRepository interface {
+	Record(ctx context.Context, event AuditEvent) error
+	// Oldest first
+	ListByUser(ctx context.Context, userID string) ([]AuditEvent, error)
+	// Anonymize drops the details of a user's events, but keeps the events themselves
+	Anonymize(ctx context.Context, userID string) error
+}
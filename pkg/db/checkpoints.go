@@ -0,0 +1,21 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Checkpoint is the last block the indexer went through on a chain
+type Checkpoint struct {
+	Chain string `bson:"_id"`
+	Block uint64 `bson:"block"`
+	// Hash of Block, so a reorg that replaced it can be noticed
+	Hash      string    `bson:"hash"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+// CheckpointRepository keeps one checkpoint per chain. Get returns ErrNotFound before the first Set
+type CheckpointRepository interface {
+	Get(ctx context.Context, chain string) (Checkpoint, error)
+	Set(ctx context.Context, checkpoint Checkpoint) error
+}
@@ -0,0 +1,961 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/gating"
+	"github.com/cryptopatron/koen-backend/pkg/pagination"
+)
+
+// Every DBConn implementation has to pass these.
+// Values are unique per run since the Mongo and Postgres test DBs keep data around
+func testConformance(t *testing.T, conn DBConn) {
+	users := conn.Users()
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	createdAt := time.Now().UTC().Truncate(time.Second)
+	walletIndex := uint32(1 << 31)
+
+	user := &User{
+		Email:                             "conformance" + suffix + "@koen.com",
+		Name:                              "Koen San",
+		PageName:                          "Conformance" + suffix,
+		GeneratedMaticWalletPublicAddress: "0xmatic" + suffix,
+		WalletIndex:                       &walletIndex,
+		Profile: Profile{
+			Bio:             "Makes things",
+			SocialLinks:     []SocialLink{{Platform: "twitter", URL: "https://twitter.com/koen"}},
+			Categories:      []string{"art", "music"},
+			DisplayCurrency: "EUR",
+			Visibility:      Visibility{HideSupporters: true},
+			Avatar: &Image{
+				URLs: map[string]string{"large": "/media/avatars/1/large.jpg"},
+				Keys: []string{"avatars/1/large.jpg"},
+			},
+		},
+		CreatedAt: createdAt,
+		UpdatedAt: createdAt,
+	}
+	if err := users.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	wallet := &User{MetaMaskWalletPublicAddress: "0xMetaMask" + suffix, CreatedAt: createdAt}
+	if err := users.Create(ctx, wallet); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Create assigns an ID", func(t *testing.T) {
+		if user.ID == "" || wallet.ID == "" || user.ID == wallet.ID {
+			t.Errorf("got IDs %q and %q", user.ID, wallet.ID)
+		}
+	})
+
+	t.Run("Users round trip", func(t *testing.T) {
+		got, err := users.GetByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.CreatedAt.Equal(createdAt) {
+			t.Errorf("got createdAt %v, want %v", got.CreatedAt, createdAt)
+		}
+		got.CreatedAt, got.UpdatedAt = user.CreatedAt, user.UpdatedAt
+		if !reflect.DeepEqual(got, *user) {
+			t.Errorf("got %+v, want %+v", got, *user)
+		}
+	})
+
+	t.Run("Lookups are case-insensitive", func(t *testing.T) {
+		lookups := map[string]func() (User, error){
+			"email":    func() (User, error) { return users.GetByEmail(ctx, "CONFORMANCE"+suffix+"@KOEN.COM") },
+			"pageName": func() (User, error) { return users.GetByPageName(ctx, "conformance"+suffix) },
+		}
+		for name, lookup := range lookups {
+			got, err := lookup()
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			if got.ID != user.ID {
+				t.Errorf("%s: got user %s, want %s", name, got.ID, user.ID)
+			}
+		}
+
+		got, err := users.GetByWallet(ctx, "0xmetamask"+suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != wallet.ID {
+			t.Errorf("wallet: got user %s, want %s", got.ID, wallet.ID)
+		}
+	})
+
+	t.Run("ErrNotFound on unknown or empty values", func(t *testing.T) {
+		lookups := map[string]func() (User, error){
+			"unknown email":  func() (User, error) { return users.GetByEmail(ctx, "nobody"+suffix+"@koen.com") },
+			"empty email":    func() (User, error) { return users.GetByEmail(ctx, "") },
+			"empty wallet":   func() (User, error) { return users.GetByWallet(ctx, "") },
+			"empty pageName": func() (User, error) { return users.GetByPageName(ctx, "") },
+			"malformed ID":   func() (User, error) { return users.GetByID(ctx, "bleh") },
+		}
+		for name, lookup := range lookups {
+			if _, err := lookup(); !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s: got %v, want %v", name, err, ErrNotFound)
+			}
+		}
+	})
+
+	t.Run("Conflicts name the taken field", func(t *testing.T) {
+		dupes := map[string]User{
+			"pageName":                          {PageName: "CONFORMANCE" + suffix},
+			"email":                             {Email: "Conformance" + suffix + "@koen.com"},
+			"metaMaskWalletPublicAddress":       {MetaMaskWalletPublicAddress: "0xmetamask" + suffix},
+			"generatedMaticWalletPublicAddress": {GeneratedMaticWalletPublicAddress: "0xMATIC" + suffix},
+		}
+		for field, dupe := range dupes {
+			dupe.CreatedAt = createdAt
+			err := users.Create(ctx, &dupe)
+			var conflict *ConflictError
+			if !errors.As(err, &conflict) || conflict.Field != field {
+				t.Errorf("got %v, want conflict on %s", err, field)
+			}
+		}
+	})
+
+	t.Run("Empty fields never conflict", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			u := &User{Name: "No identifiers", CreatedAt: createdAt}
+			if err := users.Create(ctx, u); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	t.Run("Users with a deposit address", func(t *testing.T) {
+		gone := &User{GeneratedMaticWalletPublicAddress: "0xgone" + suffix, CreatedAt: createdAt}
+		if err := users.Create(ctx, gone); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.SoftDelete(ctx, gone.ID, createdAt); err != nil {
+			t.Fatal(err)
+		}
+		list, err := users.ListWithDepositAddress(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := map[string]bool{}
+		for _, u := range list {
+			ids[u.ID] = true
+		}
+		if !ids[user.ID] || ids[wallet.ID] || ids[gone.ID] {
+			t.Errorf("got %v, want %s without %s or the deleted %s", ids, user.ID, wallet.ID, gone.ID)
+		}
+	})
+
+	t.Run("Page names can be changed", func(t *testing.T) {
+		renamed := &User{PageName: "before" + suffix, CreatedAt: createdAt}
+		if err := users.Create(ctx, renamed); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.UpdatePageName(ctx, renamed.ID, "after"+suffix); err != nil {
+			t.Fatal(err)
+		}
+		got, err := users.GetByPageName(ctx, "AFTER"+suffix)
+		if err != nil || got.ID != renamed.ID {
+			t.Errorf("got %v %v, want user %s", got.ID, err, renamed.ID)
+		}
+		if _, err := users.GetByPageName(ctx, "before"+suffix); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+
+		err = users.UpdatePageName(ctx, renamed.ID, "conformance"+suffix)
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) || conflict.Field != "pageName" {
+			t.Errorf("got %v, want conflict on pageName", err)
+		}
+		if err := users.UpdatePageName(ctx, "404", "nobody"+suffix); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("Page name history returns the latest change", func(t *testing.T) {
+		history := conn.PageNames()
+		if _, err := history.GetByOldName(ctx, "old"+suffix); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+		changes := []PageNameChange{
+			{UserID: "a" + suffix, OldName: "Old" + suffix, NewName: "first" + suffix, ChangedAt: createdAt},
+			{UserID: "a" + suffix, OldName: "first" + suffix, NewName: "second" + suffix, ChangedAt: createdAt.Add(time.Second)},
+			{UserID: "b" + suffix, OldName: "old" + suffix, NewName: "third" + suffix, ChangedAt: createdAt.Add(2 * time.Second)},
+		}
+		for _, c := range changes {
+			if err := history.Record(ctx, c); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := history.GetByOldName(ctx, "OLD"+suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != changes[2] {
+			t.Errorf("got %+v, want %+v", got, changes[2])
+		}
+		got, err = history.LastByUser(ctx, "a"+suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != changes[1] {
+			t.Errorf("got %+v, want %+v", got, changes[1])
+		}
+		if _, err := history.LastByUser(ctx, "c"+suffix); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+
+		if err := history.DeleteByUser(ctx, "b"+suffix); err != nil {
+			t.Fatal(err)
+		}
+		got, err = history.GetByOldName(ctx, "old"+suffix)
+		if err != nil || got != changes[0] {
+			t.Errorf("got %+v %v, want %+v", got, err, changes[0])
+		}
+	})
+
+	t.Run("Updates only apply to the version they were made against", func(t *testing.T) {
+		updated := *user
+		updated.Name = "Koen Sama"
+		updated.Profile = Profile{Bio: "Makes other things", Categories: []string{"writing"}}
+		updated.UpdatedAt = createdAt.Add(time.Second)
+		if err := users.Update(ctx, updated, createdAt); err != nil {
+			t.Fatal(err)
+		}
+		got, err := users.GetByID(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != updated.Name || got.Bio != updated.Bio || !reflect.DeepEqual(got.Categories, updated.Categories) ||
+			got.SocialLinks != nil || got.Visibility != (Visibility{}) || !got.UpdatedAt.Equal(updated.UpdatedAt) {
+			t.Errorf("got %+v, want %+v", got, updated)
+		}
+		if got.Email != user.Email || got.PageName != user.PageName {
+			t.Errorf("got %+v, want identifiers untouched", got)
+		}
+
+		// Still made against the old version
+		if err := users.Update(ctx, updated, createdAt); !errors.Is(err, ErrVersionMismatch) {
+			t.Errorf("got %v, want %v", err, ErrVersionMismatch)
+		}
+		updated.ID = "404"
+		if err := users.Update(ctx, updated, createdAt); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("Deleted users are soft deleted first", func(t *testing.T) {
+		deleted := &User{PageName: "deleted" + suffix, CreatedAt: createdAt}
+		if err := users.Create(ctx, deleted); err != nil {
+			t.Fatal(err)
+		}
+		at := createdAt.Add(-time.Hour)
+		if err := users.SoftDelete(ctx, deleted.ID, at); err != nil {
+			t.Fatal(err)
+		}
+		got, err := users.GetByPageName(ctx, deleted.PageName)
+		if err != nil || !got.DeletedAt.Equal(at) {
+			t.Errorf("got %v %v, want deletedAt %v", got.DeletedAt, err, at)
+		}
+
+		if err := users.Restore(ctx, deleted.ID); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := users.GetByID(ctx, deleted.ID); !got.DeletedAt.IsZero() {
+			t.Errorf("got deletedAt %v after restoring, want none", got.DeletedAt)
+		}
+		if err := users.SoftDelete(ctx, deleted.ID, at); err != nil {
+			t.Fatal(err)
+		}
+
+		found := func(before time.Time) bool {
+			list, err := users.ListDeletedBefore(ctx, before)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, u := range list {
+				if u.ID == deleted.ID {
+					return true
+				}
+				if u.DeletedAt.IsZero() {
+					t.Errorf("got active user %s", u.ID)
+				}
+			}
+			return false
+		}
+		if found(at) || !found(createdAt) {
+			t.Error("ListDeletedBefore doesn't honor the deletion time")
+		}
+
+		if err := users.Delete(ctx, deleted.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := users.GetByID(ctx, deleted.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+		if err := users.Delete(ctx, deleted.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("Anonymized audit events keep their type", func(t *testing.T) {
+		audit := conn.Audit()
+		userID := "anon" + suffix
+		event := AuditEvent{Type: AuditUserCreated, UserID: userID, Data: map[string]string{"pageName": "x"}, At: createdAt}
+		if err := audit.Record(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+		if err := audit.Anonymize(ctx, userID); err != nil {
+			t.Fatal(err)
+		}
+		events, err := audit.ListByUser(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].Type != AuditUserCreated || len(events[0].Data) != 0 {
+			t.Errorf("got %+v, want one event without data", events)
+		}
+	})
+
+	t.Run("List pages in a stable order", func(t *testing.T) {
+		// Far in the future, so earlier runs against the same DB sort before us
+		base := time.Now().UTC().AddDate(100, 0, 0).Truncate(time.Millisecond)
+		var want []string
+		for i := 0; i < 5; i++ {
+			// Two users share a timestamp, the ID has to keep them apart
+			u := &User{Name: "Listed", CreatedAt: base.Add(time.Duration(i/2) * time.Second)}
+			if err := users.Create(ctx, u); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, u.ID)
+		}
+
+		walk := func(p pagination.Params) []string {
+			var got []string
+			for i := 0; i < 10; i++ {
+				page, next, err := users.List(ctx, p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, u := range page {
+					got = append(got, u.ID)
+				}
+				if next == nil {
+					break
+				}
+				p.After = next
+			}
+			return got
+		}
+
+		asc := walk(pagination.Params{Limit: 2, After: &pagination.Key{Time: base.Add(-time.Millisecond)}})
+		if len(asc) != 5 {
+			t.Fatalf("got %v, want 5 users", asc)
+		}
+		// Order within a timestamp depends on the backend's IDs
+		for _, group := range [][2]int{{0, 2}, {2, 4}, {4, 5}} {
+			got := map[string]bool{}
+			for _, id := range asc[group[0]:group[1]] {
+				got[id] = true
+			}
+			for _, id := range want[group[0]:group[1]] {
+				if !got[id] {
+					t.Errorf("got %v, want %v", asc, want)
+				}
+			}
+		}
+
+		// Walking backwards from past our users gives the same order reversed
+		far := pagination.Key{Time: base.Add(time.Hour)}
+		desc := walk(pagination.Params{Limit: 2, Desc: true, After: &far})
+		if len(desc) < 5 {
+			t.Fatalf("got %v, want at least 5 users", desc)
+		}
+		for i := 0; i < 5; i++ {
+			if desc[i] != asc[4-i] {
+				t.Errorf("got %v, want the reverse of %v", desc[:5], asc)
+				break
+			}
+		}
+	})
+
+	t.Run("Search finds listed creators", func(t *testing.T) {
+		// A word only this run's creators have
+		word := "searchable" + suffix
+		creators := []User{
+			{PageName: "SearchA" + suffix, Name: "Koen " + word, SupporterCount: 5, Profile: Profile{Categories: []string{"art"}}},
+			{PageName: "SearchB" + suffix, SupporterCount: 10, Profile: Profile{Bio: "Plays " + word + " songs", Categories: []string{"music"}}},
+			{PageName: "SearchC" + suffix, Name: word, Profile: Profile{Visibility: Visibility{Unlisted: true}}},
+			{PageName: "SearchD" + suffix, Name: word},
+			{Name: word + " without a page"},
+		}
+		for i := range creators {
+			creators[i].CreatedAt = createdAt
+			if err := users.Create(ctx, &creators[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := users.SoftDelete(ctx, creators[3].ID, createdAt); err != nil {
+			t.Fatal(err)
+		}
+
+		search := func(q SearchQuery) []string {
+			found, err := users.Search(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pageNames []string
+			for _, u := range found {
+				pageNames = append(pageNames, u.PageName)
+			}
+			return pageNames
+		}
+		got := search(SearchQuery{Text: strings.ToUpper(word), Sort: SortSupporters, Limit: 10})
+		if want := []string{creators[1].PageName, creators[0].PageName}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		got = search(SearchQuery{Text: word, Categories: []string{"music", "video"}, Sort: SortRelevance, Limit: 10})
+		if want := []string{creators[1].PageName}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		// One more than the limit
+		if got = search(SearchQuery{Text: word, Sort: SortSupporters, Limit: 1}); len(got) != 2 {
+			t.Errorf("got %v, want 2 creators", got)
+		}
+		if got = search(SearchQuery{Text: word, Sort: SortSupporters, Offset: 1, Limit: 1}); !reflect.DeepEqual(got, []string{creators[0].PageName}) {
+			t.Errorf("got %v, want %v", got, []string{creators[0].PageName})
+		}
+	})
+
+	t.Run("Search matches prefixes and typos", func(t *testing.T) {
+		// A made up word only this run's creator has, short enough for backends to narrow candidates down by
+		word := strings.Map(func(r rune) rune { return 'a' + r - '0' }, suffix[len(suffix)-7:])
+		// Long enough to be cut into pieces instead
+		long := word + word + "ab"
+		creator := &User{PageName: "Fuzzy" + suffix, Name: "Koen " + word, CreatedAt: createdAt}
+		creator.Bio = "Paints " + long
+		if err := users.Create(ctx, creator); err != nil {
+			t.Fatal(err)
+		}
+		found := func(text string) bool {
+			list, err := users.Search(ctx, SearchQuery{Text: text, Sort: SortRelevance, Limit: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, u := range list {
+				if u.ID == creator.ID {
+					return true
+				}
+			}
+			return false
+		}
+		for _, text := range []string{
+			word[:4],
+			"koen " + word[:5],
+			word[:3] + "x" + word[4:],
+			word[:2] + word[3:4] + word[2:3] + word[4:],
+			word[:5] + word[6:],
+			long[:3] + "x" + long[4:10] + "y" + long[11:],
+		} {
+			if !found(text) {
+				t.Errorf("%s: got nothing, want %s", text, word)
+			}
+		}
+		if found(word[:2] + "xx" + word[4:]) {
+			t.Errorf("got a match for two typos in %s, want only one allowed", word)
+		}
+	})
+
+	t.Run("Tiers round trip", func(t *testing.T) {
+		tiers := conn.Tiers()
+		creatorID := "creator" + suffix
+		first := &Tier{
+			CreatorID: creatorID, Name: "Supporter", Description: "Thanks!",
+			Price:    Price{Chain: "polygon", Token: "USDC", Amount: "5"},
+			Benefits: []string{"Early access", "Discord role"},
+			Active:   true, CreatedAt: createdAt, UpdatedAt: createdAt,
+		}
+		second := &Tier{CreatorID: creatorID, Name: "Patron", Price: Price{Chain: "polygon", Token: "MATIC", Amount: "20"},
+			MaxMembers: 10, CreatedAt: createdAt.Add(time.Second), UpdatedAt: createdAt}
+		for _, tier := range []*Tier{first, second} {
+			if err := tiers.Create(ctx, tier); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := tiers.GetByID(ctx, first.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, *first) {
+			t.Errorf("got %+v, want %+v", got, *first)
+		}
+
+		second.Name, second.Active, second.Benefits = "Big patron", true, []string{"Shoutout"}
+		second.CreatorID, second.CreatedAt = "someone else", createdAt.Add(time.Hour)
+		if err := tiers.Update(ctx, *second); err != nil {
+			t.Fatal(err)
+		}
+		list, err := tiers.ListByCreator(ctx, creatorID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 2 || list[0].ID != first.ID || list[1].Name != "Big patron" || !list[1].Active {
+			t.Errorf("got %+v, want both tiers, oldest first, with the update applied", list)
+		}
+
+		if err := tiers.Delete(ctx, first.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tiers.GetByID(ctx, first.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+		if err := tiers.Delete(ctx, first.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+		if err := tiers.DeleteByCreator(ctx, creatorID); err != nil {
+			t.Fatal(err)
+		}
+		if list, _ := tiers.ListByCreator(ctx, creatorID); len(list) != 0 {
+			t.Errorf("got %+v, want no tiers left", list)
+		}
+	})
+
+	t.Run("Payments are recorded once", func(t *testing.T) {
+		payments := conn.Payments()
+		payment := &Payment{
+			Chain: "polygon", TxHash: "0xtx" + suffix, CreatorID: "creator" + suffix, PayerID: "payer" + suffix,
+			From: "0xfrom", To: "0xto", Token: "USDC", Amount: "5.5", BlockNumber: 1 << 40, VerifiedAt: createdAt,
+			FiatCurrency: "EUR", FiatRate: "0.92", FiatAmount: "5.06",
+		}
+		if err := payments.Create(ctx, payment); err != nil {
+			t.Fatal(err)
+		}
+		got, err := payments.GetByTxHash(ctx, payment.TxHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, *payment) {
+			t.Errorf("got %+v, want %+v", got, *payment)
+		}
+		var conflict *ConflictError
+		if err := payments.Create(ctx, &Payment{TxHash: payment.TxHash}); !errors.As(err, &conflict) || conflict.Field != "txHash" {
+			t.Errorf("got %v, want a conflict on txHash", err)
+		}
+		if _, err := payments.GetByTxHash(ctx, "0xother"+suffix); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+		if list, err := payments.ListByCreator(ctx, payment.CreatorID); err != nil || len(list) != 1 || !reflect.DeepEqual(list[0], *payment) {
+			t.Errorf("got %+v %v, want the creator's payment", list, err)
+		}
+
+		if err := payments.AnonymizePayer(ctx, payment.PayerID); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := payments.GetByTxHash(ctx, payment.TxHash); got.PayerID != "" || got.Amount != "5.5" {
+			t.Errorf("got %+v, want the payment kept without its payer", got)
+		}
+	})
+
+	t.Run("Payments from a block on can be dropped", func(t *testing.T) {
+		payments := conn.Payments()
+		// A chain of its own, other runs share the collection
+		chainName := "reorged" + suffix
+		var hashes []string
+		for _, block := range []uint64{12, 10, 11, 9} {
+			p := &Payment{Chain: chainName, TxHash: fmt.Sprintf("0xblock%d%s", block, suffix), CreatorID: "creator" + suffix,
+				Token: "USDC", Amount: "1", BlockNumber: block, VerifiedAt: createdAt}
+			if err := payments.Create(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+			hashes = append(hashes, p.TxHash)
+		}
+		list, err := payments.ListFromBlock(ctx, chainName, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var blocks []uint64
+		for _, p := range list {
+			blocks = append(blocks, p.BlockNumber)
+		}
+		if !reflect.DeepEqual(blocks, []uint64{10, 11, 12}) {
+			t.Errorf("got blocks %v, want 10, 11 and 12", blocks)
+		}
+
+		if err := payments.Delete(ctx, hashes[0]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := payments.GetByTxHash(ctx, hashes[0]); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+		if err := payments.Delete(ctx, hashes[0]); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v deleting it again, want %v", err, ErrNotFound)
+		}
+		if list, _ := payments.ListFromBlock(ctx, chainName, 10); len(list) != 2 {
+			t.Errorf("got %+v, want the payments in blocks 10 and 11", list)
+		}
+	})
+
+	t.Run("Subscriptions round trip", func(t *testing.T) {
+		subs := conn.Subscriptions()
+		patronID, creatorID := "patron"+suffix, "creator"+suffix
+		first := &Subscription{
+			PatronID: patronID, CreatorID: creatorID, TierID: "tier" + suffix, Period: PeriodMonthly,
+			Status: SubscriptionActive, NextDueAt: createdAt.Add(time.Hour), CreatedAt: createdAt, UpdatedAt: createdAt,
+		}
+		second := &Subscription{
+			PatronID: "other" + suffix, CreatorID: patronID, TierID: "tier" + suffix, Period: PeriodMonthly,
+			Status: SubscriptionPastDue, NextDueAt: createdAt, CreatedAt: createdAt.Add(time.Second), UpdatedAt: createdAt,
+		}
+		for _, sub := range []*Subscription{first, second} {
+			if err := subs.Create(ctx, sub); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := subs.GetByID(ctx, first.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, *first) {
+			t.Errorf("got %+v, want %+v", got, *first)
+		}
+
+		canceledAt := createdAt.Add(time.Minute)
+		first.Status, first.CanceledAt, first.LastPaymentTx = SubscriptionCanceled, &canceledAt, "0xtx"
+		if err := subs.Update(ctx, *first); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := subs.GetByID(ctx, first.ID); !reflect.DeepEqual(got, *first) {
+			t.Errorf("got %+v, want %+v", got, *first)
+		}
+		if list, _ := subs.ListByCreator(ctx, creatorID); len(list) != 1 || list[0].ID != first.ID {
+			t.Errorf("got %+v, want the creator's subscription", list)
+		}
+
+		// Canceled ones are never due, other tests may have left some that are
+		due, err := subs.ListDue(ctx, createdAt.Add(2*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, sub := range due {
+			if sub.ID == first.ID || sub.ID == second.ID {
+				ids = append(ids, sub.ID)
+			}
+		}
+		if !reflect.DeepEqual(ids, []string{second.ID}) {
+			t.Errorf("got %v, want %v", ids, []string{second.ID})
+		}
+
+		if err := subs.DeleteByUser(ctx, patronID); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{first.ID, second.ID} {
+			if _, err := subs.GetByID(ctx, id); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v, want %v", err, ErrNotFound)
+			}
+		}
+	})
+
+	t.Run("Withdrawals round trip", func(t *testing.T) {
+		withdrawals := conn.Withdrawals()
+		creatorID := "creator" + suffix
+		first := &Withdrawal{CreatorID: creatorID, Chain: "polygon", Token: "USDC", Amount: "12.5",
+			To: "0x1111111111111111111111111111111111111111", Status: WithdrawalPending, CreatedAt: createdAt, UpdatedAt: createdAt}
+		second := &Withdrawal{CreatorID: creatorID, Chain: "ethereum", Token: "ETH", Amount: "0.1",
+			To: first.To, Status: WithdrawalFailed, CreatedAt: createdAt.Add(time.Second), UpdatedAt: createdAt}
+		for _, w := range []*Withdrawal{first, second} {
+			if err := withdrawals.Create(ctx, w); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		first.Status, first.TxHash, first.Nonce, first.UpdatedAt = WithdrawalSent, "0xtx"+suffix, 1<<40, createdAt.Add(time.Minute)
+		if err := withdrawals.Update(ctx, *first); err != nil {
+			t.Fatal(err)
+		}
+		list, err := withdrawals.ListByCreator(ctx, creatorID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []Withdrawal{*first, *second}; !reflect.DeepEqual(list, want) {
+			t.Errorf("got %+v, want %+v", list, want)
+		}
+		if err := withdrawals.Update(ctx, Withdrawal{ID: "bleh"}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("Ledger entries round trip", func(t *testing.T) {
+		ledger := conn.Ledger()
+		creatorID := "creator" + suffix
+		payment, err := paymentEntries(Payment{Chain: "polygon", TxHash: "0xledger" + suffix, CreatorID: creatorID,
+			Token: "USDC", Amount: "10", VerifiedAt: createdAt, FiatCurrency: "USD", FiatRate: "1.0001"}, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		withdrawal := withdrawalEntries(Withdrawal{ID: "w" + suffix, CreatorID: creatorID, Chain: "polygon", Token: "USDC",
+			Amount: "4.5"}, LedgerWithdrawal, createdAt.Add(time.Hour))
+		for _, entries := range [][]LedgerEntry{withdrawal, payment} {
+			if err := ledger.Post(ctx, entries); err != nil {
+				t.Fatal(err)
+			}
+		}
+		unbalanced := append([]LedgerEntry{}, payment...)
+		unbalanced[0].Amount = "11"
+		if err := ledger.Post(ctx, unbalanced); !errors.Is(err, ErrUnbalanced) {
+			t.Errorf("got %v, want %v", err, ErrUnbalanced)
+		}
+
+		all, err := ledger.ListByCreator(ctx, creatorID, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := append(append([]LedgerEntry{}, payment...), withdrawal...); !reflect.DeepEqual(all, want) {
+			t.Errorf("got %+v, want %+v", all, want)
+		}
+		later, err := ledger.ListByCreator(ctx, creatorID, createdAt.Add(time.Second), createdAt.Add(2*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(later, withdrawal) {
+			t.Errorf("got %+v, want %+v", later, withdrawal)
+		}
+		if none, _ := ledger.ListByCreator(ctx, creatorID, time.Time{}, createdAt); len(none) != 0 {
+			t.Errorf("got %+v, want nothing before the payment", none)
+		}
+	})
+
+	t.Run("Posts round trip", func(t *testing.T) {
+		posts := conn.Posts()
+		creatorID := "creator" + suffix
+		first := &Post{
+			CreatorID: creatorID, Title: "Hello", Body: "*Hi*",
+			Attachments: []Attachment{{URL: "https://cdn.koen.com/a.png", Name: "a.png", ContentType: "image/png"}},
+			Visibility:  VisibilityToken, TierIDs: []string{"1"},
+			Gate:      &gating.Rule{Chain: "polygon", Contract: "0x3333333333333333333333333333333333333333", Standard: "erc1155", MinBalance: "2", TokenIDs: []string{"7"}},
+			PublishAt: createdAt, CreatedAt: createdAt, UpdatedAt: createdAt,
+		}
+		second := &Post{CreatorID: creatorID, Title: "Second", Visibility: VisibilityPublic,
+			PublishAt: createdAt.Add(time.Second), CreatedAt: createdAt, UpdatedAt: createdAt}
+		scheduled := &Post{CreatorID: creatorID, Title: "Later", Visibility: VisibilityPublic,
+			PublishAt: createdAt.Add(time.Hour), CreatedAt: createdAt, UpdatedAt: createdAt}
+		for _, post := range []*Post{first, second, scheduled} {
+			if err := posts.Create(ctx, post); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := posts.GetByID(ctx, first.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, *first) {
+			t.Errorf("got %+v, want %+v", got, *first)
+		}
+
+		// Newest first, scheduled ones left out
+		p := pagination.Params{Limit: 1, Desc: true}
+		var titles []string
+		for {
+			page, next, err := posts.ListByCreator(ctx, creatorID, createdAt.Add(time.Minute), p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, post := range page {
+				titles = append(titles, post.Title)
+			}
+			if next == nil {
+				break
+			}
+			p.After = next
+		}
+		if want := []string{"Second", "Hello"}; !reflect.DeepEqual(titles, want) {
+			t.Errorf("got %v, want %v", titles, want)
+		}
+		if all, _, _ := posts.ListByCreator(ctx, creatorID, time.Time{}, pagination.Params{Limit: 10}); len(all) != 3 {
+			t.Errorf("got %d posts, want scheduled ones too", len(all))
+		}
+
+		second.Title, second.Body, second.CreatorID = "Edited", "More", "someone else"
+		if err := posts.Update(ctx, *second); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := posts.GetByID(ctx, second.ID); got.Title != "Edited" || got.Body != "More" || got.CreatorID != creatorID {
+			t.Errorf("got %+v, want the update applied to the same creator", got)
+		}
+
+		if err := posts.Delete(ctx, first.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := posts.Delete(ctx, first.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+		if err := posts.DeleteByCreator(ctx, creatorID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := posts.GetByID(ctx, scheduled.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("Wallet indexes are never handed out twice", func(t *testing.T) {
+		seen := map[uint32]bool{}
+		for i := 0; i < 3; i++ {
+			index, err := users.NextWalletIndex(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen[index] {
+				t.Errorf("got %d again", index)
+			}
+			seen[index] = true
+		}
+		if got, _ := users.GetByID(ctx, wallet.ID); got.WalletIndex != nil {
+			t.Errorf("got wallet index %d, want none", *got.WalletIndex)
+		}
+	})
+
+	t.Run("Checkpoints are replaced", func(t *testing.T) {
+		checkpoints := conn.Checkpoints()
+		name := "chain" + suffix
+		if _, err := checkpoints.Get(ctx, name); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+		for _, block := range []uint64{100, 1 << 40} {
+			want := Checkpoint{Chain: name, Block: block, Hash: fmt.Sprint("0x", block), UpdatedAt: createdAt}
+			if err := checkpoints.Set(ctx, want); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := checkpoints.Get(ctx, name); err != nil || got != want {
+				t.Errorf("got %+v %v, want %+v", got, err, want)
+			}
+		}
+	})
+
+	t.Run("Canceled context is respected", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := users.GetByID(canceled, user.ID); err == nil {
+			t.Error("want error, got nil")
+		}
+	})
+}
+
+// Only for backends with real transactions, MemoryDB doesn't roll back
+func testTransactions(t *testing.T, conn DBConn) {
+	ctx := context.Background()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+
+	t.Run("Writes are kept on success", func(t *testing.T) {
+		user := &User{PageName: "committed" + suffix, CreatedAt: time.Now().UTC()}
+		err := conn.WithTransaction(ctx, func(ctx context.Context) error {
+			if err := conn.Users().Create(ctx, user); err != nil {
+				return err
+			}
+			return conn.Audit().Record(ctx, AuditEvent{Type: AuditUserCreated, UserID: user.ID, At: time.Now().UTC()})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Users().GetByPageName(ctx, user.PageName); err != nil {
+			t.Error(err)
+		}
+		events, err := conn.Audit().ListByUser(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].Type != AuditUserCreated {
+			t.Errorf("got %v, want one %s event", events, AuditUserCreated)
+		}
+	})
+
+	t.Run("Nothing is kept on failure", func(t *testing.T) {
+		user := &User{PageName: "rolledback" + suffix, CreatedAt: time.Now().UTC()}
+		want := errors.New("bleh")
+		var index uint32
+		err := conn.WithTransaction(ctx, func(ctx context.Context) error {
+			var err error
+			if index, err = conn.Users().NextWalletIndex(ctx); err != nil {
+				return err
+			}
+			if err := conn.Users().Create(ctx, user); err != nil {
+				return err
+			}
+			if err := conn.Audit().Record(ctx, AuditEvent{Type: AuditUserCreated, UserID: user.ID, At: time.Now().UTC()}); err != nil {
+				return err
+			}
+			return want
+		})
+		if !errors.Is(err, want) {
+			t.Fatalf("got %v, want %v", err, want)
+		}
+		if _, err := conn.Users().GetByPageName(ctx, user.PageName); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+		events, err := conn.Audit().ListByUser(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 0 {
+			t.Errorf("got %v, want no events", events)
+		}
+		if next, err := conn.Users().NextWalletIndex(ctx); err != nil || next != index {
+			t.Errorf("got wallet index %d %v, want %d handed out again", next, err, index)
+		}
+	})
+}
+
+func TestConformanceMemory(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	testConformance(t, conn)
+}
+
+func TestConformanceSQLite(t *testing.T) {
+	conn := &SQLInstance{Driver: SQLite, DSN: filepath.Join(t.TempDir(), "koen.db")}
+	conn.Open()
+	defer conn.Close()
+	testConformance(t, conn)
+	testTransactions(t, conn)
+
+	t.Run("Schema migrations are only applied once", func(t *testing.T) {
+		again := &SQLInstance{Driver: SQLite, DSN: conn.DSN}
+		again.Open()
+		again.Close()
+	})
+}
+
+// Needs a throwaway database, e.g. KOEN_TEST_POSTGRES_DSN=postgres://koen@localhost/koen_test?sslmode=disable
+func TestConformancePostgres(t *testing.T) {
+	dsn := os.Getenv("KOEN_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("KOEN_TEST_POSTGRES_DSN not set")
+	}
+	conn := &SQLInstance{Driver: Postgres, DSN: dsn}
+	conn.Open()
+	defer conn.Close()
+	testConformance(t, conn)
+	testTransactions(t, conn)
+}
+
+func TestConformanceMongo(t *testing.T) {
+	conn := testMongoInstance(t)
+	conn.Open()
+	defer conn.Close()
+	testConformance(t, conn)
+	testTransactions(t, conn)
+}
@@ -0,0 +1,453 @@
+package db
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/prices"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+)
+
+// How earnings can be grouped
+const (
+	GroupByDay   = "day"
+	GroupByTier  = "tier"
+	GroupByToken = "token"
+)
+
+// EarningsRow sums up a group of payments in one token. Amounts can't be added up across
+// tokens, so a day or tier paid in two tokens gets two rows
+type EarningsRow struct {
+	// The day (YYYY-MM-DD), tier ID or token symbol. Empty for tips when grouping by tier
+	Key string `json:"key"`
+	// Name of the tier
+	Name     string `json:"name,omitempty"`
+	Chain    string `json:"chain"`
+	Token    string `json:"token"`
+	Gross    string `json:"gross"`
+	Fees     string `json:"fees"`
+	Net      string `json:"net"`
+	Payments int    `json:"payments"`
+	// In the report's currency at the prices when the payments were made. Empty when
+	// there's no price for one of them
+	FiatGross string `json:"fiatGross,omitempty"`
+	FiatFees  string `json:"fiatFees,omitempty"`
+	FiatNet   string `json:"fiatNet,omitempty"`
+}
+
+// Balance is what a creator can withdraw of a token
+type Balance struct {
+	Chain     string `json:"chain"`
+	Token     string `json:"token"`
+	Available string `json:"available"`
+	// At the current price, empty without one
+	Fiat string `json:"fiat,omitempty"`
+}
+
+type Earnings struct {
+	// The creator's display currency, fiat amounts are in it
+	Currency string        `json:"currency"`
+	Rows     []EarningsRow `json:"rows"`
+	Balances []Balance     `json:"balances"`
+}
+
+// StatementLine is a month of a creator's account in one token. Closing is opening plus
+// earned minus withdrawn, earned being gross minus fees
+type StatementLine struct {
+	Chain     string `json:"chain"`
+	Token     string `json:"token"`
+	Opening   string `json:"opening"`
+	Gross     string `json:"gross"`
+	Fees      string `json:"fees"`
+	Earned    string `json:"earned"`
+	Withdrawn string `json:"withdrawn"`
+	Closing   string `json:"closing"`
+}
+
+type Statement struct {
+	// YYYY-MM
+	Month string          `json:"month"`
+	Lines []StatementLine `json:"lines"`
+}
+
+type earningsKey struct {
+	Key   string
+	Chain string
+	Token string
+}
+
+type earningsTotals struct {
+	token              chain.Token
+	gross, fees, net   *big.Int
+	payments           int
+	withdrawn, opening *big.Int
+
+	fiatGross, fiatFees, fiatNet *big.Rat
+	// One of the payments had no price
+	unpriced bool
+}
+
+func newTotals(token chain.Token) *earningsTotals {
+	return &earningsTotals{token: token, gross: new(big.Int), fees: new(big.Int), net: new(big.Int),
+		withdrawn: new(big.Int), opening: new(big.Int), fiatGross: new(big.Rat), fiatFees: new(big.Rat), fiatNet: new(big.Rat)}
+}
+
+// Adds an entry of a payment to the totals, with its price when there's one. Gross is what came
+// into custody, the creator's account and ours are credited so their signs flip
+func (t *earningsTotals) addPayment(e LedgerEntry, amount *big.Int, rate string) {
+	total, fiat := t.gross, t.fiatGross
+	switch e.Account {
+	case AccountCustody:
+		// Payments taken back after a reorg come out of custody
+		if amount.Sign() > 0 {
+			t.payments++
+		} else {
+			t.payments--
+		}
+	case AccountFees:
+		total, fiat = t.fees, t.fiatFees
+		amount = new(big.Int).Neg(amount)
+	case creatorAccount(e.CreatorID):
+		total, fiat = t.net, t.fiatNet
+		amount = new(big.Int).Neg(amount)
+	default:
+		return
+	}
+	total.Add(total, amount)
+	value := prices.Value(formatSigned(amount, t.token), rate)
+	if value == nil {
+		t.unpriced = true
+		return
+	}
+	fiat.Add(fiat, value)
+}
+
+// What fiat amounts in a report are worth, the price stored with the payment if it was
+// priced in currency, or what the feed says it was then
+type fiatRates struct {
+	rates    *prices.Service
+	currency string
+	// By ledger transaction
+	found map[string]string
+	// Stops asking once the feed fails, so one that's down doesn't hold up the report
+	failed bool
+}
+
+func (f *fiatRates) rate(ctx context.Context, e LedgerEntry) string {
+	if e.FiatCurrency == f.currency && e.FiatRate != "" {
+		return e.FiatRate
+	}
+	if rate, ok := f.found[e.TxnID]; ok {
+		return rate
+	}
+	if f.rates == nil || f.failed {
+		return ""
+	}
+	rate, err := f.rates.Rate(ctx, e.Token, f.currency, e.At)
+	// Some tokens have no price, anything else is the feed's fault
+	if err != nil && !errors.Is(err, prices.ErrUnknownToken) && !errors.Is(err, prices.ErrNoRate) {
+		log.Printf("No %s price of %s for earnings: %v", f.currency, e.Token, err)
+		f.failed = true
+	}
+	f.found[e.TxnID] = rate
+	return rate
+}
+
+func formatFiat(value *big.Rat, unpriced bool) string {
+	if unpriced {
+		return ""
+	}
+	return prices.Format(value)
+}
+
+// Reads a YYYY-MM-DD query parameter, the start of the day in UTC
+func dateParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	day, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.New(name + " must be a date like 2021-01-31")
+	}
+	return day, nil
+}
+
+// format=csv downloads the same thing as a spreadsheet
+func wantsCSV(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		return false, true
+	case "csv":
+		return true, true
+	}
+	utils.Respond(http.StatusBadRequest, "format must be json or csv").ServeHTTP(w, r)
+	return false, false
+}
+
+func respondWithCSV(w http.ResponseWriter, filename string, records [][]string) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+	cw := csv.NewWriter(w)
+	cw.WriteAll(records)
+}
+
+func sortedKeys(totals map[earningsKey]*earningsTotals) []earningsKey {
+	keys := make([]earningsKey, 0, len(totals))
+	for k := range totals {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.Chain != b.Chain {
+			return a.Chain < b.Chain
+		}
+		return a.Token < b.Token
+	})
+	return keys
+}
+
+// HandleEarnings sums up the signed in creator's payments by groupBy (day, tier or token,
+// day by default) between the from and to dates, both included, along with what they can
+// withdraw. Amounts are after the platform's fee in net. Fiat amounts are in the creator's
+// display currency, priced by rates when payments weren't priced in it. rates can be nil
+func HandleEarnings(db DBConn, rates *prices.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groupBy := r.URL.Query().Get("groupBy")
+		if groupBy == "" {
+			groupBy = GroupByDay
+		}
+		if !contains([]string{GroupByDay, GroupByTier, GroupByToken}, groupBy) {
+			utils.Respond(http.StatusBadRequest, "groupBy must be day, tier or token").ServeHTTP(w, r)
+			return
+		}
+		from, err := dateParam(r, "from")
+		if err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		to, err := dateParam(r, "to")
+		if err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		if !to.IsZero() {
+			to = to.AddDate(0, 0, 1)
+		}
+		asCSV, ok := wantsCSV(w, r)
+		if !ok {
+			return
+		}
+
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		ctx := r.Context()
+		// Everything, the balances need it all and the range is picked out below
+		entries, err := db.Ledger().ListByCreator(ctx, user.ID, time.Time{}, time.Time{})
+		if err != nil {
+			respondWithDBError(err, "Couldn't get earnings!").ServeHTTP(w, r)
+			return
+		}
+		fiat := &fiatRates{rates: rates, currency: user.DisplayCurrency, found: map[string]string{}}
+		if fiat.currency == "" {
+			fiat.currency = DefaultCurrency
+		}
+		names := map[string]string{}
+		if groupBy == GroupByTier {
+			tiers, err := db.Tiers().ListByCreator(ctx, user.ID)
+			if err != nil {
+				respondWithDBError(err, "Couldn't get tiers!").ServeHTTP(w, r)
+				return
+			}
+			for _, t := range tiers {
+				names[t.ID] = t.Name
+			}
+		}
+
+		totals := map[earningsKey]*earningsTotals{}
+		for _, e := range entries {
+			isPayment := e.Kind == LedgerPayment || e.Kind == LedgerOrphaned
+			if !isPayment || e.At.Before(from) || !to.IsZero() && !e.At.Before(to) {
+				continue
+			}
+			token, ok := ledgerToken(e)
+			if !ok {
+				continue
+			}
+			amount, err := parseSigned(e.Amount, token)
+			if err != nil {
+				continue
+			}
+			key := earningsKey{Chain: e.Chain, Token: e.Token}
+			switch groupBy {
+			case GroupByDay:
+				key.Key = e.At.UTC().Format("2006-01-02")
+			case GroupByTier:
+				key.Key = e.TierID
+			case GroupByToken:
+				key.Key = e.Token
+			}
+			if totals[key] == nil {
+				totals[key] = newTotals(token)
+			}
+			totals[key].addPayment(e, amount, fiat.rate(ctx, e))
+		}
+
+		earnings := Earnings{Currency: fiat.currency, Rows: []EarningsRow{}, Balances: []Balance{}}
+		for _, k := range sortedKeys(totals) {
+			t := totals[k]
+			earnings.Rows = append(earnings.Rows, EarningsRow{
+				Key:       k.Key,
+				Name:      names[k.Key],
+				Chain:     k.Chain,
+				Token:     k.Token,
+				Gross:     formatSigned(t.gross, t.token),
+				Fees:      formatSigned(t.fees, t.token),
+				Net:       formatSigned(t.net, t.token),
+				Payments:  t.payments,
+				FiatGross: formatFiat(t.fiatGross, t.unpriced),
+				FiatFees:  formatFiat(t.fiatFees, t.unpriced),
+				FiatNet:   formatFiat(t.fiatNet, t.unpriced),
+			})
+		}
+
+		if asCSV {
+			currency := strings.ToLower(fiat.currency)
+			header := []string{groupBy, "chain", "token", "gross", "fees", "net", "payments",
+				"gross_" + currency, "fees_" + currency, "net_" + currency}
+			if groupBy == GroupByTier {
+				header = append([]string{"tier", "name"}, header[1:]...)
+			}
+			records := [][]string{header}
+			for _, row := range earnings.Rows {
+				record := []string{row.Key, row.Chain, row.Token, row.Gross, row.Fees, row.Net, strconv.Itoa(row.Payments),
+					row.FiatGross, row.FiatFees, row.FiatNet}
+				if groupBy == GroupByTier {
+					record = append([]string{row.Key, row.Name}, record[1:]...)
+				}
+				records = append(records, record)
+			}
+			respondWithCSV(w, "earnings.csv", records)
+			return
+		}
+
+		balances := accountBalances(entries, creatorAccount(user.ID))
+		keys := make([]balanceKey, 0, len(balances))
+		for k := range balances {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].Chain < keys[j].Chain || keys[i].Chain == keys[j].Chain && keys[i].Token < keys[j].Token
+		})
+		for _, k := range keys {
+			c, _ := chain.Lookup(k.Chain)
+			token, _ := c.Token(k.Token)
+			balance := Balance{Chain: k.Chain, Token: k.Token, Available: formatSigned(balances[k], token)}
+			if rates != nil && !fiat.failed {
+				rate, err := rates.Rate(ctx, k.Token, fiat.currency, time.Now())
+				if value := prices.Value(balance.Available, rate); err == nil && value != nil {
+					balance.Fiat = prices.Format(value)
+				}
+			}
+			earnings.Balances = append(earnings.Balances, balance)
+		}
+		utils.RespondWithJSON(earnings, http.StatusOK)(w, r)
+	}
+}
+
+// HandleStatement is the signed in creator's account for a month (YYYY-MM, in UTC): what
+// they were owed going in, earned, withdrew and were owed coming out, per token
+func HandleStatement(db DBConn, month string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, err := time.Parse("2006-01", month)
+		if err != nil {
+			utils.Respond(http.StatusBadRequest, "Month must be like 2021-01").ServeHTTP(w, r)
+			return
+		}
+		end := start.AddDate(0, 1, 0)
+		asCSV, ok := wantsCSV(w, r)
+		if !ok {
+			return
+		}
+
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		entries, err := db.Ledger().ListByCreator(r.Context(), user.ID, time.Time{}, end)
+		if err != nil {
+			respondWithDBError(err, "Couldn't get statement!").ServeHTTP(w, r)
+			return
+		}
+		account := creatorAccount(user.ID)
+		totals := map[earningsKey]*earningsTotals{}
+		for _, e := range entries {
+			token, ok := ledgerToken(e)
+			if !ok {
+				continue
+			}
+			amount, err := parseSigned(e.Amount, token)
+			if err != nil {
+				continue
+			}
+			key := earningsKey{Chain: e.Chain, Token: e.Token}
+			if totals[key] == nil {
+				totals[key] = newTotals(token)
+			}
+			t := totals[key]
+			switch {
+			case e.At.Before(start):
+				if e.Account == account {
+					t.opening.Sub(t.opening, amount)
+				}
+			case e.Kind == LedgerPayment || e.Kind == LedgerOrphaned:
+				t.addPayment(e, amount, "")
+			case e.Account == account:
+				// Withdrawals debit the creator's account, reversals credit it back
+				t.withdrawn.Add(t.withdrawn, amount)
+			}
+		}
+
+		statement := Statement{Month: start.Format("2006-01"), Lines: []StatementLine{}}
+		for _, k := range sortedKeys(totals) {
+			t := totals[k]
+			closing := new(big.Int).Add(t.opening, t.net)
+			closing.Sub(closing, t.withdrawn)
+			statement.Lines = append(statement.Lines, StatementLine{
+				Chain:     k.Chain,
+				Token:     k.Token,
+				Opening:   formatSigned(t.opening, t.token),
+				Gross:     formatSigned(t.gross, t.token),
+				Fees:      formatSigned(t.fees, t.token),
+				Earned:    formatSigned(t.net, t.token),
+				Withdrawn: formatSigned(t.withdrawn, t.token),
+				Closing:   formatSigned(closing, t.token),
+			})
+		}
+
+		if asCSV {
+			records := [][]string{{"chain", "token", "opening", "gross", "fees", "earned", "withdrawn", "closing"}}
+			for _, l := range statement.Lines {
+				records = append(records, []string{l.Chain, l.Token, l.Opening, l.Gross, l.Fees, l.Earned, l.Withdrawn, l.Closing})
+			}
+			respondWithCSV(w, "statement-"+statement.Month+".csv", records)
+			return
+		}
+		utils.RespondWithJSON(statement, http.StatusOK)(w, r)
+	}
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/prices"
+)
+
+func TestPaymentEntries(t *testing.T) {
+	payment := Payment{Chain: "polygon", TxHash: "0x1", CreatorID: "1", Token: "USDC", Amount: "10.000001"}
+
+	t.Run("The fee is split off and rounded down", func(t *testing.T) {
+		entries, err := paymentEntries(payment, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, e := range entries {
+			got[e.Account] = e.Amount
+		}
+		want := map[string]string{AccountCustody: "10.000001", "creator:1": "-9.500001", AccountFees: "-0.5"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if err := checkBalanced(entries); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("No fee, no fee entry", func(t *testing.T) {
+		ConfigureEarnings(config.EarningsConfig{FeeBps: 0})
+		defer ConfigureEarnings(config.EarningsConfig{FeeBps: 500})
+		entries, _ := paymentEntries(payment, "")
+		if len(entries) != 2 || entries[1].Amount != "-10.000001" {
+			t.Errorf("got %+v, want custody and creator entries only", entries)
+		}
+	})
+
+	t.Run("Reversals undo withdrawals", func(t *testing.T) {
+		w := Withdrawal{ID: "7", CreatorID: "1", Chain: "polygon", Token: "USDC", Amount: "3"}
+		entries := append(withdrawalEntries(w, LedgerWithdrawal, time.Time{}), withdrawalEntries(w, LedgerReversal, time.Time{})...)
+		if balance := accountBalances(entries, "creator:1"); balance[balanceKey{"polygon", "USDC"}].Sign() != 0 {
+			t.Errorf("got %v, want nothing left", balance)
+		}
+	})
+}
+
+func TestEarnings(t *testing.T) {
+	ctx := context.Background()
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	creator := &User{Email: "creator@koen.com", PageName: "koen-san"}
+	creator.DisplayCurrency = "EUR"
+	if err := conn.Users().Create(ctx, creator); err != nil {
+		t.Fatal(err)
+	}
+	gold := &Tier{CreatorID: creator.ID, Name: "Gold", Price: Price{Chain: "polygon", Token: "USDC", Amount: "10"}, Active: true}
+	if err := conn.Tiers().Create(ctx, gold); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two tier payments and a tip in January, a tip in MATIC and a withdrawal in February.
+	// The first was priced in euros, the second back when the creator showed dollars
+	jan := time.Date(2021, 1, 30, 12, 0, 0, 0, time.UTC)
+	payments := []struct {
+		payment Payment
+		tierID  string
+	}{
+		{Payment{TxHash: "0x1", Token: "USDC", Amount: "10", VerifiedAt: jan, FiatCurrency: "EUR", FiatRate: "0.9"}, gold.ID},
+		{Payment{TxHash: "0x2", Token: "USDC", Amount: "10", VerifiedAt: jan.Add(24 * time.Hour), FiatCurrency: "USD",
+			FiatRate: "1"}, gold.ID},
+		{Payment{TxHash: "0x3", Token: "USDC", Amount: "2", VerifiedAt: jan.Add(24 * time.Hour)}, ""},
+		{Payment{TxHash: "0x4", Token: "MATIC", Amount: "1", VerifiedAt: jan.AddDate(0, 0, 5)}, ""},
+	}
+	for _, p := range payments {
+		p.payment.Chain, p.payment.CreatorID = "polygon", creator.ID
+		entries, err := paymentEntries(p.payment, p.tierID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.Ledger().Post(ctx, entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	withdrawal := Withdrawal{ID: "1", CreatorID: creator.ID, Chain: "polygon", Token: "USDC", Amount: "15"}
+	if err := conn.Ledger().Post(ctx, withdrawalEntries(withdrawal, LedgerWithdrawal, jan.AddDate(0, 0, 3))); err != nil {
+		t.Fatal(err)
+	}
+
+	// No MATIC price
+	rates := &prices.Service{Feed: prices.StaticFeed{"USDC": {"EUR": "0.92"}}}
+
+	serve := func(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", target, nil)
+		req = req.WithContext(context.WithValue(req.Context(), "userData", auth.Claims{
+			GoogleClaims: auth.GoogleClaims{Email: creator.Email},
+		}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Earnings by token, with balances", func(t *testing.T) {
+		rr := serve(HandleEarnings(conn, rates), "/creators/me/earnings?groupBy=token")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		var got Earnings
+		json.Unmarshal(rr.Body.Bytes(), &got)
+		want := Earnings{
+			Currency: "EUR",
+			Rows: []EarningsRow{
+				{Key: "MATIC", Chain: "polygon", Token: "MATIC", Gross: "1", Fees: "0.05", Net: "0.95", Payments: 1},
+				{Key: "USDC", Chain: "polygon", Token: "USDC", Gross: "22", Fees: "1.1", Net: "20.9", Payments: 3,
+					FiatGross: "20.04", FiatFees: "1.00", FiatNet: "19.04"},
+			},
+			Balances: []Balance{{"polygon", "MATIC", "0.95", ""}, {"polygon", "USDC", "5.9", "5.43"}},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("Earnings by day within a range", func(t *testing.T) {
+		var got Earnings
+		json.Unmarshal(serve(HandleEarnings(conn, rates), "/creators/me/earnings?from=2021-01-31&to=2021-01-31").Body.Bytes(), &got)
+		if len(got.Rows) != 1 || got.Rows[0].Key != "2021-01-31" || got.Rows[0].Gross != "12" || got.Rows[0].Payments != 2 {
+			t.Errorf("got %+v, want the 31st only", got.Rows)
+		}
+	})
+
+	t.Run("Earnings by tier as CSV", func(t *testing.T) {
+		rr := serve(HandleEarnings(conn, rates), "/creators/me/earnings?groupBy=tier&to=2021-01-31&format=csv")
+		want := "tier,name,chain,token,gross,fees,net,payments,gross_eur,fees_eur,net_eur\n" +
+			",,polygon,USDC,2,0.1,1.9,1,1.84,0.09,1.75\n" +
+			gold.ID + ",Gold,polygon,USDC,20,1,19,2,18.20,0.91,17.29\n"
+		if rr.Body.String() != want || rr.Header().Get("Content-Type") != "text/csv" {
+			t.Errorf("got %q, want %q", rr.Body, want)
+		}
+	})
+
+	t.Run("Bad parameters", func(t *testing.T) {
+		for _, target := range []string{"?groupBy=week", "?from=yesterday", "?format=xml"} {
+			if rr := serve(HandleEarnings(conn, rates), "/creators/me/earnings"+target); rr.Code != http.StatusBadRequest {
+				t.Errorf("%s: got %v, want %v", target, rr.Code, http.StatusBadRequest)
+			}
+		}
+		if rr := serve(HandleStatement(conn, "2021-13"), "/creators/me/statements/2021-13"); rr.Code != http.StatusBadRequest {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("Statements carry the balance over", func(t *testing.T) {
+		var got Statement
+		json.Unmarshal(serve(HandleStatement(conn, "2021-02"), "/creators/me/statements/2021-02").Body.Bytes(), &got)
+		want := Statement{Month: "2021-02", Lines: []StatementLine{
+			{Chain: "polygon", Token: "MATIC", Opening: "0", Gross: "1", Fees: "0.05", Earned: "0.95", Withdrawn: "0", Closing: "0.95"},
+			{Chain: "polygon", Token: "USDC", Opening: "20.9", Gross: "0", Fees: "0", Earned: "0", Withdrawn: "15", Closing: "5.9"},
+		}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/cryptopatron/koen-backend/pkg/blob"
+	"github.com/cryptopatron/koen-backend/pkg/media"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+)
+
+// Room for the multipart boundaries and headers around the image itself
+const multipartOverhead = 64 << 10
+
+// Where an image kind lives on a profile
+func imageFields(p *Profile, kind media.Kind) (*string, **Image) {
+	if kind.Name == media.Banner.Name {
+		return &p.BannerURL, &p.Banner
+	}
+	return &p.AvatarURL, &p.Avatar
+}
+
+// Reads the "image" field of a multipart upload, false if it's larger than maxSize
+func readUpload(r *http.Request, maxSize int64) ([]byte, bool, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, true, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, true, errors.New("image is required")
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		if part.FormName() != "image" {
+			continue
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(part, maxSize+1))
+		if err != nil {
+			return nil, true, err
+		}
+		return data, int64(len(data)) <= maxSize, nil
+	}
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Stores all renditions, removing the ones already stored if any of them fails
+func storeRenditions(ctx context.Context, store blob.Store, prefix string, renditions []media.Rendition) (*Image, error) {
+	image := &Image{URLs: map[string]string{}}
+	for _, r := range renditions {
+		key := prefix + r.Size + r.Ext()
+		if err := store.Put(ctx, key, bytes.NewReader(r.Data), r.ContentType); err != nil {
+			deleteBlobs(ctx, store, image.Keys)
+			return nil, err
+		}
+		image.Keys = append(image.Keys, key)
+		image.URLs[r.Size] = store.URL(key)
+	}
+	return image, nil
+}
+
+// Leftover files only cost storage, so failures are just logged
+func deleteBlobs(ctx context.Context, store blob.Store, keys []string) {
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			log.Printf("Couldn't delete %s: %v", key, err)
+		}
+	}
+}
+
+// HandleUploadImage takes a multipart upload with an "image" field and makes it the signed in user's
+// avatar or banner, depending on kind. Whatever image it replaces is deleted from the store
+func HandleUploadImage(db DBConn, store blob.Store, kind media.Kind, maxSize int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxSize+multipartOverhead {
+			utils.Respond(http.StatusRequestEntityTooLarge, "Image is too large").ServeHTTP(w, r)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize+multipartOverhead)
+
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		data, fits, err := readUpload(r, maxSize)
+		if err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		if !fits {
+			utils.Respond(http.StatusRequestEntityTooLarge, "Image is too large").ServeHTTP(w, r)
+			return
+		}
+
+		renditions, err := media.Process(data, kind)
+		if errors.Is(err, media.ErrUnsupportedType) {
+			utils.Respond(http.StatusUnsupportedMediaType, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		if errors.Is(err, media.ErrInvalidImage) || errors.Is(err, media.ErrDimensions) {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			utils.Respond(http.StatusInternalServerError, "Couldn't process image!").ServeHTTP(w, r)
+			return
+		}
+
+		// A new prefix per upload, so caches never serve the old image under a new profile
+		id, err := randomID()
+		if err != nil {
+			utils.Respond(http.StatusInternalServerError, "Couldn't store image!").ServeHTTP(w, r)
+			return
+		}
+		image, err := storeRenditions(r.Context(), store, kind.Name+"s/"+user.ID+"/"+id+"/", renditions)
+		if err != nil {
+			log.Println(err)
+			utils.Respond(http.StatusInternalServerError, "Couldn't store image!").ServeHTTP(w, r)
+			return
+		}
+
+		// The upload doesn't depend on the rest of the profile, so it's applied on top
+		// of whatever version is current instead of failing on concurrent edits
+		var old *Image
+		for attempt := 0; ; attempt++ {
+			urlField, imageField := imageFields(&user.Profile, kind)
+			old = *imageField
+			*urlField, *imageField = image.URLs[kind.Sizes[0].Name], image
+			version := user.UpdatedAt
+			user.UpdatedAt = nextVersion(version)
+			err = db.Users().Update(r.Context(), user, version)
+			if !errors.Is(err, ErrVersionMismatch) || attempt == 2 {
+				break
+			}
+			if user, err = activeUser(db.Users().GetByID(r.Context(), user.ID)); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			deleteBlobs(r.Context(), store, image.Keys)
+			if errors.Is(err, ErrNotFound) {
+				utils.Respond(http.StatusNotFound, "User not found").ServeHTTP(w, r)
+				return
+			}
+			respondWithDBError(err, "Couldn't update user!").ServeHTTP(w, r)
+			return
+		}
+		if old != nil {
+			deleteBlobs(r.Context(), store, old.Keys)
+		}
+		utils.RespondWithJSON(user, http.StatusOK)(w, r)
+	}
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/blob"
+	"github.com/cryptopatron/koen-backend/pkg/media"
+)
+
+func pngUpload(t *testing.T, w, h int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.Set(0, 0, color.Black)
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandleUploadImage(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	dir, err := ioutil.TempDir("", "koen-media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &blob.LocalStore{Dir: dir, BaseURL: "/media"}
+
+	user := &User{Email: "test@koen.com", PageName: "koen-san", UpdatedAt: newVersion()}
+	if err := conn.Users().Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(kind media.Kind, field string, data []byte) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		part, _ := mw.CreateFormFile(field, "upload.png")
+		part.Write(data)
+		mw.Close()
+		req, _ := http.NewRequest("POST", "/users/me/"+kind.Name, body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req = req.WithContext(context.WithValue(req.Context(), "userData", auth.Claims{
+			GoogleClaims: auth.GoogleClaims{Email: "test@koen.com"},
+		}))
+		rr := httptest.NewRecorder()
+		HandleUploadImage(conn, store, kind, 1<<20).ServeHTTP(rr, req)
+		return rr
+	}
+	stored := func(url string) bool {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(url, "/media/"))))
+		return err == nil
+	}
+
+	var first *Image
+	t.Run("Avatar is stored in every size", func(t *testing.T) {
+		rr := upload(media.Avatar, "image", pngUpload(t, 500, 300))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		got, _ := conn.Users().GetByID(context.Background(), user.ID)
+		if got.Avatar == nil || len(got.Avatar.URLs) != len(media.Avatar.Sizes) {
+			t.Fatalf("got %+v, want an avatar in every size", got.Avatar)
+		}
+		if got.AvatarURL != got.Avatar.URLs["large"] {
+			t.Errorf("got avatarUrl %v, want %v", got.AvatarURL, got.Avatar.URLs["large"])
+		}
+		for _, url := range got.Avatar.URLs {
+			if !stored(url) {
+				t.Errorf("got nothing stored for %v", url)
+			}
+		}
+		if !strings.Contains(rr.Body.String(), got.Avatar.URLs["small"]) || strings.Contains(rr.Body.String(), "keys") {
+			t.Errorf("got %s, want the URLs without keys", rr.Body)
+		}
+		first = got.Avatar
+	})
+
+	t.Run("Replacing the avatar deletes the old one", func(t *testing.T) {
+		if rr := upload(media.Avatar, "image", pngUpload(t, 100, 100)); rr.Code != http.StatusOK {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		for _, url := range first.URLs {
+			if stored(url) {
+				t.Errorf("got %v still stored, want it deleted", url)
+			}
+		}
+	})
+
+	t.Run("Banner leaves the avatar alone", func(t *testing.T) {
+		if rr := upload(media.Banner, "image", pngUpload(t, 600, 200)); rr.Code != http.StatusOK {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		got, _ := conn.Users().GetByID(context.Background(), user.ID)
+		if got.Banner == nil || got.Avatar == nil || got.BannerURL == got.AvatarURL {
+			t.Errorf("got %+v, want both images", got.Profile)
+		}
+	})
+
+	t.Run("Bad uploads", func(t *testing.T) {
+		cases := []struct {
+			field string
+			data  []byte
+			want  int
+		}{
+			{"image", []byte("<svg></svg>"), http.StatusUnsupportedMediaType},
+			{"image", []byte("\x89PNG\r\n\x1a\nbleh"), http.StatusBadRequest},
+			{"image", pngUpload(t, 8, 8), http.StatusBadRequest},
+			{"file", pngUpload(t, 100, 100), http.StatusBadRequest},
+			{"image", append(pngUpload(t, 100, 100), make([]byte, 1<<20)...), http.StatusRequestEntityTooLarge},
+		}
+		for _, c := range cases {
+			if rr := upload(media.Avatar, c.field, c.data); rr.Code != c.want {
+				t.Errorf("got %v, want %v: %s", rr.Code, c.want, rr.Body)
+			}
+		}
+	})
+
+	t.Run("Pasting a URL replaces the upload", func(t *testing.T) {
+		got, _ := conn.Users().GetByID(context.Background(), user.ID)
+		patch := profilePatch{AvatarURL: new(string)}
+		*patch.AvatarURL = "https://cdn.koen.com/a.png"
+		patch.apply(&got)
+		if got.Avatar != nil || got.AvatarURL != "https://cdn.koen.com/a.png" {
+			t.Errorf("got %+v, want the pasted URL only", got.Profile)
+		}
+		if got.Banner == nil {
+			t.Error("got no banner, want it kept")
+		}
+	})
+}
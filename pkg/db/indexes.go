@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrConflict is returned when a write would break a unique index.
+// Use errors.As with *ConflictError to find out which field clashed
+var ErrConflict = errors.New("conflict")
+
+type ConflictError struct {
+	Field string
+}
+
+func (e *ConflictError) Error() string {
+	if e.Field == "" {
+		return "entry already exists"
+	}
+	return fmt.Sprintf("%s is already taken", e.Field)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Index describes a single field index on a collection
+type Index struct {
+	Field  string
+	Unique bool
+	// Compare values case-insensitively, so "Koen" and "koen" clash
+	CaseInsensitive bool
+}
+
+// Name is what we call the index in Mongo.
+// Duplicate key errors only mention the index name, so it has to map back to the field
+func (i Index) Name() string {
+	if i.Unique {
+		return i.Field + "_unique"
+	}
+	return i.Field + "_1"
+}
+
+var UserIndexes = []Index{
+	{Field: "pageName", Unique: true, CaseInsensitive: true},
+	{Field: "email", Unique: true, CaseInsensitive: true},
+	{Field: "metaMaskWalletPublicAddress", Unique: true, CaseInsensitive: true},
+	{Field: "generatedMaticWalletPublicAddress", Unique: true, CaseInsensitive: true},
+}
+
+// A transaction is only recorded as a payment once
+var PaymentIndexes = []Index{
+	{Field: "txHash", Unique: true},
+	{Field: "creatorId"},
+	{Field: "payerId"},
+	// Reorgs look up the payments from a block on
+	{Field: "blockNumber"},
+}
+
+// Due dates are what the scheduler looks for
+var SubscriptionIndexes = []Index{
+	{Field: "patronId"},
+	{Field: "creatorId"},
+	{Field: "nextDueAt"},
+}
+
+var PageNameChangeIndexes = []Index{
+	{Field: "oldName", CaseInsensitive: true},
+	{Field: "userId"},
+}
+
+func (i Index) model() mongo.IndexModel {
+	opts := options.Index().SetName(i.Name())
+	if i.Unique {
+		// Users only have some of these fields set, so leave empty ones out of the index
+		opts.SetUnique(true).SetPartialFilterExpression(bson.M{i.Field: bson.M{"$gt": ""}})
+	}
+	if i.CaseInsensitive {
+		// Strength 2 compares base letters and accents but ignores case
+		opts.SetCollation(&options.Collation{Locale: "en", Strength: 2})
+	}
+	return mongo.IndexModel{Keys: bson.D{{Key: i.Field, Value: 1}}, Options: opts}
+}
+
+func ensureIndexes(ctx context.Context, coll *mongo.Collection, indexes []Index) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+	models := make([]mongo.IndexModel, len(indexes))
+	for idx, i := range indexes {
+		models[idx] = i.model()
+	}
+	_, err := coll.Indexes().CreateMany(ctx, models)
+	return err
+}
+
+var dupKeyIndex = regexp.MustCompile(`index: (\S+) dup key`)
+
+// Turns Mongo's duplicate key errors into a *ConflictError, other errors are passed through
+func conflictFromMongo(err error, indexes []Index) error {
+	if err == nil || !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	match := dupKeyIndex.FindStringSubmatch(err.Error())
+	if match != nil {
+		for _, i := range indexes {
+			if i.Name() == match[1] {
+				return &ConflictError{Field: i.Field}
+			}
+		}
+		return &ConflictError{Field: strings.TrimSuffix(match[1], "_unique")}
+	}
+	return &ConflictError{}
+}
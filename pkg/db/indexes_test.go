@@ -0,0 +1,153 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/pagination"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func duplicateKeyError(index string) error {
+	return mongo.WriteException{
+		WriteErrors: mongo.WriteErrors{{
+			Code:    11000,
+			Message: "E11000 duplicate key error collection: koen_test.users index: " + index + ` dup key: { pageName: "koen" }`,
+		}},
+	}
+}
+
+func TestConflictFromMongo(t *testing.T) {
+
+	t.Run("Duplicate key maps to the indexed field", func(t *testing.T) {
+		err := conflictFromMongo(duplicateKeyError("pageName_unique"), UserIndexes)
+
+		if !errors.Is(err, ErrConflict) {
+			t.Fatalf("got %v, want ErrConflict", err)
+		}
+		var conflict *ConflictError
+		errors.As(err, &conflict)
+		if conflict.Field != "pageName" {
+			t.Errorf("got %q, want %q", conflict.Field, "pageName")
+		}
+	})
+
+	t.Run("Other errors are passed through", func(t *testing.T) {
+		want := errors.New("bleh")
+		got := conflictFromMongo(want, UserIndexes)
+
+		if got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
+
+// Only knows how to fail, enough to check how handlers surface errors
+type failingConn struct {
+	err error
+	// What looking users up by email or wallet fails with, err if not set
+	lookupErr error
+}
+
+func (f failingConn) Open()  {}
+func (f failingConn) Close() {}
+func (f failingConn) Users() UserRepository {
+	return failingUsers(f)
+}
+func (f failingConn) Audit() AuditRepository {
+	return &memoryAudit{}
+}
+func (f failingConn) PageNames() PageNameRepository {
+	return &memoryPageNames{}
+}
+func (f failingConn) Tiers() TierRepository {
+	return &memoryTiers{}
+}
+func (f failingConn) Payments() PaymentRepository {
+	return &memoryPayments{}
+}
+func (f failingConn) Checkpoints() CheckpointRepository {
+	return &memoryCheckpoints{byChain: map[string]Checkpoint{}}
+}
+func (f failingConn) Subscriptions() SubscriptionRepository {
+	return &memorySubscriptions{}
+}
+func (f failingConn) Posts() PostRepository {
+	return &memoryPosts{}
+}
+func (f failingConn) Withdrawals() WithdrawalRepository {
+	return &memoryWithdrawals{}
+}
+func (f failingConn) Ledger() LedgerRepository {
+	return &memoryLedger{}
+}
+func (f failingConn) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+type failingUsers failingConn
+
+func (f failingUsers) Create(ctx context.Context, user *User) error { return f.err }
+func (f failingUsers) GetByID(ctx context.Context, id string) (User, error) {
+	return User{}, f.err
+}
+func (f failingUsers) lookupError() error {
+	if f.lookupErr != nil {
+		return f.lookupErr
+	}
+	return f.err
+}
+func (f failingUsers) GetByEmail(ctx context.Context, email string) (User, error) {
+	return User{}, f.lookupError()
+}
+func (f failingUsers) GetByWallet(ctx context.Context, address string) (User, error) {
+	return User{}, f.lookupError()
+}
+func (f failingUsers) GetByPageName(ctx context.Context, pageName string) (User, error) {
+	return User{}, f.err
+}
+func (f failingUsers) UpdatePageName(ctx context.Context, id, pageName string) error {
+	return f.err
+}
+func (f failingUsers) Update(ctx context.Context, user User, version time.Time) error {
+	return f.err
+}
+func (f failingUsers) SetSupporterCount(ctx context.Context, id string, n int) error {
+	return f.err
+}
+func (f failingUsers) SoftDelete(ctx context.Context, id string, at time.Time) error {
+	return f.err
+}
+func (f failingUsers) Restore(ctx context.Context, id string) error        { return f.err }
+func (f failingUsers) NextWalletIndex(ctx context.Context) (uint32, error) { return 0, f.err }
+func (f failingUsers) Delete(ctx context.Context, id string) error         { return f.err }
+func (f failingUsers) ListDeletedBefore(ctx context.Context, before time.Time) ([]User, error) {
+	return nil, f.err
+}
+func (f failingUsers) ListWithDepositAddress(ctx context.Context) ([]User, error) {
+	return nil, f.err
+}
+func (f failingUsers) List(ctx context.Context, p pagination.Params) ([]User, *pagination.Key, error) {
+	return nil, nil, f.err
+}
+func (f failingUsers) Search(ctx context.Context, q SearchQuery) ([]User, error) {
+	return nil, f.err
+}
+
+func TestCreateUserConflict(t *testing.T) {
+	htc := &utils.HttpTestCase{
+		Handler: HandleCreateUser(failingConn{err: &ConflictError{Field: "pageName"}, lookupErr: ErrNotFound}, testDeposits(t), nil),
+	}
+
+	htc.SetRequestBody(strings.NewReader(`{"pageName": "koen-san"}`))
+	htc.SetContext("userData", auth.Claims{
+		GoogleClaims: auth.GoogleClaims{Email: "test@koen.com"},
+	})
+	t.Run("HTTP 409 on a taken pageName", htc.CheckReturnStatus(http.StatusConflict))
+}
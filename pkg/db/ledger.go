@@ -0,0 +1,332 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/prices"
+)
+
+// Ledger accounts. Custody is what we hold on chain for creators, fees is what the
+// platform earned and every creator has an account of what they're owed
+const (
+	AccountCustody = "custody"
+	AccountFees    = "fees"
+)
+
+func creatorAccount(creatorID string) string {
+	return "creator:" + creatorID
+}
+
+// What a ledger transaction was for
+const (
+	LedgerPayment    = "payment"
+	LedgerWithdrawal = "withdrawal"
+	// Gives back a withdrawal that failed
+	LedgerReversal = "reversal"
+	// Takes back a payment whose transaction a reorg dropped
+	LedgerOrphaned = "orphaned"
+)
+
+var ErrUnbalanced = errors.New("ledger entries don't add up to zero")
+
+// Set from config by ConfigureEarnings
+var platformFeeBps = 500
+
+func ConfigureEarnings(c config.EarningsConfig) {
+	platformFeeBps = c.FeeBps
+}
+
+// LedgerEntry is one side of a double-entry transaction. Debits are positive and credits
+// negative, so a creator's account going more negative means they're owed more
+type LedgerEntry struct {
+	// Assigned by the repository on Post
+	ID string `bson:"-" json:"-"`
+	// Shared by the entries of one transaction, like "payment:<tx hash>"
+	TxnID   string `bson:"txnId" json:"txnId"`
+	Account string `bson:"account" json:"account"`
+	// Whose earnings the transaction is about
+	CreatorID string `bson:"creatorId" json:"-"`
+	Kind      string `bson:"kind" json:"kind"`
+	Chain     string `bson:"chain" json:"chain"`
+	Token     string `bson:"token" json:"token"`
+	// Signed decimal amount of the token
+	Amount string `bson:"amount" json:"amount"`
+	// Tier a payment renewed, empty for tips
+	TierID string    `bson:"tierId" json:"tierId,omitempty"`
+	At     time.Time `bson:"at" json:"at"`
+	// Price of one token when a payment was made, in the creator's display currency at the time
+	FiatCurrency string `bson:"fiatCurrency" json:"fiatCurrency,omitempty"`
+	FiatRate     string `bson:"fiatRate" json:"fiatRate,omitempty"`
+}
+
+// LedgerRepository stores ledger entries. Entries are never changed, mistakes are
+// corrected by posting more of them
+type LedgerRepository interface {
+	// Post stores the entries of a transaction, returning ErrUnbalanced unless
+	// they add up to zero for every token
+	Post(ctx context.Context, entries []LedgerEntry) error
+	// Entries of a creator's transactions from from up to (not including) to, oldest first.
+	// A zero time leaves that end open
+	ListByCreator(ctx context.Context, creatorID string, from, to time.Time) ([]LedgerEntry, error)
+}
+
+// Amounts in entries are the token's decimal amounts with a sign in front
+func parseSigned(amount string, token chain.Token) (*big.Int, error) {
+	n, err := chain.ParseAmount(strings.TrimPrefix(amount, "-"), token.Decimals)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(amount, "-") {
+		n.Neg(n)
+	}
+	return n, nil
+}
+
+func formatSigned(n *big.Int, token chain.Token) string {
+	if n.Sign() < 0 {
+		return "-" + chain.FormatAmount(new(big.Int).Neg(n), token.Decimals)
+	}
+	return chain.FormatAmount(n, token.Decimals)
+}
+
+func ledgerToken(e LedgerEntry) (chain.Token, bool) {
+	c, ok := chain.Lookup(e.Chain)
+	if !ok {
+		return chain.Token{}, false
+	}
+	return c.Token(e.Token)
+}
+
+// Checks entries before they're posted, the repositories all go through it
+func checkBalanced(entries []LedgerEntry) error {
+	if len(entries) < 2 {
+		return ErrUnbalanced
+	}
+	sums := map[string]*big.Int{}
+	for _, e := range entries {
+		token, ok := ledgerToken(e)
+		if !ok || e.TxnID != entries[0].TxnID {
+			return ErrUnbalanced
+		}
+		amount, err := parseSigned(e.Amount, token)
+		if err != nil {
+			return err
+		}
+		key := e.Chain + "/" + e.Token
+		if sums[key] == nil {
+			sums[key] = new(big.Int)
+		}
+		sums[key].Add(sums[key], amount)
+	}
+	for _, sum := range sums {
+		if sum.Sign() != 0 {
+			return ErrUnbalanced
+		}
+	}
+	return nil
+}
+
+// The platform's cut of a payment, rounded down
+func platformFee(amount *big.Int) *big.Int {
+	fee := new(big.Int).Mul(amount, big.NewInt(int64(platformFeeBps)))
+	return fee.Div(fee, big.NewInt(10000))
+}
+
+// A payment comes into custody, the fee goes to us and the rest is owed to the creator
+func paymentEntries(p Payment, tierID string) ([]LedgerEntry, error) {
+	c, _ := chain.Lookup(p.Chain)
+	token, ok := c.Token(p.Token)
+	if !ok {
+		return nil, errors.New("payment in an unknown token")
+	}
+	gross, err := chain.ParseAmount(p.Amount, token.Decimals)
+	if err != nil {
+		return nil, err
+	}
+	fee := platformFee(gross)
+	entry := LedgerEntry{TxnID: LedgerPayment + ":" + p.TxHash, CreatorID: p.CreatorID, Kind: LedgerPayment,
+		Chain: p.Chain, Token: p.Token, TierID: tierID, At: p.VerifiedAt, FiatCurrency: p.FiatCurrency, FiatRate: p.FiatRate}
+	entries := []LedgerEntry{}
+	add := func(account string, amount *big.Int) {
+		if amount.Sign() != 0 {
+			e := entry
+			e.Account, e.Amount = account, formatSigned(amount, token)
+			entries = append(entries, e)
+		}
+	}
+	add(AccountCustody, gross)
+	add(creatorAccount(p.CreatorID), new(big.Int).Sub(fee, gross))
+	add(AccountFees, new(big.Int).Neg(fee))
+	return entries, nil
+}
+
+// A withdrawal pays out of custody what the creator was owed. Reversing it books it back
+func withdrawalEntries(w Withdrawal, kind string, at time.Time) []LedgerEntry {
+	entry := LedgerEntry{TxnID: kind + ":" + w.ID, CreatorID: w.CreatorID, Kind: kind, Chain: w.Chain, Token: w.Token, At: at}
+	owed, custody := entry, entry
+	owed.Account, owed.Amount = creatorAccount(w.CreatorID), w.Amount
+	custody.Account, custody.Amount = AccountCustody, "-"+w.Amount
+	if kind == LedgerReversal {
+		owed.Amount, custody.Amount = custody.Amount, owed.Amount
+	}
+	return []LedgerEntry{owed, custody}
+}
+
+// Prices a payment in its creator's display currency. Payments are recorded whether or not
+// there's a price, reports look one up later for those without
+func priceFiat(ctx context.Context, db DBConn, rates *prices.Service, p *Payment) {
+	if rates == nil {
+		return
+	}
+	creator, err := db.Users().GetByID(ctx, p.CreatorID)
+	if err != nil {
+		log.Printf("Couldn't get the creator of payment %s to price it: %v", p.TxHash, err)
+		return
+	}
+	currency := creator.DisplayCurrency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	rate, err := rates.Rate(ctx, p.Token, currency, p.VerifiedAt)
+	if err != nil {
+		log.Printf("No %s price of %s for payment %s: %v", currency, p.Token, p.TxHash, err)
+		return
+	}
+	if value := prices.Value(p.Amount, rate); value != nil {
+		p.FiatCurrency, p.FiatRate, p.FiatAmount = currency, rate, prices.Format(value)
+	}
+}
+
+// RecordPayment stores a verified payment, renews the subscription it pays for and books
+// it to the creator's earnings, all as one unit of work. It's priced with rates first, which
+// can be nil. Returns a *ConflictError on txHash if the transaction was recorded already
+func RecordPayment(ctx context.Context, db DBConn, rates *prices.Service, payment *Payment) error {
+	priceFiat(ctx, db, rates, payment)
+	return db.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := db.Payments().Create(ctx, payment); err != nil {
+			return err
+		}
+		tierID, err := RenewSubscriptions(ctx, db, *payment)
+		if err != nil {
+			return err
+		}
+		entries, err := paymentEntries(*payment, tierID)
+		if err != nil {
+			return err
+		}
+		return db.Ledger().Post(ctx, entries)
+	})
+}
+
+// OrphanPayment forgets a payment whose transaction was dropped from the chain and books
+// back what it added to the ledger. Subscriptions it renewed stay renewed until they're due
+func OrphanPayment(ctx context.Context, db DBConn, payment Payment) error {
+	return db.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := db.Payments().Delete(ctx, payment.TxHash); err != nil {
+			return err
+		}
+		entries, err := db.Ledger().ListByCreator(ctx, payment.CreatorID, time.Time{}, time.Time{})
+		if err != nil {
+			return err
+		}
+		orphaned := orphanedEntries(entries, payment.TxHash, time.Now().UTC())
+		if len(orphaned) == 0 {
+			return nil
+		}
+		return db.Ledger().Post(ctx, orphaned)
+	})
+}
+
+// What the ledger still holds of a transaction's payment, the other way around. A transaction
+// can be mined again after a reorg and then dropped again, earlier reversals count too
+func orphanedEntries(entries []LedgerEntry, txHash string, at time.Time) []LedgerEntry {
+	type key struct {
+		account string
+		chain   string
+		token   string
+	}
+	var keys []key
+	sums := map[key]*big.Int{}
+	// The payment's own entry, for the tier and price
+	paid := map[key]LedgerEntry{}
+	for _, e := range entries {
+		if e.TxnID != LedgerPayment+":"+txHash && e.TxnID != LedgerOrphaned+":"+txHash {
+			continue
+		}
+		token, ok := ledgerToken(e)
+		if !ok {
+			continue
+		}
+		amount, err := parseSigned(e.Amount, token)
+		if err != nil {
+			continue
+		}
+		k := key{e.Account, e.Chain, e.Token}
+		if sums[k] == nil {
+			sums[k] = new(big.Int)
+			keys = append(keys, k)
+		}
+		sums[k].Add(sums[k], amount)
+		if _, ok := paid[k]; !ok || e.Kind == LedgerPayment {
+			paid[k] = e
+		}
+	}
+	orphaned := []LedgerEntry{}
+	for _, k := range keys {
+		if sums[k].Sign() == 0 {
+			continue
+		}
+		e := paid[k]
+		token, _ := ledgerToken(e)
+		e.ID, e.TxnID, e.Kind, e.At = "", LedgerOrphaned+":"+txHash, LedgerOrphaned, at
+		e.Amount = formatSigned(new(big.Int).Neg(sums[k]), token)
+		orphaned = append(orphaned, e)
+	}
+	return orphaned
+}
+
+// What a creator is owed of token on c, going by their ledger account
+func creatorBalance(ctx context.Context, db DBConn, creatorID string, c chain.Chain, token chain.Token) (*big.Int, error) {
+	entries, err := db.Ledger().ListByCreator(ctx, creatorID, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	balances := accountBalances(entries, creatorAccount(creatorID))
+	if balance, ok := balances[balanceKey{c.Name, token.Symbol}]; ok {
+		return balance, nil
+	}
+	return new(big.Int), nil
+}
+
+type balanceKey struct {
+	Chain string
+	Token string
+}
+
+// Credit balances of account by token, what it's owed is positive
+func accountBalances(entries []LedgerEntry, account string) map[balanceKey]*big.Int {
+	balances := map[balanceKey]*big.Int{}
+	for _, e := range entries {
+		token, ok := ledgerToken(e)
+		if !ok || e.Account != account {
+			continue
+		}
+		amount, err := parseSigned(e.Amount, token)
+		if err != nil {
+			continue
+		}
+		key := balanceKey{e.Chain, e.Token}
+		if balances[key] == nil {
+			balances[key] = new(big.Int)
+		}
+		balances[key].Sub(balances[key], amount)
+	}
+	return balances
+}
@@ -0,0 +1,947 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/pagination"
+)
+
+// MemoryDB keeps everything in process memory.
+// Handy for tests and running the server without a Mongo instance
+type MemoryDB struct {
+	users         *memoryUsers
+	audit         *memoryAudit
+	pageNames     *memoryPageNames
+	tiers         *memoryTiers
+	payments      *memoryPayments
+	checkpoints   *memoryCheckpoints
+	subscriptions *memorySubscriptions
+	posts         *memoryPosts
+	withdrawals   *memoryWithdrawals
+	ledger        *memoryLedger
+}
+
+func (m *MemoryDB) Open() {
+	m.users = &memoryUsers{byID: map[string]User{}}
+	m.audit = &memoryAudit{}
+	m.pageNames = &memoryPageNames{}
+	m.tiers = &memoryTiers{}
+	m.payments = &memoryPayments{}
+	m.checkpoints = &memoryCheckpoints{byChain: map[string]Checkpoint{}}
+	m.subscriptions = &memorySubscriptions{}
+	m.posts = &memoryPosts{}
+	m.withdrawals = &memoryWithdrawals{}
+	m.ledger = &memoryLedger{}
+}
+
+func (m *MemoryDB) Close() {}
+
+func (m *MemoryDB) Users() UserRepository {
+	return m.users
+}
+
+func (m *MemoryDB) Audit() AuditRepository {
+	return m.audit
+}
+
+func (m *MemoryDB) PageNames() PageNameRepository {
+	return m.pageNames
+}
+
+func (m *MemoryDB) Tiers() TierRepository {
+	return m.tiers
+}
+
+func (m *MemoryDB) Payments() PaymentRepository {
+	return m.payments
+}
+
+func (m *MemoryDB) Checkpoints() CheckpointRepository {
+	return m.checkpoints
+}
+
+func (m *MemoryDB) Subscriptions() SubscriptionRepository {
+	return m.subscriptions
+}
+
+func (m *MemoryDB) Posts() PostRepository {
+	return m.posts
+}
+
+func (m *MemoryDB) Withdrawals() WithdrawalRepository {
+	return m.withdrawals
+}
+
+func (m *MemoryDB) Ledger() LedgerRepository {
+	return m.ledger
+}
+
+// No rollback here, writes made before fn fails stay around
+func (m *MemoryDB) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+type memoryUsers struct {
+	mu              sync.RWMutex
+	byID            map[string]User
+	nextID          int
+	nextWalletIndex uint32
+}
+
+// Same fields as the Mongo unique indexes
+func uniqueUserFields(u User) map[string]string {
+	return map[string]string{
+		"pageName":                          u.PageName,
+		"email":                             u.Email,
+		"metaMaskWalletPublicAddress":       u.MetaMaskWalletPublicAddress,
+		"generatedMaticWalletPublicAddress": u.GeneratedMaticWalletPublicAddress,
+	}
+}
+
+func (m *memoryUsers) Create(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fields := uniqueUserFields(*user)
+	for _, i := range UserIndexes {
+		value := fields[i.Field]
+		if value == "" {
+			continue
+		}
+		for _, other := range m.byID {
+			if strings.EqualFold(uniqueUserFields(other)[i.Field], value) {
+				return &ConflictError{Field: i.Field}
+			}
+		}
+	}
+
+	m.nextID++
+	user.ID = strconv.Itoa(m.nextID)
+	m.byID[user.ID] = *user
+	return nil
+}
+
+func (m *memoryUsers) UpdatePageName(ctx context.Context, id, pageName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.byID[id]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, other := range m.byID {
+		if other.ID != id && pageName != "" && strings.EqualFold(other.PageName, pageName) {
+			return &ConflictError{Field: "pageName"}
+		}
+	}
+	user.PageName = pageName
+	m.byID[id] = user
+	return nil
+}
+
+func (m *memoryUsers) Update(ctx context.Context, user User, version time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.byID[user.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if !stored.UpdatedAt.Equal(version) {
+		return ErrVersionMismatch
+	}
+	stored.Name = user.Name
+	stored.Profile = user.Profile
+	stored.UpdatedAt = user.UpdatedAt
+	m.byID[user.ID] = stored
+	return nil
+}
+
+func (m *memoryUsers) NextWalletIndex(ctx context.Context) (uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	index := m.nextWalletIndex
+	m.nextWalletIndex++
+	return index, nil
+}
+
+func (m *memoryUsers) SetSupporterCount(ctx context.Context, id string, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.byID[id]
+	if !ok {
+		return ErrNotFound
+	}
+	user.SupporterCount = n
+	m.byID[id] = user
+	return nil
+}
+
+func (m *memoryUsers) SoftDelete(ctx context.Context, id string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.byID[id]
+	if !ok {
+		return ErrNotFound
+	}
+	user.DeletedAt = at
+	m.byID[id] = user
+	return nil
+}
+
+func (m *memoryUsers) Restore(ctx context.Context, id string) error {
+	return m.SoftDelete(ctx, id, time.Time{})
+}
+
+func (m *memoryUsers) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.byID[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.byID, id)
+	return nil
+}
+
+func (m *memoryUsers) ListDeletedBefore(ctx context.Context, before time.Time) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := []User{}
+	for _, u := range m.byID {
+		if !u.DeletedAt.IsZero() && u.DeletedAt.Before(before) {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (m *memoryUsers) ListWithDepositAddress(ctx context.Context) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := []User{}
+	for _, u := range m.byID {
+		if u.DeletedAt.IsZero() && u.GeneratedMaticWalletPublicAddress != "" {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (m *memoryUsers) Search(ctx context.Context, q SearchQuery) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := make([]User, 0, len(m.byID))
+	for _, u := range m.byID {
+		users = append(users, u)
+	}
+	return rankUsers(users, q), nil
+}
+
+func (m *memoryUsers) find(ctx context.Context, match func(User) bool) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, u := range m.byID {
+		if match(u) {
+			return u, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (m *memoryUsers) findBy(ctx context.Context, field, value string) (User, error) {
+	if value == "" {
+		return User{}, ErrNotFound
+	}
+	return m.find(ctx, func(u User) bool {
+		return strings.EqualFold(uniqueUserFields(u)[field], value)
+	})
+}
+
+func (m *memoryUsers) GetByID(ctx context.Context, id string) (User, error) {
+	return m.find(ctx, func(u User) bool { return u.ID == id })
+}
+
+func (m *memoryUsers) GetByEmail(ctx context.Context, email string) (User, error) {
+	return m.findBy(ctx, "email", email)
+}
+
+func (m *memoryUsers) GetByWallet(ctx context.Context, address string) (User, error) {
+	return m.findBy(ctx, "metaMaskWalletPublicAddress", address)
+}
+
+func (m *memoryUsers) GetByPageName(ctx context.Context, pageName string) (User, error) {
+	return m.findBy(ctx, "pageName", pageName)
+}
+
+func (m *memoryUsers) List(ctx context.Context, p pagination.Params) ([]User, *pagination.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var all []User
+	var keys []pagination.Key
+	for _, u := range m.byID {
+		all = append(all, u)
+		keys = append(keys, u.key())
+	}
+	page, next := pagination.Paginate(keys, p)
+	users := make([]User, len(page))
+	for i, idx := range page {
+		users[i] = all[idx]
+	}
+	return users, next, nil
+}
+
+type memoryAudit struct {
+	mu     sync.RWMutex
+	events []AuditEvent
+}
+
+func (m *memoryAudit) Record(ctx context.Context, event AuditEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+	return nil
+}
+
+func (m *memoryAudit) ListByUser(ctx context.Context, userID string) ([]AuditEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	events := []AuditEvent{}
+	for _, e := range m.events {
+		if e.UserID == userID {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (m *memoryAudit) Anonymize(ctx context.Context, userID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.events {
+		if m.events[i].UserID == userID {
+			m.events[i].Data = nil
+		}
+	}
+	return nil
+}
+
+type memoryPageNames struct {
+	mu      sync.RWMutex
+	changes []PageNameChange
+}
+
+func (m *memoryPageNames) Record(ctx context.Context, change PageNameChange) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.changes = append(m.changes, change)
+	return nil
+}
+
+// Changes are appended in order, so the last match is the latest
+func (m *memoryPageNames) last(ctx context.Context, match func(PageNameChange) bool) (PageNameChange, error) {
+	if err := ctx.Err(); err != nil {
+		return PageNameChange{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := len(m.changes) - 1; i >= 0; i-- {
+		if match(m.changes[i]) {
+			return m.changes[i], nil
+		}
+	}
+	return PageNameChange{}, ErrNotFound
+}
+
+func (m *memoryPageNames) GetByOldName(ctx context.Context, oldName string) (PageNameChange, error) {
+	return m.last(ctx, func(c PageNameChange) bool { return oldName != "" && strings.EqualFold(c.OldName, oldName) })
+}
+
+func (m *memoryPageNames) LastByUser(ctx context.Context, userID string) (PageNameChange, error) {
+	return m.last(ctx, func(c PageNameChange) bool { return c.UserID == userID })
+}
+
+func (m *memoryPageNames) DeleteByUser(ctx context.Context, userID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.changes[:0]
+	for _, c := range m.changes {
+		if c.UserID != userID {
+			kept = append(kept, c)
+		}
+	}
+	m.changes = kept
+	return nil
+}
+
+// Tiers are kept in the order they were created
+type memoryTiers struct {
+	mu     sync.RWMutex
+	nextID int
+	tiers  []Tier
+}
+
+func (m *memoryTiers) Create(ctx context.Context, tier *Tier) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	tier.ID = strconv.Itoa(m.nextID)
+	m.tiers = append(m.tiers, *tier)
+	return nil
+}
+
+func (m *memoryTiers) index(id string) int {
+	for i, t := range m.tiers {
+		if t.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *memoryTiers) GetByID(ctx context.Context, id string) (Tier, error) {
+	if err := ctx.Err(); err != nil {
+		return Tier{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if i := m.index(id); i >= 0 {
+		return m.tiers[i], nil
+	}
+	return Tier{}, ErrNotFound
+}
+
+func (m *memoryTiers) ListByCreator(ctx context.Context, creatorID string) ([]Tier, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	tiers := []Tier{}
+	for _, t := range m.tiers {
+		if t.CreatorID == creatorID {
+			tiers = append(tiers, t)
+		}
+	}
+	return tiers, nil
+}
+
+func (m *memoryTiers) Update(ctx context.Context, tier Tier) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.index(tier.ID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	tier.CreatorID, tier.CreatedAt = m.tiers[i].CreatorID, m.tiers[i].CreatedAt
+	m.tiers[i] = tier
+	return nil
+}
+
+func (m *memoryTiers) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.index(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.tiers = append(m.tiers[:i], m.tiers[i+1:]...)
+	return nil
+}
+
+func (m *memoryTiers) DeleteByCreator(ctx context.Context, creatorID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.tiers[:0]
+	for _, t := range m.tiers {
+		if t.CreatorID != creatorID {
+			kept = append(kept, t)
+		}
+	}
+	m.tiers = kept
+	return nil
+}
+
+type memoryPayments struct {
+	mu       sync.RWMutex
+	nextID   int
+	payments []Payment
+}
+
+func (m *memoryPayments) Create(ctx context.Context, payment *Payment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.payments {
+		if p.TxHash == payment.TxHash {
+			return &ConflictError{Field: "txHash"}
+		}
+	}
+	m.nextID++
+	payment.ID = strconv.Itoa(m.nextID)
+	m.payments = append(m.payments, *payment)
+	return nil
+}
+
+func (m *memoryPayments) GetByTxHash(ctx context.Context, txHash string) (Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return Payment{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, p := range m.payments {
+		if p.TxHash == txHash {
+			return p, nil
+		}
+	}
+	return Payment{}, ErrNotFound
+}
+
+func (m *memoryPayments) ListByCreator(ctx context.Context, creatorID string) ([]Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	payments := []Payment{}
+	for _, p := range m.payments {
+		if p.CreatorID == creatorID {
+			payments = append(payments, p)
+		}
+	}
+	return payments, nil
+}
+
+func (m *memoryPayments) AnonymizePayer(ctx context.Context, payerID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.payments {
+		if m.payments[i].PayerID == payerID {
+			m.payments[i].PayerID = ""
+		}
+	}
+	return nil
+}
+
+func (m *memoryPayments) ListFromBlock(ctx context.Context, chain string, block uint64) ([]Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	payments := []Payment{}
+	for _, p := range m.payments {
+		if p.Chain == chain && p.BlockNumber >= block {
+			payments = append(payments, p)
+		}
+	}
+	sort.SliceStable(payments, func(i, j int) bool { return payments[i].BlockNumber < payments[j].BlockNumber })
+	return payments, nil
+}
+
+func (m *memoryPayments) Delete(ctx context.Context, txHash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, p := range m.payments {
+		if p.TxHash == txHash {
+			m.payments = append(m.payments[:i], m.payments[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+type memoryCheckpoints struct {
+	mu      sync.RWMutex
+	byChain map[string]Checkpoint
+}
+
+func (m *memoryCheckpoints) Get(ctx context.Context, chain string) (Checkpoint, error) {
+	if err := ctx.Err(); err != nil {
+		return Checkpoint{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.byChain[chain]
+	if !ok {
+		return Checkpoint{}, ErrNotFound
+	}
+	return c, nil
+}
+
+func (m *memoryCheckpoints) Set(ctx context.Context, checkpoint Checkpoint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.byChain[checkpoint.Chain] = checkpoint
+	return nil
+}
+
+type memorySubscriptions struct {
+	mu     sync.RWMutex
+	nextID int
+	subs   []Subscription
+}
+
+func (m *memorySubscriptions) Create(ctx context.Context, sub *Subscription) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	sub.ID = strconv.Itoa(m.nextID)
+	m.subs = append(m.subs, *sub)
+	return nil
+}
+
+func (m *memorySubscriptions) GetByID(ctx context.Context, id string) (Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return Subscription{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.subs {
+		if s.ID == id {
+			return s, nil
+		}
+	}
+	return Subscription{}, ErrNotFound
+}
+
+func (m *memorySubscriptions) list(ctx context.Context, match func(s Subscription) bool) ([]Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	subs := []Subscription{}
+	for _, s := range m.subs {
+		if match(s) {
+			subs = append(subs, s)
+		}
+	}
+	return subs, nil
+}
+
+func (m *memorySubscriptions) ListByPatron(ctx context.Context, patronID string) ([]Subscription, error) {
+	return m.list(ctx, func(s Subscription) bool { return s.PatronID == patronID })
+}
+
+func (m *memorySubscriptions) ListByCreator(ctx context.Context, creatorID string) ([]Subscription, error) {
+	return m.list(ctx, func(s Subscription) bool { return s.CreatorID == creatorID })
+}
+
+func (m *memorySubscriptions) ListDue(ctx context.Context, before time.Time) ([]Subscription, error) {
+	return m.list(ctx, func(s Subscription) bool {
+		return s.Status != SubscriptionCanceled && s.NextDueAt.Before(before)
+	})
+}
+
+func (m *memorySubscriptions) Update(ctx context.Context, sub Subscription) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, s := range m.subs {
+		if s.ID == sub.ID {
+			s.Status, s.NextDueAt, s.LastPaymentTx = sub.Status, sub.NextDueAt, sub.LastPaymentTx
+			s.UpdatedAt, s.CanceledAt = sub.UpdatedAt, sub.CanceledAt
+			m.subs[i] = s
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *memorySubscriptions) DeleteByUser(ctx context.Context, userID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.subs[:0]
+	for _, s := range m.subs {
+		if s.PatronID != userID && s.CreatorID != userID {
+			kept = append(kept, s)
+		}
+	}
+	m.subs = kept
+	return nil
+}
+
+type memoryPosts struct {
+	mu     sync.RWMutex
+	nextID int
+	posts  []Post
+}
+
+func (m *memoryPosts) Create(ctx context.Context, post *Post) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	post.ID = strconv.Itoa(m.nextID)
+	m.posts = append(m.posts, *post)
+	return nil
+}
+
+func (m *memoryPosts) index(id string) int {
+	for i, p := range m.posts {
+		if p.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *memoryPosts) GetByID(ctx context.Context, id string) (Post, error) {
+	if err := ctx.Err(); err != nil {
+		return Post{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if i := m.index(id); i >= 0 {
+		return m.posts[i], nil
+	}
+	return Post{}, ErrNotFound
+}
+
+func (m *memoryPosts) ListByCreator(ctx context.Context, creatorID string, publishedBy time.Time, p pagination.Params) ([]Post, *pagination.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var all []Post
+	var keys []pagination.Key
+	for _, post := range m.posts {
+		if post.CreatorID != creatorID || !publishedBy.IsZero() && post.PublishAt.After(publishedBy) {
+			continue
+		}
+		all = append(all, post)
+		keys = append(keys, post.key())
+	}
+	page, next := pagination.Paginate(keys, p)
+	posts := make([]Post, len(page))
+	for i, idx := range page {
+		posts[i] = all[idx]
+	}
+	return posts, next, nil
+}
+
+func (m *memoryPosts) Update(ctx context.Context, post Post) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.index(post.ID)
+	if i < 0 {
+		return ErrNotFound
+	}
+	post.CreatorID, post.CreatedAt, post.Locked = m.posts[i].CreatorID, m.posts[i].CreatedAt, false
+	m.posts[i] = post
+	return nil
+}
+
+func (m *memoryPosts) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.index(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.posts = append(m.posts[:i], m.posts[i+1:]...)
+	return nil
+}
+
+func (m *memoryPosts) DeleteByCreator(ctx context.Context, creatorID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.posts[:0]
+	for _, p := range m.posts {
+		if p.CreatorID != creatorID {
+			kept = append(kept, p)
+		}
+	}
+	m.posts = kept
+	return nil
+}
+
+type memoryWithdrawals struct {
+	mu          sync.RWMutex
+	nextID      int
+	withdrawals []Withdrawal
+}
+
+func (m *memoryWithdrawals) Create(ctx context.Context, w *Withdrawal) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	w.ID = strconv.Itoa(m.nextID)
+	m.withdrawals = append(m.withdrawals, *w)
+	return nil
+}
+
+func (m *memoryWithdrawals) Update(ctx context.Context, w Withdrawal) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, existing := range m.withdrawals {
+		if existing.ID == w.ID {
+			existing.Status, existing.TxHash, existing.Nonce, existing.UpdatedAt = w.Status, w.TxHash, w.Nonce, w.UpdatedAt
+			m.withdrawals[i] = existing
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *memoryWithdrawals) ListByCreator(ctx context.Context, creatorID string) ([]Withdrawal, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := []Withdrawal{}
+	for _, w := range m.withdrawals {
+		if w.CreatorID == creatorID {
+			list = append(list, w)
+		}
+	}
+	return list, nil
+}
+
+type memoryLedger struct {
+	mu      sync.RWMutex
+	nextID  int
+	entries []LedgerEntry
+}
+
+func (m *memoryLedger) Post(ctx context.Context, entries []LedgerEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := checkBalanced(entries); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range entries {
+		m.nextID++
+		entries[i].ID = strconv.Itoa(m.nextID)
+		m.entries = append(m.entries, entries[i])
+	}
+	return nil
+}
+
+func (m *memoryLedger) ListByCreator(ctx context.Context, creatorID string, from, to time.Time) ([]LedgerEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := []LedgerEntry{}
+	for _, e := range m.entries {
+		if e.CreatorID == creatorID && !e.At.Before(from) && (to.IsZero() || e.At.Before(to)) {
+			entries = append(entries, e)
+		}
+	}
+	// Posted in the order they happened mostly, but payments are booked at when they were verified
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].At.Before(entries[j].At) })
+	return entries, nil
+}
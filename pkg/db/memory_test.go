@@ -0,0 +1,240 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/ens"
+	"github.com/cryptopatron/koen-backend/pkg/ens/enstest"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc/ethrpctest"
+	"github.com/cryptopatron/koen-backend/pkg/hdwallet"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestMemoryUsers(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	users := conn.Users()
+	ctx := context.Background()
+
+	user := &User{Email: "test@koen.com", PageName: "Koen"}
+	if err := users.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == "" {
+		t.Error("ID wasn't assigned on create")
+	}
+
+	t.Run("Lookups are case-insensitive", func(t *testing.T) {
+		got, err := users.GetByPageName(ctx, "KOEN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Email != user.Email {
+			t.Errorf("got %v, want %v", got, *user)
+		}
+	})
+
+	t.Run("ErrNotFound on unknown or empty values", func(t *testing.T) {
+		for _, lookup := range []func() (User, error){
+			func() (User, error) { return users.GetByEmail(ctx, "nope@koen.com") },
+			func() (User, error) { return users.GetByWallet(ctx, "") },
+			func() (User, error) { return users.GetByID(ctx, "bleh") },
+		} {
+			if _, err := lookup(); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v, want %v", err, ErrNotFound)
+			}
+		}
+	})
+
+	t.Run("Conflict on taken pageName", func(t *testing.T) {
+		err := users.Create(ctx, &User{Email: "other@koen.com", PageName: "kOEN"})
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) || conflict.Field != "pageName" {
+			t.Errorf("got %v, want conflict on pageName", err)
+		}
+	})
+}
+
+func TestGetUserResponse(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	err := conn.Users().Create(context.Background(), &User{Email: "test@koen.com", PageName: "koen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Only User fields are returned", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/users/pageName/koen", nil)
+		rr := httptest.NewRecorder()
+		GetUser(conn, "koen").ServeHTTP(rr, req)
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range []string{"_id", "ID", "id", "email", "metaMaskWalletPublicAddress"} {
+			if _, ok := body[field]; ok {
+				t.Errorf("response leaks %s: %v", field, body)
+			}
+		}
+		if body["pageName"] != "koen" {
+			t.Errorf("got %v, want pageName koen", body)
+		}
+	})
+
+	t.Run("Empty object for empty claims", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/users/get", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "userData", auth.Claims{}))
+		rr := httptest.NewRecorder()
+		HandleGetUser(conn).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK || rr.Body.String() != "{}\n" {
+			t.Errorf("got %d %q, want 200 {}", rr.Code, rr.Body.String())
+		}
+	})
+}
+
+func TestCreateUserOnboarding(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+
+	htc := &utils.HttpTestCase{Handler: HandleCreateUser(conn, testDeposits(t), nil)}
+	htc.SetRequestBody(strings.NewReader(`{"pageName": "koen-san", "supporterCount": 999999, "avatar": {"urls": {"large": "javascript:alert(1)"}},
+		"metaMaskWalletPublicAddress": "0x5555555555555555555555555555555555555555"}`))
+	htc.SetContext("userData", auth.Claims{
+		GoogleClaims: auth.GoogleClaims{Email: "test@koen.com"},
+	})
+	t.Run("HTTP 200 on creating a user", htc.CheckReturnStatus(http.StatusOK))
+
+	user, err := conn.Users().GetByPageName(context.Background(), "koen-san")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.SupporterCount != 0 || user.Avatar != nil {
+		t.Errorf("got %d supporters and avatar %+v, want neither taken from the request", user.SupporterCount, user.Avatar)
+	}
+	if user.MetaMaskWalletPublicAddress != "" {
+		t.Errorf("got wallet %s, want none without a wallet sign in", user.MetaMaskWalletPublicAddress)
+	}
+	events, err := conn.Audit().ListByUser(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != AuditUserCreated {
+		t.Errorf("got %v, want one %s event", events, AuditUserCreated)
+	}
+}
+
+// Deposits from the test profile's xpub
+func testDeposits(t *testing.T) *hdwallet.Deposits {
+	c, err := config.Profile(config.EnvTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deposits, err := hdwallet.NewDeposits(string(c.Wallets.XPub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deposits
+}
+
+func TestCreateUserGeneratedWallet(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	deposits := testDeposits(t)
+	create := func(email, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/users/create", strings.NewReader(body))
+		claims := auth.Claims{GoogleClaims: auth.GoogleClaims{Email: email}}
+		req = req.WithContext(context.WithValue(req.Context(), "userData", claims))
+		rr := httptest.NewRecorder()
+		HandleCreateUser(conn, deposits, nil).ServeHTTP(rr, req)
+		return rr
+	}
+
+	first, _ := deposits.Address(0)
+	second, _ := deposits.Address(1)
+	if rr := create("first@koen.com", `{"pageName": "first"}`); rr.Code != http.StatusOK {
+		t.Fatalf("got %v, want %v", rr.Code, http.StatusOK)
+	}
+	rr := create("second@koen.com", `{"pageName": "second", "generatedMaticWalletPublicAddress": "`+
+		strings.ToLower(second.Hex())+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	for i, want := range []string{first.Hex(), second.Hex()} {
+		user, err := conn.Users().GetByPageName(context.Background(), []string{"first", "second"}[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.GeneratedMaticWalletPublicAddress != want || user.WalletIndex == nil || *user.WalletIndex != uint32(i) {
+			t.Errorf("got %s at %v, want %s at %d", user.GeneratedMaticWalletPublicAddress, user.WalletIndex, want, i)
+		}
+	}
+
+	t.Run("HTTP 400 on an address we didn't derive", func(t *testing.T) {
+		rr := create("third@koen.com", `{"pageName": "third", "generatedMaticWalletPublicAddress": "`+first.Hex()+`"}`)
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "generatedMaticWalletPublicAddress") {
+			t.Errorf("got %v %s, want %v", rr.Code, rr.Body, http.StatusBadRequest)
+		}
+		if _, err := conn.Users().GetByPageName(context.Background(), "third"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+	})
+}
+
+func TestCreateUserFromENS(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	node := ethrpctest.NewNode(100)
+	server := httptest.NewServer(node)
+	defer server.Close()
+	names := &ens.Resolver{Client: &ethrpc.HTTPClient{URL: server.URL}, Registry: ens.Registry}
+	named := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	enstest.SetName(node, named, "koen.eth", named, "https://koen.com/avatar.png")
+	other := common.HexToAddress("0x2222222222222222222222222222222222222222")
+	enstest.SetName(node, other, "other.eth", other, "https://koen.com/other.png")
+
+	create := func(wallet common.Address, body string) User {
+		req, _ := http.NewRequest("POST", "/users/create", strings.NewReader(body))
+		claims := auth.Claims{WalletClaims: auth.WalletClaims{WalletPublicAddress: wallet.Hex()}}
+		req = req.WithContext(context.WithValue(req.Context(), "userData", claims))
+		rr := httptest.NewRecorder()
+		HandleCreateUser(conn, testDeposits(t), names).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		var user User
+		json.Unmarshal(rr.Body.Bytes(), &user)
+		return user
+	}
+
+	if got := create(named, `{"pageName": "koen-san"}`); got.Name != "koen.eth" || got.AvatarURL != "https://koen.com/avatar.png" {
+		t.Errorf("got %s with %s, want the ENS name and avatar", got.Name, got.AvatarURL)
+	}
+	if got := create(other, `{"pageName": "other", "name": "Other"}`); got.Name != "Other" || got.AvatarURL != "https://koen.com/other.png" {
+		t.Errorf("got %s with %s, want the name they picked and the ENS avatar", got.Name, got.AvatarURL)
+	}
+
+	t.Run("Emails only come from Google sign ins", func(t *testing.T) {
+		third := common.HexToAddress("0x3333333333333333333333333333333333333333")
+		create(third, `{"pageName": "third", "email": "victim@koen.com"}`)
+		if _, err := conn.Users().GetByEmail(context.Background(), "victim@koen.com"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want the email left out", err)
+		}
+	})
+}
@@ -2,22 +2,37 @@ package db
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/config"
 	"github.com/cryptopatron/koen-backend/pkg/utils"
 )
 
+// Test DB comes from the same env vars the server reads
+func testMongoInstance(t *testing.T) *MongoInstance {
+	c, err := config.Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &MongoInstance{URI: string(c.Mongo.URI), Database: c.Mongo.Database,
+		ConnectTimeout: c.Mongo.ConnectTimeout, Timeout: c.Mongo.Timeout}
+}
+
 func TestCreateUserHandler(t *testing.T) {
 	// Connect to DB
-	var conn DBConn = &MongoInstance{Database: "koen_test", Collection: "users"}
+	var conn DBConn = testMongoInstance(t)
 	conn.Open()
 	defer conn.Close()
 
 	htc := &utils.HttpTestCase{
-		Handler: HandleCreateUser(conn),
+		Handler: HandleCreateUser(conn, testDeposits(t), nil),
 	}
 
 	htc.SetRequestBody(nil)
@@ -26,9 +41,13 @@ func TestCreateUserHandler(t *testing.T) {
 	htc.SetRequestBody(bytes.NewBuffer([]byte("bleh")))
 	t.Run("HTTP 400 on random request body", htc.CheckReturnStatus(http.StatusBadRequest))
 
+	// Unique values per run, the test DB keeps users around between runs.
+	// Short enough to stay within the page name length limit
+	suffix := fmt.Sprint(time.Now().UnixNano() % 1e12)
+
 	// JSON which follow User key semantics but with some random fields
 	var extraJson string = `{
-		"pageName": "fakeasstoken",
+		"pageName": "fakeasstoken` + suffix + `",
 		"idToken": "bleh",
 		"random": "random",
 		"metaMaskWalletPublicKey":"",    
@@ -39,32 +58,43 @@ func TestCreateUserHandler(t *testing.T) {
 	htc.SetRequestBody(strings.NewReader(extraJson))
 	claim := auth.Claims{
 		GoogleClaims: auth.GoogleClaims{
-			Email: "test@koen.com", FirstName: "Koen", LastName: "San",
+			Email: "test" + suffix + "@koen.com", FirstName: "Koen", LastName: "San",
 		},
 	}
 	htc.SetContext("userData", claim)
 	t.Run("HTTP 200 on correct JSON with extra fields", htc.CheckReturnStatus(http.StatusOK))
 
 	var correctJson string = `{
-		"pageName":"fakeasstoken",
+		"pageName":"other` + suffix + `",
 		"name":"fakeasstoken",
-		"email":"fakeasstoken",
-		"generatedMaticWalletPublicAddress": "kuhgihjygyuh"
+		"email":"fakeasstoken"
 		}`
 	htc.SetRequestBody(strings.NewReader(correctJson))
 	htc.SetContext("userData", claim)
-	t.Run("HTTP 200 on correctly matching JSON", htc.CheckReturnStatus(http.StatusOK))
+	t.Run("HTTP 409 on creating a second user with the same email", htc.CheckReturnStatus(http.StatusConflict))
 
 	htc.SetRequestBody(strings.NewReader(correctJson))
 	htc.SetContext("userData", auth.Claims{
-		WalletClaims: auth.WalletClaims{WalletPublicAddress: "fakeasstoken"},
+		GoogleClaims: auth.GoogleClaims{Email: "other" + suffix + "@koen.com"},
+	})
+	t.Run("HTTP 200 on correctly matching JSON", htc.CheckReturnStatus(http.StatusOK))
+
+	htc.SetRequestBody(strings.NewReader(`{"pageName":"FakeAssToken` + suffix + `"}`))
+	htc.SetContext("userData", auth.Claims{
+		WalletClaims: auth.WalletClaims{WalletPublicAddress: "0x" + suffix},
+	})
+	t.Run("HTTP 409 on pageName differing only in case", htc.CheckReturnStatus(http.StatusConflict))
+
+	htc.SetRequestBody(strings.NewReader(`{}`))
+	htc.SetContext("userData", auth.Claims{
+		WalletClaims: auth.WalletClaims{WalletPublicAddress: "0x" + suffix},
 	})
 	t.Run("HTTP 200 with WalletClaims in userData", htc.CheckReturnStatus(http.StatusOK))
 }
 
 func TestHandleGetUser(t *testing.T) {
 	// Connect to DB
-	var conn DBConn = &MongoInstance{Database: "koen_test", Collection: "users"}
+	var conn DBConn = testMongoInstance(t)
 	conn.Open()
 	defer conn.Close()
 
@@ -90,3 +120,40 @@ func TestHandleGetUser(t *testing.T) {
 	})
 	t.Run("HTTP 200 on getting user with WalletClaims key", htc.CheckReturnStatus(http.StatusOK))
 }
+
+func TestHandlersOnDBTimeout(t *testing.T) {
+	conn := failingConn{err: fmt.Errorf("server selection: %w", context.DeadlineExceeded)}
+	claim := auth.Claims{
+		GoogleClaims: auth.GoogleClaims{Email: "test@koen.com"},
+	}
+
+	htc := &utils.HttpTestCase{Handler: HandleCreateUser(conn, testDeposits(t), nil)}
+	htc.SetRequestBody(strings.NewReader(`{"pageName": "koen-san"}`))
+	htc.SetContext("userData", claim)
+	t.Run("HTTP 504 on creating a user", htc.CheckReturnStatus(http.StatusGatewayTimeout))
+
+	htc = &utils.HttpTestCase{Handler: HandleGetUser(conn)}
+	htc.SetRequestBody(nil)
+	htc.SetContext("userData", claim)
+	t.Run("HTTP 504 on getting a user", htc.CheckReturnStatus(http.StatusGatewayTimeout))
+
+	htc = &utils.HttpTestCase{Handler: GetUser(conn, "koen-san")}
+	htc.SetRequestBody(nil)
+	t.Run("HTTP 504 on public user lookup", htc.CheckReturnStatus(http.StatusGatewayTimeout))
+}
+
+func TestTimeoutError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+
+	err := timeoutError(ctx, errors.New("connection reset"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want it to wrap %v", err, context.DeadlineExceeded)
+	}
+
+	err = timeoutError(context.Background(), errors.New("bleh"))
+	if errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want a plain error", err)
+	}
+}
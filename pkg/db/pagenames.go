@@ -0,0 +1,230 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/pagename"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+)
+
+// Set from config by ConfigurePageNames
+var (
+	renameCooldown = 30 * 24 * time.Hour
+	gracePeriod    = 90 * 24 * time.Hour
+)
+
+func ConfigurePageNames(c config.PageNamesConfig) {
+	renameCooldown = c.RenameCooldown
+	gracePeriod = c.GracePeriod
+}
+
+// PageNameChange is kept for every rename, so links to old names keep working
+type PageNameChange struct {
+	UserID    string    `bson:"userId" json:"userId"`
+	OldName   string    `bson:"oldName" json:"oldName"`
+	NewName   string    `bson:"newName" json:"newName"`
+	ChangedAt time.Time `bson:"changedAt" json:"changedAt"`
+}
+
+// PageNameRepository stores the rename history. Lookups return ErrNotFound
+// when there's no match, and the most recent change when there are several
+type PageNameRepository interface {
+	Record(ctx context.Context, change PageNameChange) error
+	// Case-insensitive, like page names themselves
+	GetByOldName(ctx context.Context, oldName string) (PageNameChange, error)
+	LastByUser(ctx context.Context, userID string) (PageNameChange, error)
+	DeleteByUser(ctx context.Context, userID string) error
+}
+
+type PageNameAvailability struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+	// Why the name can't be used, if it can't
+	Reason      string   `json:"reason,omitempty"`
+	Suggestions []string `json:"suggestions"`
+}
+
+// Old names stay with their previous owner for the grace period, so nobody
+// can take over a creator's links right after they rename. userID is who
+// wants the name, creators can always go back to one of their own
+func pageNameHeld(ctx context.Context, db DBConn, name, userID string) (bool, error) {
+	if name == "" {
+		return false, nil
+	}
+	change, err := db.PageNames().GetByOldName(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return change.UserID != userID && time.Since(change.ChangedAt) < gracePeriod, nil
+}
+
+func pageNameTaken(ctx context.Context, db DBConn, name string) (bool, error) {
+	_, err := db.Users().GetByPageName(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		return pageNameHeld(ctx, db, name, "")
+	}
+	return err == nil, err
+}
+
+// Who a page name used to belong to, as long as nobody has claimed it since
+func renamedUser(ctx context.Context, db DBConn, oldName string) (User, error) {
+	change, err := db.PageNames().GetByOldName(ctx, oldName)
+	if err != nil {
+		return User{}, err
+	}
+	return activeUser(db.Users().GetByID(ctx, change.UserID))
+}
+
+// PageNameRedirect is sent instead of a user when the page was renamed
+type PageNameRedirect struct {
+	// Always 301, the old name isn't coming back
+	Status   int    `json:"status"`
+	PageName string `json:"pageName"`
+	Location string `json:"location"`
+}
+
+func respondWithRedirect(r *http.Request, pageName string) http.HandlerFunc {
+	location := path.Join(path.Dir(r.URL.Path), pageName)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", location)
+		utils.RespondWithJSON(map[string]PageNameRedirect{
+			"redirect": {Status: http.StatusMovedPermanently, PageName: pageName, Location: location},
+		}, http.StatusOK)(w, r)
+	}
+}
+
+// HandlePageNameAvailable tells the web app if a page name can be registered,
+// with a few alternatives when it can't
+func HandlePageNameAvailable(db DBConn, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		name := pagename.Normalize(name)
+		result := PageNameAvailability{Name: name, Suggestions: []string{}}
+
+		if err := pagename.Validate(name); err != nil {
+			result.Reason = err.Error()
+		} else {
+			taken, err := pageNameTaken(ctx, db, name)
+			if err != nil {
+				respondWithDBError(err, "Couldn't check page name!").ServeHTTP(w, r)
+				return
+			}
+			result.Available = !taken
+			if taken {
+				result.Reason = "page name is already taken"
+			}
+		}
+
+		if !result.Available {
+			suggestions, err := pagename.Suggest(name, 3, func(candidate string) (bool, error) {
+				return pageNameTaken(ctx, db, candidate)
+			})
+			if err != nil {
+				respondWithDBError(err, "Couldn't check page name!").ServeHTTP(w, r)
+				return
+			}
+			result.Suggestions = suggestions
+		}
+		utils.RespondWithJSON(result, http.StatusOK)(w, r)
+	}
+}
+
+type changePageNameRequest struct {
+	PageName string `json:"pageName"`
+}
+
+// HandleChangePageName renames the signed in user's page. The old name is
+// recorded so it redirects to the new one, and renames are rate limited
+func HandleChangePageName(db DBConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := &changePageNameRequest{}
+		if err := utils.DecodeJSON(r.Body, req, false); err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		newName := pagename.Normalize(req.PageName)
+		if err := pagename.Validate(newName); err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		if strings.EqualFold(user.PageName, newName) {
+			utils.RespondWithJSON(user, http.StatusOK)(w, r)
+			return
+		}
+
+		// Picking a first page name isn't a rename, no cooldown or history for that
+		renaming := user.PageName != ""
+		if renaming {
+			last, err := db.PageNames().LastByUser(ctx, user.ID)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				respondWithDBError(err, "Couldn't change page name!").ServeHTTP(w, r)
+				return
+			}
+			if wait := renameCooldown - time.Since(last.ChangedAt); err == nil && wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				utils.Respond(http.StatusTooManyRequests,
+					fmt.Sprintf("Page name was changed recently, try again in %s", wait.Round(time.Minute))).ServeHTTP(w, r)
+				return
+			}
+		}
+
+		now := time.Now().UTC()
+		err := db.WithTransaction(ctx, func(ctx context.Context) error {
+			held, err := pageNameHeld(ctx, db, newName, user.ID)
+			if err != nil {
+				return err
+			}
+			if held {
+				return &ConflictError{Field: "pageName"}
+			}
+			if err := db.Users().UpdatePageName(ctx, user.ID, newName); err != nil {
+				return err
+			}
+			if renaming {
+				err := db.PageNames().Record(ctx, PageNameChange{
+					UserID:    user.ID,
+					OldName:   user.PageName,
+					NewName:   newName,
+					ChangedAt: now,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return db.Audit().Record(ctx, AuditEvent{
+				Type:   AuditPageNameChanged,
+				UserID: user.ID,
+				Data:   map[string]string{"from": user.PageName, "to": newName},
+				At:     now,
+			})
+		})
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			utils.RespondWithJSON(map[string]string{"error": conflict.Error(), "field": conflict.Field}, http.StatusConflict)(w, r)
+			return
+		}
+		if err != nil {
+			respondWithDBError(err, "Couldn't change page name!").ServeHTTP(w, r)
+			return
+		}
+		user.PageName = newName
+		utils.RespondWithJSON(user, http.StatusOK)(w, r)
+	}
+}
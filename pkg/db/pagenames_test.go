@@ -0,0 +1,161 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+)
+
+func TestHandlePageNameAvailable(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	if err := conn.Users().Create(context.Background(), &User{PageName: "koen-san"}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string) PageNameAvailability {
+		req, _ := http.NewRequest("GET", "/pageNames/"+name+"/available", nil)
+		rr := httptest.NewRecorder()
+		HandlePageNameAvailable(conn, name).ServeHTTP(rr, req)
+		var result PageNameAvailability
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	t.Run("Free name is available", func(t *testing.T) {
+		got := check("Satoshi")
+		if !got.Available || got.Name != "satoshi" {
+			t.Errorf("got %+v", got)
+		}
+	})
+
+	t.Run("Taken name comes with suggestions", func(t *testing.T) {
+		got := check("KOEN-SAN")
+		if got.Available || len(got.Suggestions) == 0 {
+			t.Errorf("got %+v", got)
+		}
+	})
+
+	t.Run("Reserved name isn't available", func(t *testing.T) {
+		got := check("api")
+		if got.Available || got.Reason == "" {
+			t.Errorf("got %+v", got)
+		}
+	})
+}
+
+func TestCreateUserPageNameValidation(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	claim := auth.Claims{
+		GoogleClaims: auth.GoogleClaims{Email: "test@koen.com"},
+	}
+	htc := &utils.HttpTestCase{Handler: HandleCreateUser(conn, testDeposits(t), nil)}
+
+	htc.SetRequestBody(strings.NewReader(`{"pageName": "admin"}`))
+	htc.SetContext("userData", claim)
+	t.Run("HTTP 400 on reserved pageName", htc.CheckReturnStatus(http.StatusBadRequest))
+
+	htc.SetRequestBody(strings.NewReader(`{"pageName": "` + strings.Repeat("a", 500) + `"}`))
+	htc.SetContext("userData", claim)
+	t.Run("HTTP 400 on overly long pageName", htc.CheckReturnStatus(http.StatusBadRequest))
+
+	htc.SetRequestBody(strings.NewReader(`{"pageName": "Koen-San"}`))
+	htc.SetContext("userData", claim)
+	t.Run("HTTP 200 on valid pageName", htc.CheckReturnStatus(http.StatusOK))
+
+	if _, err := conn.Users().GetByPageName(context.Background(), "koen-san"); err != nil {
+		t.Errorf("pageName wasn't stored normalized: %v", err)
+	}
+}
+
+func TestHandleChangePageName(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	ctx := context.Background()
+	if err := conn.Users().Create(ctx, &User{Email: "test@koen.com", PageName: "koen-san"}); err != nil {
+		t.Fatal(err)
+	}
+	claim := auth.Claims{
+		GoogleClaims: auth.GoogleClaims{Email: "test@koen.com"},
+	}
+	other := auth.Claims{
+		GoogleClaims: auth.GoogleClaims{Email: "other@koen.com"},
+	}
+	defer func(cooldown, grace time.Duration) {
+		renameCooldown, gracePeriod = cooldown, grace
+	}(renameCooldown, gracePeriod)
+	renameCooldown, gracePeriod = time.Hour, time.Hour
+
+	rename := func(claims auth.Claims, body string, want int) func(t *testing.T) {
+		htc := &utils.HttpTestCase{Handler: HandleChangePageName(conn)}
+		htc.SetRequestBody(strings.NewReader(body))
+		htc.SetContext("userData", claims)
+		return htc.CheckReturnStatus(want)
+	}
+
+	t.Run("HTTP 200 on renaming", rename(claim, `{"pageName": "Koen-Art"}`, http.StatusOK))
+	if _, err := conn.Users().GetByPageName(ctx, "koen-art"); err != nil {
+		t.Errorf("user wasn't renamed: %v", err)
+	}
+	events, _ := conn.Audit().ListByUser(ctx, "1")
+	if len(events) != 1 || events[0].Type != AuditPageNameChanged {
+		t.Errorf("got %v, want one %s event", events, AuditPageNameChanged)
+	}
+
+	t.Run("HTTP 400 on invalid pageName", rename(claim, `{"pageName": "api"}`, http.StatusBadRequest))
+	t.Run("HTTP 400 on unknown fields", rename(claim, `{"pageName": "koen-music", "email": "x"}`, http.StatusBadRequest))
+	t.Run("HTTP 429 during the cooldown", rename(claim, `{"pageName": "koen-music"}`, http.StatusTooManyRequests))
+	t.Run("HTTP 404 for users without an account", rename(other, `{"pageName": "koen-music"}`, http.StatusNotFound))
+
+	t.Run("Old name redirects to the new one", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/v1/users/pageName/Koen-San", nil)
+		rr := httptest.NewRecorder()
+		GetUser(conn, "Koen-San").ServeHTTP(rr, req)
+
+		var body struct {
+			Redirect PageNameRedirect `json:"redirect"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		want := PageNameRedirect{Status: http.StatusMovedPermanently, PageName: "koen-art", Location: "/api/v1/users/pageName/koen-art"}
+		if body.Redirect != want {
+			t.Errorf("got %+v, want %+v", body.Redirect, want)
+		}
+	})
+
+	// Somebody else wants the old name
+	if err := conn.Users().Create(ctx, &User{Email: "other@koen.com"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("HTTP 409 on a name in its grace period", rename(other, `{"pageName": "koen-san"}`, http.StatusConflict))
+	t.Run("Name in its grace period isn't available", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/pageNames/koen-san/available", nil)
+		rr := httptest.NewRecorder()
+		HandlePageNameAvailable(conn, "koen-san").ServeHTTP(rr, req)
+		var result PageNameAvailability
+		json.Unmarshal(rr.Body.Bytes(), &result)
+		if result.Available {
+			t.Errorf("got %+v, want unavailable", result)
+		}
+	})
+
+	gracePeriod = 0
+	t.Run("HTTP 200 once the grace period is over", rename(other, `{"pageName": "koen-san"}`, http.StatusOK))
+	if got, _ := conn.Users().GetByPageName(ctx, "koen-san"); got.Email != "other@koen.com" {
+		t.Errorf("got %q, want the name to belong to other@koen.com", got.Email)
+	}
+}
@@ -0,0 +1,282 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/prices"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Payment is a verified on-chain transfer to a creator
+type Payment struct {
+	// Assigned by the repository on Create
+	ID    string `bson:"-" json:"id"`
+	Chain string `bson:"chain" json:"chain"`
+	// Lowercase hex, a transaction is only ever recorded once
+	TxHash    string `bson:"txHash" json:"txHash"`
+	CreatorID string `bson:"creatorId" json:"-"`
+	// The user whose wallet sent the payment, empty when we don't know them
+	PayerID string `bson:"payerId" json:"-"`
+	From    string `bson:"from" json:"from"`
+	To      string `bson:"to" json:"to"`
+	Token   string `bson:"token" json:"token"`
+	// Decimal amount of the token that reached the creator
+	Amount      string    `bson:"amount" json:"amount"`
+	BlockNumber uint64    `bson:"blockNumber" json:"blockNumber"`
+	VerifiedAt  time.Time `bson:"verifiedAt" json:"verifiedAt"`
+	// What it was worth in the creator's display currency when it was verified. Empty when
+	// there was no price for it
+	FiatCurrency string `bson:"fiatCurrency" json:"fiatCurrency,omitempty"`
+	// Price of one token
+	FiatRate   string `bson:"fiatRate" json:"fiatRate,omitempty"`
+	FiatAmount string `bson:"fiatAmount" json:"fiatAmount,omitempty"`
+}
+
+// PaymentRepository stores verified payments. Lookups return ErrNotFound when there's no match
+type PaymentRepository interface {
+	// Create returns a *ConflictError on txHash if the transaction was recorded already
+	Create(ctx context.Context, payment *Payment) error
+	GetByTxHash(ctx context.Context, txHash string) (Payment, error)
+	// Oldest first
+	ListByCreator(ctx context.Context, creatorID string) ([]Payment, error)
+	// Payments on chain mined in block or after it, oldest block first
+	ListFromBlock(ctx context.Context, chain string, block uint64) ([]Payment, error)
+	// AnonymizePayer forgets who made payments. Creators keep them in their records
+	AnonymizePayer(ctx context.Context, payerID string) error
+	// Delete forgets a payment whose transaction was dropped from the chain
+	Delete(ctx context.Context, txHash string) error
+}
+
+// Node is how payments on a chain get verified
+type Node struct {
+	Client ethrpc.Client
+	// Blocks on top of a payment's own before it counts
+	Confirmations uint64
+}
+
+var txHashPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{64}$`)
+
+type verifyRequest struct {
+	// Sent along by clients that authenticate through the body
+	IdToken string `json:"idToken"`
+	TxHash  string `json:"txHash"`
+	// Page name of the creator who was paid
+	PageName string `json:"pageName"`
+	// Defaults to polygon
+	Chain string `json:"chain"`
+	Token string `json:"token"`
+	// The least the transaction has to pay the creator
+	Amount string `json:"amount"`
+}
+
+// What a transaction still waiting for confirmations looks like
+type pendingPayment struct {
+	Status        string `json:"status"`
+	Confirmations uint64 `json:"confirmations"`
+	Required      uint64 `json:"required"`
+}
+
+func respondPending(confirmations, required uint64) http.HandlerFunc {
+	return utils.RespondWithJSON(pendingPayment{Status: "pending", Confirmations: confirmations, Required: required},
+		http.StatusAccepted)
+}
+
+// A payment that was recorded before is fine, as long as it's for the same creator
+func respondWithRecorded(payment Payment, creatorID string) http.HandlerFunc {
+	if payment.CreatorID != creatorID {
+		return utils.Respond(http.StatusConflict, "Transaction was already recorded for another creator")
+	}
+	return utils.RespondWithJSON(payment, http.StatusOK)
+}
+
+// The signed in user's wallets, to tell if they sent a payment
+func payerWallets(user User) []string {
+	var wallets []string
+	for _, w := range []string{user.MetaMaskWalletPublicAddress, user.GeneratedMaticWalletPublicAddress} {
+		if w != "" {
+			wallets = append(wallets, w)
+		}
+	}
+	return wallets
+}
+
+// Adds up what a transaction's transfers paid to in token
+func paidTo(transfers []ethrpc.Transfer, to common.Address, token chain.Token) *big.Int {
+	total := new(big.Int)
+	for _, t := range transfers {
+		if t.To != to {
+			continue
+		}
+		if token.Native() && t.Native() || !token.Native() && t.Token == common.HexToAddress(token.Contract) {
+			total.Add(total, t.Value)
+		}
+	}
+	return total
+}
+
+// HandleVerifyPayment checks a transaction on chain and records it as a payment to a creator.
+// Verifying the same transaction again is fine and returns the recorded payment. Transactions
+// without enough confirmations get a 202, clients are expected to try again a bit later
+func HandleVerifyPayment(db DBConn, nodes map[string]Node, rates *prices.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		req := verifyRequest{}
+		if err := utils.DecodeJSON(r.Body, &req, false); err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		if !txHashPattern.MatchString(req.TxHash) {
+			utils.Respond(http.StatusBadRequest, "txHash must be a 32 byte hex string").ServeHTTP(w, r)
+			return
+		}
+		if req.Chain == "" {
+			req.Chain = "polygon"
+		}
+		c, ok := chain.Lookup(req.Chain)
+		node, hasNode := nodes[c.Name]
+		if !ok || !hasNode {
+			utils.Respond(http.StatusBadRequest, "Payments on "+req.Chain+" can't be verified").ServeHTTP(w, r)
+			return
+		}
+		token, ok := c.Token(req.Token)
+		if !ok {
+			utils.Respond(http.StatusBadRequest, "Unsupported token on "+c.Name).ServeHTTP(w, r)
+			return
+		}
+		expected, err := chain.ParseAmount(req.Amount, token.Decimals)
+		if err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+
+		claims, ok := r.Context().Value("userData").(auth.Claims)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+			return
+		}
+		// Patrons don't need an account to tip
+		payer, err := userFromClaims(ctx, db.Users(), claims)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			respondWithDBError(err, "Couldn't get user!").ServeHTTP(w, r)
+			return
+		}
+		creator, err := activeUser(db.Users().GetByPageName(ctx, req.PageName))
+		if errors.Is(err, ErrNotFound) {
+			utils.Respond(http.StatusNotFound, "Creator not found").ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			respondWithDBError(err, "Couldn't get creator!").ServeHTTP(w, r)
+			return
+		}
+		if !common.IsHexAddress(creator.GeneratedMaticWalletPublicAddress) {
+			utils.Respond(http.StatusUnprocessableEntity, "Creator has no wallet to pay").ServeHTTP(w, r)
+			return
+		}
+
+		txHash := strings.ToLower(req.TxHash)
+		recorded, err := db.Payments().GetByTxHash(ctx, txHash)
+		if err == nil {
+			respondWithRecorded(recorded, creator.ID).ServeHTTP(w, r)
+			return
+		}
+		if !errors.Is(err, ErrNotFound) {
+			respondWithDBError(err, "Couldn't get payment!").ServeHTTP(w, r)
+			return
+		}
+
+		rpcError := func(err error) {
+			utils.Respond(http.StatusBadGateway, fmt.Sprintf("Couldn't reach the %s node: %v", c.Name, err)).ServeHTTP(w, r)
+		}
+		hash := common.HexToHash(txHash)
+		tx, err := node.Client.TransactionByHash(ctx, hash)
+		if errors.Is(err, ethrpc.ErrNotFound) {
+			utils.Respond(http.StatusNotFound, "Transaction not found").ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			rpcError(err)
+			return
+		}
+		receipt, err := node.Client.TransactionReceipt(ctx, hash)
+		if errors.Is(err, ethrpc.ErrNotFound) {
+			// Not mined yet
+			respondPending(0, node.Confirmations).ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			rpcError(err)
+			return
+		}
+		head, err := node.Client.BlockNumber(ctx)
+		if err != nil {
+			rpcError(err)
+			return
+		}
+		confirmations := uint64(0)
+		if head >= uint64(receipt.BlockNumber) {
+			confirmations = head - uint64(receipt.BlockNumber) + 1
+		}
+		if confirmations < node.Confirmations {
+			respondPending(confirmations, node.Confirmations).ServeHTTP(w, r)
+			return
+		}
+		if receipt.Status != 1 {
+			utils.Respond(http.StatusUnprocessableEntity, "Transaction failed").ServeHTTP(w, r)
+			return
+		}
+
+		to := common.HexToAddress(creator.GeneratedMaticWalletPublicAddress)
+		paid := paidTo(ethrpc.Transfers(tx, receipt), to, token)
+		if paid.Sign() == 0 {
+			utils.Respond(http.StatusUnprocessableEntity, "Transaction doesn't pay "+token.Symbol+" to the creator").ServeHTTP(w, r)
+			return
+		}
+		if paid.Cmp(expected) < 0 {
+			utils.Respond(http.StatusUnprocessableEntity, "Transaction pays less than "+req.Amount+" "+token.Symbol).ServeHTTP(w, r)
+			return
+		}
+
+		payment := Payment{
+			Chain:       c.Name,
+			TxHash:      txHash,
+			CreatorID:   creator.ID,
+			From:        tx.From.Hex(),
+			To:          to.Hex(),
+			Token:       token.Symbol,
+			Amount:      chain.FormatAmount(paid, token.Decimals),
+			BlockNumber: uint64(receipt.BlockNumber),
+			VerifiedAt:  time.Now().UTC(),
+		}
+		for _, wallet := range payerWallets(payer) {
+			if strings.EqualFold(wallet, payment.From) {
+				payment.PayerID = payer.ID
+			}
+		}
+		// Paying for a tier renews the payer's subscription to it
+		err = RecordPayment(ctx, db, rates, &payment)
+		if errors.Is(err, ErrConflict) {
+			// Someone verified the same transaction at the same time
+			if recorded, err = db.Payments().GetByTxHash(ctx, txHash); err == nil {
+				respondWithRecorded(recorded, creator.ID).ServeHTTP(w, r)
+				return
+			}
+		}
+		if err != nil {
+			respondWithDBError(err, "Couldn't record payment!").ServeHTTP(w, r)
+			return
+		}
+		utils.RespondWithJSON(payment, http.StatusCreated)(w, r)
+	}
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc/ethrpctest"
+	"github.com/cryptopatron/koen-backend/pkg/prices"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+func TestHandleVerifyPayment(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	payerWallet := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	creatorWallet := common.HexToAddress("0x2222222222222222222222222222222222222222")
+	usdc := common.HexToAddress("0x2791Bca1f2de4661ED88A30C99A7a9449Aa84174")
+	creator := &User{Email: "creator@koen.com", PageName: "koen-san", GeneratedMaticWalletPublicAddress: creatorWallet.Hex()}
+	other := &User{Email: "other@koen.com", PageName: "other", GeneratedMaticWalletPublicAddress: "0x3333333333333333333333333333333333333333"}
+	payer := &User{Email: "payer@koen.com", PageName: "payer", MetaMaskWalletPublicAddress: strings.ToLower(payerWallet.Hex())}
+	for _, u := range []*User{creator, other, payer} {
+		if err := conn.Users().Create(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	node := ethrpctest.NewNode(100)
+	server := httptest.NewServer(node)
+	defer server.Close()
+	nodes := map[string]Node{"polygon": {Client: &ethrpc.HTTPClient{URL: server.URL}, Confirmations: 5}}
+	// No MATIC price, those payments go unpriced
+	rates := &prices.Service{Feed: prices.StaticFeed{"USDC": {"USD": "1.0001"}}}
+
+	// Canned transactions, mined in the given block and paying creatorWallet unless said otherwise
+	n := 0
+	add := func(block uint64, status uint64, value int64, logs ...ethrpc.Log) string {
+		n++
+		hash := common.BigToHash(big.NewInt(int64(n)))
+		b := hexutil.Uint64(block)
+		to := creatorWallet
+		if len(logs) > 0 {
+			to = usdc
+		}
+		tx := &ethrpc.Transaction{Hash: hash, From: payerWallet, To: &to, Value: (*hexutil.Big)(big.NewInt(value)), BlockNumber: &b}
+		var receipt *ethrpc.Receipt
+		if block > 0 {
+			receipt = &ethrpc.Receipt{TxHash: hash, Status: hexutil.Uint64(status), BlockNumber: b, Logs: logs}
+		} else {
+			tx.BlockNumber = nil
+		}
+		node.Add(tx, receipt)
+		return hash.Hex()
+	}
+	usdcTip := add(90, 1, 0, ethrpctest.TransferLog(usdc, payerWallet, creatorWallet, big.NewInt(5500000), 0))
+	maticTip := add(90, 1, 2e18)
+	pending := add(0, 0, 2e18)
+	recent := add(98, 1, 2e18)
+	reverted := add(90, 0, 2e18)
+	elsewhere := add(90, 1, 0, ethrpctest.TransferLog(usdc, payerWallet, common.HexToAddress("0x4444444444444444444444444444444444444444"), big.NewInt(5500000), 0))
+
+	verify := func(email, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/payments/verify", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), "userData", auth.Claims{
+			GoogleClaims: auth.GoogleClaims{Email: email},
+		}))
+		rr := httptest.NewRecorder()
+		HandleVerifyPayment(conn, nodes, rates).ServeHTTP(rr, req)
+		return rr
+	}
+	body := func(txHash, pageName, token, amount string) string {
+		return `{"txHash": "` + txHash + `", "pageName": "` + pageName + `", "token": "` + token + `", "amount": "` + amount + `"}`
+	}
+
+	t.Run("ERC-20 tip is recorded", func(t *testing.T) {
+		rr := verify("payer@koen.com", body(usdcTip, "koen-san", "usdc", "5"))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body)
+		}
+		var got Payment
+		json.Unmarshal(rr.Body.Bytes(), &got)
+		if got.Amount != "5.5" || got.Token != "USDC" || got.Chain != "polygon" || got.BlockNumber != 90 {
+			t.Errorf("got %+v, want 5.5 USDC on polygon", got)
+		}
+		stored, err := conn.Payments().GetByTxHash(context.Background(), strings.ToLower(usdcTip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.CreatorID != creator.ID || stored.PayerID != payer.ID {
+			t.Errorf("got %+v, want it linked to the creator and payer", stored)
+		}
+		if stored.FiatCurrency != "USD" || stored.FiatRate != "1.0001" || stored.FiatAmount != "5.50" {
+			t.Errorf("got %+v, want it priced in USD", stored)
+		}
+	})
+
+	t.Run("Verifying again returns the recorded payment", func(t *testing.T) {
+		calls := node.Calls["eth_getTransactionReceipt"]
+		if rr := verify("payer@koen.com", body(strings.ToUpper(usdcTip[2:]), "koen-san", "USDC", "5")); rr.Code != http.StatusBadRequest {
+			t.Errorf("got %v without 0x, want %v", rr.Code, http.StatusBadRequest)
+		}
+		if rr := verify("payer@koen.com", body(usdcTip, "koen-san", "USDC", "5")); rr.Code != http.StatusOK {
+			t.Errorf("got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		if node.Calls["eth_getTransactionReceipt"] != calls {
+			t.Error("got another RPC call, want the recorded payment")
+		}
+		if rr := verify("payer@koen.com", body(usdcTip, "other", "USDC", "5")); rr.Code != http.StatusConflict {
+			t.Errorf("got %v for another creator, want %v", rr.Code, http.StatusConflict)
+		}
+	})
+
+	t.Run("Native tip from someone without an account", func(t *testing.T) {
+		rr := verify("stranger@koen.com", body(maticTip, "koen-san", "MATIC", "1.5"))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body)
+		}
+		stored, _ := conn.Payments().GetByTxHash(context.Background(), strings.ToLower(maticTip))
+		if stored.Amount != "2" || stored.PayerID != "" {
+			t.Errorf("got %+v, want 2 MATIC without a payer", stored)
+		}
+	})
+
+	t.Run("HTTP 202 until confirmed", func(t *testing.T) {
+		for tx, want := range map[string]pendingPayment{
+			pending: {Status: "pending", Confirmations: 0, Required: 5},
+			recent:  {Status: "pending", Confirmations: 3, Required: 5},
+		} {
+			rr := verify("payer@koen.com", body(tx, "koen-san", "MATIC", "2"))
+			var got pendingPayment
+			json.Unmarshal(rr.Body.Bytes(), &got)
+			if rr.Code != http.StatusAccepted || got != want {
+				t.Errorf("got %v %+v, want %v %+v", rr.Code, got, http.StatusAccepted, want)
+			}
+		}
+
+		node.SetBlock(102)
+		if rr := verify("payer@koen.com", body(recent, "koen-san", "MATIC", "2")); rr.Code != http.StatusCreated {
+			t.Errorf("got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body)
+		}
+	})
+
+	t.Run("Rejected payments aren't recorded", func(t *testing.T) {
+		cases := []struct {
+			name string
+			body string
+			code int
+		}{
+			{"reverted", body(reverted, "koen-san", "MATIC", "2"), http.StatusUnprocessableEntity},
+			{"wrong recipient", body(elsewhere, "koen-san", "USDC", "5"), http.StatusUnprocessableEntity},
+			{"wrong token", body(elsewhere, "koen-san", "DAI", "5"), http.StatusUnprocessableEntity},
+			{"unknown transaction", body(common.HexToHash("0xdead").Hex(), "koen-san", "MATIC", "2"), http.StatusNotFound},
+			{"unknown creator", body(elsewhere, "nobody", "USDC", "5"), http.StatusNotFound},
+			{"unsupported chain", `{"txHash": "` + elsewhere + `", "pageName": "koen-san", "chain": "ethereum", "token": "ETH", "amount": "1"}`, http.StatusBadRequest},
+			{"bad amount", body(elsewhere, "koen-san", "USDC", "0.0000001"), http.StatusBadRequest},
+		}
+		for _, c := range cases {
+			if rr := verify("payer@koen.com", c.body); rr.Code != c.code {
+				t.Errorf("%s: got %v, want %v: %s", c.name, rr.Code, c.code, rr.Body)
+			}
+		}
+		if _, err := conn.Payments().GetByTxHash(context.Background(), strings.ToLower(reverted)); err != ErrNotFound {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+
+		// Pays 2 MATIC once mined, which is too little
+		node.Add(&ethrpc.Transaction{Hash: common.HexToHash(pending), From: payerWallet, To: &creatorWallet,
+			Value: (*hexutil.Big)(big.NewInt(2e18))}, &ethrpc.Receipt{TxHash: common.HexToHash(pending), Status: 1, BlockNumber: 90})
+		if rr := verify("payer@koen.com", body(pending, "koen-san", "MATIC", "3")); rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusUnprocessableEntity)
+		}
+	})
+}
@@ -0,0 +1,492 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/gating"
+	"github.com/cryptopatron/koen-backend/pkg/pagination"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+)
+
+const (
+	MaxPostTitleLength   = 200
+	MaxPostBodyLength    = 50000
+	MaxAttachments       = 10
+	MaxAttachmentNameLen = 200
+)
+
+// Who gets to see a post's body
+const (
+	VisibilityPublic = "public"
+	// Patrons with an active subscription to one of the post's tiers
+	VisibilityTiers = "tiers"
+	// Wallets satisfying the post's gating rule
+	VisibilityToken = "token"
+)
+
+// Post is something a creator publishes on their page
+type Post struct {
+	// Assigned by the repository on Create
+	ID        string `bson:"-" json:"id"`
+	CreatorID string `bson:"creatorId" json:"-"`
+	Title     string `bson:"title" json:"title"`
+	// Markdown, rendered by the web app
+	Body        string       `bson:"body" json:"body"`
+	Attachments []Attachment `bson:"attachments" json:"attachments"`
+	// One of the Visibility constants
+	Visibility string `bson:"visibility" json:"visibility"`
+	// For tier-gated posts, empty lets patrons of any tier in
+	TierIDs []string `bson:"tierIds" json:"tierIds"`
+	// For token-gated posts
+	Gate *gating.Rule `bson:"gate" json:"gate"`
+	// Scheduled posts stay off the feed until then
+	PublishAt time.Time `bson:"publishAt" json:"publishAt"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+	// Set when the body and attachments were left out because the viewer has no access
+	Locked bool `bson:"-" json:"locked"`
+}
+
+// Attachment links to a file that goes with a post
+type Attachment struct {
+	URL         string `bson:"url" json:"url"`
+	Name        string `bson:"name" json:"name"`
+	ContentType string `bson:"contentType" json:"contentType"`
+}
+
+// PostRepository stores posts. Lookups return ErrNotFound when there's no match
+type PostRepository interface {
+	Create(ctx context.Context, post *Post) error
+	GetByID(ctx context.Context, id string) (Post, error)
+	// A page of a creator's posts sorted by publish time, as far as published by the given time.
+	// A zero time includes the scheduled ones too
+	ListByCreator(ctx context.Context, creatorID string, publishedBy time.Time, p pagination.Params) ([]Post, *pagination.Key, error)
+	// Update saves everything but the ID, creator and creation time
+	Update(ctx context.Context, post Post) error
+	Delete(ctx context.Context, id string) error
+	DeleteByCreator(ctx context.Context, creatorID string) error
+}
+
+func (p Post) key() pagination.Key {
+	return pagination.Key{Time: p.PublishAt, ID: p.ID}
+}
+
+// Validate checks a post. Tiers are checked against the creator's by the handlers
+func (p *Post) Validate() FieldErrors {
+	errs := FieldErrors{}
+	p.Title = strings.TrimSpace(p.Title)
+	if p.Title == "" {
+		errs["title"] = "title is required"
+	} else if utf8.RuneCountInString(p.Title) > MaxPostTitleLength {
+		errs["title"] = "title is too long"
+	}
+	if utf8.RuneCountInString(p.Body) > MaxPostBodyLength {
+		errs["body"] = "body is too long"
+	}
+	if len(p.Attachments) > MaxAttachments {
+		errs["attachments"] = "too many attachments"
+	}
+	for _, a := range p.Attachments {
+		if !validURL(a.URL) || utf8.RuneCountInString(a.Name) > MaxAttachmentNameLen || len(a.ContentType) > 100 {
+			errs["attachments"] = "attachments need a URL and a short name"
+		}
+	}
+	if p.PublishAt.IsZero() {
+		errs["publishAt"] = "publishAt is required"
+	}
+
+	// What doesn't apply to the visibility is dropped, so switching back and forth is painless
+	if p.Visibility != VisibilityTiers {
+		p.TierIDs = nil
+	}
+	if p.Visibility != VisibilityToken {
+		p.Gate = nil
+	}
+	switch p.Visibility {
+	case VisibilityPublic, VisibilityTiers:
+	case VisibilityToken:
+		if p.Gate == nil {
+			errs["gate"] = "token-gated posts need a gate"
+		} else if err := p.Gate.Validate(); err != nil {
+			errs["gate"] = err.Error()
+		}
+	default:
+		errs["visibility"] = "visibility must be public, tiers or token"
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Fields a post is created or patched with. Anything left out of a patch stays as it is
+type postInput struct {
+	IdToken     string        `json:"idToken"`
+	Title       *string       `json:"title"`
+	Body        *string       `json:"body"`
+	Attachments *[]Attachment `json:"attachments"`
+	Visibility  *string       `json:"visibility"`
+	TierIDs     *[]string     `json:"tierIds"`
+	Gate        *gating.Rule  `json:"gate"`
+	PublishAt   *time.Time    `json:"publishAt"`
+}
+
+func (in postInput) apply(p *Post) {
+	setString(&p.Title, in.Title)
+	setString(&p.Body, in.Body)
+	setString(&p.Visibility, in.Visibility)
+	if in.Attachments != nil {
+		p.Attachments = *in.Attachments
+	}
+	if in.TierIDs != nil {
+		p.TierIDs = *in.TierIDs
+	}
+	if in.Gate != nil {
+		p.Gate = in.Gate
+	}
+	if in.PublishAt != nil {
+		p.PublishAt = in.PublishAt.UTC()
+	}
+}
+
+// Decodes and applies a postInput, responding with what's wrong if it doesn't make a valid post
+func readPost(w http.ResponseWriter, r *http.Request, db DBConn, post *Post) bool {
+	in := postInput{}
+	if err := utils.DecodeJSON(r.Body, &in, false); err != nil {
+		utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+		return false
+	}
+	in.apply(post)
+	errs := post.Validate()
+	if len(post.TierIDs) > 0 {
+		tiers, err := db.Tiers().ListByCreator(r.Context(), post.CreatorID)
+		if err != nil {
+			respondWithDBError(err, "Couldn't get tiers!").ServeHTTP(w, r)
+			return false
+		}
+		own := map[string]bool{}
+		for _, t := range tiers {
+			own[t.ID] = true
+		}
+		for _, id := range post.TierIDs {
+			if !own[id] {
+				if errs == nil {
+					errs = FieldErrors{}
+				}
+				errs["tierIds"] = "unknown tier " + id
+			}
+		}
+	}
+	if errs != nil {
+		utils.RespondWithJSON(map[string]FieldErrors{"errors": errs}, http.StatusBadRequest)(w, r)
+		return false
+	}
+	return true
+}
+
+// Finds one of the signed in user's posts. Other creators' posts are as good as missing
+func ownPost(w http.ResponseWriter, r *http.Request, db DBConn, id string) (Post, bool) {
+	user, ok := currentUser(w, r, db)
+	if !ok {
+		return Post{}, false
+	}
+	post, err := db.Posts().GetByID(r.Context(), id)
+	if errors.Is(err, ErrNotFound) || err == nil && post.CreatorID != user.ID {
+		utils.Respond(http.StatusNotFound, "Post not found").ServeHTTP(w, r)
+		return Post{}, false
+	}
+	if err != nil {
+		respondWithDBError(err, "Couldn't get post!").ServeHTTP(w, r)
+		return Post{}, false
+	}
+	return post, true
+}
+
+// HandleListMyPosts lists the signed in user's posts newest first, scheduled ones included
+func HandleListMyPosts(db DBConn, signer pagination.Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := signer.FromRequest(r)
+		if err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		p.Desc = true
+		posts, next, err := db.Posts().ListByCreator(r.Context(), user.ID, time.Time{}, p)
+		if err != nil {
+			respondWithDBError(err, "Couldn't get posts!").ServeHTTP(w, r)
+			return
+		}
+		signer.Respond(posts, next).ServeHTTP(w, r)
+	}
+}
+
+// HandleCreatePost publishes a post for the signed in user, right away unless publishAt says otherwise
+func HandleCreatePost(db DBConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		now := time.Now().UTC()
+		post := Post{CreatorID: user.ID, Visibility: VisibilityPublic, PublishAt: now, CreatedAt: now, UpdatedAt: now}
+		if !readPost(w, r, db, &post) {
+			return
+		}
+		if err := db.Posts().Create(r.Context(), &post); err != nil {
+			respondWithDBError(err, "Couldn't create post!").ServeHTTP(w, r)
+			return
+		}
+		utils.RespondWithJSON(post, http.StatusCreated)(w, r)
+	}
+}
+
+// HandleUpdatePost applies a partial update to one of the signed in user's posts
+func HandleUpdatePost(db DBConn, id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post, ok := ownPost(w, r, db, id)
+		if !ok || !readPost(w, r, db, &post) {
+			return
+		}
+		post.UpdatedAt = time.Now().UTC()
+		if err := db.Posts().Update(r.Context(), post); err != nil {
+			respondWithDBError(err, "Couldn't update post!").ServeHTTP(w, r)
+			return
+		}
+		utils.RespondWithJSON(post, http.StatusOK)(w, r)
+	}
+}
+
+func HandleDeletePost(db DBConn, id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post, ok := ownPost(w, r, db, id)
+		if !ok {
+			return
+		}
+		if err := db.Posts().Delete(r.Context(), post.ID); err != nil {
+			respondWithDBError(err, "Couldn't delete post!").ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Whoever is looking at a creator's posts, and what they have access to
+type postViewer struct {
+	// Empty when not signed in or without an account
+	userID string
+	wallet string
+	// Tiers they paid to be a patron of, counting past due ones still in their grace period.
+	// Pending subscriptions unlock nothing until their first payment
+	tiers   map[string]bool
+	checker *gating.Checker
+}
+
+// Routes with auth.OptionalJWT know who's asking, if anyone
+func newPostViewer(r *http.Request, db DBConn, checker *gating.Checker, creatorID string) (*postViewer, error) {
+	v := &postViewer{wallet: gating.Wallet(r), tiers: map[string]bool{}, checker: checker}
+	claims, ok := r.Context().Value("userData").(auth.Claims)
+	if !ok {
+		return v, nil
+	}
+	user, err := userFromClaims(r.Context(), db.Users(), claims)
+	if errors.Is(err, ErrNotFound) {
+		// Wallets can hold tokens without signing up
+		return v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.userID = user.ID
+	subs, err := db.Subscriptions().ListByPatron(r.Context(), user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subs {
+		if sub.CreatorID == creatorID && sub.current() {
+			v.tiers[sub.TierID] = true
+		}
+	}
+	return v, nil
+}
+
+func (v *postViewer) canSee(ctx context.Context, post Post) bool {
+	if v.userID != "" && v.userID == post.CreatorID {
+		return true
+	}
+	switch post.Visibility {
+	case VisibilityPublic:
+		return true
+	case VisibilityTiers:
+		if len(post.TierIDs) == 0 {
+			return len(v.tiers) > 0
+		}
+		for _, id := range post.TierIDs {
+			if v.tiers[id] {
+				return true
+			}
+		}
+	case VisibilityToken:
+		if post.Gate == nil || v.wallet == "" || v.checker == nil {
+			return false
+		}
+		ok, err := v.checker.Allowed(ctx, *post.Gate, v.wallet)
+		if err != nil {
+			// One node acting up shouldn't take the whole feed down, the post just stays locked
+			log.Printf("Checking gate of post %s: %v", post.ID, err)
+		}
+		return ok
+	}
+	return false
+}
+
+// Leaves out what the viewer has no access to
+func (v *postViewer) redact(ctx context.Context, post Post) Post {
+	if !v.canSee(ctx, post) {
+		post.Body, post.Attachments, post.Locked = "", nil, true
+	}
+	return post
+}
+
+// HandleCreatorFeed lists a creator's published posts newest first. Everyone sees
+// every post, gated ones without their body for viewers who lack access
+func HandleCreatorFeed(db DBConn, checker *gating.Checker, signer pagination.Signer, pageName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := signer.FromRequest(r)
+		if err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		creator, err := activeUser(db.Users().GetByPageName(r.Context(), pageName))
+		if errors.Is(err, ErrNotFound) {
+			utils.Respond(http.StatusNotFound, "Creator not found").ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			respondWithDBError(err, "Couldn't get creator!").ServeHTTP(w, r)
+			return
+		}
+		viewer, err := newPostViewer(r, db, checker, creator.ID)
+		if err != nil {
+			respondWithDBError(err, "Couldn't get user!").ServeHTTP(w, r)
+			return
+		}
+
+		p.Desc = true
+		posts, next, err := db.Posts().ListByCreator(r.Context(), creator.ID, time.Now().UTC(), p)
+		if err != nil {
+			respondWithDBError(err, "Couldn't get posts!").ServeHTTP(w, r)
+			return
+		}
+		for i := range posts {
+			posts[i] = viewer.redact(r.Context(), posts[i])
+		}
+		signer.Respond(posts, next).ServeHTTP(w, r)
+	}
+}
+
+// HandleGetPost shows a single published post, redacted like in the feed.
+// Creators can see their scheduled posts here too
+func HandleGetPost(db DBConn, checker *gating.Checker, id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post, err := db.Posts().GetByID(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			utils.Respond(http.StatusNotFound, "Post not found").ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			respondWithDBError(err, "Couldn't get post!").ServeHTTP(w, r)
+			return
+		}
+		viewer, err := newPostViewer(r, db, checker, post.CreatorID)
+		if err != nil {
+			respondWithDBError(err, "Couldn't get user!").ServeHTTP(w, r)
+			return
+		}
+		// Their creator might be gone too
+		creator, err := activeUser(db.Users().GetByID(r.Context(), post.CreatorID))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			respondWithDBError(err, "Couldn't get creator!").ServeHTTP(w, r)
+			return
+		}
+		scheduled := post.PublishAt.After(time.Now())
+		if err != nil || scheduled && viewer.userID != creator.ID {
+			utils.Respond(http.StatusNotFound, "Post not found").ServeHTTP(w, r)
+			return
+		}
+		utils.RespondWithJSON(viewer.redact(r.Context(), post), http.StatusOK)(w, r)
+	}
+}
+
+// PostGate is the token gate of a post, the rule gating.Checker.Require enforces on its routes.
+// Nil for posts that aren't token gated or don't exist, and for their own creator
+func PostGate(db DBConn, r *http.Request, id string) (*gating.Rule, error) {
+	post, err := db.Posts().GetByID(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil || post.Visibility != VisibilityToken {
+		return nil, err
+	}
+	if claims, ok := r.Context().Value("userData").(auth.Claims); ok {
+		user, err := userFromClaims(r.Context(), db.Users(), claims)
+		if err == nil && user.ID == post.CreatorID {
+			return nil, nil
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+	return post.Gate, nil
+}
+
+// HandleGetPostAttachments lists the files of a published post. Token gates are left to
+// gating.Checker.Require with PostGate in front of it, tiers are checked here
+func HandleGetPostAttachments(db DBConn, checker *gating.Checker, id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		post, err := db.Posts().GetByID(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			utils.Respond(http.StatusNotFound, "Post not found").ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			respondWithDBError(err, "Couldn't get post!").ServeHTTP(w, r)
+			return
+		}
+		viewer, err := newPostViewer(r, db, checker, post.CreatorID)
+		if err != nil {
+			respondWithDBError(err, "Couldn't get user!").ServeHTTP(w, r)
+			return
+		}
+		creator, err := activeUser(db.Users().GetByID(r.Context(), post.CreatorID))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			respondWithDBError(err, "Couldn't get creator!").ServeHTTP(w, r)
+			return
+		}
+		scheduled := post.PublishAt.After(time.Now())
+		if err != nil || scheduled && viewer.userID != creator.ID {
+			utils.Respond(http.StatusNotFound, "Post not found").ServeHTTP(w, r)
+			return
+		}
+		if !viewer.canSee(r.Context(), post) {
+			utils.Respond(http.StatusForbidden, "Only patrons of the post's tiers can see this").ServeHTTP(w, r)
+			return
+		}
+		attachments := post.Attachments
+		if attachments == nil {
+			attachments = []Attachment{}
+		}
+		utils.RespondWithJSON(map[string][]Attachment{"attachments": attachments}, http.StatusOK)(w, r)
+	}
+}
@@ -0,0 +1,267 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc/ethrpctest"
+	"github.com/cryptopatron/koen-backend/pkg/gating"
+	"github.com/cryptopatron/koen-backend/pkg/pagination"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestPostValidate(t *testing.T) {
+	now := time.Now()
+	gate := func() *gating.Rule {
+		return &gating.Rule{Chain: "polygon", Contract: "0x3333333333333333333333333333333333333333", Standard: "erc721"}
+	}
+	cases := []struct {
+		post  Post
+		field string
+	}{
+		{Post{Title: " ", Visibility: VisibilityPublic, PublishAt: now}, "title"},
+		{Post{Title: "Hi", Body: strings.Repeat("a", MaxPostBodyLength+1), Visibility: VisibilityPublic, PublishAt: now}, "body"},
+		{Post{Title: "Hi", Attachments: []Attachment{{URL: "javascript:alert(1)"}}, Visibility: VisibilityPublic, PublishAt: now}, "attachments"},
+		{Post{Title: "Hi", Visibility: "friends", PublishAt: now}, "visibility"},
+		{Post{Title: "Hi", Visibility: VisibilityToken, PublishAt: now}, "gate"},
+		{Post{Title: "Hi", Visibility: VisibilityToken, Gate: &gating.Rule{Chain: "polygon"}, PublishAt: now}, "gate"},
+		{Post{Title: "Hi", Visibility: VisibilityPublic}, "publishAt"},
+	}
+	for _, c := range cases {
+		errs := c.post.Validate()
+		if _, ok := errs[c.field]; !ok || len(errs) != 1 {
+			t.Errorf("got %v for %+v, want an error on %s", errs, c.post, c.field)
+		}
+	}
+
+	post := Post{Title: "Hi", Visibility: VisibilityPublic, TierIDs: []string{"1"}, Gate: gate(), PublishAt: now}
+	if errs := post.Validate(); errs != nil || post.TierIDs != nil || post.Gate != nil {
+		t.Errorf("got %v %+v, want what doesn't apply dropped", errs, post)
+	}
+	post = Post{Title: "Hi", Visibility: VisibilityToken, Gate: gate(), PublishAt: now}
+	if errs := post.Validate(); errs != nil || post.Gate.MinBalance != "1" {
+		t.Errorf("got %v %+v, want the gate in canonical form", errs, post.Gate)
+	}
+}
+
+func TestPosts(t *testing.T) {
+	ctx := context.Background()
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	creator := &User{Email: "creator@koen.com", PageName: "koen-san"}
+	patron := &User{Email: "patron@koen.com", PageName: "patron"}
+	late := &User{Email: "late@koen.com", PageName: "late"}
+	unpaid := &User{Email: "unpaid@koen.com", PageName: "unpaid"}
+	for _, u := range []*User{creator, patron, late, unpaid} {
+		if err := conn.Users().Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tier := &Tier{CreatorID: creator.ID, Name: "Supporter", Active: true}
+	other := &Tier{CreatorID: "someone else", Name: "Theirs", Active: true}
+	for _, tr := range []*Tier{tier, other} {
+		if err := conn.Tiers().Create(ctx, tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Subscriptions().Create(ctx, &Subscription{PatronID: patron.ID, CreatorID: creator.ID, TierID: tier.ID,
+		Status: SubscriptionActive, NextDueAt: time.Now().Add(time.Hour)})
+	conn.Subscriptions().Create(ctx, &Subscription{PatronID: late.ID, CreatorID: creator.ID, TierID: tier.ID,
+		Status: SubscriptionPastDue, NextDueAt: time.Now().Add(-time.Hour), LastPaymentTx: "0xpaid"})
+	conn.Subscriptions().Create(ctx, &Subscription{PatronID: unpaid.ID, CreatorID: creator.ID, TierID: tier.ID,
+		Status: SubscriptionPending, NextDueAt: time.Now()})
+
+	// Holders of an NFT on a fake node, everyone else has none
+	node := ethrpctest.NewNode(100)
+	server := httptest.NewServer(node)
+	defer server.Close()
+	checker := &gating.Checker{Clients: map[string]ethrpc.Client{"polygon": &ethrpc.HTTPClient{URL: server.URL}}}
+	nft := common.HexToAddress("0x3333333333333333333333333333333333333333")
+	holder := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	balanceOf := []byte{0x70, 0xa0, 0x82, 0x31}
+	node.SetCall(nft, append(balanceOf, common.LeftPadBytes(holder.Bytes(), 32)...), common.LeftPadBytes([]byte{1}, 32))
+	signer := pagination.Signer{Secret: []byte("test"), DefaultLimit: 10, MaxLimit: 10}
+
+	google := func(email string) *auth.Claims {
+		return &auth.Claims{GoogleClaims: auth.GoogleClaims{Email: email}}
+	}
+	wallet := &auth.Claims{WalletClaims: auth.WalletClaims{WalletPublicAddress: holder.Hex()}}
+	serve := func(handler http.HandlerFunc, method string, claims *auth.Claims, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/posts", strings.NewReader(body))
+		if claims != nil {
+			req = req.WithContext(context.WithValue(req.Context(), "userData", *claims))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	create := func(body string) Post {
+		rr := serve(HandleCreatePost(conn), "POST", google("creator@koen.com"), body)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body)
+		}
+		var post Post
+		json.Unmarshal(rr.Body.Bytes(), &post)
+		return post
+	}
+	feed := func(claims *auth.Claims) map[string]Post {
+		rr := serve(HandleCreatorFeed(conn, checker, signer, "koen-san"), "GET", claims, "")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got %v, want %v", rr.Code, http.StatusOK)
+		}
+		var page struct {
+			Items []Post `json:"items"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		posts := map[string]Post{}
+		for _, p := range page.Items {
+			posts[p.Title] = p
+		}
+		return posts
+	}
+
+	public := create(`{"title": "Public", "body": "Hello *world*"}`)
+	patrons := create(`{"title": "Patrons", "body": "Thanks", "visibility": "tiers", "tierIds": ["` + tier.ID + `"],
+		"attachments": [{"url": "https://cdn.koen.com/a.zip", "name": "a.zip"}]}`)
+	holders := create(`{"title": "Holders", "body": "Gm", "visibility": "token",
+		"gate": {"chain": "polygon", "contract": "` + nft.Hex() + `", "standard": "erc721"}}`)
+	scheduled := create(`{"title": "Later", "body": "Soon", "publishAt": "` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`)
+
+	t.Run("HTTP 400 on posts that don't validate", func(t *testing.T) {
+		for _, body := range []string{
+			`{"title": "Theirs", "visibility": "tiers", "tierIds": ["` + other.ID + `"]}`,
+			`{"title": "Nope", "visibility": "friends"}`,
+			`{"title": "Nope", "creatorId": "someone else"}`,
+		} {
+			if rr := serve(HandleCreatePost(conn), "POST", google("creator@koen.com"), body); rr.Code != http.StatusBadRequest {
+				t.Errorf("got %v for %s, want %v", rr.Code, body, http.StatusBadRequest)
+			}
+		}
+	})
+
+	t.Run("Gated bodies are redacted", func(t *testing.T) {
+		cases := []struct {
+			name   string
+			claims *auth.Claims
+			open   []string
+		}{
+			{"anonymous", nil, []string{"Public"}},
+			{"patron", google("patron@koen.com"), []string{"Public", "Patrons"}},
+			{"patron in their grace period", google("late@koen.com"), []string{"Public", "Patrons"}},
+			{"patron who hasn't paid yet", google("unpaid@koen.com"), []string{"Public"}},
+			{"holder", wallet, []string{"Public", "Holders"}},
+			{"creator", google("creator@koen.com"), []string{"Public", "Patrons", "Holders"}},
+		}
+		for _, c := range cases {
+			posts := feed(c.claims)
+			if len(posts) != 3 {
+				t.Errorf("%s: got %v, want the 3 published posts", c.name, posts)
+			}
+			for title, post := range posts {
+				open := contains(c.open, title)
+				if open == post.Locked || open != (post.Body != "") {
+					t.Errorf("%s: got %+v, want it locked only if not one of %v", c.name, post, c.open)
+				}
+				if post.Locked && len(post.Attachments) != 0 {
+					t.Errorf("%s: got attachments %v on a locked post", c.name, post.Attachments)
+				}
+			}
+		}
+	})
+
+	t.Run("Scheduled posts are only shown to their creator", func(t *testing.T) {
+		if rr := serve(HandleGetPost(conn, checker, scheduled.ID), "GET", google("patron@koen.com"), ""); rr.Code != http.StatusNotFound {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusNotFound)
+		}
+		if rr := serve(HandleGetPost(conn, checker, scheduled.ID), "GET", google("creator@koen.com"), ""); rr.Code != http.StatusOK {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusOK)
+		}
+		rr := serve(HandleListMyPosts(conn, signer), "GET", google("creator@koen.com"), "")
+		var page struct {
+			Items []Post `json:"items"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		if len(page.Items) != 4 || page.Items[0].ID != scheduled.ID {
+			t.Errorf("got %+v, want all posts, the scheduled one first", page.Items)
+		}
+	})
+
+	t.Run("Attachments are only handed out past the gates", func(t *testing.T) {
+		stranger := common.HexToAddress("0x2222222222222222222222222222222222222222")
+		node.SetCall(nft, append(balanceOf, common.LeftPadBytes(stranger.Bytes(), 32)...), common.LeftPadBytes(nil, 32))
+		attachments := func(id string) http.HandlerFunc {
+			gate := checker.Require(func(r *http.Request) (*gating.Rule, error) {
+				return PostGate(conn, r, id)
+			})
+			return gate(HandleGetPostAttachments(conn, checker, id)).ServeHTTP
+		}
+		cases := []struct {
+			name   string
+			id     string
+			claims *auth.Claims
+			want   int
+		}{
+			{"patron", patrons.ID, google("patron@koen.com"), http.StatusOK},
+			{"patron who hasn't paid yet", patrons.ID, google("unpaid@koen.com"), http.StatusForbidden},
+			{"anonymous on a tier post", patrons.ID, nil, http.StatusForbidden},
+			{"holder", holders.ID, wallet, http.StatusOK},
+			{"wallet without the token", holders.ID, &auth.Claims{WalletClaims: auth.WalletClaims{WalletPublicAddress: stranger.Hex()}},
+				http.StatusForbidden},
+			{"Google sign in on a token post", holders.ID, google("patron@koen.com"), http.StatusUnauthorized},
+			{"creator of a token post", holders.ID, google("creator@koen.com"), http.StatusOK},
+			{"scheduled", scheduled.ID, nil, http.StatusNotFound},
+			{"missing", "bleh", nil, http.StatusNotFound},
+		}
+		for _, c := range cases {
+			if rr := serve(attachments(c.id), "GET", c.claims, ""); rr.Code != c.want {
+				t.Errorf("%s: got %v, want %v: %s", c.name, rr.Code, c.want, rr.Body)
+			}
+		}
+		rr := serve(attachments(patrons.ID), "GET", google("patron@koen.com"), "")
+		var body struct {
+			Attachments []Attachment `json:"attachments"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if len(body.Attachments) != 1 || body.Attachments[0].Name != "a.zip" {
+			t.Errorf("got %+v, want a.zip", body.Attachments)
+		}
+	})
+
+	t.Run("Posts can be edited and deleted by their creator", func(t *testing.T) {
+		update := HandleUpdatePost(conn, public.ID)
+		if rr := serve(update, "PATCH", google("patron@koen.com"), `{"title": "Mine now"}`); rr.Code != http.StatusNotFound {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusNotFound)
+		}
+		rr := serve(update, "PATCH", google("creator@koen.com"), `{"visibility": "tiers"}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		if got := feed(nil)["Public"]; !got.Locked || got.Body != "" {
+			t.Errorf("got %+v, want it locked after going tier-gated", got)
+		}
+
+		if rr := serve(HandleDeletePost(conn, public.ID), "DELETE", google("patron@koen.com"), ""); rr.Code != http.StatusNotFound {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusNotFound)
+		}
+		if rr := serve(HandleDeletePost(conn, public.ID), "DELETE", google("creator@koen.com"), ""); rr.Code != http.StatusNoContent {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusNoContent)
+		}
+		if rr := serve(HandleGetPost(conn, checker, public.ID), "GET", nil, ""); rr.Code != http.StatusNotFound {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("HTTP 404 on the feed of an unknown creator", func(t *testing.T) {
+		if rr := serve(HandleCreatorFeed(conn, checker, signer, "bleh"), "GET", nil, ""); rr.Code != http.StatusNotFound {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+}
@@ -0,0 +1,284 @@
+package db
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+)
+
+// Profile is the part of a user creators fill in themselves
+type Profile struct {
+	Bio             string       `bson:"bio" json:"bio"`
+	AvatarURL       string       `bson:"avatarUrl" json:"avatarUrl"`
+	BannerURL       string       `bson:"bannerUrl" json:"bannerUrl"`
+	Website         string       `bson:"website" json:"website"`
+	SocialLinks     []SocialLink `bson:"socialLinks" json:"socialLinks"`
+	Categories      []string     `bson:"categories" json:"categories"`
+	DisplayCurrency string       `bson:"displayCurrency" json:"displayCurrency"`
+	Visibility      Visibility   `bson:"visibility" json:"visibility"`
+	// Set when the avatar or banner was uploaded rather than linked
+	Avatar *Image `bson:"avatar" json:"avatar,omitempty"`
+	Banner *Image `bson:"banner" json:"banner,omitempty"`
+}
+
+// Image is an uploaded image, resized into a few renditions
+type Image struct {
+	// Rendition URLs by size name
+	URLs map[string]string `bson:"urls" json:"urls"`
+	// Blob keys of the renditions, so they can be deleted when replaced
+	Keys []string `bson:"keys" json:"-"`
+}
+
+type SocialLink struct {
+	Platform string `bson:"platform" json:"platform"`
+	URL      string `bson:"url" json:"url"`
+}
+
+// The zero value shows everything, which is what users had before these settings existed
+type Visibility struct {
+	// Unlisted pages can be visited by link but don't show up in search
+	Unlisted        bool `bson:"unlisted" json:"unlisted"`
+	HideSupporters  bool `bson:"hideSupporters" json:"hideSupporters"`
+	HideSocialLinks bool `bson:"hideSocialLinks" json:"hideSocialLinks"`
+}
+
+const (
+	MaxNameLength   = 50
+	MaxBioLength    = 500
+	MaxURLLength    = 2048
+	MaxSocialLinks  = 10
+	MaxCategories   = 3
+	DefaultCurrency = "USD"
+)
+
+var SocialPlatforms = []string{"twitter", "instagram", "youtube", "tiktok", "twitch", "discord", "github", "facebook", "linkedin", "other"}
+
+var Categories = []string{"art", "music", "writing", "video", "podcasts", "gaming", "education",
+	"software", "photography", "comics", "crypto", "science", "other"}
+
+// Currencies we can show prices in
+var Currencies = []string{"USD", "EUR", "GBP", "INR", "JPY", "CAD", "AUD", "BRL", "CHF", "KRW"}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Versions are kept to the millisecond, that's all Mongo stores
+func newVersion() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// Version for an update of prev, always after it even within the same millisecond
+func nextVersion(prev time.Time) time.Time {
+	if v := newVersion(); v.After(prev) {
+		return v
+	}
+	return prev.Add(time.Millisecond)
+}
+
+func validURL(s string) bool {
+	if len(s) > MaxURLLength {
+		return false
+	}
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// FieldErrors maps JSON field names to what's wrong with them
+type FieldErrors map[string]string
+
+// Validate checks the name and profile of a user. Empty values are always fine
+func (u User) Validate() FieldErrors {
+	errs := FieldErrors{}
+	if utf8.RuneCountInString(u.Name) > MaxNameLength {
+		errs["name"] = "name is too long"
+	}
+	if utf8.RuneCountInString(u.Bio) > MaxBioLength {
+		errs["bio"] = "bio is too long"
+	}
+	urls := map[string]string{"website": u.Website}
+	// Uploaded images can live on a relative URL, only pasted ones are checked
+	if u.Avatar == nil {
+		urls["avatarUrl"] = u.AvatarURL
+	}
+	if u.Banner == nil {
+		urls["bannerUrl"] = u.BannerURL
+	}
+	for field, value := range urls {
+		if value != "" && !validURL(value) {
+			errs[field] = "must be an http(s) URL"
+		}
+	}
+
+	if len(u.SocialLinks) > MaxSocialLinks {
+		errs["socialLinks"] = "too many social links"
+	}
+	for _, link := range u.SocialLinks {
+		if !contains(SocialPlatforms, link.Platform) {
+			errs["socialLinks"] = "unknown platform " + link.Platform
+		} else if !validURL(link.URL) {
+			errs["socialLinks"] = link.Platform + " link must be an http(s) URL"
+		}
+	}
+
+	if len(u.Categories) > MaxCategories {
+		errs["categories"] = "too many categories"
+	}
+	seen := map[string]bool{}
+	for _, c := range u.Categories {
+		if !contains(Categories, c) {
+			errs["categories"] = "unknown category " + c
+		} else if seen[c] {
+			errs["categories"] = "duplicate category " + c
+		}
+		seen[c] = true
+	}
+
+	if u.DisplayCurrency != "" && !contains(Currencies, u.DisplayCurrency) {
+		errs["displayCurrency"] = "unsupported currency"
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Fields PATCH /users/me accepts. Anything left out stays as it is
+type profilePatch struct {
+	// Sent along by clients that authenticate through the body
+	IdToken string `json:"idToken"`
+	// Required, the updatedAt of the user this patch was made against
+	UpdatedAt       *time.Time    `json:"updatedAt"`
+	Name            *string       `json:"name"`
+	Bio             *string       `json:"bio"`
+	AvatarURL       *string       `json:"avatarUrl"`
+	BannerURL       *string       `json:"bannerUrl"`
+	Website         *string       `json:"website"`
+	SocialLinks     *[]SocialLink `json:"socialLinks"`
+	Categories      *[]string     `json:"categories"`
+	DisplayCurrency *string       `json:"displayCurrency"`
+	Visibility      *struct {
+		Unlisted        *bool `json:"unlisted"`
+		HideSupporters  *bool `json:"hideSupporters"`
+		HideSocialLinks *bool `json:"hideSocialLinks"`
+	} `json:"visibility"`
+}
+
+func setString(field *string, value *string) {
+	if value != nil {
+		*field = strings.TrimSpace(*value)
+	}
+}
+
+func setBool(field *bool, value *bool) {
+	if value != nil {
+		*field = *value
+	}
+}
+
+// Pasting a different URL replaces an uploaded image. Its files stay in blob storage
+func setImageURL(field *string, image **Image, value *string) {
+	if value != nil && strings.TrimSpace(*value) != *field {
+		*image = nil
+	}
+	setString(field, value)
+}
+
+func (p profilePatch) apply(u *User) {
+	setString(&u.Name, p.Name)
+	setString(&u.Bio, p.Bio)
+	setImageURL(&u.AvatarURL, &u.Avatar, p.AvatarURL)
+	setImageURL(&u.BannerURL, &u.Banner, p.BannerURL)
+	setString(&u.Website, p.Website)
+	if p.DisplayCurrency != nil {
+		u.DisplayCurrency = strings.ToUpper(strings.TrimSpace(*p.DisplayCurrency))
+	}
+	if p.SocialLinks != nil {
+		u.SocialLinks = *p.SocialLinks
+		for i := range u.SocialLinks {
+			u.SocialLinks[i].Platform = strings.ToLower(u.SocialLinks[i].Platform)
+		}
+	}
+	if p.Categories != nil {
+		u.Categories = *p.Categories
+		for i := range u.Categories {
+			u.Categories[i] = strings.ToLower(u.Categories[i])
+		}
+	}
+	if v := p.Visibility; v != nil {
+		setBool(&u.Visibility.Unlisted, v.Unlisted)
+		setBool(&u.Visibility.HideSupporters, v.HideSupporters)
+		setBool(&u.Visibility.HideSocialLinks, v.HideSocialLinks)
+	}
+}
+
+// HandleUpdateProfile applies a partial update to the signed in user's profile.
+// Page names are changed through HandleChangePageName, identifiers can't be changed at all
+func HandleUpdateProfile(db DBConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		patch := profilePatch{}
+		if err := utils.DecodeJSON(r.Body, &patch, false); err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		if patch.UpdatedAt == nil {
+			utils.RespondWithJSON(map[string]FieldErrors{
+				"errors": {"updatedAt": "updatedAt of the profile being edited is required"},
+			}, http.StatusBadRequest)(w, r)
+			return
+		}
+
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		version := *patch.UpdatedAt
+		if !user.UpdatedAt.Equal(version) {
+			respondWithStaleUser(user).ServeHTTP(w, r)
+			return
+		}
+
+		patch.apply(&user)
+		if errs := user.Validate(); errs != nil {
+			utils.RespondWithJSON(map[string]FieldErrors{"errors": errs}, http.StatusBadRequest)(w, r)
+			return
+		}
+
+		user.UpdatedAt = nextVersion(version)
+		err := db.Users().Update(r.Context(), user, version)
+		if errors.Is(err, ErrVersionMismatch) {
+			// Lost a race with another update, send the winner
+			current, err := db.Users().GetByID(r.Context(), user.ID)
+			if err != nil {
+				respondWithDBError(err, "Couldn't update user!").ServeHTTP(w, r)
+				return
+			}
+			respondWithStaleUser(current).ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			respondWithDBError(err, "Couldn't update user!").ServeHTTP(w, r)
+			return
+		}
+		utils.RespondWithJSON(user, http.StatusOK)(w, r)
+	}
+}
+
+// Clients get the current user back, so they can reapply their changes on top of it
+func respondWithStaleUser(current User) http.HandlerFunc {
+	return utils.RespondWithJSON(map[string]interface{}{
+		"error": ErrVersionMismatch.Error(),
+		"field": "updatedAt",
+		"user":  current,
+	}, http.StatusConflict)
+}
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+)
+
+func TestProfileValidation(t *testing.T) {
+	cases := []struct {
+		profile Profile
+		field   string
+	}{
+		{Profile{Bio: strings.Repeat("a", MaxBioLength+1)}, "bio"},
+		{Profile{AvatarURL: "javascript:alert(1)"}, "avatarUrl"},
+		{Profile{Website: "koen.com"}, "website"},
+		{Profile{SocialLinks: []SocialLink{{Platform: "myspace", URL: "https://myspace.com/koen"}}}, "socialLinks"},
+		{Profile{SocialLinks: []SocialLink{{Platform: "twitter", URL: "@koen"}}}, "socialLinks"},
+		{Profile{Categories: []string{"art", "music", "video", "gaming"}}, "categories"},
+		{Profile{Categories: []string{"art", "art"}}, "categories"},
+		{Profile{Categories: []string{"bleh"}}, "categories"},
+		{Profile{DisplayCurrency: "DOGE"}, "displayCurrency"},
+	}
+	for _, c := range cases {
+		errs := User{Profile: c.profile}.Validate()
+		if _, ok := errs[c.field]; !ok || len(errs) != 1 {
+			t.Errorf("got %v for %+v, want an error on %s", errs, c.profile, c.field)
+		}
+	}
+
+	valid := Profile{
+		Bio:             "Makes things",
+		AvatarURL:       "https://cdn.koen.com/a.png",
+		SocialLinks:     []SocialLink{{Platform: "github", URL: "https://github.com/koen"}},
+		Categories:      []string{"software"},
+		DisplayCurrency: "INR",
+	}
+	if errs := (User{Profile: valid}).Validate(); errs != nil {
+		t.Errorf("got %v, want no errors", errs)
+	}
+}
+
+func TestHandleUpdateProfile(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	version := newVersion()
+	user := &User{
+		Email:     "test@koen.com",
+		PageName:  "koen-san",
+		Profile:   Profile{Bio: "Makes things", Categories: []string{"art"}},
+		UpdatedAt: version,
+	}
+	if err := conn.Users().Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PATCH", "/users/me", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), "userData", auth.Claims{
+			GoogleClaims: auth.GoogleClaims{Email: "test@koen.com"},
+		}))
+		rr := httptest.NewRecorder()
+		HandleUpdateProfile(conn).ServeHTTP(rr, req)
+		return rr
+	}
+	at := func(v time.Time) string {
+		dat, _ := json.Marshal(v)
+		return string(dat)
+	}
+
+	t.Run("Partial update keeps other fields", func(t *testing.T) {
+		rr := patch(`{"updatedAt": ` + at(version) + `, "website": "https://koen.com", "displayCurrency": "eur",
+			"visibility": {"unlisted": true}}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		got, _ := conn.Users().GetByID(context.Background(), user.ID)
+		if got.Website != "https://koen.com" || got.DisplayCurrency != "EUR" || !got.Visibility.Unlisted {
+			t.Errorf("got %+v, want the patch applied", got.Profile)
+		}
+		if got.Bio != "Makes things" || len(got.Categories) != 1 {
+			t.Errorf("got %+v, want other fields kept", got.Profile)
+		}
+		if !got.UpdatedAt.After(version) {
+			t.Errorf("got updatedAt %v, want it bumped", got.UpdatedAt)
+		}
+	})
+
+	t.Run("HTTP 409 on an outdated version", func(t *testing.T) {
+		rr := patch(`{"updatedAt": ` + at(version) + `, "bio": "Overwritten"}`)
+		if rr.Code != http.StatusConflict {
+			t.Fatalf("got %v, want %v", rr.Code, http.StatusConflict)
+		}
+		var body struct {
+			User User `json:"user"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if body.User.Website != "https://koen.com" {
+			t.Errorf("got %+v, want the current user", body.User)
+		}
+	})
+
+	t.Run("HTTP 400 with errors per field", func(t *testing.T) {
+		current, _ := conn.Users().GetByID(context.Background(), user.ID)
+		rr := patch(`{"updatedAt": ` + at(current.UpdatedAt) + `, "bio": "` + strings.Repeat("a", 600) + `", "categories": ["bleh"]}`)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+		var body struct {
+			Errors FieldErrors `json:"errors"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if body.Errors["bio"] == "" || body.Errors["categories"] == "" {
+			t.Errorf("got %v, want errors on bio and categories", body.Errors)
+		}
+	})
+
+	t.Run("HTTP 400 without a version", func(t *testing.T) {
+		if rr := patch(`{"bio": "No version"}`); rr.Code != http.StatusBadRequest {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("HTTP 400 on fields that can't be patched", func(t *testing.T) {
+		if rr := patch(`{"updatedAt": ` + at(version) + `, "email": "other@koen.com"}`); rr.Code != http.StatusBadRequest {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+}
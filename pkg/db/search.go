@@ -0,0 +1,350 @@
+package db
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/cryptopatron/koen-backend/pkg/pagination"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+)
+
+// How search results can be sorted
+const (
+	SortRelevance  = "relevance"
+	SortSupporters = "supporters"
+	SortRecent     = "recent"
+)
+
+const (
+	// Deep pages are expensive to fetch and nobody reads them
+	MaxSearchOffset = 1000
+	MaxSearchLength = 100
+	maxSearchTerms  = 8
+	// Past this many patterns a term is split into pieces instead
+	maxTermPatterns = 64
+	// Backends that rank in memory look at no more than this many candidates, the first
+	// ones by supporters or by date for recent. Enough for every page up to MaxSearchOffset
+	maxSearchCandidates = 2000
+)
+
+// SearchQuery describes a search over listed creators
+type SearchQuery struct {
+	// Free text, matched against name, pageName, bio and categories. Empty matches everyone
+	Text string
+	// Only creators in any of these categories
+	Categories []string
+	// One of the Sort constants, relevance falls back to supporters without any text
+	Sort   string
+	Offset int
+	Limit  int
+}
+
+// Lowercased words of a search, without duplicates
+func searchTerms(text string) []string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if !contains(terms, word) && len(terms) < maxSearchTerms {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// Creators show up in search once they have a page, unless they asked not to
+func listed(u User) bool {
+	return u.PageName != "" && u.DeletedAt.IsZero() && !u.Visibility.Unlisted
+}
+
+func inCategories(u User, categories []string) bool {
+	if len(categories) == 0 {
+		return true
+	}
+	for _, c := range u.Categories {
+		if contains(categories, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Edit distance counting swapped letters as one edit, giving up once it's past max
+func editDistance(a, b []rune, max int) int {
+	if d := len(a) - len(b); d > max || -d > max {
+		return max + 1
+	}
+	var prev2 []int
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		best := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && prev2[j-2]+1 < cur[j] {
+				cur[j] = prev2[j-2] + 1
+			}
+			if cur[j] < best {
+				best = cur[j]
+			}
+		}
+		if best > max {
+			return max + 1
+		}
+		prev2, prev = prev, cur
+	}
+	return prev[len(b)]
+}
+
+// How many typos a term can have, longer words get more
+func typoAllowance(term string) int {
+	if n := utf8.RuneCountInString(term); n >= 8 {
+		return 2
+	} else if n >= 4 {
+		return 1
+	}
+	return 0
+}
+
+// How well a search term matches a word: exactly, as a prefix while typing,
+// or with a typo or two in longer words
+func termScore(term, word string) float64 {
+	switch {
+	case term == word:
+		return 1
+	case strings.HasPrefix(word, term):
+		return 0.75
+	}
+	if allowed := typoAllowance(term); allowed > 0 && editDistance([]rune(term), []rune(word), allowed) <= allowed {
+		return 0.5
+	}
+	return 0
+}
+
+// Backends that can't score matches themselves narrow down candidates with these
+// and leave the rest to rankUsers. Anything termScore matches contains all the pieces
+// of at least one pattern, in order. A typo changes at most two letters in a row, so
+// every pattern leaves out a pair for each typo allowed. Long terms would have too
+// many of those, they're cut into one more piece than their typos can break instead
+// and any piece on its own is a pattern. That lets more through, but never too little
+func termPatterns(term string) [][]string {
+	r := []rune(term)
+	n := len(r)
+	allowed := typoAllowance(term)
+	pieces := func(cuts ...int) []string {
+		var p []string
+		start := 0
+		for _, cut := range cuts {
+			if cut > start {
+				p = append(p, string(r[start:cut]))
+			}
+			start = cut + 2
+		}
+		if start < n {
+			p = append(p, string(r[start:]))
+		}
+		return p
+	}
+	var patterns [][]string
+	switch allowed {
+	case 0:
+		patterns = append(patterns, []string{term})
+	case 1:
+		for i := 0; i+2 <= n; i++ {
+			patterns = append(patterns, pieces(i))
+		}
+	default:
+		for i := 0; i+4 <= n; i++ {
+			for j := i + 2; j+2 <= n; j++ {
+				patterns = append(patterns, pieces(i, j))
+			}
+		}
+	}
+	if len(patterns) > maxTermPatterns {
+		patterns = nil
+		for i, cuts := 0, 2*allowed+1; i < cuts; i++ {
+			patterns = append(patterns, []string{string(r[i*n/cuts : (i+1)*n/cuts])})
+		}
+	}
+	return patterns
+}
+
+// Scores how well u matches all of terms, false if any of them doesn't match at all
+func searchScore(u User, terms []string) (float64, bool) {
+	fields := []struct {
+		weight float64
+		words  []string
+	}{
+		{3, append(searchTerms(u.PageName), strings.ToLower(u.PageName))},
+		{3, searchTerms(u.Name)},
+		{2, u.Categories},
+		{1, strings.Fields(strings.ToLower(u.Bio))},
+	}
+	total := 0.0
+	for _, term := range terms {
+		best := 0.0
+		for _, f := range fields {
+			for _, word := range f.words {
+				word = strings.TrimFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+				if s := f.weight * termScore(term, word); s > best {
+					best = s
+				}
+			}
+		}
+		if best == 0 {
+			return 0, false
+		}
+		total += best
+	}
+	return total, true
+}
+
+// Sorts by supporters, most recent first for ties
+func bySupporters(a, b User) bool {
+	if a.SupporterCount != b.SupporterCount {
+		return a.SupporterCount > b.SupporterCount
+	}
+	return b.key().Before(a.key())
+}
+
+// Matches and sorts users held in memory, for backends that can't do it themselves.
+// Returns a page of up to q.Limit+1 users
+func rankUsers(users []User, q SearchQuery) []User {
+	terms := searchTerms(q.Text)
+	var matches []User
+	scores := map[string]float64{}
+	for _, u := range users {
+		if !listed(u) || !inCategories(u, q.Categories) {
+			continue
+		}
+		score, ok := searchScore(u, terms)
+		if !ok {
+			continue
+		}
+		scores[u.ID] = score
+		matches = append(matches, u)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		switch {
+		case q.Sort == SortRecent:
+			return b.key().Before(a.key())
+		case q.Sort == SortRelevance && scores[a.ID] != scores[b.ID]:
+			return scores[a.ID] > scores[b.ID]
+		}
+		return bySupporters(a, b)
+	})
+
+	if q.Offset >= len(matches) {
+		return []User{}
+	}
+	matches = matches[q.Offset:]
+	if len(matches) > q.Limit+1 {
+		matches = matches[:q.Limit+1]
+	}
+	return matches
+}
+
+// What anyone can see of a creator. Emails, wallets and the rest of what's only
+// for the creator themselves stay out, as does anything they chose to hide
+type publicCreator struct {
+	Name     string `json:"name"`
+	PageName string `json:"pageName"`
+	Profile
+	SupporterCount int       `json:"supporterCount"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+func newPublicCreator(u User) publicCreator {
+	c := publicCreator{Name: u.Name, PageName: u.PageName, Profile: u.Profile, SupporterCount: u.SupporterCount, CreatedAt: u.CreatedAt}
+	if u.Visibility.HideSocialLinks {
+		c.SocialLinks = nil
+	}
+	if u.Visibility.HideSupporters {
+		c.SupporterCount = 0
+	}
+	return c
+}
+
+// Reads a search from the query string: q, category (repeatable), sort, limit and cursor
+func searchFromRequest(r *http.Request, signer pagination.Signer) (SearchQuery, error) {
+	params, err := signer.FromRequest(r)
+	if err != nil {
+		return SearchQuery{}, err
+	}
+	query := r.URL.Query()
+	q := SearchQuery{Text: strings.TrimSpace(query.Get("q")), Sort: query.Get("sort"), Limit: params.Limit}
+	if utf8.RuneCountInString(q.Text) > MaxSearchLength {
+		return SearchQuery{}, errors.New("search is too long")
+	}
+	if q.Sort == "" {
+		q.Sort = SortRelevance
+	}
+	if !contains([]string{SortRelevance, SortSupporters, SortRecent}, q.Sort) {
+		return SearchQuery{}, errors.New("sort must be relevance, supporters or recent")
+	}
+	for _, c := range query["category"] {
+		c = strings.ToLower(c)
+		if !contains(Categories, c) {
+			return SearchQuery{}, errors.New("unknown category " + c)
+		}
+		q.Categories = append(q.Categories, c)
+	}
+	// Results have no stable key to continue from, cursors just hold an offset
+	if params.After != nil {
+		if q.Offset, err = strconv.Atoi(params.After.ID); err != nil {
+			return SearchQuery{}, pagination.ErrInvalidCursor
+		}
+	}
+	return q, nil
+}
+
+// HandleSearchCreators searches listed creators, returning a page of public profiles
+func HandleSearchCreators(db DBConn, signer pagination.Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := searchFromRequest(r, signer)
+		if err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		users, err := db.Users().Search(r.Context(), q)
+		if err != nil {
+			respondWithDBError(err, "Couldn't search users!").ServeHTTP(w, r)
+			return
+		}
+
+		var next *pagination.Key
+		if len(users) > q.Limit {
+			users = users[:q.Limit]
+			if offset := q.Offset + q.Limit; offset < MaxSearchOffset {
+				next = &pagination.Key{ID: strconv.Itoa(offset)}
+			}
+		}
+		creators := make([]publicCreator, len(users))
+		for i, u := range users {
+			creators[i] = newPublicCreator(u)
+		}
+		signer.Respond(creators, next).ServeHTTP(w, r)
+	}
+}
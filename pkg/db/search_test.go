@@ -0,0 +1,192 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/pagination"
+)
+
+func TestSearchTerms(t *testing.T) {
+	got := searchTerms("  Koen-San, koen SAN!! ")
+	if len(got) != 2 || got[0] != "koen" || got[1] != "san" {
+		t.Errorf("got %v, want [koen san]", got)
+	}
+	for term, want := range map[string]float64{"koen": 1, "ko": 0.75, "keon": 0.5, "kn": 0, "photgrapher": 0.5, "potgrapher": 0.5} {
+		word := "koen"
+		if len(term) > 6 {
+			word = "photographer"
+		}
+		if got := termScore(term, word); got != want {
+			t.Errorf("got %v for %s, want %v", got, term, want)
+		}
+	}
+}
+
+func TestTermPatterns(t *testing.T) {
+	like := func(word string, pattern []string) bool {
+		for _, p := range pattern {
+			i := strings.Index(word, p)
+			if i < 0 {
+				return false
+			}
+			word = word[i+len(p):]
+		}
+		return true
+	}
+	// Every word within reach of a typo or two, made of a few letters so there are plenty
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = "abc"[rng.Intn(3)]
+		}
+		return string(b)
+	}
+	for i := 0; i < 20000; i++ {
+		term, word := random(3+rng.Intn(16)), random(1+rng.Intn(20))
+		if termScore(term, word) == 0 {
+			continue
+		}
+		matched := false
+		for _, p := range termPatterns(term) {
+			matched = matched || like(word, p)
+		}
+		if !matched {
+			t.Fatalf("%s matches %s but none of %v do", term, word, termPatterns(term))
+		}
+	}
+	if got := termPatterns(strings.Repeat("a", 20)); len(got) != 5 {
+		t.Errorf("got %d patterns, want long terms cut into 5 pieces", len(got))
+	}
+}
+
+func TestHandleSearchCreators(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	base := time.Now().UTC()
+	creators := []User{
+		{PageName: "koen-san", Name: "Koen San", SupporterCount: 3,
+			Profile: Profile{Bio: "Painter", Categories: []string{"art"}, Visibility: Visibility{HideSupporters: true}}},
+		{PageName: "lens", Name: "Lena", SupporterCount: 50,
+			Profile: Profile{Bio: "Landscape photographer", Categories: []string{"photography"},
+				SocialLinks: []SocialLink{{Platform: "github", URL: "https://github.com/lens"}}, Visibility: Visibility{HideSocialLinks: true}}},
+		{PageName: "koenig", Name: "Koenig", SupporterCount: 7, Profile: Profile{Categories: []string{"music"}}},
+		{PageName: "hidden-koen", Name: "Koen", Profile: Profile{Visibility: Visibility{Unlisted: true}}},
+	}
+	creators[0].Email = "koen@koen.com"
+	creators[0].MetaMaskWalletPublicAddress = "0x1111111111111111111111111111111111111111"
+	for i := range creators {
+		creators[i].CreatedAt = base.Add(time.Duration(i) * time.Minute)
+		if err := conn.Users().Create(context.Background(), &creators[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signer := pagination.Signer{Secret: []byte("koen"), DefaultLimit: 10, MaxLimit: 50}
+
+	search := func(query url.Values) (*httptest.ResponseRecorder, []User, string) {
+		req, _ := http.NewRequest("GET", "/users/search?"+query.Encode(), nil)
+		rr := httptest.NewRecorder()
+		HandleSearchCreators(conn, signer).ServeHTTP(rr, req)
+		var page struct {
+			Items      []User `json:"items"`
+			NextCursor string `json:"next_cursor"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		return rr, page.Items, page.NextCursor
+	}
+	pageNames := func(users []User) []string {
+		names := []string{}
+		for _, u := range users {
+			names = append(names, u.PageName)
+		}
+		return names
+	}
+
+	cases := []struct {
+		name  string
+		query url.Values
+		want  []string
+	}{
+		{"Exact matches rank above prefixes", url.Values{"q": {"koen"}}, []string{"koen-san", "koenig"}},
+		{"Typos still match", url.Values{"q": {"photgrapher"}}, []string{"lens"}},
+		{"Every term has to match", url.Values{"q": {"koen painter"}}, []string{"koen-san"}},
+		{"Categories filter", url.Values{"q": {"koe"}, "category": {"Music", "video"}}, []string{"koenig"}},
+		{"Everyone listed without a search", url.Values{"sort": {"supporters"}}, []string{"lens", "koenig", "koen-san"}},
+		{"Newest first", url.Values{"sort": {"recent"}}, []string{"koenig", "lens", "koen-san"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rr, users, _ := search(c.query)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+			if got := pageNames(users); fmt.Sprint(got) != fmt.Sprint(c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+
+	t.Run("Hidden fields are left out", func(t *testing.T) {
+		_, all, _ := search(url.Values{})
+		for _, u := range all {
+			if u.PageName == "koen-san" && u.SupporterCount != 0 {
+				t.Errorf("got %d supporters, want them hidden", u.SupporterCount)
+			}
+			if u.PageName == "lens" && u.SocialLinks != nil {
+				t.Errorf("got %v, want social links hidden", u.SocialLinks)
+			}
+		}
+	})
+
+	t.Run("Emails and wallets are left out", func(t *testing.T) {
+		rr, _, _ := search(url.Values{"q": {"koen"}})
+		var page struct {
+			Items []map[string]interface{} `json:"items"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		if len(page.Items) == 0 {
+			t.Fatalf("got %s, want creators", rr.Body)
+		}
+		for _, item := range page.Items {
+			for _, field := range []string{"email", "metaMaskWalletPublicAddress", "generatedMaticWalletPublicAddress", "updatedAt"} {
+				if _, ok := item[field]; ok {
+					t.Errorf("response leaks %s: %v", field, item)
+				}
+			}
+		}
+	})
+
+	t.Run("Cursors continue where the page ended", func(t *testing.T) {
+		_, first, cursor := search(url.Values{"sort": {"supporters"}, "limit": {"2"}})
+		if len(first) != 2 || cursor == "" {
+			t.Fatalf("got %v and cursor %q, want 2 creators and a cursor", pageNames(first), cursor)
+		}
+		_, second, cursor := search(url.Values{"sort": {"supporters"}, "limit": {"2"}, "cursor": {cursor}})
+		if got := pageNames(second); len(got) != 1 || got[0] != "koen-san" || cursor != "" {
+			t.Errorf("got %v and cursor %q, want [koen-san] and no cursor", got, cursor)
+		}
+	})
+
+	t.Run("HTTP 400 on bad parameters", func(t *testing.T) {
+		for _, query := range []url.Values{
+			{"sort": {"popular"}},
+			{"category": {"bleh"}},
+			{"cursor": {"bleh"}},
+			{"q": {string(make([]byte, MaxSearchLength+1))}},
+		} {
+			if rr, _, _ := search(query); rr.Code != http.StatusBadRequest {
+				t.Errorf("got %v for %v, want %v", rr.Code, query, http.StatusBadRequest)
+			}
+		}
+	})
+}
@@ -0,0 +1,1393 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/pagination"
+
+	// Drivers we know how to talk to
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Supported SQL drivers, as registered with database/sql
+const (
+	SQLite   = "sqlite3"
+	Postgres = "postgres"
+)
+
+// SQLInstance stores everything in a relational DB through database/sql.
+// SQLite is meant for local development, PostgreSQL for self-hosted production setups
+type SQLInstance struct {
+	db     *sql.DB
+	Driver string
+	DSN    string
+	// Same meaning as on MongoInstance
+	ConnectTimeout time.Duration
+	Timeout        time.Duration
+}
+
+func (s *SQLInstance) Open() {
+	if s.Driver != SQLite && s.Driver != Postgres {
+		panic(fmt.Sprintf("unsupported SQL driver %q", s.Driver))
+	}
+	db, err := sql.Open(s.Driver, s.DSN)
+	if err != nil {
+		panic(err)
+	}
+	if s.Driver == SQLite {
+		// SQLite only allows a single writer, and every connection to
+		// ":memory:" would get its own empty DB
+		db.SetMaxOpenConns(1)
+	}
+	s.db = db
+
+	ctx, cancel := withTimeout(context.Background(), s.ConnectTimeout)
+	defer cancel()
+	if err := s.db.PingContext(ctx); err != nil {
+		panic(err)
+	}
+	if err := migrateSQL(ctx, s.db, s.Driver); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Successfully connected to %s\n", s.Driver)
+}
+
+func (s *SQLInstance) Close() {
+	if err := s.db.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func (s *SQLInstance) Users() UserRepository {
+	return &sqlUsers{db: s.db, driver: s.Driver, timeout: s.Timeout}
+}
+
+func (s *SQLInstance) Audit() AuditRepository {
+	return &sqlAudit{db: s.db, driver: s.Driver, timeout: s.Timeout}
+}
+
+func (s *SQLInstance) PageNames() PageNameRepository {
+	return &sqlPageNames{db: s.db, driver: s.Driver, timeout: s.Timeout}
+}
+
+func (s *SQLInstance) Tiers() TierRepository {
+	return &sqlTiers{db: s.db, driver: s.Driver, timeout: s.Timeout}
+}
+
+func (s *SQLInstance) Payments() PaymentRepository {
+	return &sqlPayments{db: s.db, driver: s.Driver, timeout: s.Timeout}
+}
+
+func (s *SQLInstance) Checkpoints() CheckpointRepository {
+	return &sqlCheckpoints{db: s.db, driver: s.Driver, timeout: s.Timeout}
+}
+
+func (s *SQLInstance) Subscriptions() SubscriptionRepository {
+	return &sqlSubscriptions{db: s.db, driver: s.Driver, timeout: s.Timeout}
+}
+
+func (s *SQLInstance) Posts() PostRepository {
+	return &sqlPosts{db: s.db, driver: s.Driver, timeout: s.Timeout}
+}
+
+func (s *SQLInstance) Withdrawals() WithdrawalRepository {
+	return &sqlWithdrawals{db: s.db, driver: s.Driver, timeout: s.Timeout}
+}
+
+func (s *SQLInstance) Ledger() LedgerRepository {
+	return &sqlLedger{db: s.db, driver: s.Driver, timeout: s.Timeout}
+}
+
+type sqlTxKey struct{}
+
+// What repositories need from either *sql.DB or *sql.Tx
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Repositories go through the transaction in ctx if there is one
+func querier(ctx context.Context, db *sql.DB) sqlQuerier {
+	if tx, ok := ctx.Value(sqlTxKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return db
+}
+
+func (s *SQLInstance) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return inTransaction(ctx, s.db, fn)
+}
+
+func inTransaction(ctx context.Context, db *sql.DB, fn func(ctx context.Context) error) error {
+	// Already part of a transaction
+	if _, ok := ctx.Value(sqlTxKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(context.WithValue(ctx, sqlTxKey{}, tx)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Queries are written with '?' placeholders, Postgres wants $1, $2...
+func rebind(driver, query string) string {
+	if driver != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Name of the unique index on a users column. Like with Mongo, constraint
+// errors only mention the index, so it has to map back to the field
+func sqlIndexName(column string) string {
+	return "users_" + column + "_unique"
+}
+
+// Turns unique constraint violations from either driver into a *ConflictError
+func conflictFromSQL(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	// SQLite: "UNIQUE constraint failed: ..."
+	// Postgres: "pq: duplicate key value violates unique constraint ..."
+	if !strings.Contains(msg, "UNIQUE constraint failed") && !strings.Contains(msg, "duplicate key value") {
+		return err
+	}
+	for _, c := range userColumns {
+		if strings.Contains(msg, sqlIndexName(c.column)) {
+			return &ConflictError{Field: c.field}
+		}
+	}
+	return &ConflictError{}
+}
+
+// Maps unique User fields to their column
+var userColumns = []struct{ field, column string }{
+	{"pageName", "page_name"},
+	{"email", "email"},
+	{"metaMaskWalletPublicAddress", "metamask_wallet_address"},
+	{"generatedMaticWalletPublicAddress", "generated_matic_wallet_address"},
+}
+
+func userColumn(field string) string {
+	for _, c := range userColumns {
+		if c.field == field {
+			return c.column
+		}
+	}
+	panic("no column for user field " + field)
+}
+
+type sqlUsers struct {
+	db      *sql.DB
+	driver  string
+	timeout time.Duration
+}
+
+func (s *sqlUsers) Create(ctx context.Context, user *User) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+
+	profile, err := profileValues(user.Profile)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO users (email, name, page_name, generated_matic_wallet_address, metamask_wallet_address, created_at,
+		bio, avatar_url, banner_url, website, display_currency, social_links, categories, visibility, avatar_images, banner_images,
+		updated_at, supporter_count, wallet_index)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	args := []interface{}{user.Email, user.Name, user.PageName, user.GeneratedMaticWalletPublicAddress,
+		user.MetaMaskWalletPublicAddress, user.CreatedAt.UTC()}
+	var walletIndex sql.NullInt64
+	if user.WalletIndex != nil {
+		walletIndex = sql.NullInt64{Int64: int64(*user.WalletIndex), Valid: true}
+	}
+	args = append(append(args, profile...), user.UpdatedAt.UTC(), user.SupporterCount, walletIndex)
+
+	id, err := insertReturningID(ctx, querier(ctx, s.db), s.driver, query, args...)
+	if err != nil {
+		return timeoutError(ctx, conflictFromSQL(err))
+	}
+	user.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+// Runs an INSERT and returns the ID of the new row
+func insertReturningID(ctx context.Context, q sqlQuerier, driver, query string, args ...interface{}) (int64, error) {
+	if driver == Postgres {
+		// lib/pq doesn't support LastInsertId
+		var id int64
+		err := q.QueryRowContext(ctx, rebind(driver, query+" RETURNING id"), args...).Scan(&id)
+		return id, err
+	}
+	res, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Runs a statement on the user with the given ID, its last placeholder is the ID
+func (s *sqlUsers) execByID(ctx context.Context, id, query string, args ...interface{}) error {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return ErrNotFound
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	res, err := querier(ctx, s.db).ExecContext(ctx, rebind(s.driver, query), append(args, n)...)
+	if err != nil {
+		return timeoutError(ctx, conflictFromSQL(err))
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlUsers) UpdatePageName(ctx context.Context, id, pageName string) error {
+	return s.execByID(ctx, id, "UPDATE users SET page_name = ? WHERE id = ?", pageName)
+}
+
+func (s *sqlUsers) Update(ctx context.Context, user User, version time.Time) error {
+	profile, err := profileValues(user.Profile)
+	if err != nil {
+		return err
+	}
+	args := append([]interface{}{user.Name}, profile...)
+	args = append(args, user.UpdatedAt.UTC(), version.UTC())
+	err = s.execByID(ctx, user.ID, `UPDATE users SET name = ?, bio = ?, avatar_url = ?, banner_url = ?, website = ?,
+		display_currency = ?, social_links = ?, categories = ?, visibility = ?, avatar_images = ?, banner_images = ?,
+		updated_at = ? WHERE updated_at = ? AND id = ?`, args...)
+	if errors.Is(err, ErrNotFound) {
+		// Either it's gone or the version moved on
+		if _, err := s.GetByID(ctx, user.ID); err != nil {
+			return err
+		}
+		return ErrVersionMismatch
+	}
+	return err
+}
+
+func (s *sqlUsers) SetSupporterCount(ctx context.Context, id string, n int) error {
+	return s.execByID(ctx, id, "UPDATE users SET supporter_count = ? WHERE id = ?", n)
+}
+
+func (s *sqlUsers) SoftDelete(ctx context.Context, id string, at time.Time) error {
+	return s.execByID(ctx, id, "UPDATE users SET deleted_at = ? WHERE id = ?", at.UTC())
+}
+
+func (s *sqlUsers) Restore(ctx context.Context, id string) error {
+	return s.execByID(ctx, id, "UPDATE users SET deleted_at = NULL WHERE id = ?")
+}
+
+// Bumps the counter and reads it back in a transaction of its own, unless it's already in one
+func (s *sqlUsers) NextWalletIndex(ctx context.Context) (uint32, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	var next int64
+	err := inTransaction(ctx, s.db, func(ctx context.Context) error {
+		q := querier(ctx, s.db)
+		_, err := q.ExecContext(ctx, "UPDATE counters SET value = value + 1 WHERE name = 'wallet_index'")
+		if err != nil {
+			return err
+		}
+		return q.QueryRowContext(ctx, "SELECT value FROM counters WHERE name = 'wallet_index'").Scan(&next)
+	})
+	if err != nil {
+		return 0, timeoutError(ctx, err)
+	}
+	return uint32(next - 1), nil
+}
+
+func (s *sqlUsers) Delete(ctx context.Context, id string) error {
+	return s.execByID(ctx, id, "DELETE FROM users WHERE id = ?")
+}
+
+const userSelect = `SELECT id, email, name, page_name, generated_matic_wallet_address, metamask_wallet_address, created_at, deleted_at,
+	bio, avatar_url, banner_url, website, display_currency, social_links, categories, visibility, avatar_images, banner_images,
+	updated_at, supporter_count, wallet_index FROM users `
+
+// Images are stored with their keys, which Image leaves out of its JSON
+type sqlImage struct {
+	URLs map[string]string `json:"urls"`
+	Keys []string          `json:"keys"`
+}
+
+func toSQLImage(image *Image) *sqlImage {
+	if image == nil {
+		return nil
+	}
+	return &sqlImage{URLs: image.URLs, Keys: image.Keys}
+}
+
+func fromSQLImage(image *sqlImage) *Image {
+	if image == nil {
+		return nil
+	}
+	return &Image{URLs: image.URLs, Keys: image.Keys}
+}
+
+// Profile columns in the order of userSelect, lists, visibility and images as JSON
+func profileValues(p Profile) ([]interface{}, error) {
+	values := []interface{}{p.Bio, p.AvatarURL, p.BannerURL, p.Website, p.DisplayCurrency}
+	for _, v := range []interface{}{p.SocialLinks, p.Categories, p.Visibility, toSQLImage(p.Avatar), toSQLImage(p.Banner)} {
+		dat, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, string(dat))
+	}
+	return values, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	var id int64
+	var deletedAt, updatedAt sql.NullTime
+	var socialLinks, categories, visibility, avatar, banner string
+	var walletIndex sql.NullInt64
+	err := row.Scan(&id, &u.Email, &u.Name, &u.PageName,
+		&u.GeneratedMaticWalletPublicAddress, &u.MetaMaskWalletPublicAddress, &u.CreatedAt, &deletedAt,
+		&u.Bio, &u.AvatarURL, &u.BannerURL, &u.Website, &u.DisplayCurrency, &socialLinks, &categories, &visibility,
+		&avatar, &banner, &updatedAt, &u.SupporterCount, &walletIndex)
+	if err != nil {
+		return User{}, err
+	}
+	if walletIndex.Valid {
+		index := uint32(walletIndex.Int64)
+		u.WalletIndex = &index
+	}
+	var avatarImage, bannerImage *sqlImage
+	for _, col := range []struct {
+		dat string
+		v   interface{}
+	}{{socialLinks, &u.SocialLinks}, {categories, &u.Categories}, {visibility, &u.Visibility},
+		{avatar, &avatarImage}, {banner, &bannerImage}} {
+		if err := json.Unmarshal([]byte(col.dat), col.v); err != nil {
+			return User{}, err
+		}
+	}
+	u.Avatar, u.Banner = fromSQLImage(avatarImage), fromSQLImage(bannerImage)
+	if updatedAt.Valid {
+		u.UpdatedAt = updatedAt.Time.UTC()
+	}
+	u.ID = strconv.FormatInt(id, 10)
+	u.CreatedAt = u.CreatedAt.UTC()
+	if deletedAt.Valid {
+		u.DeletedAt = deletedAt.Time.UTC()
+	}
+	return u, nil
+}
+
+func (s *sqlUsers) findOne(ctx context.Context, where string, arg interface{}) (User, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+
+	u, err := scanUser(querier(ctx, s.db).QueryRowContext(ctx, rebind(s.driver, userSelect+"WHERE "+where), arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, timeoutError(ctx, err)
+	}
+	return u, nil
+}
+
+// Compares lowercased values so lookups line up with the unique indexes
+func (s *sqlUsers) findBy(ctx context.Context, field, value string) (User, error) {
+	if value == "" {
+		return User{}, ErrNotFound
+	}
+	return s.findOne(ctx, "lower("+userColumn(field)+") = lower(?)", value)
+}
+
+func (s *sqlUsers) GetByID(ctx context.Context, id string) (User, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return User{}, ErrNotFound
+	}
+	return s.findOne(ctx, "id = ?", n)
+}
+
+func (s *sqlUsers) GetByEmail(ctx context.Context, email string) (User, error) {
+	return s.findBy(ctx, "email", email)
+}
+
+func (s *sqlUsers) GetByWallet(ctx context.Context, address string) (User, error) {
+	return s.findBy(ctx, "metaMaskWalletPublicAddress", address)
+}
+
+func (s *sqlUsers) GetByPageName(ctx context.Context, pageName string) (User, error) {
+	return s.findBy(ctx, "pageName", pageName)
+}
+
+// Keyset pagination on a time column, with the integer primary key breaking ties
+func sqlPage(p pagination.Params, timeColumn string) (where string, args []interface{}, orderLimit string, err error) {
+	cmp, dir := ">", "ASC"
+	if p.Desc {
+		cmp, dir = "<", "DESC"
+	}
+	if p.After != nil {
+		// No ID means starting at a point in time, IDs start at 1
+		var id int64
+		if p.After.ID != "" {
+			if id, err = strconv.ParseInt(p.After.ID, 10, 64); err != nil {
+				return "", nil, "", pagination.ErrInvalidCursor
+			}
+		}
+		where = fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", timeColumn, cmp, timeColumn, cmp)
+		args = []interface{}{p.After.Time.UTC(), p.After.Time.UTC(), id}
+	}
+	orderLimit = fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %d", timeColumn, dir, dir, p.Limit+1)
+	return where, args, orderLimit, nil
+}
+
+func (s *sqlUsers) List(ctx context.Context, p pagination.Params) ([]User, *pagination.Key, error) {
+	where, args, orderLimit, err := sqlPage(p, "created_at")
+	if err != nil {
+		return nil, nil, err
+	}
+	if where != "" {
+		where = "WHERE " + where
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	rows, err := querier(ctx, s.db).QueryContext(ctx, rebind(s.driver, userSelect+where+orderLimit), args...)
+	if err != nil {
+		return nil, nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+
+	var users []User
+	var keys []pagination.Key
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		users = append(users, u)
+		keys = append(keys, u.key())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, timeoutError(ctx, err)
+	}
+	n, next := pagination.Trim(keys, p)
+	return users[:n], next, nil
+}
+
+// Search narrows down creators with LIKE and leaves ranking to rankUsers
+func (s *sqlUsers) Search(ctx context.Context, q SearchQuery) ([]User, error) {
+	where := []string{"page_name <> ''", "deleted_at IS NULL"}
+	var args []interface{}
+	if len(q.Categories) > 0 {
+		var any []string
+		for _, c := range q.Categories {
+			any = append(any, "categories LIKE ?")
+			args = append(args, `%"`+c+`"%`)
+		}
+		where = append(where, "("+strings.Join(any, " OR ")+")")
+	}
+	// Terms are only letters and digits, nothing in them means anything to LIKE
+	for _, term := range searchTerms(q.Text) {
+		var any []string
+		for _, p := range termPatterns(term) {
+			any = append(any, "lower(page_name || ' ' || name || ' ' || bio || ' ' || categories) LIKE ?")
+			args = append(args, "%"+strings.Join(p, "%")+"%")
+		}
+		where = append(where, "("+strings.Join(any, " OR ")+")")
+	}
+	order := "supporter_count DESC, created_at DESC"
+	if q.Sort == SortRecent {
+		order = "created_at DESC"
+	}
+	// Ranked afterwards, from the candidates first in the requested order
+	query := userSelect + "WHERE " + strings.Join(where, " AND ") +
+		" ORDER BY " + order + " LIMIT " + strconv.Itoa(maxSearchCandidates)
+
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	rows, err := querier(ctx, s.db).QueryContext(ctx, rebind(s.driver, query), args...)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	return rankUsers(users, q), nil
+}
+
+func (s *sqlUsers) ListDeletedBefore(ctx context.Context, before time.Time) ([]User, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	rows, err := querier(ctx, s.db).QueryContext(ctx, rebind(s.driver, userSelect+"WHERE deleted_at < ?"), before.UTC())
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, timeoutError(ctx, rows.Err())
+}
+
+func (s *sqlUsers) ListWithDepositAddress(ctx context.Context) ([]User, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	query := userSelect + "WHERE generated_matic_wallet_address <> '' AND deleted_at IS NULL"
+	rows, err := querier(ctx, s.db).QueryContext(ctx, rebind(s.driver, query))
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, timeoutError(ctx, rows.Err())
+}
+
+type sqlAudit struct {
+	db      *sql.DB
+	driver  string
+	timeout time.Duration
+}
+
+func (s *sqlAudit) Record(ctx context.Context, event AuditEvent) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	_, err = querier(ctx, s.db).ExecContext(ctx,
+		rebind(s.driver, "INSERT INTO audit_events (type, user_id, data, at) VALUES (?, ?, ?, ?)"),
+		event.Type, event.UserID, string(data), event.At.UTC())
+	return timeoutError(ctx, err)
+}
+
+func (s *sqlAudit) ListByUser(ctx context.Context, userID string) ([]AuditEvent, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	rows, err := querier(ctx, s.db).QueryContext(ctx,
+		rebind(s.driver, "SELECT type, user_id, data, at FROM audit_events WHERE user_id = ? ORDER BY id"), userID)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		var data string
+		if err := rows.Scan(&e.Type, &e.UserID, &data, &e.At); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &e.Data); err != nil {
+			return nil, err
+		}
+		e.At = e.At.UTC()
+		events = append(events, e)
+	}
+	return events, timeoutError(ctx, rows.Err())
+}
+
+func (s *sqlAudit) Anonymize(ctx context.Context, userID string) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	_, err := querier(ctx, s.db).ExecContext(ctx,
+		rebind(s.driver, "UPDATE audit_events SET data = 'null' WHERE user_id = ?"), userID)
+	return timeoutError(ctx, err)
+}
+
+type sqlPageNames struct {
+	db      *sql.DB
+	driver  string
+	timeout time.Duration
+}
+
+func (s *sqlPageNames) Record(ctx context.Context, change PageNameChange) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	_, err := querier(ctx, s.db).ExecContext(ctx,
+		rebind(s.driver, "INSERT INTO page_name_changes (user_id, old_name, new_name, changed_at) VALUES (?, ?, ?, ?)"),
+		change.UserID, change.OldName, change.NewName, change.ChangedAt.UTC())
+	return timeoutError(ctx, err)
+}
+
+func (s *sqlPageNames) latest(ctx context.Context, where string, arg interface{}) (PageNameChange, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	query := "SELECT user_id, old_name, new_name, changed_at FROM page_name_changes WHERE " + where +
+		" ORDER BY changed_at DESC, id DESC LIMIT 1"
+	var c PageNameChange
+	err := querier(ctx, s.db).QueryRowContext(ctx, rebind(s.driver, query), arg).
+		Scan(&c.UserID, &c.OldName, &c.NewName, &c.ChangedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PageNameChange{}, ErrNotFound
+	}
+	if err != nil {
+		return PageNameChange{}, timeoutError(ctx, err)
+	}
+	c.ChangedAt = c.ChangedAt.UTC()
+	return c, nil
+}
+
+func (s *sqlPageNames) GetByOldName(ctx context.Context, oldName string) (PageNameChange, error) {
+	if oldName == "" {
+		return PageNameChange{}, ErrNotFound
+	}
+	return s.latest(ctx, "lower(old_name) = lower(?)", oldName)
+}
+
+func (s *sqlPageNames) LastByUser(ctx context.Context, userID string) (PageNameChange, error) {
+	return s.latest(ctx, "user_id = ?", userID)
+}
+
+func (s *sqlPageNames) DeleteByUser(ctx context.Context, userID string) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	_, err := querier(ctx, s.db).ExecContext(ctx,
+		rebind(s.driver, "DELETE FROM page_name_changes WHERE user_id = ?"), userID)
+	return timeoutError(ctx, err)
+}
+
+type sqlTiers struct {
+	db      *sql.DB
+	driver  string
+	timeout time.Duration
+}
+
+func (s *sqlTiers) Create(ctx context.Context, tier *Tier) error {
+	benefits, err := json.Marshal(tier.Benefits)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	query := `INSERT INTO tiers (creator_id, name, description, chain, token, amount, benefits, max_members, active,
+		created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	args := []interface{}{tier.CreatorID, tier.Name, tier.Description, tier.Price.Chain, tier.Price.Token, tier.Price.Amount,
+		string(benefits), tier.MaxMembers, tier.Active, tier.CreatedAt.UTC(), tier.UpdatedAt.UTC()}
+	id, err := insertReturningID(ctx, querier(ctx, s.db), s.driver, query, args...)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	tier.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+const tierSelect = `SELECT id, creator_id, name, description, chain, token, amount, benefits, max_members, active,
+	created_at, updated_at FROM tiers `
+
+func scanTier(row rowScanner) (Tier, error) {
+	var t Tier
+	var id int64
+	var benefits string
+	err := row.Scan(&id, &t.CreatorID, &t.Name, &t.Description, &t.Price.Chain, &t.Price.Token, &t.Price.Amount,
+		&benefits, &t.MaxMembers, &t.Active, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		return Tier{}, err
+	}
+	if err := json.Unmarshal([]byte(benefits), &t.Benefits); err != nil {
+		return Tier{}, err
+	}
+	t.ID = strconv.FormatInt(id, 10)
+	t.CreatedAt, t.UpdatedAt = t.CreatedAt.UTC(), t.UpdatedAt.UTC()
+	return t, nil
+}
+
+func (s *sqlTiers) GetByID(ctx context.Context, id string) (Tier, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return Tier{}, ErrNotFound
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	t, err := scanTier(querier(ctx, s.db).QueryRowContext(ctx, rebind(s.driver, tierSelect+"WHERE id = ?"), n))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Tier{}, ErrNotFound
+	}
+	return t, timeoutError(ctx, err)
+}
+
+func (s *sqlTiers) ListByCreator(ctx context.Context, creatorID string) ([]Tier, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	rows, err := querier(ctx, s.db).QueryContext(ctx,
+		rebind(s.driver, tierSelect+"WHERE creator_id = ? ORDER BY created_at, id"), creatorID)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+	tiers := []Tier{}
+	for rows.Next() {
+		t, err := scanTier(rows)
+		if err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, t)
+	}
+	return tiers, timeoutError(ctx, rows.Err())
+}
+
+// Runs a statement on the tier with the given ID, its last placeholder is the ID
+func (s *sqlTiers) execByID(ctx context.Context, id, query string, args ...interface{}) error {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return ErrNotFound
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	res, err := querier(ctx, s.db).ExecContext(ctx, rebind(s.driver, query), append(args, n)...)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlTiers) Update(ctx context.Context, tier Tier) error {
+	benefits, err := json.Marshal(tier.Benefits)
+	if err != nil {
+		return err
+	}
+	return s.execByID(ctx, tier.ID, `UPDATE tiers SET name = ?, description = ?, chain = ?, token = ?, amount = ?,
+		benefits = ?, max_members = ?, active = ?, updated_at = ? WHERE id = ?`,
+		tier.Name, tier.Description, tier.Price.Chain, tier.Price.Token, tier.Price.Amount,
+		string(benefits), tier.MaxMembers, tier.Active, tier.UpdatedAt.UTC())
+}
+
+func (s *sqlTiers) Delete(ctx context.Context, id string) error {
+	return s.execByID(ctx, id, "DELETE FROM tiers WHERE id = ?")
+}
+
+func (s *sqlTiers) DeleteByCreator(ctx context.Context, creatorID string) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	_, err := querier(ctx, s.db).ExecContext(ctx, rebind(s.driver, "DELETE FROM tiers WHERE creator_id = ?"), creatorID)
+	return timeoutError(ctx, err)
+}
+
+type sqlPayments struct {
+	db      *sql.DB
+	driver  string
+	timeout time.Duration
+}
+
+func (s *sqlPayments) Create(ctx context.Context, payment *Payment) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	query := `INSERT INTO payments (chain, tx_hash, creator_id, payer_id, from_address, to_address, token, amount,
+		block_number, verified_at, fiat_currency, fiat_rate, fiat_amount) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	id, err := insertReturningID(ctx, querier(ctx, s.db), s.driver, query, payment.Chain, payment.TxHash,
+		payment.CreatorID, payment.PayerID, payment.From, payment.To, payment.Token, payment.Amount,
+		int64(payment.BlockNumber), payment.VerifiedAt.UTC(), payment.FiatCurrency, payment.FiatRate, payment.FiatAmount)
+	if errors.Is(conflictFromSQL(err), ErrConflict) {
+		// The only unique column
+		return &ConflictError{Field: "txHash"}
+	}
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	payment.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+const paymentSelect = `SELECT id, chain, tx_hash, creator_id, payer_id, from_address, to_address, token, amount,
+	block_number, verified_at, fiat_currency, fiat_rate, fiat_amount FROM payments `
+
+func scanPayment(row rowScanner) (Payment, error) {
+	var p Payment
+	var id, block int64
+	err := row.Scan(&id, &p.Chain, &p.TxHash, &p.CreatorID, &p.PayerID, &p.From, &p.To, &p.Token, &p.Amount, &block,
+		&p.VerifiedAt, &p.FiatCurrency, &p.FiatRate, &p.FiatAmount)
+	if err != nil {
+		return Payment{}, err
+	}
+	p.ID = strconv.FormatInt(id, 10)
+	p.BlockNumber = uint64(block)
+	p.VerifiedAt = p.VerifiedAt.UTC()
+	return p, nil
+}
+
+func (s *sqlPayments) GetByTxHash(ctx context.Context, txHash string) (Payment, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	p, err := scanPayment(querier(ctx, s.db).QueryRowContext(ctx, rebind(s.driver, paymentSelect+"WHERE tx_hash = ?"), txHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Payment{}, ErrNotFound
+	}
+	return p, timeoutError(ctx, err)
+}
+
+func (s *sqlPayments) ListByCreator(ctx context.Context, creatorID string) ([]Payment, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	rows, err := querier(ctx, s.db).QueryContext(ctx,
+		rebind(s.driver, paymentSelect+"WHERE creator_id = ? ORDER BY verified_at, id"), creatorID)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+	payments := []Payment{}
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, timeoutError(ctx, rows.Err())
+}
+
+func (s *sqlPayments) AnonymizePayer(ctx context.Context, payerID string) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	_, err := querier(ctx, s.db).ExecContext(ctx,
+		rebind(s.driver, "UPDATE payments SET payer_id = '' WHERE payer_id = ?"), payerID)
+	return timeoutError(ctx, err)
+}
+
+func (s *sqlPayments) ListFromBlock(ctx context.Context, chain string, block uint64) ([]Payment, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	rows, err := querier(ctx, s.db).QueryContext(ctx,
+		rebind(s.driver, paymentSelect+"WHERE chain = ? AND block_number >= ? ORDER BY block_number, id"), chain, int64(block))
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+	payments := []Payment{}
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, timeoutError(ctx, rows.Err())
+}
+
+func (s *sqlPayments) Delete(ctx context.Context, txHash string) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	res, err := querier(ctx, s.db).ExecContext(ctx, rebind(s.driver, "DELETE FROM payments WHERE tx_hash = ?"), txHash)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type sqlCheckpoints struct {
+	db      *sql.DB
+	driver  string
+	timeout time.Duration
+}
+
+func (s *sqlCheckpoints) Get(ctx context.Context, chain string) (Checkpoint, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	c := Checkpoint{Chain: chain}
+	var block int64
+	err := querier(ctx, s.db).QueryRowContext(ctx,
+		rebind(s.driver, "SELECT block, hash, updated_at FROM indexer_checkpoints WHERE chain = ?"), chain).
+		Scan(&block, &c.Hash, &c.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Checkpoint{}, ErrNotFound
+	}
+	if err != nil {
+		return Checkpoint{}, timeoutError(ctx, err)
+	}
+	c.Block = uint64(block)
+	c.UpdatedAt = c.UpdatedAt.UTC()
+	return c, nil
+}
+
+func (s *sqlCheckpoints) Set(ctx context.Context, checkpoint Checkpoint) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	// Both SQLite and Postgres know ON CONFLICT
+	_, err := querier(ctx, s.db).ExecContext(ctx, rebind(s.driver, `INSERT INTO indexer_checkpoints (chain, block, hash, updated_at)
+		VALUES (?, ?, ?, ?) ON CONFLICT (chain) DO UPDATE SET block = excluded.block, hash = excluded.hash,
+		updated_at = excluded.updated_at`),
+		checkpoint.Chain, int64(checkpoint.Block), checkpoint.Hash, checkpoint.UpdatedAt.UTC())
+	return timeoutError(ctx, err)
+}
+
+type sqlSubscriptions struct {
+	db      *sql.DB
+	driver  string
+	timeout time.Duration
+}
+
+// NULL unless canceled
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+func (s *sqlSubscriptions) Create(ctx context.Context, sub *Subscription) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	query := `INSERT INTO subscriptions (patron_id, creator_id, tier_id, period, status, next_due_at, last_payment_tx,
+		created_at, updated_at, canceled_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	id, err := insertReturningID(ctx, querier(ctx, s.db), s.driver, query, sub.PatronID, sub.CreatorID, sub.TierID,
+		sub.Period, sub.Status, sub.NextDueAt.UTC(), sub.LastPaymentTx, sub.CreatedAt.UTC(), sub.UpdatedAt.UTC(),
+		nullTime(sub.CanceledAt))
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	sub.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+const subscriptionSelect = `SELECT id, patron_id, creator_id, tier_id, period, status, next_due_at, last_payment_tx,
+	created_at, updated_at, canceled_at FROM subscriptions `
+
+func scanSubscription(row rowScanner) (Subscription, error) {
+	var sub Subscription
+	var id int64
+	var canceledAt sql.NullTime
+	err := row.Scan(&id, &sub.PatronID, &sub.CreatorID, &sub.TierID, &sub.Period, &sub.Status, &sub.NextDueAt,
+		&sub.LastPaymentTx, &sub.CreatedAt, &sub.UpdatedAt, &canceledAt)
+	if err != nil {
+		return Subscription{}, err
+	}
+	sub.ID = strconv.FormatInt(id, 10)
+	sub.NextDueAt, sub.CreatedAt, sub.UpdatedAt = sub.NextDueAt.UTC(), sub.CreatedAt.UTC(), sub.UpdatedAt.UTC()
+	if canceledAt.Valid {
+		t := canceledAt.Time.UTC()
+		sub.CanceledAt = &t
+	}
+	return sub, nil
+}
+
+func (s *sqlSubscriptions) GetByID(ctx context.Context, id string) (Subscription, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return Subscription{}, ErrNotFound
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	sub, err := scanSubscription(querier(ctx, s.db).QueryRowContext(ctx, rebind(s.driver, subscriptionSelect+"WHERE id = ?"), n))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Subscription{}, ErrNotFound
+	}
+	return sub, timeoutError(ctx, err)
+}
+
+func (s *sqlSubscriptions) list(ctx context.Context, where string, args ...interface{}) ([]Subscription, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	rows, err := querier(ctx, s.db).QueryContext(ctx,
+		rebind(s.driver, subscriptionSelect+"WHERE "+where+" ORDER BY created_at, id"), args...)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+	subs := []Subscription{}
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, timeoutError(ctx, rows.Err())
+}
+
+func (s *sqlSubscriptions) ListByPatron(ctx context.Context, patronID string) ([]Subscription, error) {
+	return s.list(ctx, "patron_id = ?", patronID)
+}
+
+func (s *sqlSubscriptions) ListByCreator(ctx context.Context, creatorID string) ([]Subscription, error) {
+	return s.list(ctx, "creator_id = ?", creatorID)
+}
+
+func (s *sqlSubscriptions) ListDue(ctx context.Context, before time.Time) ([]Subscription, error) {
+	return s.list(ctx, "status <> ? AND next_due_at < ?", SubscriptionCanceled, before.UTC())
+}
+
+func (s *sqlSubscriptions) Update(ctx context.Context, sub Subscription) error {
+	n, err := strconv.ParseInt(sub.ID, 10, 64)
+	if err != nil {
+		return ErrNotFound
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	res, err := querier(ctx, s.db).ExecContext(ctx, rebind(s.driver, `UPDATE subscriptions SET status = ?, next_due_at = ?,
+		last_payment_tx = ?, updated_at = ?, canceled_at = ? WHERE id = ?`),
+		sub.Status, sub.NextDueAt.UTC(), sub.LastPaymentTx, sub.UpdatedAt.UTC(), nullTime(sub.CanceledAt), n)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlSubscriptions) DeleteByUser(ctx context.Context, userID string) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	_, err := querier(ctx, s.db).ExecContext(ctx,
+		rebind(s.driver, "DELETE FROM subscriptions WHERE patron_id = ? OR creator_id = ?"), userID, userID)
+	return timeoutError(ctx, err)
+}
+
+type sqlPosts struct {
+	db      *sql.DB
+	driver  string
+	timeout time.Duration
+}
+
+// The columns stored as JSON
+func postJSON(post Post) (attachments, tierIDs, gate string, err error) {
+	var dat [3][]byte
+	for i, v := range []interface{}{post.Attachments, post.TierIDs, post.Gate} {
+		if dat[i], err = json.Marshal(v); err != nil {
+			return "", "", "", err
+		}
+	}
+	return string(dat[0]), string(dat[1]), string(dat[2]), nil
+}
+
+func (s *sqlPosts) Create(ctx context.Context, post *Post) error {
+	attachments, tierIDs, gate, err := postJSON(*post)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	query := `INSERT INTO posts (creator_id, title, body, attachments, visibility, tier_ids, gate, publish_at,
+		created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	id, err := insertReturningID(ctx, querier(ctx, s.db), s.driver, query, post.CreatorID, post.Title, post.Body,
+		attachments, post.Visibility, tierIDs, gate, post.PublishAt.UTC(), post.CreatedAt.UTC(), post.UpdatedAt.UTC())
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	post.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+const postSelect = `SELECT id, creator_id, title, body, attachments, visibility, tier_ids, gate, publish_at,
+	created_at, updated_at FROM posts `
+
+func scanPost(row rowScanner) (Post, error) {
+	var p Post
+	var id int64
+	var attachments, tierIDs, gate string
+	err := row.Scan(&id, &p.CreatorID, &p.Title, &p.Body, &attachments, &p.Visibility, &tierIDs, &gate,
+		&p.PublishAt, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return Post{}, err
+	}
+	if err := json.Unmarshal([]byte(attachments), &p.Attachments); err != nil {
+		return Post{}, err
+	}
+	if err := json.Unmarshal([]byte(tierIDs), &p.TierIDs); err != nil {
+		return Post{}, err
+	}
+	if err := json.Unmarshal([]byte(gate), &p.Gate); err != nil {
+		return Post{}, err
+	}
+	p.ID = strconv.FormatInt(id, 10)
+	p.PublishAt, p.CreatedAt, p.UpdatedAt = p.PublishAt.UTC(), p.CreatedAt.UTC(), p.UpdatedAt.UTC()
+	return p, nil
+}
+
+func (s *sqlPosts) GetByID(ctx context.Context, id string) (Post, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return Post{}, ErrNotFound
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	p, err := scanPost(querier(ctx, s.db).QueryRowContext(ctx, rebind(s.driver, postSelect+"WHERE id = ?"), n))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Post{}, ErrNotFound
+	}
+	return p, timeoutError(ctx, err)
+}
+
+func (s *sqlPosts) ListByCreator(ctx context.Context, creatorID string, publishedBy time.Time, p pagination.Params) ([]Post, *pagination.Key, error) {
+	page, pageArgs, orderLimit, err := sqlPage(p, "publish_at")
+	if err != nil {
+		return nil, nil, err
+	}
+	where := []string{"creator_id = ?"}
+	args := []interface{}{creatorID}
+	if !publishedBy.IsZero() {
+		where = append(where, "publish_at <= ?")
+		args = append(args, publishedBy.UTC())
+	}
+	if page != "" {
+		where = append(where, page)
+		args = append(args, pageArgs...)
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	rows, err := querier(ctx, s.db).QueryContext(ctx,
+		rebind(s.driver, postSelect+"WHERE "+strings.Join(where, " AND ")+orderLimit), args...)
+	if err != nil {
+		return nil, nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+
+	var posts []Post
+	var keys []pagination.Key
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		posts = append(posts, post)
+		keys = append(keys, post.key())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, timeoutError(ctx, err)
+	}
+	n, next := pagination.Trim(keys, p)
+	return posts[:n], next, nil
+}
+
+func (s *sqlPosts) Update(ctx context.Context, post Post) error {
+	n, err := strconv.ParseInt(post.ID, 10, 64)
+	if err != nil {
+		return ErrNotFound
+	}
+	attachments, tierIDs, gate, err := postJSON(post)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	res, err := querier(ctx, s.db).ExecContext(ctx, rebind(s.driver, `UPDATE posts SET title = ?, body = ?,
+		attachments = ?, visibility = ?, tier_ids = ?, gate = ?, publish_at = ?, updated_at = ? WHERE id = ?`),
+		post.Title, post.Body, attachments, post.Visibility, tierIDs, gate, post.PublishAt.UTC(), post.UpdatedAt.UTC(), n)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlPosts) Delete(ctx context.Context, id string) error {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return ErrNotFound
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	res, err := querier(ctx, s.db).ExecContext(ctx, rebind(s.driver, "DELETE FROM posts WHERE id = ?"), n)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlPosts) DeleteByCreator(ctx context.Context, creatorID string) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	_, err := querier(ctx, s.db).ExecContext(ctx, rebind(s.driver, "DELETE FROM posts WHERE creator_id = ?"), creatorID)
+	return timeoutError(ctx, err)
+}
+
+type sqlWithdrawals struct {
+	db      *sql.DB
+	driver  string
+	timeout time.Duration
+}
+
+func (s *sqlWithdrawals) Create(ctx context.Context, w *Withdrawal) error {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	query := `INSERT INTO withdrawals (creator_id, chain, token, amount, to_address, status, tx_hash, nonce,
+		created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	id, err := insertReturningID(ctx, querier(ctx, s.db), s.driver, query, w.CreatorID, w.Chain, w.Token, w.Amount,
+		w.To, w.Status, w.TxHash, int64(w.Nonce), w.CreatedAt.UTC(), w.UpdatedAt.UTC())
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	w.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+func (s *sqlWithdrawals) Update(ctx context.Context, w Withdrawal) error {
+	n, err := strconv.ParseInt(w.ID, 10, 64)
+	if err != nil {
+		return ErrNotFound
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	res, err := querier(ctx, s.db).ExecContext(ctx, rebind(s.driver,
+		"UPDATE withdrawals SET status = ?, tx_hash = ?, nonce = ?, updated_at = ? WHERE id = ?"),
+		w.Status, w.TxHash, int64(w.Nonce), w.UpdatedAt.UTC(), n)
+	if err != nil {
+		return timeoutError(ctx, err)
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlWithdrawals) ListByCreator(ctx context.Context, creatorID string) ([]Withdrawal, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	rows, err := querier(ctx, s.db).QueryContext(ctx, rebind(s.driver, `SELECT id, creator_id, chain, token, amount,
+		to_address, status, tx_hash, nonce, created_at, updated_at FROM withdrawals WHERE creator_id = ?
+		ORDER BY created_at, id`), creatorID)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+	list := []Withdrawal{}
+	for rows.Next() {
+		var w Withdrawal
+		var id, nonce int64
+		err := rows.Scan(&id, &w.CreatorID, &w.Chain, &w.Token, &w.Amount, &w.To, &w.Status, &w.TxHash, &nonce,
+			&w.CreatedAt, &w.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		w.ID = strconv.FormatInt(id, 10)
+		w.Nonce = uint64(nonce)
+		w.CreatedAt, w.UpdatedAt = w.CreatedAt.UTC(), w.UpdatedAt.UTC()
+		list = append(list, w)
+	}
+	return list, timeoutError(ctx, rows.Err())
+}
+
+type sqlLedger struct {
+	db      *sql.DB
+	driver  string
+	timeout time.Duration
+}
+
+func (s *sqlLedger) Post(ctx context.Context, entries []LedgerEntry) error {
+	if err := checkBalanced(entries); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	err := inTransaction(ctx, s.db, func(ctx context.Context) error {
+		for i, e := range entries {
+			query := `INSERT INTO ledger_entries (txn_id, account, creator_id, kind, chain, token, amount, tier_id, at,
+				fiat_currency, fiat_rate) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+			id, err := insertReturningID(ctx, querier(ctx, s.db), s.driver, query, e.TxnID, e.Account, e.CreatorID,
+				e.Kind, e.Chain, e.Token, e.Amount, e.TierID, e.At.UTC(), e.FiatCurrency, e.FiatRate)
+			if err != nil {
+				return err
+			}
+			entries[i].ID = strconv.FormatInt(id, 10)
+		}
+		return nil
+	})
+	return timeoutError(ctx, err)
+}
+
+func (s *sqlLedger) ListByCreator(ctx context.Context, creatorID string, from, to time.Time) ([]LedgerEntry, error) {
+	ctx, cancel := withTimeout(ctx, s.timeout)
+	defer cancel()
+	where, args := "creator_id = ? AND at >= ?", []interface{}{creatorID, from.UTC()}
+	if !to.IsZero() {
+		where, args = where+" AND at < ?", append(args, to.UTC())
+	}
+	rows, err := querier(ctx, s.db).QueryContext(ctx, rebind(s.driver, `SELECT id, txn_id, account, creator_id, kind, chain,
+		token, amount, tier_id, at, fiat_currency, fiat_rate FROM ledger_entries WHERE `+where+` ORDER BY at, id`), args...)
+	if err != nil {
+		return nil, timeoutError(ctx, err)
+	}
+	defer rows.Close()
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		var e LedgerEntry
+		var id int64
+		err := rows.Scan(&id, &e.TxnID, &e.Account, &e.CreatorID, &e.Kind, &e.Chain, &e.Token, &e.Amount, &e.TierID, &e.At,
+			&e.FiatCurrency, &e.FiatRate)
+		if err != nil {
+			return nil, err
+		}
+		e.ID = strconv.FormatInt(id, 10)
+		e.At = e.At.UTC()
+		entries = append(entries, e)
+	}
+	return entries, timeoutError(ctx, rows.Err())
+}
@@ -0,0 +1,439 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// sqlMigration is one step of the relational schema. Statements are run in order
+// within a single transaction, per driver since SQLite and Postgres disagree on some types
+type sqlMigration struct {
+	version    int
+	statements map[string][]string
+}
+
+// Append new steps at the end, never edit one that has shipped
+var sqlMigrations = []sqlMigration{
+	{
+		version: 1,
+		statements: map[string][]string{
+			SQLite: {
+				`CREATE TABLE users (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					email TEXT NOT NULL DEFAULT '',
+					name TEXT NOT NULL DEFAULT '',
+					page_name TEXT NOT NULL DEFAULT '',
+					generated_matic_wallet_address TEXT NOT NULL DEFAULT '',
+					metamask_wallet_address TEXT NOT NULL DEFAULT '',
+					created_at TIMESTAMP NOT NULL
+				)`,
+			},
+			Postgres: {
+				`CREATE TABLE users (
+					id BIGSERIAL PRIMARY KEY,
+					email TEXT NOT NULL DEFAULT '',
+					name TEXT NOT NULL DEFAULT '',
+					page_name TEXT NOT NULL DEFAULT '',
+					generated_matic_wallet_address TEXT NOT NULL DEFAULT '',
+					metamask_wallet_address TEXT NOT NULL DEFAULT '',
+					created_at TIMESTAMPTZ NOT NULL
+				)`,
+			},
+		},
+	},
+	{
+		// Case-insensitive uniqueness, matching the Mongo indexes
+		version:    2,
+		statements: sameForAll(uniqueUserIndexStatements()...),
+	},
+	{
+		version: 3,
+		statements: map[string][]string{
+			SQLite: {
+				`CREATE TABLE audit_events (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					type TEXT NOT NULL,
+					user_id TEXT NOT NULL,
+					data TEXT NOT NULL,
+					at TIMESTAMP NOT NULL
+				)`,
+				`CREATE INDEX audit_events_user_id ON audit_events (user_id)`,
+			},
+			Postgres: {
+				`CREATE TABLE audit_events (
+					id BIGSERIAL PRIMARY KEY,
+					type TEXT NOT NULL,
+					user_id TEXT NOT NULL,
+					data TEXT NOT NULL,
+					at TIMESTAMPTZ NOT NULL
+				)`,
+				`CREATE INDEX audit_events_user_id ON audit_events (user_id)`,
+			},
+		},
+	},
+	{
+		version: 4,
+		statements: map[string][]string{
+			SQLite: {
+				`CREATE TABLE page_name_changes (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_id TEXT NOT NULL,
+					old_name TEXT NOT NULL,
+					new_name TEXT NOT NULL,
+					changed_at TIMESTAMP NOT NULL
+				)`,
+				`CREATE INDEX page_name_changes_old_name ON page_name_changes (lower(old_name))`,
+				`CREATE INDEX page_name_changes_user_id ON page_name_changes (user_id)`,
+			},
+			Postgres: {
+				`CREATE TABLE page_name_changes (
+					id BIGSERIAL PRIMARY KEY,
+					user_id TEXT NOT NULL,
+					old_name TEXT NOT NULL,
+					new_name TEXT NOT NULL,
+					changed_at TIMESTAMPTZ NOT NULL
+				)`,
+				`CREATE INDEX page_name_changes_old_name ON page_name_changes (lower(old_name))`,
+				`CREATE INDEX page_name_changes_user_id ON page_name_changes (user_id)`,
+			},
+		},
+	},
+	{
+		// Soft deletes, NULL for active users
+		version: 5,
+		statements: map[string][]string{
+			SQLite:   {`ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP`},
+			Postgres: {`ALTER TABLE users ADD COLUMN deleted_at TIMESTAMPTZ`},
+		},
+	},
+	{
+		// Profiles, lists and visibility are stored as JSON
+		version: 6,
+		statements: map[string][]string{
+			SQLite:   profileColumnStatements("TIMESTAMP"),
+			Postgres: profileColumnStatements("TIMESTAMPTZ"),
+		},
+	},
+	{
+		// Uploaded avatars and banners as JSON
+		version: 7,
+		statements: sameForAll(
+			`ALTER TABLE users ADD COLUMN avatar_images TEXT NOT NULL DEFAULT 'null'`,
+			`ALTER TABLE users ADD COLUMN banner_images TEXT NOT NULL DEFAULT 'null'`,
+		),
+	},
+	{
+		// Search ranks creators by supporters
+		version: 8,
+		statements: sameForAll(
+			`ALTER TABLE users ADD COLUMN supporter_count INTEGER NOT NULL DEFAULT 0`,
+			`CREATE INDEX users_supporter_count ON users (supporter_count)`,
+		),
+	},
+	{
+		// Benefits are stored as JSON
+		version: 9,
+		statements: map[string][]string{
+			SQLite:   tierTableStatements("INTEGER PRIMARY KEY AUTOINCREMENT", "TIMESTAMP"),
+			Postgres: tierTableStatements("BIGSERIAL PRIMARY KEY", "TIMESTAMPTZ"),
+		},
+	},
+	{
+		// Amounts are decimal strings, they don't fit any numeric type we have everywhere
+		version: 10,
+		statements: map[string][]string{
+			SQLite:   paymentTableStatements("INTEGER PRIMARY KEY AUTOINCREMENT", "TIMESTAMP"),
+			Postgres: paymentTableStatements("BIGSERIAL PRIMARY KEY", "TIMESTAMPTZ"),
+		},
+	},
+	{
+		// One row per chain the indexer follows
+		version: 11,
+		statements: map[string][]string{
+			SQLite: {`CREATE TABLE indexer_checkpoints (chain TEXT PRIMARY KEY, block BIGINT NOT NULL,
+				hash TEXT NOT NULL, updated_at TIMESTAMP NOT NULL)`},
+			Postgres: {`CREATE TABLE indexer_checkpoints (chain TEXT PRIMARY KEY, block BIGINT NOT NULL,
+				hash TEXT NOT NULL, updated_at TIMESTAMPTZ NOT NULL)`},
+		},
+	},
+	{
+		// canceled_at is NULL until a subscription is canceled
+		version: 12,
+		statements: map[string][]string{
+			SQLite:   subscriptionTableStatements("INTEGER PRIMARY KEY AUTOINCREMENT", "TIMESTAMP"),
+			Postgres: subscriptionTableStatements("BIGSERIAL PRIMARY KEY", "TIMESTAMPTZ"),
+		},
+	},
+	{
+		version: 13,
+		statements: map[string][]string{
+			SQLite:   postTableStatements("INTEGER PRIMARY KEY AUTOINCREMENT", "TIMESTAMP"),
+			Postgres: postTableStatements("BIGSERIAL PRIMARY KEY", "TIMESTAMPTZ"),
+		},
+	},
+	{
+		// wallet_index is NULL for users whose generated wallet came from the web app
+		version: 14,
+		statements: sameForAll(
+			`ALTER TABLE users ADD COLUMN wallet_index BIGINT`,
+			`CREATE TABLE counters (name TEXT PRIMARY KEY, value BIGINT NOT NULL)`,
+			`INSERT INTO counters (name, value) VALUES ('wallet_index', 0)`,
+		),
+	},
+	{
+		// tx_hash is empty until a withdrawal is sent
+		version: 15,
+		statements: map[string][]string{
+			SQLite:   withdrawalTableStatements("INTEGER PRIMARY KEY AUTOINCREMENT", "TIMESTAMP"),
+			Postgres: withdrawalTableStatements("BIGSERIAL PRIMARY KEY", "TIMESTAMPTZ"),
+		},
+	},
+	{
+		// Payments and withdrawals from before are booked without a fee
+		version: 16,
+		statements: map[string][]string{
+			SQLite:   ledgerTableStatements("INTEGER PRIMARY KEY AUTOINCREMENT", "TIMESTAMP"),
+			Postgres: ledgerTableStatements("BIGSERIAL PRIMARY KEY", "TIMESTAMPTZ"),
+		},
+	},
+	{
+		// Earlier payments have no price, reports look it up when they need one
+		version: 17,
+		statements: sameForAll(
+			`ALTER TABLE payments ADD COLUMN fiat_currency TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE payments ADD COLUMN fiat_rate TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE payments ADD COLUMN fiat_amount TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE ledger_entries ADD COLUMN fiat_currency TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE ledger_entries ADD COLUMN fiat_rate TEXT NOT NULL DEFAULT ''`,
+		),
+	},
+	{
+		// Reorgs look up the payments from a block on
+		version: 18,
+		statements: sameForAll(
+			`CREATE INDEX payments_chain_block_number ON payments (chain, block_number)`,
+		),
+	},
+}
+
+func tierTableStatements(id, timestamp string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE tiers (
+			id %s,
+			creator_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			description TEXT NOT NULL,
+			chain TEXT NOT NULL,
+			token TEXT NOT NULL,
+			amount TEXT NOT NULL,
+			benefits TEXT NOT NULL,
+			max_members INTEGER NOT NULL,
+			active BOOLEAN NOT NULL,
+			created_at %s NOT NULL,
+			updated_at %s NOT NULL
+		)`, id, timestamp, timestamp),
+		`CREATE INDEX tiers_creator_id ON tiers (creator_id)`,
+	}
+}
+
+func paymentTableStatements(id, timestamp string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE payments (
+			id %s,
+			chain TEXT NOT NULL,
+			tx_hash TEXT NOT NULL,
+			creator_id TEXT NOT NULL,
+			payer_id TEXT NOT NULL,
+			from_address TEXT NOT NULL,
+			to_address TEXT NOT NULL,
+			token TEXT NOT NULL,
+			amount TEXT NOT NULL,
+			block_number BIGINT NOT NULL,
+			verified_at %s NOT NULL
+		)`, id, timestamp),
+		`CREATE UNIQUE INDEX payments_tx_hash_unique ON payments (tx_hash)`,
+		`CREATE INDEX payments_creator_id ON payments (creator_id)`,
+		`CREATE INDEX payments_payer_id ON payments (payer_id)`,
+	}
+}
+
+func subscriptionTableStatements(id, timestamp string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE subscriptions (
+			id %s,
+			patron_id TEXT NOT NULL,
+			creator_id TEXT NOT NULL,
+			tier_id TEXT NOT NULL,
+			period TEXT NOT NULL,
+			status TEXT NOT NULL,
+			next_due_at %s NOT NULL,
+			last_payment_tx TEXT NOT NULL,
+			created_at %s NOT NULL,
+			updated_at %s NOT NULL,
+			canceled_at %s
+		)`, id, timestamp, timestamp, timestamp, timestamp),
+		`CREATE INDEX subscriptions_patron_id ON subscriptions (patron_id)`,
+		`CREATE INDEX subscriptions_creator_id ON subscriptions (creator_id)`,
+		`CREATE INDEX subscriptions_next_due_at ON subscriptions (next_due_at)`,
+	}
+}
+
+func withdrawalTableStatements(id, timestamp string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE withdrawals (
+			id %s,
+			creator_id TEXT NOT NULL,
+			chain TEXT NOT NULL,
+			token TEXT NOT NULL,
+			amount TEXT NOT NULL,
+			to_address TEXT NOT NULL,
+			status TEXT NOT NULL,
+			tx_hash TEXT NOT NULL,
+			nonce BIGINT NOT NULL,
+			created_at %s NOT NULL,
+			updated_at %s NOT NULL
+		)`, id, timestamp, timestamp),
+		`CREATE INDEX withdrawals_creator_id ON withdrawals (creator_id)`,
+	}
+}
+
+// Amounts are signed decimal strings, debits positive
+func ledgerTableStatements(id, timestamp string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE ledger_entries (
+			id %s,
+			txn_id TEXT NOT NULL,
+			account TEXT NOT NULL,
+			creator_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			chain TEXT NOT NULL,
+			token TEXT NOT NULL,
+			amount TEXT NOT NULL,
+			tier_id TEXT NOT NULL,
+			at %s NOT NULL
+		)`, id, timestamp),
+		`CREATE INDEX ledger_entries_creator_id_at ON ledger_entries (creator_id, at)`,
+		`INSERT INTO ledger_entries (txn_id, account, creator_id, kind, chain, token, amount, tier_id, at)
+			SELECT 'payment:' || tx_hash, 'custody', creator_id, 'payment', chain, token, amount, '', verified_at FROM payments`,
+		`INSERT INTO ledger_entries (txn_id, account, creator_id, kind, chain, token, amount, tier_id, at)
+			SELECT 'payment:' || tx_hash, 'creator:' || creator_id, creator_id, 'payment', chain, token, '-' || amount, '',
+			verified_at FROM payments`,
+		`INSERT INTO ledger_entries (txn_id, account, creator_id, kind, chain, token, amount, tier_id, at)
+			SELECT 'withdrawal:' || id, 'creator:' || creator_id, creator_id, 'withdrawal', chain, token, amount, '',
+			created_at FROM withdrawals WHERE status <> 'failed'`,
+		`INSERT INTO ledger_entries (txn_id, account, creator_id, kind, chain, token, amount, tier_id, at)
+			SELECT 'withdrawal:' || id, 'custody', creator_id, 'withdrawal', chain, token, '-' || amount, '',
+			created_at FROM withdrawals WHERE status <> 'failed'`,
+	}
+}
+
+// Attachments, tier IDs and the gate are stored as JSON
+func postTableStatements(id, timestamp string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE posts (
+			id %s,
+			creator_id TEXT NOT NULL,
+			title TEXT NOT NULL,
+			body TEXT NOT NULL,
+			attachments TEXT NOT NULL,
+			visibility TEXT NOT NULL,
+			tier_ids TEXT NOT NULL,
+			gate TEXT NOT NULL,
+			publish_at %s NOT NULL,
+			created_at %s NOT NULL,
+			updated_at %s NOT NULL
+		)`, id, timestamp, timestamp, timestamp),
+		`CREATE INDEX posts_creator_id_publish_at ON posts (creator_id, publish_at)`,
+	}
+}
+
+func profileColumnStatements(timestamp string) []string {
+	stmts := []string{}
+	for _, column := range []string{"bio", "avatar_url", "banner_url", "website", "display_currency"} {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE users ADD COLUMN %s TEXT NOT NULL DEFAULT ''", column))
+	}
+	for _, column := range []string{"social_links", "categories"} {
+		stmts = append(stmts, fmt.Sprintf("ALTER TABLE users ADD COLUMN %s TEXT NOT NULL DEFAULT 'null'", column))
+	}
+	return append(stmts,
+		`ALTER TABLE users ADD COLUMN visibility TEXT NOT NULL DEFAULT '{}'`,
+		"ALTER TABLE users ADD COLUMN updated_at "+timestamp,
+		`UPDATE users SET updated_at = created_at`,
+	)
+}
+
+func uniqueUserIndexStatements() []string {
+	var stmts []string
+	for _, c := range userColumns {
+		stmts = append(stmts, fmt.Sprintf(
+			"CREATE UNIQUE INDEX %s ON users (lower(%s)) WHERE %s <> ''",
+			sqlIndexName(c.column), c.column, c.column,
+		))
+	}
+	return stmts
+}
+
+func sameForAll(stmts ...string) map[string][]string {
+	return map[string][]string{SQLite: stmts, Postgres: stmts}
+}
+
+// Arbitrary key for the Postgres advisory lock that serializes migrations
+const sqlMigrationLock = 7242364
+
+// Brings the schema up to date. Every step runs in its own transaction together
+// with its schema_migrations row, so a failed step leaves nothing behind
+func migrateSQL(ctx context.Context, db *sql.DB, driver string) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range sqlMigrations {
+		if err := applySQLMigration(ctx, db, driver, m); err != nil {
+			return fmt.Errorf("schema migration %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+func applySQLMigration(ctx context.Context, db *sql.DB, driver string, m sqlMigration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Other instances starting up at the same time wait here until we commit.
+	// SQLite doesn't need this, it only ever lets one writer in
+	if driver == Postgres {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", sqlMigrationLock); err != nil {
+			return err
+		}
+	}
+
+	var applied int
+	err = tx.QueryRowContext(ctx, rebind(driver, "SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), m.version).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+
+	for _, stmt := range m.statements[driver] {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, rebind(driver, "INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"),
+		m.version, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,381 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+)
+
+// Subscription statuses. Pending ones wait for their first payment, active ones are paid up,
+// past due ones are late but within the grace period, and canceled ones are over for good
+const (
+	SubscriptionPending  = "pending"
+	SubscriptionActive   = "active"
+	SubscriptionPastDue  = "past_due"
+	SubscriptionCanceled = "canceled"
+)
+
+// Billing periods. Only monthly for now, tiers are priced per month
+const PeriodMonthly = "monthly"
+
+// Set from config by ConfigureSubscriptions
+var subscriptionGrace = 7 * 24 * time.Hour
+
+func ConfigureSubscriptions(c config.SubscriptionsConfig) {
+	subscriptionGrace = c.GracePeriod
+}
+
+// Subscription is a patron supporting a creator through one of their tiers
+type Subscription struct {
+	// Assigned by the repository on Create
+	ID        string `bson:"-" json:"id"`
+	PatronID  string `bson:"patronId" json:"-"`
+	CreatorID string `bson:"creatorId" json:"-"`
+	TierID    string `bson:"tierId" json:"tierId"`
+	Period    string `bson:"period" json:"period"`
+	Status    string `bson:"status" json:"status"`
+	// Paid up until then
+	NextDueAt time.Time `bson:"nextDueAt" json:"nextDueAt"`
+	// Hash of the payment that last renewed it, a payment only counts once
+	LastPaymentTx string     `bson:"lastPaymentTx" json:"lastPaymentTx"`
+	CreatedAt     time.Time  `bson:"createdAt" json:"createdAt"`
+	UpdatedAt     time.Time  `bson:"updatedAt" json:"updatedAt"`
+	CanceledAt    *time.Time `bson:"canceledAt,omitempty" json:"canceledAt,omitempty"`
+}
+
+// SubscriptionRepository stores subscriptions. Lookups return ErrNotFound when there's no match
+type SubscriptionRepository interface {
+	Create(ctx context.Context, sub *Subscription) error
+	GetByID(ctx context.Context, id string) (Subscription, error)
+	// Lists are oldest first
+	ListByPatron(ctx context.Context, patronID string) ([]Subscription, error)
+	ListByCreator(ctx context.Context, creatorID string) ([]Subscription, error)
+	// Subscriptions that aren't canceled and were due before the given time
+	ListDue(ctx context.Context, before time.Time) ([]Subscription, error)
+	// Update saves the status, due date, last payment and when it was updated or canceled
+	Update(ctx context.Context, sub Subscription) error
+	// DeleteByUser removes the subscriptions a user has and the ones others have to them
+	DeleteByUser(ctx context.Context, userID string) error
+}
+
+// Holds a place in its tier and unlocks its posts. Only the grace period of a subscription
+// that was paid for at least once counts, not waiting for the first payment
+func (s Subscription) current() bool {
+	return s.Status == SubscriptionActive || s.Status == SubscriptionPastDue && s.LastPaymentTx != ""
+}
+
+// Not canceled, so a payment can still renew it
+func (s Subscription) open() bool {
+	return s.Status != SubscriptionCanceled
+}
+
+// Moves the due date a period ahead. Counted from the old due date so paying late doesn't
+// earn free time, unless it lapsed so long ago that would still leave it due
+func (s *Subscription) renew(now time.Time, txHash string) {
+	next := s.NextDueAt.AddDate(0, 1, 0)
+	if next.Before(now) {
+		next = now.AddDate(0, 1, 0)
+	}
+	s.NextDueAt, s.Status, s.LastPaymentTx, s.UpdatedAt = next, SubscriptionActive, txHash, now
+}
+
+// Moves a subscription along once it's due: past due at first, canceled when the
+// grace period is over too. Pending ones are canceled if they're still unpaid by then.
+// Reports whether anything changed
+func (s *Subscription) lapse(now time.Time, grace time.Duration) bool {
+	if !s.open() || !now.After(s.NextDueAt) {
+		return false
+	}
+	if now.After(s.NextDueAt.Add(grace)) {
+		s.cancel(now)
+		return true
+	}
+	if s.Status != SubscriptionActive {
+		return false
+	}
+	s.Status, s.UpdatedAt = SubscriptionPastDue, now
+	return true
+}
+
+func (s *Subscription) cancel(now time.Time) {
+	s.Status, s.UpdatedAt, s.CanceledAt = SubscriptionCanceled, now, &now
+}
+
+// Supporters are patrons with an active subscription, past due ones don't count
+func refreshSupporterCount(ctx context.Context, db DBConn, creatorID string) error {
+	subs, err := db.Subscriptions().ListByCreator(ctx, creatorID)
+	if err != nil {
+		return err
+	}
+	patrons := map[string]bool{}
+	for _, s := range subs {
+		if s.Status == SubscriptionActive {
+			patrons[s.PatronID] = true
+		}
+	}
+	err = db.Users().SetSupporterCount(ctx, creatorID, len(patrons))
+	if errors.Is(err, ErrNotFound) {
+		// Creator is gone already
+		return nil
+	}
+	return err
+}
+
+// Whether a payment covers a price, in the same token on the same chain
+func paysFor(payment Payment, price Price) bool {
+	c, ok := chain.Lookup(price.Chain)
+	if !ok || payment.Chain != c.Name || payment.Token != price.Token {
+		return false
+	}
+	token, _ := c.Token(price.Token)
+	paid, err := chain.ParseAmount(payment.Amount, token.Decimals)
+	if err != nil {
+		return false
+	}
+	owed, err := chain.ParseAmount(price.Amount, token.Decimals)
+	return err == nil && paid.Cmp(owed) >= 0
+}
+
+// RenewSubscriptions renews the payer's subscription to the creator a payment went to,
+// if it pays for the tier. A payment renews one subscription at most, the ID of its tier
+// is returned. Empty when it renewed none
+func RenewSubscriptions(ctx context.Context, db DBConn, payment Payment) (string, error) {
+	if payment.PayerID == "" {
+		return "", nil
+	}
+	subs, err := db.Subscriptions().ListByPatron(ctx, payment.PayerID)
+	if err != nil {
+		return "", err
+	}
+	for _, sub := range subs {
+		if sub.CreatorID != payment.CreatorID || !sub.open() || sub.LastPaymentTx == payment.TxHash {
+			continue
+		}
+		tier, err := db.Tiers().GetByID(ctx, sub.TierID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if !paysFor(payment, tier.Price) {
+			continue
+		}
+		sub.renew(time.Now().UTC(), payment.TxHash)
+		if err := db.Subscriptions().Update(ctx, sub); err != nil {
+			return "", err
+		}
+		return sub.TierID, refreshSupporterCount(ctx, db, sub.CreatorID)
+	}
+	return "", nil
+}
+
+// ExpireSubscriptions moves every subscription that's due along and returns how many changed
+func ExpireSubscriptions(ctx context.Context, db DBConn, now time.Time) (int, error) {
+	due, err := db.Subscriptions().ListDue(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	creators := map[string]bool{}
+	for _, sub := range due {
+		if !sub.lapse(now, subscriptionGrace) {
+			continue
+		}
+		if err := db.Subscriptions().Update(ctx, sub); err != nil {
+			return changed, fmt.Errorf("expiring subscription %s: %w", sub.ID, err)
+		}
+		changed++
+		creators[sub.CreatorID] = true
+	}
+	for creatorID := range creators {
+		if err := refreshSupporterCount(ctx, db, creatorID); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// RunSubscriptionScheduler expires lapsed subscriptions every check interval until ctx is done
+func RunSubscriptionScheduler(ctx context.Context, db DBConn, c config.SubscriptionsConfig) {
+	ticker := time.NewTicker(c.CheckInterval)
+	defer ticker.Stop()
+	for {
+		n, err := ExpireSubscriptions(ctx, db, time.Now().UTC())
+		if err != nil {
+			log.Printf("Subscription check failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Moved %d lapsed subscriptions along", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// A subscription as its patron sees it, with the tier and whose it is
+type patronSubscription struct {
+	Subscription
+	PageName string `json:"pageName"`
+	Tier     Tier   `json:"tier"`
+}
+
+// HandleListMySubscriptions lists the signed in user's subscriptions, canceled ones included
+func HandleListMySubscriptions(db DBConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		ctx := r.Context()
+		subs, err := db.Subscriptions().ListByPatron(ctx, user.ID)
+		if err != nil {
+			respondWithDBError(err, "Couldn't get subscriptions!").ServeHTTP(w, r)
+			return
+		}
+		list := []patronSubscription{}
+		for _, sub := range subs {
+			item := patronSubscription{Subscription: sub}
+			// Deleted creators and tiers leave these empty
+			if creator, err := activeUser(db.Users().GetByID(ctx, sub.CreatorID)); err == nil {
+				item.PageName = creator.PageName
+			} else if !errors.Is(err, ErrNotFound) {
+				respondWithDBError(err, "Couldn't get subscriptions!").ServeHTTP(w, r)
+				return
+			}
+			if tier, err := db.Tiers().GetByID(ctx, sub.TierID); err == nil {
+				item.Tier = tier
+			} else if !errors.Is(err, ErrNotFound) {
+				respondWithDBError(err, "Couldn't get subscriptions!").ServeHTTP(w, r)
+				return
+			}
+			list = append(list, item)
+		}
+		utils.RespondWithJSON(map[string][]patronSubscription{"subscriptions": list}, http.StatusOK)(w, r)
+	}
+}
+
+type subscribeRequest struct {
+	IdToken string `json:"idToken"`
+	TierID  string `json:"tierId"`
+}
+
+// HandleSubscribe subscribes the signed in user to a tier. Subscriptions are pending until
+// their first payment, which has to come within the grace period. They don't unlock posts
+// or take a seat in tiers with a member limit before that
+func HandleSubscribe(db DBConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := subscribeRequest{}
+		if err := utils.DecodeJSON(r.Body, &req, false); err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		ctx := r.Context()
+		tier, err := db.Tiers().GetByID(ctx, req.TierID)
+		if errors.Is(err, ErrNotFound) || err == nil && !tier.Active {
+			utils.Respond(http.StatusNotFound, "Tier not found").ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			respondWithDBError(err, "Couldn't get tier!").ServeHTTP(w, r)
+			return
+		}
+		if tier.CreatorID == user.ID {
+			utils.Respond(http.StatusBadRequest, "Creators can't subscribe to themselves").ServeHTTP(w, r)
+			return
+		}
+
+		mine, err := db.Subscriptions().ListByPatron(ctx, user.ID)
+		if err != nil {
+			respondWithDBError(err, "Couldn't subscribe!").ServeHTTP(w, r)
+			return
+		}
+		for _, s := range mine {
+			if s.CreatorID == tier.CreatorID && s.open() {
+				utils.Respond(http.StatusConflict, "Already subscribed to this creator").ServeHTTP(w, r)
+				return
+			}
+		}
+		if tier.MaxMembers > 0 {
+			members, err := db.Subscriptions().ListByCreator(ctx, tier.CreatorID)
+			if err != nil {
+				respondWithDBError(err, "Couldn't subscribe!").ServeHTTP(w, r)
+				return
+			}
+			taken := 0
+			for _, s := range members {
+				if s.TierID == tier.ID && s.current() {
+					taken++
+				}
+			}
+			if taken >= tier.MaxMembers {
+				utils.Respond(http.StatusConflict, "Tier is full").ServeHTTP(w, r)
+				return
+			}
+		}
+
+		now := time.Now().UTC()
+		sub := Subscription{
+			PatronID:  user.ID,
+			CreatorID: tier.CreatorID,
+			TierID:    tier.ID,
+			Period:    PeriodMonthly,
+			Status:    SubscriptionPending,
+			NextDueAt: now,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if err := db.Subscriptions().Create(ctx, &sub); err != nil {
+			respondWithDBError(err, "Couldn't subscribe!").ServeHTTP(w, r)
+			return
+		}
+		utils.RespondWithJSON(sub, http.StatusCreated)(w, r)
+	}
+}
+
+// HandleCancelSubscription cancels one of the signed in user's subscriptions right away
+func HandleCancelSubscription(db DBConn, id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		ctx := r.Context()
+		sub, err := db.Subscriptions().GetByID(ctx, id)
+		if errors.Is(err, ErrNotFound) || err == nil && sub.PatronID != user.ID {
+			utils.Respond(http.StatusNotFound, "Subscription not found").ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			respondWithDBError(err, "Couldn't get subscription!").ServeHTTP(w, r)
+			return
+		}
+		if sub.Status != SubscriptionCanceled {
+			sub.cancel(time.Now().UTC())
+			err = db.WithTransaction(ctx, func(ctx context.Context) error {
+				if err := db.Subscriptions().Update(ctx, sub); err != nil {
+					return err
+				}
+				return refreshSupporterCount(ctx, db, sub.CreatorID)
+			})
+			if err != nil {
+				respondWithDBError(err, "Couldn't cancel subscription!").ServeHTTP(w, r)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
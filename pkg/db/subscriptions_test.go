@@ -0,0 +1,246 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+)
+
+func TestSubscriptionTransitions(t *testing.T) {
+	due := time.Date(2021, 1, 31, 12, 0, 0, 0, time.UTC)
+	grace := 7 * 24 * time.Hour
+
+	t.Run("Renewals count from the due date", func(t *testing.T) {
+		sub := Subscription{Status: SubscriptionPastDue, NextDueAt: due}
+		sub.renew(due.Add(24*time.Hour), "0x1")
+		if want := due.AddDate(0, 1, 0); !sub.NextDueAt.Equal(want) || sub.Status != SubscriptionActive {
+			t.Errorf("got %s due %v, want active due %v", sub.Status, sub.NextDueAt, want)
+		}
+		// Lapsed for months, starts over from the payment
+		now := due.AddDate(0, 3, 0)
+		sub.renew(now, "0x2")
+		if want := now.AddDate(0, 1, 0); !sub.NextDueAt.Equal(want) || sub.LastPaymentTx != "0x2" {
+			t.Errorf("got due %v, want %v", sub.NextDueAt, want)
+		}
+	})
+
+	t.Run("Lapsed subscriptions go past due, then get canceled", func(t *testing.T) {
+		sub := Subscription{Status: SubscriptionActive, NextDueAt: due}
+		if sub.lapse(due, grace) {
+			t.Error("got a change right at the due date, want none")
+		}
+		if !sub.lapse(due.Add(time.Hour), grace) || sub.Status != SubscriptionPastDue {
+			t.Errorf("got %s, want %s", sub.Status, SubscriptionPastDue)
+		}
+		if sub.lapse(due.Add(grace), grace) {
+			t.Error("got a change within the grace period, want none")
+		}
+		if !sub.lapse(due.Add(grace+time.Hour), grace) || sub.Status != SubscriptionCanceled || sub.CanceledAt == nil {
+			t.Errorf("got %+v, want it canceled", sub)
+		}
+		if sub.lapse(due.AddDate(1, 0, 0), grace) {
+			t.Error("got a change to a canceled subscription, want none")
+		}
+	})
+
+	t.Run("Only paid subscriptions are current", func(t *testing.T) {
+		sub := Subscription{Status: SubscriptionPending, NextDueAt: due}
+		if sub.current() || sub.lapse(due.Add(time.Hour), grace) {
+			t.Errorf("got %+v, want it pending and not current", sub)
+		}
+		if (Subscription{Status: SubscriptionPastDue}).current() {
+			t.Error("got a past due subscription that was never paid current, want it not to be")
+		}
+		if !sub.lapse(due.Add(grace+time.Hour), grace) || sub.Status != SubscriptionCanceled {
+			t.Errorf("got %s, want an unpaid subscription canceled after the grace period", sub.Status)
+		}
+		sub = Subscription{Status: SubscriptionPending, NextDueAt: due}
+		sub.renew(due.Add(time.Hour), "0x1")
+		sub.lapse(due.AddDate(0, 1, 1), grace)
+		if sub.Status != SubscriptionPastDue || !sub.current() {
+			t.Errorf("got %s, want it past due and still current", sub.Status)
+		}
+	})
+}
+
+func TestSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	creator := &User{Email: "creator@koen.com", PageName: "koen-san"}
+	patron := &User{Email: "patron@koen.com", PageName: "patron"}
+	other := &User{Email: "other@koen.com", PageName: "other"}
+	for _, u := range []*User{creator, patron, other} {
+		if err := conn.Users().Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	supporter := &Tier{CreatorID: creator.ID, Name: "Supporter", Price: Price{Chain: "polygon", Token: "USDC", Amount: "5"}, Active: true}
+	exclusive := &Tier{CreatorID: creator.ID, Name: "Exclusive", Price: Price{Chain: "polygon", Token: "USDC", Amount: "50"},
+		MaxMembers: 1, Active: true}
+	hidden := &Tier{CreatorID: creator.ID, Name: "Hidden", Price: Price{Chain: "polygon", Token: "USDC", Amount: "1"}}
+	for _, tier := range []*Tier{supporter, exclusive, hidden} {
+		if err := conn.Tiers().Create(ctx, tier); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serve := func(handler http.HandlerFunc, method, email, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/users/me/subscriptions", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), "userData", auth.Claims{
+			GoogleClaims: auth.GoogleClaims{Email: email},
+		}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	subscribe := func(email, tierID string) *httptest.ResponseRecorder {
+		return serve(HandleSubscribe(conn), "POST", email, `{"tierId": "`+tierID+`"}`)
+	}
+	supporters := func() int {
+		u, _ := conn.Users().GetByID(ctx, creator.ID)
+		return u.SupporterCount
+	}
+
+	var sub Subscription
+	t.Run("Subscribing starts pending", func(t *testing.T) {
+		rr := subscribe("patron@koen.com", supporter.ID)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body)
+		}
+		json.Unmarshal(rr.Body.Bytes(), &sub)
+		if sub.Status != SubscriptionPending || sub.Period != PeriodMonthly || sub.TierID != supporter.ID {
+			t.Errorf("got %+v, want a monthly pending subscription", sub)
+		}
+
+		cases := []struct {
+			name, email, tierID string
+			code                int
+		}{
+			{"twice to a creator", "patron@koen.com", exclusive.ID, http.StatusConflict},
+			{"to yourself", "creator@koen.com", supporter.ID, http.StatusBadRequest},
+			{"to an inactive tier", "other@koen.com", hidden.ID, http.StatusNotFound},
+			{"to a missing tier", "other@koen.com", "bleh", http.StatusNotFound},
+		}
+		for _, c := range cases {
+			if rr := subscribe(c.email, c.tierID); rr.Code != c.code {
+				t.Errorf("%s: got %v, want %v", c.name, rr.Code, c.code)
+			}
+		}
+	})
+
+	t.Run("Tiers fill up", func(t *testing.T) {
+		if rr := subscribe("other@koen.com", exclusive.ID); rr.Code != http.StatusCreated {
+			t.Fatalf("got %v, want %v", rr.Code, http.StatusCreated)
+		}
+		if rr := subscribe("creator@koen.com", exclusive.ID); rr.Code != http.StatusBadRequest {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusBadRequest)
+		}
+		third := &User{Email: "third@koen.com", PageName: "third"}
+		fourth := &User{Email: "fourth@koen.com", PageName: "fourth"}
+		for _, u := range []*User{third, fourth} {
+			conn.Users().Create(ctx, u)
+		}
+		// Nobody paid for the place yet
+		if rr := subscribe("third@koen.com", exclusive.ID); rr.Code != http.StatusCreated {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusCreated)
+		}
+		payment := Payment{Chain: "polygon", TxHash: "0xexclusive", CreatorID: creator.ID, PayerID: other.ID, Token: "USDC", Amount: "50"}
+		if tierID, err := RenewSubscriptions(ctx, conn, payment); err != nil || tierID != exclusive.ID {
+			t.Fatalf("got %q %v, want the exclusive tier renewed", tierID, err)
+		}
+		if rr := subscribe("fourth@koen.com", exclusive.ID); rr.Code != http.StatusConflict {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusConflict)
+		}
+	})
+
+	t.Run("Matching payments renew", func(t *testing.T) {
+		payment := Payment{Chain: "polygon", TxHash: "0x1", CreatorID: creator.ID, PayerID: patron.ID, Token: "USDC", Amount: "4.99"}
+		if tierID, err := RenewSubscriptions(ctx, conn, payment); err != nil || tierID != "" {
+			t.Fatalf("got %q %v, want nothing renewed", tierID, err)
+		}
+		if got, _ := conn.Subscriptions().GetByID(ctx, sub.ID); got.Status != SubscriptionPending {
+			t.Errorf("got %s after paying too little, want %s", got.Status, SubscriptionPending)
+		}
+
+		payment.Amount = "5"
+		for i := 0; i < 2; i++ {
+			tierID, err := RenewSubscriptions(ctx, conn, payment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{sub.TierID, ""}[i]; tierID != want {
+				t.Errorf("got tier %q, want %q", tierID, want)
+			}
+		}
+		got, _ := conn.Subscriptions().GetByID(ctx, sub.ID)
+		if want := sub.NextDueAt.AddDate(0, 1, 0); got.Status != SubscriptionActive || !got.NextDueAt.Equal(want) {
+			t.Errorf("got %s due %v, want active due %v after one renewal", got.Status, got.NextDueAt, want)
+		}
+		if supporters() != 2 {
+			t.Errorf("got %d supporters, want 2", supporters())
+		}
+	})
+
+	t.Run("Lapsed subscriptions expire", func(t *testing.T) {
+		active, _ := conn.Subscriptions().GetByID(ctx, sub.ID)
+		n, err := ExpireSubscriptions(ctx, conn, active.NextDueAt.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The third patron never paid and is past the grace period by now
+		if n != 3 {
+			t.Errorf("got %d changed, want 3", n)
+		}
+		if got, _ := conn.Subscriptions().GetByID(ctx, sub.ID); got.Status != SubscriptionPastDue {
+			t.Errorf("got %s, want %s", got.Status, SubscriptionPastDue)
+		}
+		if supporters() != 0 {
+			t.Errorf("got %d supporters, want 0", supporters())
+		}
+		// Paid once, so the place is kept for the grace period
+		if rr := subscribe("third@koen.com", exclusive.ID); rr.Code != http.StatusConflict {
+			t.Errorf("got %v within the grace period, want %v", rr.Code, http.StatusConflict)
+		}
+
+		if n, err := ExpireSubscriptions(ctx, conn, active.NextDueAt.Add(subscriptionGrace+time.Hour)); err != nil || n != 2 {
+			t.Errorf("got %d changed %v, want 2", n, err)
+		}
+		if rr := subscribe("third@koen.com", exclusive.ID); rr.Code != http.StatusCreated {
+			t.Errorf("got %v for a freed up place, want %v", rr.Code, http.StatusCreated)
+		}
+	})
+
+	t.Run("Listing and canceling", func(t *testing.T) {
+		rr := serve(HandleListMySubscriptions(conn), "GET", "patron@koen.com", "")
+		var body struct {
+			Subscriptions []patronSubscription `json:"subscriptions"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if len(body.Subscriptions) != 1 || body.Subscriptions[0].PageName != "koen-san" || body.Subscriptions[0].Tier.Name != "Supporter" {
+			t.Errorf("got %+v, want the subscription with its creator and tier", body.Subscriptions)
+		}
+
+		if rr := serve(HandleCancelSubscription(conn, sub.ID), "DELETE", "other@koen.com", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("got %v for someone else's subscription, want %v", rr.Code, http.StatusNotFound)
+		}
+		for i := 0; i < 2; i++ {
+			if rr := serve(HandleCancelSubscription(conn, sub.ID), "DELETE", "patron@koen.com", ""); rr.Code != http.StatusNoContent {
+				t.Errorf("got %v, want %v", rr.Code, http.StatusNoContent)
+			}
+		}
+		if got, _ := conn.Subscriptions().GetByID(ctx, sub.ID); got.Status != SubscriptionCanceled {
+			t.Errorf("got %s, want %s", got.Status, SubscriptionCanceled)
+		}
+		if rr := subscribe("patron@koen.com", supporter.ID); rr.Code != http.StatusCreated {
+			t.Errorf("got %v subscribing again, want %v", rr.Code, http.StatusCreated)
+		}
+	})
+}
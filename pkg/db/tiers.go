@@ -0,0 +1,250 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+)
+
+const (
+	MaxTiers          = 10
+	MaxTierNameLength = 50
+	MaxTierDescLength = 1000
+	MaxBenefits       = 10
+	MaxBenefitLength  = 200
+)
+
+// Tier is a membership level a creator offers to supporters
+type Tier struct {
+	// Assigned by the repository on Create
+	ID          string   `bson:"-" json:"id"`
+	CreatorID   string   `bson:"creatorId" json:"-"`
+	Name        string   `bson:"name" json:"name"`
+	Description string   `bson:"description" json:"description"`
+	Price       Price    `bson:"price" json:"price"`
+	Benefits    []string `bson:"benefits" json:"benefits"`
+	// Zero means there's no limit
+	MaxMembers int `bson:"maxMembers" json:"maxMembers"`
+	// Inactive tiers are hidden from the creator's page and can't be joined
+	Active    bool      `bson:"active" json:"active"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+type Price struct {
+	// One of chain.Chains and a token on it
+	Chain string `bson:"chain" json:"chain"`
+	Token string `bson:"token" json:"token"`
+	// Decimal amount of the token, e.g. "2.5"
+	Amount string `bson:"amount" json:"amount"`
+}
+
+// TierRepository stores tiers. Lookups return ErrNotFound when there's no match
+type TierRepository interface {
+	Create(ctx context.Context, tier *Tier) error
+	GetByID(ctx context.Context, id string) (Tier, error)
+	// Tiers of a creator, oldest first
+	ListByCreator(ctx context.Context, creatorID string) ([]Tier, error)
+	// Update saves everything but the ID, creator and creation time
+	Update(ctx context.Context, tier Tier) error
+	Delete(ctx context.Context, id string) error
+	DeleteByCreator(ctx context.Context, creatorID string) error
+}
+
+// Validate checks a tier and puts its price in canonical form, like "2.5 USDC on polygon"
+func (t *Tier) Validate() FieldErrors {
+	errs := FieldErrors{}
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		errs["name"] = "name is required"
+	} else if utf8.RuneCountInString(t.Name) > MaxTierNameLength {
+		errs["name"] = "name is too long"
+	}
+	if utf8.RuneCountInString(t.Description) > MaxTierDescLength {
+		errs["description"] = "description is too long"
+	}
+	if len(t.Benefits) > MaxBenefits {
+		errs["benefits"] = "too many benefits"
+	}
+	for _, b := range t.Benefits {
+		if strings.TrimSpace(b) == "" || utf8.RuneCountInString(b) > MaxBenefitLength {
+			errs["benefits"] = "benefits can't be empty or too long"
+		}
+	}
+	if t.MaxMembers < 0 {
+		errs["maxMembers"] = "maxMembers can't be negative"
+	}
+
+	c, ok := chain.Lookup(t.Price.Chain)
+	if !ok {
+		errs["price"] = "unsupported chain"
+	} else if token, ok := c.Token(t.Price.Token); !ok {
+		errs["price"] = "unsupported token on " + c.Name
+	} else if units, err := chain.ParseAmount(t.Price.Amount, token.Decimals); err != nil {
+		errs["price"] = err.Error()
+	} else {
+		t.Price = Price{Chain: c.Name, Token: token.Symbol, Amount: chain.FormatAmount(units, token.Decimals)}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Only what's on offer right now, for the creator's public page
+func activeTiers(ctx context.Context, db DBConn, creatorID string) ([]Tier, error) {
+	all, err := db.Tiers().ListByCreator(ctx, creatorID)
+	if err != nil {
+		return nil, err
+	}
+	tiers := []Tier{}
+	for _, t := range all {
+		if t.Active {
+			tiers = append(tiers, t)
+		}
+	}
+	return tiers, nil
+}
+
+// Fields a tier is created or patched with. Anything left out of a patch stays as it is
+type tierInput struct {
+	IdToken     string    `json:"idToken"`
+	Name        *string   `json:"name"`
+	Description *string   `json:"description"`
+	Price       *Price    `json:"price"`
+	Benefits    *[]string `json:"benefits"`
+	MaxMembers  *int      `json:"maxMembers"`
+	Active      *bool     `json:"active"`
+}
+
+func (in tierInput) apply(t *Tier) {
+	setString(&t.Name, in.Name)
+	setString(&t.Description, in.Description)
+	if in.Price != nil {
+		t.Price = *in.Price
+	}
+	if in.Benefits != nil {
+		t.Benefits = *in.Benefits
+	}
+	if in.MaxMembers != nil {
+		t.MaxMembers = *in.MaxMembers
+	}
+	setBool(&t.Active, in.Active)
+}
+
+// Decodes and applies a tierInput, responding with what's wrong if it doesn't make a valid tier
+func readTier(w http.ResponseWriter, r *http.Request, tier *Tier) bool {
+	in := tierInput{}
+	if err := utils.DecodeJSON(r.Body, &in, false); err != nil {
+		utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+		return false
+	}
+	in.apply(tier)
+	if errs := tier.Validate(); errs != nil {
+		utils.RespondWithJSON(map[string]FieldErrors{"errors": errs}, http.StatusBadRequest)(w, r)
+		return false
+	}
+	return true
+}
+
+// Finds one of the signed in user's tiers. Other creators' tiers are as good as missing
+func ownTier(w http.ResponseWriter, r *http.Request, db DBConn, id string) (Tier, bool) {
+	user, ok := currentUser(w, r, db)
+	if !ok {
+		return Tier{}, false
+	}
+	tier, err := db.Tiers().GetByID(r.Context(), id)
+	if errors.Is(err, ErrNotFound) || err == nil && tier.CreatorID != user.ID {
+		utils.Respond(http.StatusNotFound, "Tier not found").ServeHTTP(w, r)
+		return Tier{}, false
+	}
+	if err != nil {
+		respondWithDBError(err, "Couldn't get tier!").ServeHTTP(w, r)
+		return Tier{}, false
+	}
+	return tier, true
+}
+
+// HandleListMyTiers lists all of the signed in user's tiers, inactive ones included
+func HandleListMyTiers(db DBConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		tiers, err := db.Tiers().ListByCreator(r.Context(), user.ID)
+		if err != nil {
+			respondWithDBError(err, "Couldn't get tiers!").ServeHTTP(w, r)
+			return
+		}
+		utils.RespondWithJSON(map[string][]Tier{"tiers": tiers}, http.StatusOK)(w, r)
+	}
+}
+
+// HandleCreateTier adds a tier for the signed in user. Tiers are active unless told otherwise
+func HandleCreateTier(db DBConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		now := time.Now().UTC()
+		tier := Tier{CreatorID: user.ID, Active: true, CreatedAt: now, UpdatedAt: now}
+		if !readTier(w, r, &tier) {
+			return
+		}
+
+		existing, err := db.Tiers().ListByCreator(r.Context(), user.ID)
+		if err != nil {
+			respondWithDBError(err, "Couldn't create tier!").ServeHTTP(w, r)
+			return
+		}
+		if len(existing) >= MaxTiers {
+			utils.Respond(http.StatusConflict, fmt.Sprintf("Creators can have at most %d tiers", MaxTiers)).ServeHTTP(w, r)
+			return
+		}
+		if err := db.Tiers().Create(r.Context(), &tier); err != nil {
+			respondWithDBError(err, "Couldn't create tier!").ServeHTTP(w, r)
+			return
+		}
+		utils.RespondWithJSON(tier, http.StatusCreated)(w, r)
+	}
+}
+
+// HandleUpdateTier applies a partial update to one of the signed in user's tiers
+func HandleUpdateTier(db DBConn, id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tier, ok := ownTier(w, r, db, id)
+		if !ok || !readTier(w, r, &tier) {
+			return
+		}
+		tier.UpdatedAt = time.Now().UTC()
+		if err := db.Tiers().Update(r.Context(), tier); err != nil {
+			respondWithDBError(err, "Couldn't update tier!").ServeHTTP(w, r)
+			return
+		}
+		utils.RespondWithJSON(tier, http.StatusOK)(w, r)
+	}
+}
+
+func HandleDeleteTier(db DBConn, id string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tier, ok := ownTier(w, r, db, id)
+		if !ok {
+			return
+		}
+		if err := db.Tiers().Delete(r.Context(), tier.ID); err != nil {
+			respondWithDBError(err, "Couldn't delete tier!").ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+)
+
+func TestTierValidation(t *testing.T) {
+	tier := Tier{Name: " Supporter ", Price: Price{Chain: "Polygon", Token: "usdc", Amount: "5.50"}}
+	if errs := tier.Validate(); errs != nil {
+		t.Fatalf("got %v, want no errors", errs)
+	}
+	if want := (Price{Chain: "polygon", Token: "USDC", Amount: "5.5"}); tier.Price != want || tier.Name != "Supporter" {
+		t.Errorf("got %+v, want it in canonical form", tier)
+	}
+
+	price := Price{Chain: "polygon", Token: "USDC", Amount: "5"}
+	cases := []struct {
+		tier  Tier
+		field string
+	}{
+		{Tier{Price: price}, "name"},
+		{Tier{Name: strings.Repeat("a", MaxTierNameLength+1), Price: price}, "name"},
+		{Tier{Name: "a", Price: price, Benefits: []string{" "}}, "benefits"},
+		{Tier{Name: "a", Price: price, MaxMembers: -1}, "maxMembers"},
+		{Tier{Name: "a", Price: Price{Chain: "solana", Token: "USDC", Amount: "5"}}, "price"},
+		{Tier{Name: "a", Price: Price{Chain: "polygon", Token: "ETH", Amount: "5"}}, "price"},
+		{Tier{Name: "a", Price: Price{Chain: "polygon", Token: "USDC", Amount: "0.0000001"}}, "price"},
+		{Tier{Name: "a", Price: Price{Chain: "polygon", Token: "USDC", Amount: "-5"}}, "price"},
+	}
+	for _, c := range cases {
+		errs := c.tier.Validate()
+		if _, ok := errs[c.field]; !ok || len(errs) != 1 {
+			t.Errorf("got %v for %+v, want an error on %s", errs, c.tier, c.field)
+		}
+	}
+}
+
+func TestTierHandlers(t *testing.T) {
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	creator := &User{Email: "test@koen.com", PageName: "koen-san"}
+	other := &User{Email: "other@koen.com", PageName: "other"}
+	for _, u := range []*User{creator, other} {
+		if err := conn.Users().Create(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serve := func(handler http.HandlerFunc, method, email, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/users/me/tiers", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), "userData", auth.Claims{
+			GoogleClaims: auth.GoogleClaims{Email: email},
+		}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	create := func(body string) (Tier, *httptest.ResponseRecorder) {
+		rr := serve(HandleCreateTier(conn), "POST", "test@koen.com", body)
+		var tier Tier
+		json.Unmarshal(rr.Body.Bytes(), &tier)
+		return tier, rr
+	}
+
+	supporter, rr := create(`{"name": "Supporter", "price": {"chain": "polygon", "token": "usdc", "amount": "5.0"},
+		"benefits": ["Early access"]}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+	if !supporter.Active || supporter.Price.Amount != "5" || supporter.ID == "" {
+		t.Errorf("got %+v, want an active tier with its price in canonical form", supporter)
+	}
+	hidden, _ := create(`{"name": "Secret", "price": {"chain": "ethereum", "token": "ETH", "amount": "0.1"}, "active": false}`)
+
+	t.Run("HTTP 400 with errors per field", func(t *testing.T) {
+		_, rr := create(`{"name": "", "price": {"chain": "polygon", "token": "DOGE", "amount": "1"}}`)
+		var body struct {
+			Errors FieldErrors `json:"errors"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if rr.Code != http.StatusBadRequest || body.Errors["name"] == "" || body.Errors["price"] == "" {
+			t.Errorf("got %v %s, want 400 with errors on name and price", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("Creator page only shows active tiers", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/users/pageName/koen-san", nil)
+		rr := httptest.NewRecorder()
+		GetUser(conn, "koen-san").ServeHTTP(rr, req)
+		var page struct {
+			PageName string `json:"pageName"`
+			Tiers    []Tier `json:"tiers"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		if page.PageName != "koen-san" || len(page.Tiers) != 1 || page.Tiers[0].ID != supporter.ID {
+			t.Errorf("got %s, want the profile with just the active tier", rr.Body)
+		}
+	})
+
+	t.Run("Owners see all their tiers", func(t *testing.T) {
+		rr := serve(HandleListMyTiers(conn), "GET", "test@koen.com", "")
+		var body struct {
+			Tiers []Tier `json:"tiers"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		if len(body.Tiers) != 2 || body.Tiers[1].ID != hidden.ID {
+			t.Errorf("got %s, want both tiers", rr.Body)
+		}
+	})
+
+	t.Run("Partial update keeps other fields", func(t *testing.T) {
+		rr := serve(HandleUpdateTier(conn, supporter.ID), "PATCH", "test@koen.com", `{"maxMembers": 100}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body)
+		}
+		got, _ := conn.Tiers().GetByID(context.Background(), supporter.ID)
+		if got.MaxMembers != 100 || got.Name != "Supporter" || len(got.Benefits) != 1 {
+			t.Errorf("got %+v, want maxMembers changed and the rest kept", got)
+		}
+	})
+
+	t.Run("HTTP 404 on someone else's tier", func(t *testing.T) {
+		if rr := serve(HandleUpdateTier(conn, supporter.ID), "PATCH", "other@koen.com", `{"name": "Mine"}`); rr.Code != http.StatusNotFound {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusNotFound)
+		}
+		if rr := serve(HandleDeleteTier(conn, supporter.ID), "DELETE", "other@koen.com", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if rr := serve(HandleDeleteTier(conn, hidden.ID), "DELETE", "test@koen.com", ""); rr.Code != http.StatusNoContent {
+			t.Fatalf("got %v, want %v", rr.Code, http.StatusNoContent)
+		}
+		if _, err := conn.Tiers().GetByID(context.Background(), hidden.ID); err != ErrNotFound {
+			t.Errorf("got %v, want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("HTTP 409 past the tier limit", func(t *testing.T) {
+		for i := 1; i < MaxTiers; i++ {
+			create(`{"name": "More", "price": {"chain": "polygon", "token": "MATIC", "amount": "1"}}`)
+		}
+		if _, rr := create(`{"name": "One too many", "price": {"chain": "polygon", "token": "MATIC", "amount": "1"}}`); rr.Code != http.StatusConflict {
+			t.Errorf("got %v, want %v", rr.Code, http.StatusConflict)
+		}
+	})
+}
@@ -0,0 +1,318 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/ens"
+	"github.com/cryptopatron/koen-backend/pkg/hdwallet"
+	"github.com/cryptopatron/koen-backend/pkg/pagename"
+	"github.com/cryptopatron/koen-backend/pkg/pagination"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrNotFound is returned by repositories when nothing matches a lookup
+var ErrNotFound = errors.New("not found")
+
+// ErrVersionMismatch is returned when updating a user that changed since it was read
+var ErrVersionMismatch = errors.New("user was updated by someone else")
+
+type User struct {
+	// Assigned by the repository on Create, never sent to clients
+	ID                                string `bson:"-" json:"-"`
+	Email                             string `bson:"email" json:"email"` // Used for identifying Google users
+	Name                              string `bson:"name" json:"name"`
+	PageName                          string `bson:"pageName" json:"pageName"`
+	GeneratedMaticWalletPublicAddress string `bson:"generatedMaticWalletPublicAddress" json:"generatedMaticWalletPublicAddress"`
+	MetaMaskWalletPublicAddress       string `bson:"metaMaskWalletPublicAddress" json:"metaMaskWalletPublicAddress"` // Used for identifying MetaMask users
+	// Where GeneratedMaticWalletPublicAddress was derived from the configured xpub.
+	// Nil for users from before we derived them, whose address came from the web app
+	WalletIndex *uint32 `bson:"walletIndex,omitempty" json:"-"`
+	Profile     `bson:",inline"`
+	// How many people support this creator, search ranks by it
+	SupporterCount int       `bson:"supporterCount" json:"supporterCount"`
+	CreatedAt      time.Time `bson:"createdAt" json:"createdAt"`
+	// Changes on every update, clients send back the one they saw so they don't overwrite each other
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+	// Set when the user deletes their account, it's purged once the retention period is over
+	DeletedAt time.Time `bson:"deletedAt,omitempty" json:"-"`
+}
+
+// UserRepository stores users. Lookups are case-insensitive and
+// return ErrNotFound when there's no match, writes return a *ConflictError
+// when a unique field is already taken
+type UserRepository interface {
+	Create(ctx context.Context, user *User) error
+	GetByID(ctx context.Context, id string) (User, error)
+	GetByEmail(ctx context.Context, email string) (User, error)
+	GetByWallet(ctx context.Context, address string) (User, error)
+	GetByPageName(ctx context.Context, pageName string) (User, error)
+	// UpdatePageName renames the user with the given ID
+	UpdatePageName(ctx context.Context, id, pageName string) error
+	// Update saves the name and profile of user, as long as it's still at the given
+	// version. Returns ErrVersionMismatch if someone else updated it in the meantime
+	Update(ctx context.Context, user User, version time.Time) error
+	// NextWalletIndex hands out derivation indexes for generated wallets. The same index is
+	// never handed out twice, not even after its user is purged, unless the transaction it
+	// was handed out in doesn't go through
+	NextWalletIndex(ctx context.Context) (uint32, error)
+	// SetSupporterCount is kept up to date by subscriptions
+	SetSupporterCount(ctx context.Context, id string, n int) error
+	// SoftDelete marks a user as deleted, Restore takes that back and Delete removes them for good
+	SoftDelete(ctx context.Context, id string, at time.Time) error
+	Restore(ctx context.Context, id string) error
+	Delete(ctx context.Context, id string) error
+	// Users that were soft deleted before the given time
+	ListDeletedBefore(ctx context.Context, before time.Time) ([]User, error)
+	// Active users with a generated deposit address, the ones payments can reach
+	ListWithDepositAddress(ctx context.Context) ([]User, error)
+	// List pages through all users ordered by createdAt
+	List(ctx context.Context, p pagination.Params) ([]User, *pagination.Key, error)
+	// Search finds listed creators, fetching one more than q.Limit so callers know if there's another page
+	Search(ctx context.Context, q SearchQuery) ([]User, error)
+}
+
+func (u User) key() pagination.Key {
+	return pagination.Key{Time: u.CreatedAt, ID: u.ID}
+}
+
+// Soft deleted users stay in storage until they're purged,
+// but as far as the API is concerned they're gone
+func activeUser(user User, err error) (User, error) {
+	if err == nil && !user.DeletedAt.IsZero() {
+		return User{}, ErrNotFound
+	}
+	return user, err
+}
+
+// Looks up the user behind a validated JWT, either by email or wallet address
+func userFromClaims(ctx context.Context, users UserRepository, claims auth.Claims) (User, error) {
+	if claims.Email != "" {
+		return activeUser(users.GetByEmail(ctx, claims.Email))
+	}
+	return activeUser(users.GetByWallet(ctx, claims.WalletPublicAddress))
+}
+
+// Handlers use this to turn data layer errors they don't handle themselves into a response
+func respondWithDBError(err error, fallback string) http.HandlerFunc {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return utils.Respond(http.StatusGatewayTimeout, "Database took too long to respond")
+	}
+	return utils.Respond(http.StatusInternalServerError, fallback)
+}
+
+// ErrWalletMismatch is returned when the web app sends a generated wallet that isn't the one derived for the user
+var ErrWalletMismatch = errors.New("generated wallet doesn't match the one derived for the user")
+
+// Hands out the next deposit address, skipping the rare index that doesn't lead to a key
+func nextDepositAddress(ctx context.Context, users UserRepository, deposits *hdwallet.Deposits) (uint32, common.Address, error) {
+	for {
+		index, err := users.NextWalletIndex(ctx)
+		if err != nil {
+			return 0, common.Address{}, err
+		}
+		address, err := deposits.Address(index)
+		if errors.Is(err, hdwallet.ErrInvalidChild) {
+			continue
+		}
+		return index, address, err
+	}
+}
+
+// How long signing up waits on ENS before going on without it
+const ensTimeout = 5 * time.Second
+
+// Wallet users start out with their ENS name and avatar, unless they sent their own
+func fillFromENS(ctx context.Context, names *ens.Resolver, user *User) {
+	if names == nil || !common.IsHexAddress(user.MetaMaskWalletPublicAddress) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, ensTimeout)
+	defer cancel()
+	profile, err := names.Lookup(ctx, common.HexToAddress(user.MetaMaskWalletPublicAddress))
+	if err != nil {
+		log.Printf("Couldn't look up the ENS name of %s: %v", user.MetaMaskWalletPublicAddress, err)
+		return
+	}
+	if user.Name == "" && utf8.RuneCountInString(profile.Name) <= MaxNameLength {
+		user.Name = profile.Name
+	}
+	if user.AvatarURL == "" && profile.Avatar != "" && validURL(profile.Avatar) {
+		user.AvatarURL = profile.Avatar
+	}
+}
+
+// Generated wallets are derived here, the web app can still send the address
+// it expects but it only goes through if it's the one we derived. names fills in
+// wallet users' profiles from ENS and can be nil. Signing up with the email or
+// wallet of an account that's deleted but not purged yet restores that account
+func HandleCreateUser(db DBConn, deposits *hdwallet.Deposits, names *ens.Resolver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := &User{}
+		err := utils.DecodeJSON(r.Body, user, true)
+		if err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		// Counted from subscriptions and set by uploads, never taken from the request
+		user.SupporterCount = 0
+		user.Avatar, user.Banner = nil, nil
+
+		ctx := r.Context()
+		// TODO: Switch to Generic claims
+		userData, ok := ctx.Value("userData").(auth.Claims)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+			return
+		}
+		if deleted, ok, err := deletedUser(ctx, db.Users(), userData); err != nil {
+			respondWithDBError(err, "Couldn't create new user!").ServeHTTP(w, r)
+			return
+		} else if ok {
+			restoreUser(w, r, db, deleted)
+			return
+		}
+
+		if user.PageName != "" {
+			user.PageName = pagename.Normalize(user.PageName)
+			if err := pagename.Validate(user.PageName); err != nil {
+				utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+				return
+			}
+		}
+		if errs := user.Validate(); errs != nil {
+			utils.RespondWithJSON(map[string]FieldErrors{"errors": errs}, http.StatusBadRequest)(w, r)
+			return
+		}
+
+		// Only what the sign in proves is kept. An email or wallet from the body could be
+		// anyone's, and whoever signs in with it would end up in this account
+		if userData.Email != "" {
+			user.Name = userData.FirstName + " " + userData.LastName
+			user.Email = userData.Email
+			user.MetaMaskWalletPublicAddress = ""
+		} else {
+			user.Email = ""
+			user.MetaMaskWalletPublicAddress = userData.WalletPublicAddress
+			fillFromENS(ctx, names, user)
+		}
+
+		user.CreatedAt = newVersion()
+		user.UpdatedAt = user.CreatedAt
+		if user.DisplayCurrency == "" {
+			user.DisplayCurrency = DefaultCurrency
+		}
+		// Onboarding writes go through together or not at all
+		err = db.WithTransaction(ctx, func(ctx context.Context) error {
+			held, err := pageNameHeld(ctx, db, user.PageName, "")
+			if err != nil {
+				return err
+			}
+			if held {
+				return &ConflictError{Field: "pageName"}
+			}
+			index, address, err := nextDepositAddress(ctx, db.Users(), deposits)
+			if err != nil {
+				return err
+			}
+			if user.GeneratedMaticWalletPublicAddress != "" && !deposits.Verify(index, user.GeneratedMaticWalletPublicAddress) {
+				return ErrWalletMismatch
+			}
+			user.WalletIndex = &index
+			user.GeneratedMaticWalletPublicAddress = address.Hex()
+			if err := db.Users().Create(ctx, user); err != nil {
+				return err
+			}
+			return db.Audit().Record(ctx, AuditEvent{
+				Type:   AuditUserCreated,
+				UserID: user.ID,
+				Data:   map[string]string{"pageName": user.PageName},
+				At:     user.CreatedAt,
+			})
+		})
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			utils.RespondWithJSON(map[string]string{"error": conflict.Error(), "field": conflict.Field}, http.StatusConflict)(w, r)
+			return
+		}
+		if errors.Is(err, ErrWalletMismatch) {
+			errs := FieldErrors{"generatedMaticWalletPublicAddress": "doesn't match the address derived for you"}
+			utils.RespondWithJSON(map[string]FieldErrors{"errors": errs}, http.StatusBadRequest)(w, r)
+			return
+		}
+		if err != nil {
+			respondWithDBError(err, "Couldn't create new user!").ServeHTTP(w, r)
+			return
+		}
+		utils.RespondWithJSON(*user, http.StatusOK)(w, r)
+	}
+}
+
+func HandleGetUser(db DBConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		userData, ok := ctx.Value("userData").(auth.Claims)
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Get user either by Email or public wallet key
+		user, err := userFromClaims(ctx, db.Users(), userData)
+		respondWithUser(user, err).ServeHTTP(w, r)
+	}
+}
+
+// Looking up a page by a name it had before gets a redirect to the current one
+func GetUser(db DBConn, pageName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := activeUser(db.Users().GetByPageName(r.Context(), pageName))
+		if errors.Is(err, ErrNotFound) {
+			if renamed, err := renamedUser(r.Context(), db, pageName); err == nil {
+				respondWithRedirect(r, renamed.PageName).ServeHTTP(w, r)
+				return
+			} else if !errors.Is(err, ErrNotFound) {
+				respondWithUser(User{}, err).ServeHTTP(w, r)
+				return
+			}
+		}
+		if err != nil {
+			respondWithUser(User{}, err).ServeHTTP(w, r)
+			return
+		}
+		tiers, err := activeTiers(r.Context(), db, user.ID)
+		if err != nil {
+			respondWithUser(User{}, err).ServeHTTP(w, r)
+			return
+		}
+		page := creatorPage{publicCreator: newPublicCreator(user), DepositAddress: user.GeneratedMaticWalletPublicAddress, Tiers: tiers}
+		utils.RespondWithJSON(page, http.StatusOK)(w, r)
+	}
+}
+
+// What a creator's page shows, their public profile with the tiers on offer.
+// Patrons pay to the generated wallet, so that one address is on the page
+type creatorPage struct {
+	publicCreator
+	DepositAddress string `json:"generatedMaticWalletPublicAddress"`
+	Tiers          []Tier `json:"tiers"`
+}
+
+// Unknown users get an empty object rather than a 404, the web app relies on it
+func respondWithUser(user User, err error) http.HandlerFunc {
+	if errors.Is(err, ErrNotFound) {
+		return utils.RespondWithJSON(struct{}{}, http.StatusOK)
+	}
+	if err != nil {
+		fmt.Print(err)
+		return respondWithDBError(err, "Couldn't get user!")
+	}
+	return utils.RespondWithJSON(user, http.StatusOK)
+}
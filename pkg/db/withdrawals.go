@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/gating"
+	"github.com/cryptopatron/koen-backend/pkg/signer"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Withdrawal statuses. Pending ones were recorded but not broadcast yet, sent ones are
+// in a node's mempool and failed ones never made it there
+const (
+	WithdrawalPending = "pending"
+	WithdrawalSent    = "sent"
+	WithdrawalFailed  = "failed"
+)
+
+// Withdrawal is a creator paying out what they earned to their own wallet
+type Withdrawal struct {
+	// Assigned by the repository on Create
+	ID        string `bson:"-" json:"id"`
+	CreatorID string `bson:"creatorId" json:"-"`
+	Chain     string `bson:"chain" json:"chain"`
+	Token     string `bson:"token" json:"token"`
+	// Decimal amount of the token
+	Amount string `bson:"amount" json:"amount"`
+	To     string `bson:"to" json:"to"`
+	Status string `bson:"status" json:"status"`
+	// Set once it's sent
+	TxHash    string    `bson:"txHash" json:"txHash,omitempty"`
+	Nonce     uint64    `bson:"nonce" json:"nonce,omitempty"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+}
+
+// WithdrawalRepository stores withdrawals. Updates return ErrNotFound when there's no match
+type WithdrawalRepository interface {
+	Create(ctx context.Context, w *Withdrawal) error
+	// Update saves the status, transaction and when it was updated
+	Update(ctx context.Context, w Withdrawal) error
+	// Oldest first
+	ListByCreator(ctx context.Context, creatorID string) ([]Withdrawal, error)
+}
+
+// Counts against the limits, failed ones were never paid out
+func (w Withdrawal) counts() bool {
+	return w.Status != WithdrawalFailed
+}
+
+// Checks and records withdrawals one at a time, so two at once can't both spend the same
+// balance. Only within this process, withdrawals are meant to be handled by a single instance
+var withdrawalMu sync.Mutex
+
+type withdrawalRequest struct {
+	// Defaults to polygon
+	Chain  string `json:"chain"`
+	Token  string `json:"token"`
+	Amount string `json:"amount"`
+}
+
+// Checks amount against the limits on the last 24 hours of withdrawals. Limits are per token
+// symbol, so the same stablecoin on two chains shares one
+func checkWithdrawalLimits(limits config.WithdrawalsConfig, token chain.Token, amount *big.Int,
+	withdrawals []Withdrawal, now time.Time) error {
+	// A limit that doesn't parse for the token turns its withdrawals off like a missing one
+	limit, err := chain.ParseAmount(limits.DailyLimits[token.Symbol], token.Decimals)
+	if err != nil {
+		return fmt.Errorf("%s can't be withdrawn", token.Symbol)
+	}
+	count, total := 0, new(big.Int).Set(amount)
+	for _, w := range withdrawals {
+		if !w.counts() || w.CreatedAt.Before(now.Add(-24*time.Hour)) {
+			continue
+		}
+		count++
+		if w.Token == token.Symbol {
+			if a, err := chain.ParseAmount(w.Amount, token.Decimals); err == nil {
+				total.Add(total, a)
+			}
+		}
+	}
+	if count >= limits.MaxPerDay {
+		return fmt.Errorf("no more than %d withdrawals a day", limits.MaxPerDay)
+	}
+	if total.Cmp(limit) > 0 {
+		return fmt.Errorf("no more than %s %s a day", chain.FormatAmount(limit, token.Decimals), token.Symbol)
+	}
+	return nil
+}
+
+// HandleRequestWithdrawal pays a creator's earnings out of the hot wallet, to the wallet they
+// signed in with. The withdrawal is recorded before it's broadcast, so one that was sent is
+// never lost track of even when we can't tell how the broadcast went
+func HandleRequestWithdrawal(db DBConn, s *signer.Signer, limits config.WithdrawalsConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := withdrawalRequest{}
+		if err := utils.DecodeJSON(r.Body, &req, false); err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		if req.Chain == "" {
+			req.Chain = "polygon"
+		}
+		c, ok := chain.Lookup(req.Chain)
+		if !ok {
+			utils.Respond(http.StatusBadRequest, "Unsupported chain").ServeHTTP(w, r)
+			return
+		}
+		if _, ok := s.Nodes[c.Name]; !ok {
+			utils.Respond(http.StatusBadRequest, "Withdrawals on "+c.Name+" aren't possible").ServeHTTP(w, r)
+			return
+		}
+		token, ok := c.Token(req.Token)
+		if !ok {
+			utils.Respond(http.StatusBadRequest, "Unsupported token on "+c.Name).ServeHTTP(w, r)
+			return
+		}
+		amount, err := chain.ParseAmount(req.Amount, token.Decimals)
+		if err != nil {
+			utils.Respond(http.StatusBadRequest, err.Error()).ServeHTTP(w, r)
+			return
+		}
+
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		// Only signing in with the wallet proves it's theirs. A wallet on a Google account is
+		// whatever the web app sent, so it's never paid out to
+		wallet := gating.Wallet(r)
+		if !common.IsHexAddress(wallet) || !strings.EqualFold(wallet, user.MetaMaskWalletPublicAddress) {
+			utils.Respond(http.StatusUnprocessableEntity, "Sign in with your wallet to withdraw to it").ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		now := time.Now().UTC()
+		withdrawal := Withdrawal{
+			CreatorID: user.ID,
+			Chain:     c.Name,
+			Token:     token.Symbol,
+			Amount:    chain.FormatAmount(amount, token.Decimals),
+			To:        common.HexToAddress(wallet).Hex(),
+			Status:    WithdrawalPending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		withdrawalMu.Lock()
+		previous, err := db.Withdrawals().ListByCreator(ctx, user.ID)
+		if err != nil {
+			withdrawalMu.Unlock()
+			respondWithDBError(err, "Couldn't get withdrawals!").ServeHTTP(w, r)
+			return
+		}
+		if err := checkWithdrawalLimits(limits, token, amount, previous, now); err != nil {
+			withdrawalMu.Unlock()
+			utils.Respond(http.StatusTooManyRequests, err.Error()).ServeHTTP(w, r)
+			return
+		}
+		balance, err := creatorBalance(ctx, db, user.ID, c, token)
+		if err != nil {
+			withdrawalMu.Unlock()
+			respondWithDBError(err, "Couldn't get balance!").ServeHTTP(w, r)
+			return
+		}
+		if balance.Cmp(amount) < 0 {
+			withdrawalMu.Unlock()
+			if balance.Sign() < 0 {
+				balance.SetInt64(0)
+			}
+			utils.Respond(http.StatusUnprocessableEntity, fmt.Sprintf("Only %s %s can be withdrawn",
+				chain.FormatAmount(balance, token.Decimals), token.Symbol)).ServeHTTP(w, r)
+			return
+		}
+		err = db.WithTransaction(ctx, func(ctx context.Context) error {
+			if err := db.Withdrawals().Create(ctx, &withdrawal); err != nil {
+				return err
+			}
+			return db.Ledger().Post(ctx, withdrawalEntries(withdrawal, LedgerWithdrawal, now))
+		})
+		withdrawalMu.Unlock()
+		if err != nil {
+			respondWithDBError(err, "Couldn't record withdrawal!").ServeHTTP(w, r)
+			return
+		}
+
+		sent, sendErr := s.Send(ctx, signer.Transfer{Chain: c, Token: token, To: common.HexToAddress(withdrawal.To), Amount: amount})
+		withdrawal.UpdatedAt = time.Now().UTC()
+		switch {
+		case sendErr == nil:
+			withdrawal.Status = WithdrawalSent
+		case errors.Is(sendErr, signer.ErrMaybeSent):
+			// Stays pending, marking it failed would give the creator the money back while
+			// it may still reach them. Someone has to look at it on chain
+		default:
+			withdrawal.Status = WithdrawalFailed
+		}
+		if withdrawal.Status != WithdrawalFailed {
+			withdrawal.TxHash, withdrawal.Nonce = strings.ToLower(sent.Hash.Hex()), sent.Nonce
+		}
+		// Not the request's context, the withdrawal has to be updated even if the client is gone
+		err = db.WithTransaction(context.Background(), func(ctx context.Context) error {
+			if err := db.Withdrawals().Update(ctx, withdrawal); err != nil {
+				return err
+			}
+			if withdrawal.Status != WithdrawalFailed {
+				return nil
+			}
+			return db.Ledger().Post(ctx, withdrawalEntries(withdrawal, LedgerReversal, withdrawal.UpdatedAt))
+		})
+		if err != nil {
+			log.Printf("withdrawal %s is %s but couldn't be updated: %v", withdrawal.ID, withdrawal.Status, err)
+		}
+		if errors.Is(sendErr, signer.ErrMaybeSent) {
+			log.Printf("withdrawal %s may have been sent in %s: %v", withdrawal.ID, withdrawal.TxHash, sendErr)
+			utils.RespondWithJSON(withdrawal, http.StatusAccepted)(w, r)
+			return
+		}
+		if sendErr != nil {
+			log.Printf("withdrawal %s failed: %v", withdrawal.ID, sendErr)
+			utils.Respond(http.StatusBadGateway, "Couldn't send withdrawal").ServeHTTP(w, r)
+			return
+		}
+		utils.RespondWithJSON(withdrawal, http.StatusCreated)(w, r)
+	}
+}
+
+// HandleListMyWithdrawals lists the signed in creator's withdrawals, newest first
+func HandleListMyWithdrawals(db DBConn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := currentUser(w, r, db)
+		if !ok {
+			return
+		}
+		list, err := db.Withdrawals().ListByCreator(r.Context(), user.ID)
+		if err != nil {
+			respondWithDBError(err, "Couldn't get withdrawals!").ServeHTTP(w, r)
+			return
+		}
+		for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+			list[i], list[j] = list[j], list[i]
+		}
+		utils.RespondWithJSON(list, http.StatusOK)(w, r)
+	}
+}
@@ -0,0 +1,142 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc/ethrpctest"
+	"github.com/cryptopatron/koen-backend/pkg/signer"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestWithdrawals(t *testing.T) {
+	ctx := context.Background()
+	conn := &MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	wallet := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	creator := &User{MetaMaskWalletPublicAddress: strings.ToLower(wallet.Hex()), PageName: "koen-san"}
+	// The web app sent a wallet along when they signed up with Google, nothing proves it's theirs
+	googler := &User{Email: "googler@koen.com", PageName: "googler",
+		MetaMaskWalletPublicAddress: "0x5555555555555555555555555555555555555555"}
+	for _, u := range []*User{creator, googler} {
+		if err := conn.Users().Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 95 USDC after the 5% fee
+	for i, amount := range []string{"60", "40"} {
+		err := RecordPayment(ctx, conn, nil, &Payment{Chain: "polygon", TxHash: "0xtx" + amount, CreatorID: creator.ID,
+			Token: "USDC", Amount: amount, VerifiedAt: time.Now().Add(time.Duration(i) * time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	node := ethrpctest.NewNode(100)
+	server := httptest.NewServer(node)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys := &signer.Keystore{Dir: dir, KEK: "correct horse battery staple", ScryptN: keystore.LightScryptN, ScryptP: keystore.LightScryptP}
+	hot, err := keys.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := signer.New(keys, hot, map[string]signer.Broadcaster{"polygon": &ethrpc.HTTPClient{URL: server.URL}})
+	limits := config.WithdrawalsConfig{DailyLimits: map[string]string{"USDC": "150", "MATIC": "10"}, MaxPerDay: 3}
+
+	withdraw := func(claims auth.Claims, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/users/me/withdrawals", strings.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), "userData", claims))
+		rr := httptest.NewRecorder()
+		HandleRequestWithdrawal(conn, s, limits).ServeHTTP(rr, req)
+		return rr
+	}
+	creatorClaims := auth.Claims{WalletClaims: auth.WalletClaims{WalletPublicAddress: wallet.Hex()}}
+
+	t.Run("Withdrawals go to the creator's wallet", func(t *testing.T) {
+		rr := withdraw(creatorClaims, `{"token": "usdc", "amount": "30"}`)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body)
+		}
+		var got Withdrawal
+		json.Unmarshal(rr.Body.Bytes(), &got)
+		if got.Status != WithdrawalSent || got.To != wallet.Hex() || got.Token != "USDC" || len(node.Sent) != 1 ||
+			got.TxHash != strings.ToLower(node.Sent[0].Hash().Hex()) {
+			t.Errorf("got %+v, want it sent to %v", got, wallet.Hex())
+		}
+	})
+
+	t.Run("Withdrawals are limited", func(t *testing.T) {
+		cases := []struct {
+			name string
+			body string
+			want int
+		}{
+			{"More than was earned", `{"token": "MATIC", "amount": "1"}`, http.StatusUnprocessableEntity},
+			{"More than the daily limit", `{"token": "USDC", "amount": "120.5"}`, http.StatusTooManyRequests},
+			{"Tokens without a limit", `{"token": "DAI", "amount": "1"}`, http.StatusTooManyRequests},
+			{"Chains without a node", `{"chain": "ethereum", "token": "USDC", "amount": "1"}`, http.StatusBadRequest},
+			{"Bad amounts", `{"token": "USDC", "amount": "1.0000001"}`, http.StatusBadRequest},
+		}
+		for _, c := range cases {
+			if rr := withdraw(creatorClaims, c.body); rr.Code != c.want {
+				t.Errorf("%s: got %v, want %v: %s", c.name, rr.Code, c.want, rr.Body)
+			}
+		}
+		google := auth.Claims{GoogleClaims: auth.GoogleClaims{Email: "googler@koen.com"}}
+		if rr := withdraw(google, `{"token": "USDC", "amount": "1"}`); rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("got %v without a wallet sign in, want %v", rr.Code, http.StatusUnprocessableEntity)
+		}
+		if len(node.Sent) != 1 {
+			t.Errorf("got %d transactions, want none for refused withdrawals", len(node.Sent))
+		}
+	})
+
+	t.Run("Failed withdrawals don't count", func(t *testing.T) {
+		down := httptest.NewServer(node)
+		down.Close()
+		s.Nodes["polygon"] = &ethrpc.HTTPClient{URL: down.URL}
+		if rr := withdraw(creatorClaims, `{"token": "USDC", "amount": "65"}`); rr.Code != http.StatusBadGateway {
+			t.Errorf("got %v with the node down, want %v", rr.Code, http.StatusBadGateway)
+		}
+		s.Nodes["polygon"] = &ethrpc.HTTPClient{URL: server.URL}
+		if rr := withdraw(creatorClaims, `{"token": "USDC", "amount": "65"}`); rr.Code != http.StatusCreated {
+			t.Errorf("got %v, want the rest of the balance withdrawn: %s", rr.Code, rr.Body)
+		}
+		if rr := withdraw(creatorClaims, `{"token": "USDC", "amount": "0.000001"}`); rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("got %v, want nothing left", rr.Code)
+		}
+	})
+
+	t.Run("Creators see their withdrawals newest first", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/users/me/withdrawals", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "userData", creatorClaims))
+		rr := httptest.NewRecorder()
+		HandleListMyWithdrawals(conn).ServeHTTP(rr, req)
+		var list []Withdrawal
+		json.Unmarshal(rr.Body.Bytes(), &list)
+		statuses := []string{}
+		for _, w := range list {
+			statuses = append(statuses, w.Status)
+		}
+		if strings.Join(statuses, ",") != "sent,failed,sent" {
+			t.Errorf("got %v, want sent,failed,sent", statuses)
+		}
+	})
+}
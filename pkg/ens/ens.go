@@ -0,0 +1,190 @@
+// Package ens looks up the ENS names and avatars of Ethereum addresses, so people who
+// sign in with a wallet show up as more than a hex address
+package ens
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/ttlcache"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Registry is the ENS registry, at the same address on mainnet and the testnets
+var Registry = common.HexToAddress("0x00000000000C2E074eC69A0dFb2997BA6C7d2e1e")
+
+// Longest name or text record we take, anything longer isn't meant for us
+const maxStringLength = 2048
+
+var ErrBadResult = errors.New("ENS contract returned something that can't be decoded")
+
+// Function selectors, the first 4 bytes of keccak256 of their signatures
+var (
+	// resolver(bytes32) on the registry
+	resolverSelector = []byte{0x01, 0x78, 0xb8, 0xbf}
+	// addr(bytes32)
+	addrSelector = []byte{0x3b, 0x3b, 0x57, 0xde}
+	// name(bytes32), on reverse resolvers
+	nameSelector = []byte{0x69, 0x1f, 0x34, 0x31}
+	// text(bytes32,string)
+	textSelector = []byte{0x59, 0xd1, 0xd4, 0x3c}
+)
+
+// Namehash is the node of a name, as in EIP-137. Names are only lowercased, not fully
+// normalized, which is enough for the names reverse records point at
+func Namehash(name string) common.Hash {
+	var node common.Hash
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return node
+	}
+	labels := strings.Split(name, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = crypto.Keccak256Hash(node.Bytes(), crypto.Keccak256([]byte(labels[i])))
+	}
+	return node
+}
+
+// Profile is what an address has on ENS. Empty when it has no name that resolves back to it
+type Profile struct {
+	Name string
+	// An http(s) URL, avatars pointing at NFTs or data URLs are left out
+	Avatar string
+}
+
+// Resolver looks up profiles through a mainnet node. Addresses without one are by far
+// the most common, so those are cached too
+type Resolver struct {
+	Client   ethrpc.Client
+	Registry common.Address
+	// Gateway ipfs:// avatars are served from, like https://ipfs.io/ipfs/. Empty leaves them out
+	IPFSGateway string
+	// Zero turns the cache off
+	CacheTTL time.Duration
+
+	cache ttlcache.Cache
+}
+
+func New(client ethrpc.Client, c config.ENSConfig) *Resolver {
+	return &Resolver{Client: client, Registry: Registry, IPFSGateway: c.IPFSGateway, CacheTTL: c.CacheTTL}
+}
+
+// Reverted calls are as good as an empty result, resolvers don't all implement everything
+func (r *Resolver) call(ctx context.Context, to common.Address, data []byte) ([]byte, error) {
+	result, err := r.Client.CallContract(ctx, to, data)
+	if errors.Is(err, ethrpc.ErrReverted) {
+		return nil, nil
+	}
+	return result, err
+}
+
+func (r *Resolver) callAddress(ctx context.Context, to common.Address, selector []byte, node common.Hash) (common.Address, error) {
+	result, err := r.call(ctx, to, append(append([]byte{}, selector...), node.Bytes()...))
+	if err != nil || len(result) == 0 {
+		return common.Address{}, err
+	}
+	if len(result) != 32 {
+		return common.Address{}, ErrBadResult
+	}
+	return common.BytesToAddress(result), nil
+}
+
+func (r *Resolver) callString(ctx context.Context, to common.Address, data []byte) (string, error) {
+	result, err := r.call(ctx, to, data)
+	if err != nil || len(result) == 0 {
+		return "", err
+	}
+	return decodeString(result)
+}
+
+// ABI encoded strings are an offset to a length followed by the bytes
+func decodeString(result []byte) (string, error) {
+	if len(result) < 64 {
+		return "", ErrBadResult
+	}
+	offset := new(big.Int).SetBytes(result[:32])
+	if !offset.IsUint64() || offset.Uint64() > uint64(len(result)-32) {
+		return "", ErrBadResult
+	}
+	start := offset.Uint64() + 32
+	length := new(big.Int).SetBytes(result[offset.Uint64():start])
+	if !length.IsUint64() || length.Uint64() > maxStringLength || length.Uint64() > uint64(len(result))-start {
+		return "", ErrBadResult
+	}
+	return string(result[start : start+length.Uint64()]), nil
+}
+
+func encodeString(s string) []byte {
+	data := common.LeftPadBytes(big.NewInt(int64(len(s))).Bytes(), 32)
+	padded := make([]byte, (len(s)+31)/32*32)
+	copy(padded, s)
+	return append(data, padded...)
+}
+
+func textCall(node common.Hash, key string) []byte {
+	data := append(append([]byte{}, textSelector...), node.Bytes()...)
+	// The string comes after the two head words
+	data = append(data, common.LeftPadBytes([]byte{64}, 32)...)
+	return append(data, encodeString(key)...)
+}
+
+// Avatars can be URLs, IPFS links or NFTs. Only what a browser can load makes it
+func (r *Resolver) avatarURL(value string) string {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, "https://"), strings.HasPrefix(value, "http://"):
+		return value
+	case strings.HasPrefix(value, "ipfs://") && r.IPFSGateway != "":
+		path := strings.TrimPrefix(strings.TrimPrefix(value, "ipfs://"), "ipfs/")
+		return strings.TrimSuffix(r.IPFSGateway, "/") + "/" + path
+	}
+	return ""
+}
+
+func (r *Resolver) lookup(ctx context.Context, address common.Address) (Profile, error) {
+	reverse := Namehash(strings.ToLower(address.Hex()[2:]) + ".addr.reverse")
+	resolver, err := r.callAddress(ctx, r.Registry, resolverSelector, reverse)
+	if err != nil || resolver == (common.Address{}) {
+		return Profile{}, err
+	}
+	name, err := r.callString(ctx, resolver, append(append([]byte{}, nameSelector...), reverse.Bytes()...))
+	if err != nil || name == "" {
+		return Profile{}, err
+	}
+
+	// Anyone can set their reverse record to any name, it only counts if the name points back
+	node := Namehash(name)
+	resolver, err = r.callAddress(ctx, r.Registry, resolverSelector, node)
+	if err != nil || resolver == (common.Address{}) {
+		return Profile{}, err
+	}
+	forward, err := r.callAddress(ctx, resolver, addrSelector, node)
+	if err != nil || forward != address {
+		return Profile{}, err
+	}
+	avatar, err := r.callString(ctx, resolver, textCall(node, "avatar"))
+	if err != nil {
+		return Profile{}, err
+	}
+	return Profile{Name: name, Avatar: r.avatarURL(avatar)}, nil
+}
+
+// Lookup returns the primary ENS name of address and its avatar
+func (r *Resolver) Lookup(ctx context.Context, address common.Address) (Profile, error) {
+	if profile, ok := r.cache.Get(address); ok {
+		return profile.(Profile), nil
+	}
+
+	profile, err := r.lookup(ctx, address)
+	if err != nil {
+		return profile, err
+	}
+	r.cache.Set(address, profile, r.CacheTTL)
+	return profile, nil
+}
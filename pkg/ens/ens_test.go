@@ -0,0 +1,57 @@
+package ens
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestSelectors(t *testing.T) {
+	for signature, selector := range map[string][]byte{
+		"resolver(bytes32)":    resolverSelector,
+		"addr(bytes32)":        addrSelector,
+		"name(bytes32)":        nameSelector,
+		"text(bytes32,string)": textSelector,
+	} {
+		if want := crypto.Keccak256([]byte(signature))[:4]; !bytes.Equal(selector, want) {
+			t.Errorf("%s: got %x, want %x", signature, selector, want)
+		}
+	}
+}
+
+func TestNamehash(t *testing.T) {
+	// From EIP-137
+	cases := map[string]string{
+		"":        "0x0000000000000000000000000000000000000000000000000000000000000000",
+		"eth":     "0x93cdeb708b7545dc668eb9280176169d1c33cfd8ed6f04690a0bcc88a93fc4ae",
+		"foo.eth": "0xde9b09fd7c5f901e23a3f19fecc54828e9c848539801e86591bd9801b019f84f",
+		"Foo.ETH": "0xde9b09fd7c5f901e23a3f19fecc54828e9c848539801e86591bd9801b019f84f",
+	}
+	for name, want := range cases {
+		if got := Namehash(name); got.Hex() != want {
+			t.Errorf("%q: got %s, want %s", name, got.Hex(), want)
+		}
+	}
+}
+
+func TestAvatarURL(t *testing.T) {
+	r := &Resolver{IPFSGateway: "https://ipfs.io/ipfs/"}
+	for value, want := range map[string]string{
+		"https://koen.com/a.png":         "https://koen.com/a.png",
+		"ipfs://ipfs/QmHash":             "https://ipfs.io/ipfs/QmHash",
+		"eip155:1/erc721:0xb47e/1":       "",
+		"data:image/png;base64,iVBORw0K": "",
+	} {
+		if got := r.avatarURL(value); got != want {
+			t.Errorf("%s: got %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestDecodeString(t *testing.T) {
+	if _, err := decodeString(append(common.LeftPadBytes([]byte{32}, 32), common.LeftPadBytes([]byte{200}, 32)...)); err != ErrBadResult {
+		t.Errorf("got %v, want %v", err, ErrBadResult)
+	}
+}
@@ -0,0 +1,50 @@
+// Package enstest sets up ENS names on a fake node, for tests of code that looks them up
+package enstest
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/cryptopatron/koen-backend/pkg/ens"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc/ethrpctest"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The public resolver names are set on
+var publicResolver = common.HexToAddress("0x4976fb03C32e5B8cfe2b6cCB31c09Ba78EBaBa41")
+
+func selector(signature string) []byte {
+	return crypto.Keccak256([]byte(signature))[:4]
+}
+
+// Calls with a single word argument
+func call(signature string, node common.Hash) []byte {
+	return append(selector(signature), node.Bytes()...)
+}
+
+func encodeString(s string) []byte {
+	data := common.LeftPadBytes(big.NewInt(int64(len(s))).Bytes(), 32)
+	padded := make([]byte, (len(s)+31)/32*32)
+	copy(padded, s)
+	return append(data, padded...)
+}
+
+// A string return value, after the word pointing at it
+func abiString(s string) []byte {
+	return append(common.LeftPadBytes([]byte{32}, 32), encodeString(s)...)
+}
+
+// SetName sets up node so address's reverse record says name, which resolves to owner
+// and has avatar as its avatar record
+func SetName(node *ethrpctest.Node, address common.Address, name string, owner common.Address, avatar string) {
+	reverse := ens.Namehash(strings.ToLower(address.Hex()[2:]) + ".addr.reverse")
+	forward := ens.Namehash(name)
+	resolver := common.LeftPadBytes(publicResolver.Bytes(), 32)
+	node.SetCall(ens.Registry, call("resolver(bytes32)", reverse), resolver)
+	node.SetCall(publicResolver, call("name(bytes32)", reverse), abiString(name))
+	node.SetCall(ens.Registry, call("resolver(bytes32)", forward), resolver)
+	node.SetCall(publicResolver, call("addr(bytes32)", forward), common.LeftPadBytes(owner.Bytes(), 32))
+	text := append(call("text(bytes32,string)", forward), common.LeftPadBytes([]byte{64}, 32)...)
+	node.SetCall(publicResolver, append(text, encodeString("avatar")...), abiString(avatar))
+}
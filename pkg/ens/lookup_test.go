@@ -0,0 +1,57 @@
+package ens_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cryptopatron/koen-backend/pkg/ens"
+	"github.com/cryptopatron/koen-backend/pkg/ens/enstest"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc/ethrpctest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestLookup(t *testing.T) {
+	node := ethrpctest.NewNode(100)
+	server := httptest.NewServer(node)
+	defer server.Close()
+	r := &ens.Resolver{Client: &ethrpc.HTTPClient{URL: server.URL}, Registry: ens.Registry, IPFSGateway: "https://ipfs.io/ipfs/", CacheTTL: 1 << 62}
+
+	vitalik := common.HexToAddress("0xd8dA6BF26964aF9D7eEd9e03E53415D37aA96045")
+	enstest.SetName(node, vitalik, "vitalik.eth", vitalik, "ipfs://QmSP4nq9fnN9dAiCj42ug9Wa79rqmQerZXZch82VqpiH7U/image.gif")
+	impostor := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	enstest.SetName(node, impostor, "koen.eth", vitalik, "https://koen.com/avatar.png")
+	ctx := context.Background()
+
+	t.Run("Names that resolve back", func(t *testing.T) {
+		got, err := r.Lookup(ctx, vitalik)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ens.Profile{Name: "vitalik.eth", Avatar: "https://ipfs.io/ipfs/QmSP4nq9fnN9dAiCj42ug9Wa79rqmQerZXZch82VqpiH7U/image.gif"}
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("Reverse records claiming someone else's name", func(t *testing.T) {
+		if got, err := r.Lookup(ctx, impostor); err != nil || got != (ens.Profile{}) {
+			t.Errorf("got %+v, %v, want nothing", got, err)
+		}
+	})
+
+	t.Run("Addresses without a name are cached too", func(t *testing.T) {
+		nobody := common.HexToAddress("0x2222222222222222222222222222222222222222")
+		calls := node.Calls["eth_call"]
+		for i := 0; i < 2; i++ {
+			if got, err := r.Lookup(ctx, nobody); err != nil || got != (ens.Profile{}) {
+				t.Errorf("got %+v, %v, want nothing", got, err)
+			}
+		}
+		r.Lookup(ctx, vitalik)
+		if got := node.Calls["eth_call"] - calls; got != 1 {
+			t.Errorf("got %d calls, want just the first lookup", got)
+		}
+	})
+}
@@ -0,0 +1,327 @@
+// Package ethrpc reads transactions from Ethereum compatible nodes over JSON-RPC
+package ethrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// ErrNotFound is returned for transactions and blocks the node doesn't know about, or hasn't mined yet
+var ErrNotFound = errors.New("not found")
+
+// ErrReverted is returned by CallContract when the contract reverted the call
+var ErrReverted = errors.New("execution reverted")
+
+// Client is what we need from a node. HTTPClient talks to a real one, tests use fakes
+type Client interface {
+	BlockNumber(ctx context.Context) (uint64, error)
+	TransactionByHash(ctx context.Context, hash common.Hash) (*Transaction, error)
+	TransactionReceipt(ctx context.Context, hash common.Hash) (*Receipt, error)
+	HeaderByNumber(ctx context.Context, n uint64) (*Header, error)
+	Logs(ctx context.Context, q FilterQuery) ([]Log, error)
+	CallContract(ctx context.Context, to common.Address, data []byte) ([]byte, error)
+}
+
+type Transaction struct {
+	Hash  common.Hash     `json:"hash"`
+	From  common.Address  `json:"from"`
+	To    *common.Address `json:"to"`
+	Value *hexutil.Big    `json:"value"`
+	// Nil while pending
+	BlockNumber *hexutil.Uint64 `json:"blockNumber"`
+}
+
+type Receipt struct {
+	TxHash common.Hash `json:"transactionHash"`
+	// 1 for success, 0 if the transaction reverted
+	Status      hexutil.Uint64 `json:"status"`
+	BlockNumber hexutil.Uint64 `json:"blockNumber"`
+	Logs        []Log          `json:"logs"`
+}
+
+type Log struct {
+	Address     common.Address `json:"address"`
+	Topics      []common.Hash  `json:"topics"`
+	Data        hexutil.Bytes  `json:"data"`
+	LogIndex    hexutil.Uint64 `json:"logIndex"`
+	TxHash      common.Hash    `json:"transactionHash"`
+	BlockNumber hexutil.Uint64 `json:"blockNumber"`
+}
+
+// Header is the part of a block we care about, enough to notice reorgs
+type Header struct {
+	Number     hexutil.Uint64 `json:"number"`
+	Hash       common.Hash    `json:"hash"`
+	ParentHash common.Hash    `json:"parentHash"`
+	// Nil on chains from before London
+	BaseFee *hexutil.Big `json:"baseFeePerGas"`
+}
+
+// FilterQuery selects logs for eth_getLogs. Topics match by position, each position
+// matches any of its hashes and a nil position matches anything
+type FilterQuery struct {
+	FromBlock uint64
+	ToBlock   uint64
+	Addresses []common.Address
+	Topics    [][]common.Hash
+}
+
+func (q FilterQuery) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		FromBlock hexutil.Uint64   `json:"fromBlock"`
+		ToBlock   hexutil.Uint64   `json:"toBlock"`
+		Addresses []common.Address `json:"address,omitempty"`
+		Topics    [][]common.Hash  `json:"topics,omitempty"`
+	}{hexutil.Uint64(q.FromBlock), hexutil.Uint64(q.ToBlock), q.Addresses, q.Topics})
+}
+
+// CallMsg is a transaction that isn't signed, for estimating the gas it needs
+type CallMsg struct {
+	From  common.Address
+	To    common.Address
+	Value *big.Int
+	Data  []byte
+}
+
+func (m CallMsg) MarshalJSON() ([]byte, error) {
+	value := m.Value
+	if value == nil {
+		value = new(big.Int)
+	}
+	return json.Marshal(struct {
+		From  common.Address `json:"from"`
+		To    common.Address `json:"to"`
+		Value *hexutil.Big   `json:"value"`
+		Data  hexutil.Bytes  `json:"data,omitempty"`
+	}{m.From, m.To, (*hexutil.Big)(value), m.Data})
+}
+
+// Error is an error response from the node
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("json-rpc error %d: %s", e.Code, e.Message)
+}
+
+// HTTPClient calls a node's JSON-RPC endpoint over HTTP
+type HTTPClient struct {
+	URL string
+	// Defaults to http.DefaultClient
+	Client *http.Client
+	nextID uint64
+}
+
+type request struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type response struct {
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// Call runs method and decodes its result into result. A null result is ErrNotFound
+func (c *HTTPClient) Call(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(request{JSONRPC: "2.0", ID: atomic.AddUint64(&c.nextID, 1), Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("json-rpc %s: %s", method, res.Status)
+	}
+
+	var resp response
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("json-rpc %s: %w", method, err)
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if len(resp.Result) == 0 || string(resp.Result) == "null" {
+		return ErrNotFound
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+func (c *HTTPClient) BlockNumber(ctx context.Context) (uint64, error) {
+	var n hexutil.Uint64
+	err := c.Call(ctx, &n, "eth_blockNumber")
+	return uint64(n), err
+}
+
+func (c *HTTPClient) TransactionByHash(ctx context.Context, hash common.Hash) (*Transaction, error) {
+	var tx Transaction
+	if err := c.Call(ctx, &tx, "eth_getTransactionByHash", hash); err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+func (c *HTTPClient) TransactionReceipt(ctx context.Context, hash common.Hash) (*Receipt, error) {
+	var receipt Receipt
+	if err := c.Call(ctx, &receipt, "eth_getTransactionReceipt", hash); err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+func (c *HTTPClient) HeaderByNumber(ctx context.Context, n uint64) (*Header, error) {
+	var header Header
+	// false leaves out the block's transactions
+	if err := c.Call(ctx, &header, "eth_getBlockByNumber", hexutil.Uint64(n), false); err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// Logs runs eth_getLogs. Providers limit how many blocks a single query can span
+func (c *HTTPClient) Logs(ctx context.Context, q FilterQuery) ([]Log, error) {
+	var logs []Log
+	err := c.Call(ctx, &logs, "eth_getLogs", q)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return logs, err
+}
+
+// CallContract runs a read-only call against the latest block with eth_call
+func (c *HTTPClient) CallContract(ctx context.Context, to common.Address, data []byte) ([]byte, error) {
+	msg := struct {
+		To   common.Address `json:"to"`
+		Data hexutil.Bytes  `json:"data"`
+	}{to, data}
+	var result hexutil.Bytes
+	err := c.Call(ctx, &result, "eth_call", msg, "latest")
+	// Geth says 3 with the revert reason, other nodes only put it in the message
+	var rpcErr *Error
+	if errors.As(err, &rpcErr) && (rpcErr.Code == 3 || strings.Contains(rpcErr.Message, "revert")) {
+		return nil, ErrReverted
+	}
+	return result, err
+}
+
+// PendingNonce is the nonce of account's next transaction, counting the ones still in the mempool
+func (c *HTTPClient) PendingNonce(ctx context.Context, account common.Address) (uint64, error) {
+	var n hexutil.Uint64
+	err := c.Call(ctx, &n, "eth_getTransactionCount", account, "pending")
+	return uint64(n), err
+}
+
+// BaseFee is the base fee per gas of the latest block
+func (c *HTTPClient) BaseFee(ctx context.Context) (*big.Int, error) {
+	var header Header
+	if err := c.Call(ctx, &header, "eth_getBlockByNumber", "latest", false); err != nil {
+		return nil, err
+	}
+	if header.BaseFee == nil {
+		return nil, errors.New("node has no base fee, it's from before London")
+	}
+	return header.BaseFee.ToInt(), nil
+}
+
+// SuggestGasTipCap is the priority fee per gas the node thinks gets a transaction mined soon
+func (c *HTTPClient) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	var tip hexutil.Big
+	if err := c.Call(ctx, &tip, "eth_maxPriorityFeePerGas"); err != nil {
+		return nil, err
+	}
+	return tip.ToInt(), nil
+}
+
+func (c *HTTPClient) EstimateGas(ctx context.Context, msg CallMsg) (uint64, error) {
+	var gas hexutil.Uint64
+	err := c.Call(ctx, &gas, "eth_estimateGas", msg)
+	return uint64(gas), err
+}
+
+// SendRawTransaction broadcasts a signed transaction, encoded the way it's hashed
+func (c *HTTPClient) SendRawTransaction(ctx context.Context, raw []byte) (common.Hash, error) {
+	var hash common.Hash
+	err := c.Call(ctx, &hash, "eth_sendRawTransaction", hexutil.Bytes(raw))
+	return hash, err
+}
+
+// Transfer is value moving from one address to another, either the chain's own
+// currency or an ERC-20 token
+type Transfer struct {
+	// Zero for native transfers
+	Token common.Address
+	From  common.Address
+	To    common.Address
+	Value *big.Int
+	// Of the ERC-20 Transfer event, -1 for the native transfer
+	LogIndex int
+}
+
+func (t Transfer) Native() bool {
+	return t.Token == (common.Address{})
+}
+
+// keccak256("Transfer(address,address,uint256)")
+var TransferTopic = common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+
+// Transfers decodes everything a successful transaction moved: its own value and the ERC-20
+// Transfer events in its receipt. Reverted transactions didn't move anything
+func Transfers(tx *Transaction, receipt *Receipt) []Transfer {
+	if receipt.Status != 1 {
+		return nil
+	}
+	var transfers []Transfer
+	if tx.To != nil && tx.Value != nil && tx.Value.ToInt().Sign() > 0 {
+		transfers = append(transfers, Transfer{From: tx.From, To: *tx.To, Value: tx.Value.ToInt(), LogIndex: -1})
+	}
+	for _, l := range receipt.Logs {
+		if t, ok := TransferFromLog(l); ok {
+			transfers = append(transfers, t)
+		}
+	}
+	return transfers
+}
+
+// TransferFromLog decodes an ERC-20 Transfer event, other logs aren't transfers
+func TransferFromLog(l Log) (Transfer, bool) {
+	// ERC-721 uses the same event with the token ID indexed too, that's 4 topics
+	if len(l.Topics) != 3 || l.Topics[0] != TransferTopic || len(l.Data) != 32 {
+		return Transfer{}, false
+	}
+	return Transfer{
+		Token:    l.Address,
+		From:     common.BytesToAddress(l.Topics[1].Bytes()),
+		To:       common.BytesToAddress(l.Topics[2].Bytes()),
+		Value:    new(big.Int).SetBytes(l.Data),
+		LogIndex: int(l.LogIndex),
+	}, true
+}
@@ -0,0 +1,146 @@
+package ethrpc_test
+
+import (
+	"context"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc/ethrpctest"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	payer   = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	creator = common.HexToAddress("0x2222222222222222222222222222222222222222")
+	usdc    = common.HexToAddress("0x2791Bca1f2de4661ED88A30C99A7a9449Aa84174")
+)
+
+func TestHTTPClient(t *testing.T) {
+	node := ethrpctest.NewNode(100)
+	server := httptest.NewServer(node)
+	defer server.Close()
+	client := &ethrpc.HTTPClient{URL: server.URL}
+	ctx := context.Background()
+
+	hash := common.HexToHash("0xabc")
+	block := hexutil.Uint64(90)
+	node.Add(&ethrpc.Transaction{Hash: hash, From: payer, To: &usdc, Value: (*hexutil.Big)(big.NewInt(0)), BlockNumber: &block},
+		&ethrpc.Receipt{TxHash: hash, Status: 1, BlockNumber: block, Logs: []ethrpc.Log{ethrpctest.TransferLog(usdc, payer, creator, big.NewInt(5000000), 3)}})
+
+	n, err := client.BlockNumber(ctx)
+	if err != nil || n != 100 {
+		t.Errorf("got %d %v, want 100", n, err)
+	}
+	tx, err := client.TransactionByHash(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.From != payer || *tx.To != usdc || uint64(*tx.BlockNumber) != 90 {
+		t.Errorf("got %+v, want the canned transaction", tx)
+	}
+	receipt, err := client.TransactionReceipt(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfers := ethrpc.Transfers(tx, receipt)
+	if len(transfers) != 1 {
+		t.Fatalf("got %+v, want one transfer", transfers)
+	}
+	if got := transfers[0]; got.Token != usdc || got.From != payer || got.To != creator || got.Value.Int64() != 5000000 || got.LogIndex != 3 {
+		t.Errorf("got %+v, want 5 USDC to the creator", got)
+	}
+
+	if _, err := client.TransactionReceipt(ctx, common.HexToHash("0xdef")); err != ethrpc.ErrNotFound {
+		t.Errorf("got %v, want %v", err, ethrpc.ErrNotFound)
+	}
+	logs, err := client.Logs(ctx, ethrpc.FilterQuery{FromBlock: 80, ToBlock: 95, Addresses: []common.Address{usdc},
+		Topics: [][]common.Hash{{ethrpc.TransferTopic}, nil, {common.BytesToHash(creator.Bytes())}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].TxHash != hash || logs[0].BlockNumber != 90 {
+		t.Errorf("got %+v, want the transfer to the creator", logs)
+	}
+	if logs, _ := client.Logs(ctx, ethrpc.FilterQuery{FromBlock: 91, ToBlock: 95}); len(logs) != 0 {
+		t.Errorf("got %+v, want nothing after block 90", logs)
+	}
+
+	header, err := client.HeaderByNumber(ctx, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Reorg(90)
+	if reorged, _ := client.HeaderByNumber(ctx, 90); reorged.Hash == header.Hash {
+		t.Error("got the same hash after a reorg, want a new one")
+	}
+	if _, err := client.HeaderByNumber(ctx, 101); err != ethrpc.ErrNotFound {
+		t.Errorf("got %v for a future block, want %v", err, ethrpc.ErrNotFound)
+	}
+
+	node.SetCall(usdc, []byte{1, 2}, []byte{3})
+	node.SetCall(usdc, []byte{4}, nil)
+	if result, err := client.CallContract(ctx, usdc, []byte{1, 2}); err != nil || len(result) != 1 || result[0] != 3 {
+		t.Errorf("got %v %v, want the canned result", result, err)
+	}
+	if _, err := client.CallContract(ctx, usdc, []byte{4}); err != ethrpc.ErrReverted {
+		t.Errorf("got %v, want %v", err, ethrpc.ErrReverted)
+	}
+	if result, err := client.CallContract(ctx, creator, []byte{1, 2}); err != nil || len(result) != 0 {
+		t.Errorf("got %v %v, want an empty result from an address without code", result, err)
+	}
+
+	// Transactions are taken in nonce order
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	if fee, err := client.BaseFee(ctx); err != nil || fee.Cmp(node.BaseFee) != 0 {
+		t.Errorf("got base fee %v %v, want %v", fee, err, node.BaseFee)
+	}
+	if tip, err := client.SuggestGasTipCap(ctx); err != nil || tip.Cmp(node.Tip) != 0 {
+		t.Errorf("got tip %v %v, want %v", tip, err, node.Tip)
+	}
+	if gas, err := client.EstimateGas(ctx, ethrpc.CallMsg{From: from, To: creator}); err != nil || gas != 21000 {
+		t.Errorf("got %d %v, want 21000", gas, err)
+	}
+	for i := 0; i < 2; i++ {
+		nonce, err := client.PendingNonce(ctx, from)
+		if err != nil || nonce != uint64(i) {
+			t.Fatalf("got nonce %d %v, want %d", nonce, err, i)
+		}
+		tx, _ := types.SignNewTx(key, types.NewLondonSigner(big.NewInt(137)), &types.DynamicFeeTx{
+			ChainID: big.NewInt(137), Nonce: nonce, GasTipCap: node.Tip, GasFeeCap: big.NewInt(60e9), Gas: 21000,
+			To: &creator, Value: big.NewInt(1),
+		})
+		raw, _ := tx.MarshalBinary()
+		if hash, err := client.SendRawTransaction(ctx, raw); err != nil || hash != tx.Hash() {
+			t.Errorf("got %v %v, want %v", hash, err, tx.Hash())
+		}
+		if _, err := client.SendRawTransaction(ctx, raw); err == nil {
+			t.Error("got nil sending the same nonce twice, want an error")
+		}
+	}
+
+	var result string
+	if err := client.Call(ctx, &result, "eth_bleh"); err == nil {
+		t.Error("got nil, want an error for an unknown method")
+	}
+}
+
+func TestTransfers(t *testing.T) {
+	value := (*hexutil.Big)(big.NewInt(1e18))
+	tx := &ethrpc.Transaction{From: payer, To: &creator, Value: value}
+	nft := ethrpctest.TransferLog(usdc, payer, creator, big.NewInt(1), 0)
+	nft.Topics = append(nft.Topics, common.Hash{})
+
+	transfers := ethrpc.Transfers(tx, &ethrpc.Receipt{Status: 1, Logs: []ethrpc.Log{nft}})
+	if len(transfers) != 1 || !transfers[0].Native() || transfers[0].Value.Cmp(value.ToInt()) != 0 {
+		t.Errorf("got %+v, want only the native transfer", transfers)
+	}
+	if transfers := ethrpc.Transfers(tx, &ethrpc.Receipt{Status: 0}); len(transfers) != 0 {
+		t.Errorf("got %+v, want nothing from a reverted transaction", transfers)
+	}
+}
@@ -0,0 +1,303 @@
+// Package ethrpctest runs a fake Ethereum node for tests of code that talks JSON-RPC
+package ethrpctest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Node answers JSON-RPC calls from canned transactions and receipts.
+// Serve it with httptest.NewServer and point an HTTPClient at it
+type Node struct {
+	mu           sync.Mutex
+	block        uint64
+	transactions map[common.Hash]*ethrpc.Transaction
+	receipts     map[common.Hash]*ethrpc.Receipt
+	// Blocks that were replaced by a reorg, and how often
+	reorgs map[uint64]uint64
+	// eth_call results by contract and call data, nil reverts
+	calls map[string][]byte
+	// Next nonce by sender
+	nonces map[common.Address]uint64
+	// Fees per gas every block has, defaults to 30 gwei each
+	BaseFee *big.Int
+	Tip     *big.Int
+	// Transactions that came in through eth_sendRawTransaction, in order
+	Sent []*types.Transaction
+	// Number of calls per method
+	Calls map[string]int
+}
+
+func NewNode(block uint64) *Node {
+	return &Node{
+		block:        block,
+		transactions: map[common.Hash]*ethrpc.Transaction{},
+		receipts:     map[common.Hash]*ethrpc.Receipt{},
+		reorgs:       map[uint64]uint64{},
+		calls:        map[string][]byte{},
+		nonces:       map[common.Address]uint64{},
+		BaseFee:      big.NewInt(30e9),
+		Tip:          big.NewInt(30e9),
+		Calls:        map[string]int{},
+	}
+}
+
+func (f *Node) SetBlock(n uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.block = n
+}
+
+// Add makes a transaction known. Without a receipt it's still pending.
+// Logs in the receipt get the transaction's hash and block filled in
+func (f *Node) Add(tx *ethrpc.Transaction, receipt *ethrpc.Receipt) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.transactions[tx.Hash] = tx
+	if receipt != nil {
+		for i := range receipt.Logs {
+			receipt.Logs[i].TxHash = tx.Hash
+			receipt.Logs[i].BlockNumber = receipt.BlockNumber
+		}
+		f.receipts[tx.Hash] = receipt
+	}
+}
+
+// Reorg replaces every block from the given one up to the head. Their
+// hashes change and the transactions mined in them are dropped
+func (f *Node) Reorg(from uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for n := from; n <= f.block; n++ {
+		f.reorgs[n]++
+	}
+	for hash, r := range f.receipts {
+		if uint64(r.BlockNumber) >= from {
+			delete(f.receipts, hash)
+			delete(f.transactions, hash)
+		}
+	}
+}
+
+// SetCall makes eth_call to a contract with the given data return result, or revert
+// when result is nil. Calls nobody set up return nothing, like an address without code
+func (f *Node) SetCall(to common.Address, data, result []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[callKey(to, data)] = result
+}
+
+func callKey(to common.Address, data []byte) string {
+	return to.Hex() + hexutil.Encode(data)
+}
+
+func (f *Node) blockHash(n uint64) common.Hash {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	binary.BigEndian.PutUint64(buf[8:], f.reorgs[n])
+	return crypto.Keccak256Hash(buf[:])
+}
+
+func (f *Node) header(n uint64) *ethrpc.Header {
+	if n > f.block {
+		return nil
+	}
+	h := &ethrpc.Header{Number: hexutil.Uint64(n), Hash: f.blockHash(n), BaseFee: (*hexutil.Big)(f.BaseFee)}
+	if n > 0 {
+		h.ParentHash = f.blockHash(n - 1)
+	}
+	return h
+}
+
+type fakeFilter struct {
+	FromBlock hexutil.Uint64   `json:"fromBlock"`
+	ToBlock   hexutil.Uint64   `json:"toBlock"`
+	Addresses []common.Address `json:"address"`
+	Topics    [][]common.Hash  `json:"topics"`
+}
+
+func (q fakeFilter) matches(l ethrpc.Log) bool {
+	if l.BlockNumber < q.FromBlock || l.BlockNumber > q.ToBlock {
+		return false
+	}
+	if len(q.Addresses) > 0 && !containsAddress(q.Addresses, l.Address) {
+		return false
+	}
+	for i, position := range q.Topics {
+		if position == nil {
+			continue
+		}
+		if i >= len(l.Topics) || !containsHash(position, l.Topics[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAddress(list []common.Address, a common.Address) bool {
+	for _, b := range list {
+		if a == b {
+			return true
+		}
+	}
+	return false
+}
+
+func containsHash(list []common.Hash, h common.Hash) bool {
+	for _, b := range list {
+		if h == b {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Node) logs(q fakeFilter) []ethrpc.Log {
+	logs := []ethrpc.Log{}
+	for _, r := range f.receipts {
+		// Reverted transactions don't emit anything
+		if r.Status != 1 {
+			continue
+		}
+		for _, l := range r.Logs {
+			if q.matches(l) {
+				logs = append(logs, l)
+			}
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		if logs[i].BlockNumber != logs[j].BlockNumber {
+			return logs[i].BlockNumber < logs[j].BlockNumber
+		}
+		return logs[i].LogIndex < logs[j].LogIndex
+	})
+	return logs
+}
+
+func (f *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     json.RawMessage   `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls[req.Method]++
+
+	param := func(v interface{}) {
+		if len(req.Params) > 0 {
+			json.Unmarshal(req.Params[0], v)
+		}
+	}
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+	switch req.Method {
+	case "eth_blockNumber":
+		resp["result"] = hexutil.Uint64(f.block)
+	case "eth_getTransactionByHash":
+		var hash common.Hash
+		param(&hash)
+		resp["result"] = f.transactions[hash]
+	case "eth_getTransactionReceipt":
+		var hash common.Hash
+		param(&hash)
+		resp["result"] = f.receipts[hash]
+	case "eth_getBlockByNumber":
+		n := hexutil.Uint64(f.block)
+		var tag string
+		if param(&tag); tag != "latest" {
+			param(&n)
+		}
+		resp["result"] = f.header(uint64(n))
+	case "eth_getLogs":
+		var q fakeFilter
+		param(&q)
+		resp["result"] = f.logs(q)
+	case "eth_call":
+		var msg struct {
+			To   common.Address `json:"to"`
+			Data hexutil.Bytes  `json:"data"`
+		}
+		param(&msg)
+		result, ok := f.calls[callKey(msg.To, msg.Data)]
+		if ok && result == nil {
+			resp["error"] = ethrpc.Error{Code: 3, Message: "execution reverted"}
+		} else {
+			resp["result"] = hexutil.Bytes(result)
+		}
+	case "eth_getTransactionCount":
+		var account common.Address
+		param(&account)
+		resp["result"] = hexutil.Uint64(f.nonces[account])
+	case "eth_maxPriorityFeePerGas":
+		resp["result"] = (*hexutil.Big)(f.Tip)
+	case "eth_estimateGas":
+		var msg struct {
+			Data hexutil.Bytes `json:"data"`
+		}
+		param(&msg)
+		// Plain transfers always take 21000, token transfers about this much
+		resp["result"] = hexutil.Uint64(21000)
+		if len(msg.Data) > 0 {
+			resp["result"] = hexutil.Uint64(65000)
+		}
+	case "eth_sendRawTransaction":
+		var raw hexutil.Bytes
+		param(&raw)
+		if hash, err := f.send(raw); err != nil {
+			resp["error"] = ethrpc.Error{Code: -32000, Message: err.Error()}
+		} else {
+			resp["result"] = hash
+		}
+	default:
+		resp["error"] = ethrpc.Error{Code: -32601, Message: "the method " + req.Method + " does not exist"}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Checks a raw transaction the way a node would before taking it into its mempool
+func (f *Node) send(raw []byte) (common.Hash, error) {
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(raw); err != nil {
+		return common.Hash{}, err
+	}
+	from, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if tx.Nonce() != f.nonces[from] {
+		return common.Hash{}, fmt.Errorf("nonce %d, want %d", tx.Nonce(), f.nonces[from])
+	}
+	if tx.GasFeeCap().Cmp(f.BaseFee) < 0 {
+		return common.Hash{}, errors.New("max fee per gas less than block base fee")
+	}
+	f.nonces[from]++
+	f.Sent = append(f.Sent, tx)
+	f.transactions[tx.Hash()] = &ethrpc.Transaction{Hash: tx.Hash(), From: from, To: tx.To(), Value: (*hexutil.Big)(tx.Value())}
+	return tx.Hash(), nil
+}
+
+// TransferLog is the ERC-20 Transfer event of token moving value from one address to another
+func TransferLog(token, from, to common.Address, value *big.Int, index uint64) ethrpc.Log {
+	return ethrpc.Log{
+		Address:  token,
+		Topics:   []common.Hash{ethrpc.TransferTopic, common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes())},
+		Data:     common.LeftPadBytes(value.Bytes(), 32),
+		LogIndex: hexutil.Uint64(index),
+	}
+}
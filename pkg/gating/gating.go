@@ -0,0 +1,278 @@
+// Package gating decides who gets to see gated content, going by the tokens their wallet holds
+package gating
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/ttlcache"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Token standards a rule can check balances of
+const (
+	ERC20   = "erc20"
+	ERC721  = "erc721"
+	ERC1155 = "erc1155"
+)
+
+// Most token IDs a rule can list, each one is a call to the node
+const MaxTokenIDs = 20
+
+var (
+	ErrUnsupportedChain = errors.New("no node for the rule's chain")
+	ErrBadResult        = errors.New("contract returned something that isn't a balance")
+)
+
+// Rule is what a wallet has to hold to get in
+type Rule struct {
+	// One of chain.Chains
+	Chain    string `bson:"chain" json:"chain"`
+	Contract string `bson:"contract" json:"contract"`
+	// One of the standard constants
+	Standard string `bson:"standard" json:"standard"`
+	// Integer amount in the token's smallest unit, defaults to 1.
+	// For ERC-721 with token IDs it's how many of them the wallet has to own
+	MinBalance string `bson:"minBalance" json:"minBalance"`
+	// Decimal token IDs. Required for ERC-1155, where balances are summed up.
+	// Optional for ERC-721, without them any token of the contract counts
+	TokenIDs []string `bson:"tokenIds,omitempty" json:"tokenIds,omitempty"`
+}
+
+// Validate checks a rule and puts it in canonical form, with a checksummed contract and decimal numbers
+func (r *Rule) Validate() error {
+	c, ok := chain.Lookup(r.Chain)
+	if !ok {
+		return errors.New("unsupported chain")
+	}
+	r.Chain = c.Name
+	if !common.IsHexAddress(r.Contract) {
+		return errors.New("contract must be an address")
+	}
+	r.Contract = common.HexToAddress(r.Contract).Hex()
+	r.Standard = strings.ToLower(r.Standard)
+	switch r.Standard {
+	case ERC20:
+		if len(r.TokenIDs) > 0 {
+			return errors.New("ERC-20 tokens don't have IDs")
+		}
+	case ERC721:
+	case ERC1155:
+		if len(r.TokenIDs) == 0 {
+			return errors.New("ERC-1155 rules need token IDs")
+		}
+	default:
+		return errors.New("standard must be erc20, erc721 or erc1155")
+	}
+
+	if r.MinBalance == "" {
+		r.MinBalance = "1"
+	}
+	min, ok := new(big.Int).SetString(r.MinBalance, 10)
+	if !ok || min.Sign() <= 0 {
+		return errors.New("minBalance must be a positive integer")
+	}
+	r.MinBalance = min.String()
+
+	if len(r.TokenIDs) > MaxTokenIDs {
+		return fmt.Errorf("at most %d token IDs", MaxTokenIDs)
+	}
+	seen := map[string]bool{}
+	for i, s := range r.TokenIDs {
+		id, ok := new(big.Int).SetString(s, 10)
+		if !ok || id.Sign() < 0 || id.BitLen() > 256 {
+			return errors.New("token IDs must be non-negative integers")
+		}
+		if seen[id.String()] {
+			return errors.New("token IDs can't repeat")
+		}
+		seen[id.String()] = true
+		r.TokenIDs[i] = id.String()
+	}
+	if r.Standard == ERC721 && len(r.TokenIDs) > 0 && min.Cmp(big.NewInt(int64(len(r.TokenIDs)))) > 0 {
+		return errors.New("minBalance is more than the token IDs listed")
+	}
+	return nil
+}
+
+// Function selectors, the first 4 bytes of keccak256 of their signatures
+var (
+	// balanceOf(address), the same for ERC-20 and ERC-721
+	balanceOfSelector = []byte{0x70, 0xa0, 0x82, 0x31}
+	// ownerOf(uint256)
+	ownerOfSelector = []byte{0x63, 0x52, 0x21, 0x1e}
+	// balanceOf(address,uint256)
+	balanceOf1155Selector = []byte{0x00, 0xfd, 0xd5, 0x8e}
+)
+
+func callData(selector []byte, args ...[]byte) []byte {
+	data := append([]byte{}, selector...)
+	for _, arg := range args {
+		data = append(data, common.LeftPadBytes(arg, 32)...)
+	}
+	return data
+}
+
+type cached struct {
+	result   []byte
+	reverted bool
+}
+
+// Checker evaluates rules against what wallets hold on chain. Calls to the node
+// are cached for a short while, so busy pages don't ask for the same balance over and over
+type Checker struct {
+	// By chain name, rules on chains without one can't be checked
+	Clients map[string]ethrpc.Client
+	// Zero turns the cache off
+	CacheTTL time.Duration
+
+	cache ttlcache.Cache
+}
+
+func NewChecker(clients map[string]ethrpc.Client, c config.GatingConfig) *Checker {
+	return &Checker{Clients: clients, CacheTTL: c.BalanceCacheTTL}
+}
+
+// Reverted calls aren't an error, some contracts revert for tokens that don't exist
+func (c *Checker) call(ctx context.Context, chainName string, to common.Address, data []byte) (result []byte, reverted bool, err error) {
+	client, ok := c.Clients[chainName]
+	if !ok {
+		return nil, false, ErrUnsupportedChain
+	}
+	key := chainName + to.Hex() + common.Bytes2Hex(data)
+	if entry, ok := c.cache.Get(key); ok {
+		e := entry.(cached)
+		return e.result, e.reverted, nil
+	}
+
+	result, err = client.CallContract(ctx, to, data)
+	if errors.Is(err, ethrpc.ErrReverted) {
+		reverted, err = true, nil
+	}
+	if err != nil {
+		return result, reverted, err
+	}
+	c.cache.Set(key, cached{result: result, reverted: reverted}, c.CacheTTL)
+	return result, reverted, nil
+}
+
+func (c *Checker) uint256(ctx context.Context, chainName string, to common.Address, data []byte) (*big.Int, error) {
+	result, reverted, err := c.call(ctx, chainName, to, data)
+	if err != nil {
+		return nil, err
+	}
+	if reverted || len(result) != 32 {
+		return nil, ErrBadResult
+	}
+	return new(big.Int).SetBytes(result), nil
+}
+
+// Balance is how much of what rule asks for wallet holds: tokens for ERC-20, tokens of
+// the contract or owned IDs for ERC-721, and the summed up IDs for ERC-1155
+func (c *Checker) Balance(ctx context.Context, rule Rule, wallet common.Address) (*big.Int, error) {
+	contract := common.HexToAddress(rule.Contract)
+	owner := wallet.Bytes()
+	if rule.Standard == ERC20 || (rule.Standard == ERC721 && len(rule.TokenIDs) == 0) {
+		return c.uint256(ctx, rule.Chain, contract, callData(balanceOfSelector, owner))
+	}
+
+	total := new(big.Int)
+	for _, s := range rule.TokenIDs {
+		id, _ := new(big.Int).SetString(s, 10)
+		if rule.Standard == ERC1155 {
+			n, err := c.uint256(ctx, rule.Chain, contract, callData(balanceOf1155Selector, owner, id.Bytes()))
+			if err != nil {
+				return nil, err
+			}
+			total.Add(total, n)
+			continue
+		}
+		result, reverted, err := c.call(ctx, rule.Chain, contract, callData(ownerOfSelector, id.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		// Tokens that were never minted or got burned revert
+		if reverted {
+			continue
+		}
+		if len(result) != 32 {
+			return nil, ErrBadResult
+		}
+		if common.BytesToAddress(result) == wallet {
+			total.Add(total, big.NewInt(1))
+		}
+	}
+	return total, nil
+}
+
+// Allowed reports whether wallet holds enough to satisfy rule. Nobody without a wallet is
+func (c *Checker) Allowed(ctx context.Context, rule Rule, wallet string) (bool, error) {
+	if !common.IsHexAddress(wallet) {
+		return false, nil
+	}
+	min, ok := new(big.Int).SetString(rule.MinBalance, 10)
+	if !ok {
+		min = big.NewInt(1)
+	}
+	balance, err := c.Balance(ctx, rule, common.HexToAddress(wallet))
+	if err != nil {
+		return false, err
+	}
+	return balance.Cmp(min) >= 0, nil
+}
+
+// RuleFunc finds the rule guarding a request's resource, nil when it isn't gated.
+// Resources that don't exist aren't gated either, the handler answers for those
+type RuleFunc func(r *http.Request) (*Rule, error)
+
+// Require lets requests through only when the signed in wallet satisfies the rule of what they ask for.
+// Goes after auth.HandleJWT, only wallet sign ins can get past gated resources
+func (c *Checker) Require(ruleFor RuleFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rule, err := ruleFor(r)
+			if err != nil {
+				utils.Respond(http.StatusInternalServerError, "Couldn't check access").ServeHTTP(w, r)
+				return
+			}
+			if rule == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wallet := Wallet(r)
+			if wallet == "" {
+				utils.Respond(http.StatusUnauthorized, "Sign in with a wallet to see this").ServeHTTP(w, r)
+				return
+			}
+			ok, err := c.Allowed(r.Context(), *rule, wallet)
+			if err != nil {
+				utils.Respond(http.StatusBadGateway, "Couldn't check token balance").ServeHTTP(w, r)
+				return
+			}
+			if !ok {
+				utils.Respond(http.StatusForbidden, "Wallet doesn't hold the required tokens").ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Wallet is the address the request was signed in with, empty for Google sign ins or no sign in at all
+func Wallet(r *http.Request) string {
+	claims, ok := r.Context().Value("userData").(auth.Claims)
+	if !ok || claims.Email != "" {
+		return ""
+	}
+	return claims.WalletPublicAddress
+}
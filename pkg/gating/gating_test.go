@@ -0,0 +1,205 @@
+package gating
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc/ethrpctest"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	holder   = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	stranger = common.HexToAddress("0x2222222222222222222222222222222222222222")
+	token    = common.HexToAddress("0x3333333333333333333333333333333333333333")
+)
+
+func uint256(n int64) []byte {
+	return common.LeftPadBytes(big.NewInt(n).Bytes(), 32)
+}
+
+func TestSelectors(t *testing.T) {
+	for signature, selector := range map[string][]byte{
+		"balanceOf(address)":         balanceOfSelector,
+		"ownerOf(uint256)":           ownerOfSelector,
+		"balanceOf(address,uint256)": balanceOf1155Selector,
+	} {
+		if want := crypto.Keccak256([]byte(signature))[:4]; !bytes.Equal(selector, want) {
+			t.Errorf("%s: got %x, want %x", signature, selector, want)
+		}
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	rule := Rule{Chain: "Polygon", Contract: "0x3333333333333333333333333333333333333333", Standard: "ERC1155",
+		TokenIDs: []string{"007", "8"}}
+	if err := rule.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if rule.Chain != "polygon" || rule.Standard != ERC1155 || rule.MinBalance != "1" || rule.TokenIDs[0] != "7" {
+		t.Errorf("got %+v, want it in canonical form", rule)
+	}
+
+	cases := []Rule{
+		{Chain: "bleh", Contract: token.Hex(), Standard: ERC20},
+		{Chain: "polygon", Contract: "0x123", Standard: ERC20},
+		{Chain: "polygon", Contract: token.Hex(), Standard: "erc777"},
+		{Chain: "polygon", Contract: token.Hex(), Standard: ERC20, TokenIDs: []string{"1"}},
+		{Chain: "polygon", Contract: token.Hex(), Standard: ERC1155},
+		{Chain: "polygon", Contract: token.Hex(), Standard: ERC20, MinBalance: "0"},
+		{Chain: "polygon", Contract: token.Hex(), Standard: ERC20, MinBalance: "1.5"},
+		{Chain: "polygon", Contract: token.Hex(), Standard: ERC721, TokenIDs: []string{"-1"}},
+		{Chain: "polygon", Contract: token.Hex(), Standard: ERC721, TokenIDs: []string{"1", "01"}},
+		{Chain: "polygon", Contract: token.Hex(), Standard: ERC721, TokenIDs: []string{"1"}, MinBalance: "2"},
+	}
+	for _, c := range cases {
+		if err := c.Validate(); err == nil {
+			t.Errorf("got nil for %+v, want an error", c)
+		}
+	}
+}
+
+func TestChecker(t *testing.T) {
+	node := ethrpctest.NewNode(100)
+	server := httptest.NewServer(node)
+	defer server.Close()
+	checker := &Checker{Clients: map[string]ethrpc.Client{"polygon": &ethrpc.HTTPClient{URL: server.URL}}}
+	ctx := context.Background()
+
+	node.SetCall(token, callData(balanceOfSelector, holder.Bytes()), uint256(5))
+	node.SetCall(token, callData(balanceOfSelector, stranger.Bytes()), uint256(0))
+	node.SetCall(token, callData(ownerOfSelector, big.NewInt(1).Bytes()), common.LeftPadBytes(holder.Bytes(), 32))
+	node.SetCall(token, callData(ownerOfSelector, big.NewInt(2).Bytes()), common.LeftPadBytes(stranger.Bytes(), 32))
+	node.SetCall(token, callData(ownerOfSelector, big.NewInt(3).Bytes()), nil)
+	node.SetCall(token, callData(balanceOf1155Selector, holder.Bytes(), big.NewInt(1).Bytes()), uint256(1))
+	node.SetCall(token, callData(balanceOf1155Selector, holder.Bytes(), big.NewInt(2).Bytes()), uint256(2))
+
+	cases := []struct {
+		name   string
+		rule   Rule
+		wallet common.Address
+		want   bool
+	}{
+		{"ERC-20 balance", Rule{Standard: ERC20, MinBalance: "5"}, holder, true},
+		{"ERC-20 balance too low", Rule{Standard: ERC20, MinBalance: "6"}, holder, false},
+		{"ERC-20 nothing held", Rule{Standard: ERC20, MinBalance: "1"}, stranger, false},
+		{"ERC-721 any token", Rule{Standard: ERC721, MinBalance: "1"}, holder, true},
+		{"ERC-721 owned ID", Rule{Standard: ERC721, MinBalance: "1", TokenIDs: []string{"2", "3", "1"}}, holder, true},
+		{"ERC-721 IDs owned by someone else", Rule{Standard: ERC721, MinBalance: "2", TokenIDs: []string{"1", "2"}}, holder, false},
+		{"ERC-1155 summed up", Rule{Standard: ERC1155, MinBalance: "3", TokenIDs: []string{"1", "2"}}, holder, true},
+		{"ERC-1155 not enough", Rule{Standard: ERC1155, MinBalance: "4", TokenIDs: []string{"1", "2"}}, holder, false},
+	}
+	for _, c := range cases {
+		c.rule.Chain, c.rule.Contract = "polygon", token.Hex()
+		got, err := checker.Allowed(ctx, c.rule, c.wallet.Hex())
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		// ERC-1155 balances for someone nobody set up come back empty
+		rule := Rule{Chain: "polygon", Contract: token.Hex(), Standard: ERC1155, MinBalance: "1", TokenIDs: []string{"1"}}
+		if _, err := checker.Allowed(ctx, rule, stranger.Hex()); err != ErrBadResult {
+			t.Errorf("got %v, want %v", err, ErrBadResult)
+		}
+		rule = Rule{Chain: "ethereum", Contract: token.Hex(), Standard: ERC20, MinBalance: "1"}
+		if _, err := checker.Allowed(ctx, rule, holder.Hex()); err != ErrUnsupportedChain {
+			t.Errorf("got %v, want %v", err, ErrUnsupportedChain)
+		}
+		if ok, err := checker.Allowed(ctx, rule, ""); ok || err != nil {
+			t.Errorf("got %v %v without a wallet, want false", ok, err)
+		}
+	})
+
+	t.Run("Balances are cached", func(t *testing.T) {
+		checker.CacheTTL = time.Minute
+		rule := Rule{Chain: "polygon", Contract: token.Hex(), Standard: ERC721, MinBalance: "1", TokenIDs: []string{"1", "3"}}
+		before := node.Calls["eth_call"]
+		for i := 0; i < 3; i++ {
+			if ok, err := checker.Allowed(ctx, rule, holder.Hex()); !ok || err != nil {
+				t.Fatalf("got %v %v, want true", ok, err)
+			}
+		}
+		if calls := node.Calls["eth_call"] - before; calls != 2 {
+			t.Errorf("got %d calls, want 2", calls)
+		}
+
+		// The cache is shared by rules asking the same thing
+		node.SetCall(token, callData(ownerOfSelector, big.NewInt(1).Bytes()), common.LeftPadBytes(stranger.Bytes(), 32))
+		if ok, _ := checker.Allowed(ctx, Rule{Chain: "polygon", Contract: token.Hex(), Standard: ERC721, MinBalance: "1",
+			TokenIDs: []string{"1"}}, holder.Hex()); !ok {
+			t.Error("got false, want the cached owner")
+		}
+		checker.cache.Clear()
+		if ok, _ := checker.Allowed(ctx, rule, holder.Hex()); ok {
+			t.Error("got true, want the token gone once the cache is")
+		}
+	})
+}
+
+func TestRequire(t *testing.T) {
+	node := ethrpctest.NewNode(100)
+	server := httptest.NewServer(node)
+	defer server.Close()
+	checker := &Checker{Clients: map[string]ethrpc.Client{"polygon": &ethrpc.HTTPClient{URL: server.URL}}}
+	node.SetCall(token, callData(balanceOfSelector, holder.Bytes()), uint256(1))
+	node.SetCall(token, callData(balanceOfSelector, stranger.Bytes()), uint256(0))
+
+	gated := &Rule{Chain: "polygon", Contract: token.Hex(), Standard: ERC20, MinBalance: "1"}
+	handler := checker.Require(func(r *http.Request) (*Rule, error) {
+		if r.URL.Path == "/public" {
+			return nil, nil
+		}
+		return gated, nil
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(path string, claims *auth.Claims) int {
+		req, _ := http.NewRequest("GET", path, nil)
+		if claims != nil {
+			req = req.WithContext(context.WithValue(req.Context(), "userData", *claims))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	wallet := func(a common.Address) *auth.Claims {
+		return &auth.Claims{WalletClaims: auth.WalletClaims{WalletPublicAddress: a.Hex()}}
+	}
+	google := &auth.Claims{GoogleClaims: auth.GoogleClaims{Email: "test@koen.com"}}
+
+	cases := []struct {
+		name   string
+		path   string
+		claims *auth.Claims
+		want   int
+	}{
+		{"Holder gets in", "/gated", wallet(holder), http.StatusOK},
+		{"Others are turned away", "/gated", wallet(stranger), http.StatusForbidden},
+		{"Google sign ins have no wallet", "/gated", google, http.StatusUnauthorized},
+		{"Nobody signed in", "/gated", nil, http.StatusUnauthorized},
+		{"Ungated resources are open", "/public", nil, http.StatusOK},
+	}
+	for _, c := range cases {
+		if got := serve(c.path, c.claims); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	server.Close()
+	if got := serve("/gated", wallet(holder)); got != http.StatusBadGateway {
+		t.Errorf("got %v with the node down, want %v", got, http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,169 @@
+// Package hdwallet derives deposit addresses from a BIP-32 extended public key.
+// Only public derivation is supported, the private keys never come near the server
+package hdwallet
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Indexes from here on are hardened, which needs the private key
+const Hardened uint32 = 1 << 31
+
+var (
+	ErrBadKey   = errors.New("not a valid extended public key")
+	ErrPrivate  = errors.New("extended private keys don't belong on the server, use the xpub")
+	ErrHardened = errors.New("hardened children can't be derived from a public key")
+	// One in about 2^127 indexes, BIP-32 says to skip to the next one
+	ErrInvalidChild = errors.New("index doesn't lead to a valid key")
+)
+
+// Version bytes of serialized keys, mainnet and testnet
+var (
+	publicVersions  = [][]byte{{0x04, 0x88, 0xb2, 0x1e}, {0x04, 0x35, 0x87, 0xcf}}
+	privateVersions = [][]byte{{0x04, 0x88, 0xad, 0xe4}, {0x04, 0x35, 0x83, 0x94}}
+)
+
+// ExtendedKey is a public key together with the chain code its children are derived with
+type ExtendedKey struct {
+	Depth     byte
+	ChainCode []byte
+	// Compressed, 33 bytes
+	PublicKey []byte
+}
+
+// ParseExtendedKey reads a base58 xpub (or tpub)
+func ParseExtendedKey(s string) (*ExtendedKey, error) {
+	dat, err := decodeBase58Check(s)
+	if err != nil || len(dat) != 78 {
+		return nil, ErrBadKey
+	}
+	version := dat[:4]
+	for _, v := range privateVersions {
+		if bytes.Equal(version, v) {
+			return nil, ErrPrivate
+		}
+	}
+	known := false
+	for _, v := range publicVersions {
+		known = known || bytes.Equal(version, v)
+	}
+	if !known {
+		return nil, ErrBadKey
+	}
+	key := &ExtendedKey{Depth: dat[4], ChainCode: dat[13:45], PublicKey: dat[45:]}
+	if _, err := crypto.DecompressPubkey(key.PublicKey); err != nil {
+		return nil, ErrBadKey
+	}
+	return key, nil
+}
+
+// Child derives the non-hardened child at index
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	if index >= Hardened {
+		return nil, ErrHardened
+	}
+	data := make([]byte, 37)
+	copy(data, k.PublicKey)
+	binary.BigEndian.PutUint32(data[33:], index)
+	mac := hmac.New(sha512.New, k.ChainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+
+	curve := crypto.S256()
+	il := new(big.Int).SetBytes(sum[:32])
+	if il.Cmp(curve.Params().N) >= 0 {
+		return nil, ErrInvalidChild
+	}
+	parent, err := crypto.DecompressPubkey(k.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	x, y := curve.ScalarBaseMult(sum[:32])
+	x, y = curve.Add(x, y, parent.X, parent.Y)
+	if x.Sign() == 0 && y.Sign() == 0 {
+		return nil, ErrInvalidChild
+	}
+	pub := crypto.CompressPubkey(&ecdsa.PublicKey{Curve: curve, X: x, Y: y})
+	return &ExtendedKey{Depth: k.Depth + 1, ChainCode: sum[32:], PublicKey: pub}, nil
+}
+
+// Address is the Ethereum address of the key, the same on every EVM chain
+func (k *ExtendedKey) Address() common.Address {
+	pub, _ := crypto.DecompressPubkey(k.PublicKey)
+	return crypto.PubkeyToAddress(*pub)
+}
+
+// Deposits hands out one address per index from the external chain of a BIP-44 account.
+// The xpub is the account's, at m/44'/60'/0' like wallets such as MetaMask use for every
+// EVM chain, so the addresses show up when the account is restored into one
+type Deposits struct {
+	external *ExtendedKey
+}
+
+func NewDeposits(xpub string) (*Deposits, error) {
+	account, err := ParseExtendedKey(xpub)
+	if err != nil {
+		return nil, err
+	}
+	external, err := account.Child(0)
+	if err != nil {
+		return nil, err
+	}
+	return &Deposits{external: external}, nil
+}
+
+// Address derives the deposit address at m/44'/60'/0'/0/index
+func (d *Deposits) Address(index uint32) (common.Address, error) {
+	child, err := d.external.Child(index)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return child.Address(), nil
+}
+
+// Verify reports whether address is the one at index
+func (d *Deposits) Verify(index uint32, address string) bool {
+	want, err := d.Address(index)
+	return err == nil && common.IsHexAddress(address) && common.HexToAddress(address) == want
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// Decodes base58 and checks the trailing 4 bytes of double SHA-256
+func decodeBase58Check(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	for _, c := range []byte(s) {
+		digit := bytes.IndexByte([]byte(base58Alphabet), c)
+		if digit < 0 {
+			return nil, ErrBadKey
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+	dat := append(make([]byte, zeros), n.Bytes()...)
+	if len(dat) < 4 {
+		return nil, ErrBadKey
+	}
+	payload, checksum := dat[:len(dat)-4], dat[len(dat)-4:]
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	if !bytes.Equal(second[:4], checksum) {
+		return nil, ErrBadKey
+	}
+	return payload, nil
+}
@@ -0,0 +1,89 @@
+package hdwallet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// BIP-32 test vector 1
+const (
+	masterXPub = "xpub661MyMwAqRbcFtXgS5sYJABqqG9YLmC4Q1Rdap9gSE8NqtwybGhePY2gZ29ESFjqJoCu1Rupje8YtGqsefD265TMg7usUDFdp6W1EGMcet8"
+	masterXPrv = "xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi"
+)
+
+func TestChild(t *testing.T) {
+	// Non-hardened steps of the vector, parent and child
+	cases := [][2]string{
+		{"xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw",
+			"xpub6ASuArnXKPbfEwhqN6e3mwBcDTgzisQN1wXN9BJcM47sSikHjJf3UFHKkNAWbWMiGj7Wf5uMash7SyYq527Hqck2AxYysAA7xmALppuCkwQ"},
+		{"xpub6D4BDPcP2GT577Vvch3R8wDkScZWzQzMMUm3PWbmWvVJrZwQY4VUNgqFJPMM3No2dFDFGTsxxpG5uJh7n7epu4trkrX7x7DogT5Uv6fcLW5",
+			"xpub6FHa3pjLCk84BayeJxFW2SP4XRrFd1JYnxeLeU8EqN3vDfZmbqBqaGJAyiLjTAwm6ZLRQUMv1ZACTj37sR62cfN7fe5JnJ7dh8zL4fiyLHV"},
+		{"xpub6FHa3pjLCk84BayeJxFW2SP4XRrFd1JYnxeLeU8EqN3vDfZmbqBqaGJAyiLjTAwm6ZLRQUMv1ZACTj37sR62cfN7fe5JnJ7dh8zL4fiyLHV",
+			"xpub6H1LXWLaKsWFhvm6RVpEL9P4KfRZSW7abD2ttkWP3SSQvnyA8FSVqNTEcYFgJS2UaFcxupHiYkro49S8yGasTvXEYBVPamhGW6cFJodrTHy"},
+	}
+	indexes := []uint32{1, 2, 1000000000}
+	for i, c := range cases {
+		parent, err := ParseExtendedKey(c[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := ParseExtendedKey(c[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := parent.Child(indexes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.PublicKey, want.PublicKey) || !bytes.Equal(got.ChainCode, want.ChainCode) || got.Depth != want.Depth {
+			t.Errorf("index %d: got %x, want %x", indexes[i], got.PublicKey, want.PublicKey)
+		}
+	}
+
+	master, _ := ParseExtendedKey(masterXPub)
+	if _, err := master.Child(Hardened); err != ErrHardened {
+		t.Errorf("got %v, want %v", err, ErrHardened)
+	}
+}
+
+func TestParseExtendedKey(t *testing.T) {
+	cases := map[string]error{
+		masterXPrv:                           ErrPrivate,
+		masterXPub[:len(masterXPub)-1] + "9": ErrBadKey,
+		"0x1111111111111111":                 ErrBadKey,
+		"":                                   ErrBadKey,
+	}
+	for s, want := range cases {
+		if _, err := ParseExtendedKey(s); err != want {
+			t.Errorf("%q: got %v, want %v", s, err, want)
+		}
+	}
+}
+
+// Account xpub of the "abandon abandon ... about" test mnemonic
+const testXPub = "xpub6DCoCpSuQZB2jawqnGMEPS63ePKWkwWPH4TU45Q7LPXWuNd8TMtVxRrgjtEshuqpK3mdhaWHPFsBngh5GFZaM6si3yZdUsT8ddYM3PwnATt"
+
+func TestDeposits(t *testing.T) {
+	deposits, err := NewDeposits(testXPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What MetaMask shows for the mnemonic's first account
+	want := common.HexToAddress("0x9858EfFD232B4033E47d90003D41EC34EcaEda94")
+	if got, err := deposits.Address(0); err != nil || got != want {
+		t.Errorf("got %v %v, want %v", got.Hex(), err, want.Hex())
+	}
+	if !deposits.Verify(0, want.Hex()) {
+		t.Error("got false for the derived address, want true")
+	}
+	if deposits.Verify(1, want.Hex()) || deposits.Verify(0, "0xmatic") {
+		t.Error("got true for an address from elsewhere, want false")
+	}
+
+	if _, err := NewDeposits(masterXPrv); err != ErrPrivate {
+		t.Errorf("got %v, want %v", err, ErrPrivate)
+	}
+}
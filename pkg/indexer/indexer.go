@@ -0,0 +1,290 @@
+// Package indexer follows chains block by block and records payments to creators,
+// including the ones nobody reports through POST /payments/verify
+package indexer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/db"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/prices"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Recipients per eth_getLogs call, providers limit how large a filter can get
+const maxRecipientsPerQuery = 100
+
+// Indexer finds ERC-20 transfers to creators' payout addresses through eth_getLogs.
+// Native transfers don't emit logs, those still have to be verified by their hash
+type Indexer struct {
+	DB     db.DBConn
+	Chain  chain.Chain
+	Client ethrpc.Client
+	// Blocks on top of a block's own before it's indexed. Reorgs shallower than this never reach us
+	Confirmations uint64
+	// Where to start without a checkpoint, zero starts at the head
+	StartBlock uint64
+	// Most blocks per eth_getLogs call, zero for no limit
+	MaxBlockRange uint64
+	// Prices payments in fiat, nil leaves them unpriced
+	Prices *prices.Service
+}
+
+// Poll indexes the next range of confirmed blocks and moves the checkpoint past them.
+// It returns how many blocks it went through, zero once it's caught up
+func (ix *Indexer) Poll(ctx context.Context) (uint64, error) {
+	head, err := ix.Client.BlockNumber(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if head+1 < ix.Confirmations {
+		return 0, nil
+	}
+	safe := head + 1 - ix.Confirmations
+
+	from, err := ix.nextBlock(ctx, safe)
+	if err != nil || from > safe {
+		return 0, err
+	}
+	to := safe
+	if ix.MaxBlockRange > 0 && to-from+1 > ix.MaxBlockRange {
+		to = from + ix.MaxBlockRange - 1
+	}
+
+	creators, err := ix.creators(ctx)
+	if err != nil {
+		return 0, err
+	}
+	logs, err := ix.transferLogs(ctx, from, to, creators)
+	if err != nil {
+		return 0, err
+	}
+	if err := ix.record(ctx, logs, creators); err != nil {
+		return 0, err
+	}
+
+	header, err := ix.Client.HeaderByNumber(ctx, to)
+	if err != nil {
+		return 0, err
+	}
+	err = ix.DB.Checkpoints().Set(ctx, db.Checkpoint{
+		Chain:     ix.Chain.Name,
+		Block:     to,
+		Hash:      header.Hash.Hex(),
+		UpdatedAt: time.Now().UTC(),
+	})
+	return to - from + 1, err
+}
+
+// First block that still needs indexing. If the checkpoint's block was replaced, a reorg went
+// deeper than our confirmations. We go back that far again and index whatever is there now,
+// after taking back the payments whose transactions didn't make it into the new blocks
+func (ix *Indexer) nextBlock(ctx context.Context, safe uint64) (uint64, error) {
+	cp, err := ix.DB.Checkpoints().Get(ctx, ix.Chain.Name)
+	if errors.Is(err, db.ErrNotFound) {
+		if ix.StartBlock > 0 {
+			return ix.StartBlock, nil
+		}
+		return safe, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	header, err := ix.Client.HeaderByNumber(ctx, cp.Block)
+	if err != nil {
+		return 0, err
+	}
+	if header.Hash.Hex() == cp.Hash {
+		return cp.Block + 1, nil
+	}
+	rewind := uint64(0)
+	if cp.Block > ix.Confirmations {
+		rewind = cp.Block - ix.Confirmations
+	}
+	log.Printf("Indexer %s: block %d was reorged, indexing again from block %d", ix.Chain.Name, cp.Block, rewind)
+	return rewind, ix.orphan(ctx, rewind)
+}
+
+// Takes back payments from block on that are no longer on chain. Ones mined again in
+// another block are kept, they're still paid
+func (ix *Indexer) orphan(ctx context.Context, block uint64) error {
+	payments, err := ix.DB.Payments().ListFromBlock(ctx, ix.Chain.Name, block)
+	if err != nil {
+		return err
+	}
+	for _, p := range payments {
+		receipt, err := ix.Client.TransactionReceipt(ctx, common.HexToHash(p.TxHash))
+		if err == nil && receipt.Status == 1 {
+			continue
+		}
+		if err != nil && !errors.Is(err, ethrpc.ErrNotFound) {
+			return err
+		}
+		log.Printf("Indexer %s: transaction %s was dropped by the reorg, taking back its payment", ix.Chain.Name, p.TxHash)
+		if err := db.OrphanPayment(ctx, ix.DB, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Every active user by their payout address
+func (ix *Indexer) creators(ctx context.Context) (map[common.Address]db.User, error) {
+	users, err := ix.DB.Users().ListWithDepositAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	creators := map[common.Address]db.User{}
+	for _, u := range users {
+		if common.IsHexAddress(u.GeneratedMaticWalletPublicAddress) {
+			creators[common.HexToAddress(u.GeneratedMaticWalletPublicAddress)] = u
+		}
+	}
+	return creators, nil
+}
+
+// Transfer events of the chain's tokens to any of the creators, in the order they happened
+func (ix *Indexer) transferLogs(ctx context.Context, from, to uint64, creators map[common.Address]db.User) ([]ethrpc.Log, error) {
+	var tokens []common.Address
+	for _, t := range ix.Chain.Tokens {
+		if !t.Native() {
+			tokens = append(tokens, common.HexToAddress(t.Contract))
+		}
+	}
+	var recipients []common.Hash
+	for address := range creators {
+		recipients = append(recipients, common.BytesToHash(address.Bytes()))
+	}
+
+	var logs []ethrpc.Log
+	for start := 0; start < len(recipients); start += maxRecipientsPerQuery {
+		end := start + maxRecipientsPerQuery
+		if end > len(recipients) {
+			end = len(recipients)
+		}
+		found, err := ix.Client.Logs(ctx, ethrpc.FilterQuery{
+			FromBlock: from,
+			ToBlock:   to,
+			Addresses: tokens,
+			// Recipient is the second indexed argument, the sender can be anyone
+			Topics: [][]common.Hash{{ethrpc.TransferTopic}, nil, recipients[start:end]},
+		})
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, found...)
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		if logs[i].BlockNumber != logs[j].BlockNumber {
+			return logs[i].BlockNumber < logs[j].BlockNumber
+		}
+		return logs[i].LogIndex < logs[j].LogIndex
+	})
+	return logs, nil
+}
+
+func (ix *Indexer) token(contract common.Address) (chain.Token, bool) {
+	for _, t := range ix.Chain.Tokens {
+		if !t.Native() && common.HexToAddress(t.Contract) == contract {
+			return t, true
+		}
+	}
+	return chain.Token{}, false
+}
+
+// What a transaction paid a creator
+type txPayment struct {
+	hash    common.Hash
+	block   uint64
+	from    common.Address
+	to      common.Address
+	creator db.User
+	token   chain.Token
+	amount  *big.Int
+}
+
+// Records a payment per transaction, like POST /payments/verify would. Transfers of the same
+// token to the same creator add up. A transaction is only one payment though, so whatever
+// else it paid gets logged and left out
+func (ix *Indexer) record(ctx context.Context, logs []ethrpc.Log, creators map[common.Address]db.User) error {
+	var payments []*txPayment
+	byTx := map[common.Hash]*txPayment{}
+	for _, l := range logs {
+		t, ok := ethrpc.TransferFromLog(l)
+		if !ok {
+			continue
+		}
+		creator, isCreator := creators[t.To]
+		token, known := ix.token(t.Token)
+		if !isCreator || !known {
+			continue
+		}
+		p := byTx[l.TxHash]
+		if p == nil {
+			p = &txPayment{hash: l.TxHash, block: uint64(l.BlockNumber), from: t.From, to: t.To,
+				creator: creator, token: token, amount: new(big.Int)}
+			byTx[l.TxHash] = p
+			payments = append(payments, p)
+		} else if p.to != t.To || p.token != token {
+			log.Printf("Indexer %s: transaction %s pays more than one creator or token, only recording the first",
+				ix.Chain.Name, l.TxHash.Hex())
+			continue
+		}
+		p.amount.Add(p.amount, t.Value)
+	}
+
+	for _, p := range payments {
+		payment := db.Payment{
+			Chain:       ix.Chain.Name,
+			TxHash:      p.hash.Hex(),
+			CreatorID:   p.creator.ID,
+			From:        p.from.Hex(),
+			To:          p.to.Hex(),
+			Token:       p.token.Symbol,
+			Amount:      chain.FormatAmount(p.amount, p.token.Decimals),
+			BlockNumber: p.block,
+			VerifiedAt:  time.Now().UTC(),
+		}
+		// Payers are known by their MetaMask wallet, the one they pay from
+		if payer, err := ix.DB.Users().GetByWallet(ctx, payment.From); err == nil && payer.DeletedAt.IsZero() {
+			payment.PayerID = payer.ID
+		} else if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+		err := db.RecordPayment(ctx, ix.DB, ix.Prices, &payment)
+		// Already verified by its hash, or indexed before a rewind
+		if err != nil && !errors.Is(err, db.ErrConflict) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run polls until ctx is done. While behind it keeps going right away, once caught up
+// it waits for the interval. Errors are logged and retried on the next tick
+func (ix *Indexer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := ix.Poll(ctx)
+		if err != nil {
+			log.Printf("Indexer %s: %v", ix.Chain.Name, err)
+		} else if n > 0 {
+			log.Printf("Indexer %s: indexed %d blocks", ix.Chain.Name, n)
+		}
+		if err == nil && n > 0 && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package indexer
+
+import (
+	"context"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/db"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc/ethrpctest"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+var (
+	payerWallet    = common.HexToAddress("0x1111111111111111111111111111111111111111")
+	creatorWallet  = common.HexToAddress("0x2222222222222222222222222222222222222222")
+	strangerWallet = common.HexToAddress("0x3333333333333333333333333333333333333333")
+	usdc           = common.HexToAddress("0x2791Bca1f2de4661ED88A30C99A7a9449Aa84174")
+	dai            = common.HexToAddress("0x8f3Cf7ad23Cd3CaDbD9735AFf958023239c6A063")
+)
+
+func TestIndexer(t *testing.T) {
+	ctx := context.Background()
+	conn := &db.MemoryDB{}
+	conn.Open()
+	defer conn.Close()
+	creator := &db.User{Email: "creator@koen.com", PageName: "koen-san", GeneratedMaticWalletPublicAddress: creatorWallet.Hex()}
+	payer := &db.User{Email: "payer@koen.com", PageName: "payer", MetaMaskWalletPublicAddress: payerWallet.Hex()}
+	for _, u := range []*db.User{creator, payer} {
+		if err := conn.Users().Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	node := ethrpctest.NewNode(100)
+	server := httptest.NewServer(node)
+	defer server.Close()
+	polygon, _ := chain.Lookup("polygon")
+	ix := &Indexer{
+		DB:            conn,
+		Chain:         polygon,
+		Client:        &ethrpc.HTTPClient{URL: server.URL},
+		Confirmations: 5,
+		StartBlock:    90,
+		MaxBlockRange: 4,
+	}
+
+	n := 0
+	// A transaction mined in block with the given logs, returns its hash as we store it
+	add := func(block uint64, logs ...ethrpc.Log) string {
+		n++
+		hash := common.BigToHash(big.NewInt(int64(n)))
+		b := hexutil.Uint64(block)
+		node.Add(&ethrpc.Transaction{Hash: hash, From: payerWallet, To: &usdc, Value: (*hexutil.Big)(new(big.Int)), BlockNumber: &b},
+			&ethrpc.Receipt{TxHash: hash, Status: 1, BlockNumber: b, Logs: logs})
+		return strings.ToLower(hash.Hex())
+	}
+	usdcUnits := func(n int64) *big.Int { return big.NewInt(n * 1000000) }
+	tip := add(91, ethrpctest.TransferLog(usdc, payerWallet, creatorWallet, usdcUnits(5), 0),
+		ethrpctest.TransferLog(usdc, payerWallet, creatorWallet, usdcUnits(1), 1))
+	elsewhere := add(92, ethrpctest.TransferLog(dai, payerWallet, strangerWallet, usdcUnits(5), 0))
+	unknownToken := add(93, ethrpctest.TransferLog(common.HexToAddress("0xbad"), payerWallet, creatorWallet, usdcUnits(5), 0))
+	unconfirmed := add(98, ethrpctest.TransferLog(usdc, strangerWallet, creatorWallet, usdcUnits(2), 0))
+
+	poll := func(t *testing.T, want uint64) {
+		t.Helper()
+		got, err := ix.Poll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("got %d blocks indexed, want %d", got, want)
+		}
+	}
+	checkpoint := func(t *testing.T, want uint64) {
+		t.Helper()
+		if cp, err := conn.Checkpoints().Get(ctx, "polygon"); err != nil || cp.Block != want {
+			t.Errorf("got checkpoint %+v %v, want block %d", cp, err, want)
+		}
+	}
+
+	t.Run("Confirmed blocks are indexed in ranges", func(t *testing.T) {
+		poll(t, 4)
+		checkpoint(t, 93)
+		poll(t, 3)
+		checkpoint(t, 96)
+		poll(t, 0)
+
+		got, err := conn.Payments().GetByTxHash(ctx, tip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.CreatorID != creator.ID || got.PayerID != payer.ID || got.Amount != "6" || got.Token != "USDC" || got.BlockNumber != 91 {
+			t.Errorf("got %+v, want 6 USDC from the payer to the creator", got)
+		}
+		for _, hash := range []string{elsewhere, unknownToken, unconfirmed} {
+			if _, err := conn.Payments().GetByTxHash(ctx, hash); err != db.ErrNotFound {
+				t.Errorf("got %v for %s, want %v", err, hash, db.ErrNotFound)
+			}
+		}
+	})
+
+	t.Run("Payments verified before are kept", func(t *testing.T) {
+		verified := &db.Payment{Chain: "polygon", TxHash: unconfirmed, CreatorID: creator.ID, Token: "USDC", Amount: "2",
+			BlockNumber: 98, VerifiedAt: time.Now().UTC()}
+		if err := db.RecordPayment(ctx, conn, nil, verified); err != nil {
+			t.Fatal(err)
+		}
+		node.SetBlock(103)
+		poll(t, 3)
+		checkpoint(t, 99)
+		if got, _ := conn.Payments().GetByTxHash(ctx, unconfirmed); got.ID != verified.ID {
+			t.Errorf("got %+v, want the verified payment", got)
+		}
+	})
+
+	t.Run("Deep reorgs are indexed again", func(t *testing.T) {
+		node.Reorg(97)
+		replacement := add(97, ethrpctest.TransferLog(usdc, strangerWallet, creatorWallet, usdcUnits(3), 0))
+		// Goes back to 94, as many blocks as we wait for
+		poll(t, 4)
+		checkpoint(t, 97)
+		poll(t, 2)
+		checkpoint(t, 99)
+		got, err := conn.Payments().GetByTxHash(ctx, replacement)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Amount != "3" || got.PayerID != "" {
+			t.Errorf("got %+v, want 3 USDC from someone we don't know", got)
+		}
+
+		// The payment in block 98 was dropped, the creator isn't owed it anymore
+		if _, err := conn.Payments().GetByTxHash(ctx, unconfirmed); err != db.ErrNotFound {
+			t.Errorf("got %v for the dropped payment, want %v", err, db.ErrNotFound)
+		}
+		entries, err := conn.Ledger().ListByCreator(ctx, creator.ID, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		owed := map[string]int{}
+		for _, e := range entries {
+			if strings.HasSuffix(e.TxnID, unconfirmed) {
+				owed[e.Kind]++
+				if e.Account == "creator:"+creator.ID && e.Kind == db.LedgerOrphaned && e.Amount != "1.9" {
+					t.Errorf("got %s booked back to the creator, want 1.9", e.Amount)
+				}
+			}
+		}
+		if owed[db.LedgerPayment] != 3 || owed[db.LedgerOrphaned] != 3 {
+			t.Errorf("got %v entries of the dropped payment, want 3 to book it and 3 to take it back", owed)
+		}
+	})
+
+	t.Run("Without a start block indexing begins at the head", func(t *testing.T) {
+		ix := *ix
+		ix.Chain, _ = chain.Lookup("ethereum")
+		ix.StartBlock = 0
+		poll := func() uint64 {
+			got, err := ix.Poll(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return got
+		}
+		if got := poll(); got != 1 {
+			t.Errorf("got %d blocks indexed, want 1", got)
+		}
+		if cp, _ := conn.Checkpoints().Get(ctx, "ethereum"); cp.Block != 99 {
+			t.Errorf("got checkpoint %+v, want block 99", cp)
+		}
+	})
+}
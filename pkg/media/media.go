@@ -0,0 +1,206 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+
+	// Formats we accept uploads in
+	_ "image/gif"
+
+	_ "golang.org/x/image/webp"
+
+	"golang.org/x/image/draw"
+)
+
+// Upper bound on width * height, so a small file can't decode into gigabytes of pixels
+const MaxPixels = 40_000_000
+
+var (
+	ErrUnsupportedType = errors.New("image must be a JPEG, PNG, GIF or WebP")
+	ErrInvalidImage    = errors.New("couldn't read image")
+	ErrDimensions      = errors.New("image is too large or too small")
+)
+
+// Content types we accept, as sniffed from the data itself
+var allowedTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+type Size struct {
+	Name  string
+	Width int
+}
+
+// Kind describes how an uploaded image is cropped and which sizes are made of it
+type Kind struct {
+	Name string
+	// Width divided by height
+	Aspect float64
+	// Largest first
+	Sizes []Size
+}
+
+var (
+	Avatar = Kind{Name: "avatar", Aspect: 1, Sizes: []Size{{"large", 400}, {"medium", 200}, {"small", 64}}}
+	Banner = Kind{Name: "banner", Aspect: 3, Sizes: []Size{{"large", 1500}, {"medium", 750}, {"small", 375}}}
+)
+
+// Rendition is one resized version of an upload
+type Rendition struct {
+	Size        string
+	Width       int
+	Height      int
+	ContentType string
+	Data        []byte
+}
+
+// Extension for a rendition's content type
+func (r Rendition) Ext() string {
+	if r.ContentType == "image/png" {
+		return ".png"
+	}
+	return ".jpg"
+}
+
+// Sniff returns the content type of data, going by its contents rather than
+// whatever the client claims. Only image types we can process are allowed
+func Sniff(data []byte) (string, error) {
+	contentType := http.DetectContentType(data)
+	if !allowedTypes[contentType] {
+		return "", ErrUnsupportedType
+	}
+	return contentType, nil
+}
+
+// Process crops an uploaded image to kind's aspect ratio and renders all its sizes.
+// Images are decoded and encoded again, which leaves EXIF and any other metadata behind.
+// Smaller images aren't scaled up, so renditions can come out smaller than their size
+func Process(data []byte, kind Kind) ([]Rendition, error) {
+	contentType, err := Sniff(data)
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if cfg.Width < 16 || cfg.Height < 16 || cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrDimensions
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if contentType == "image/jpeg" {
+		// Phones store photos sideways and say how to turn them in EXIF
+		img = orient(img, exifOrientation(data))
+	}
+
+	img = cropToAspect(img, kind.Aspect)
+	opaque := isOpaque(img)
+	var renditions []Rendition
+	for _, size := range kind.Sizes {
+		width := size.Width
+		if b := img.Bounds(); b.Dx() < width {
+			width = b.Dx()
+		}
+		height := int(math.Round(float64(width) / kind.Aspect))
+		dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+		r := Rendition{Size: size.Name, Width: width, Height: height}
+		buf := &bytes.Buffer{}
+		if opaque {
+			r.ContentType = "image/jpeg"
+			err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: 85})
+		} else {
+			r.ContentType = "image/png"
+			err = png.Encode(buf, dst)
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.Data = buf.Bytes()
+		renditions = append(renditions, r)
+	}
+	return renditions, nil
+}
+
+// Largest centered part of img with the given aspect ratio
+func cropToAspect(img image.Image, aspect float64) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if float64(w)/float64(h) > aspect {
+		w = int(math.Round(float64(h) * aspect))
+	} else {
+		h = int(math.Round(float64(w) / aspect))
+	}
+	x0 := b.Min.X + (b.Dx()-w)/2
+	y0 := b.Min.Y + (b.Dy()-h)/2
+	crop := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Copy(crop, image.Point{}, img, image.Rect(x0, y0, x0+w, y0+h), draw.Src, nil)
+	return crop
+}
+
+// Opaque images are stored as JPEG, anything with transparency as PNG
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Applies an EXIF orientation, 1 to 8, so the image comes out the right way up
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations 5 to 8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored
+				dx, dy = w-1-x, y
+			case 3: // Upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // Upside down and mirrored
+				dx, dy = x, h-1-y
+			case 5: // Transposed
+				dx, dy = y, x
+			case 6: // Needs turning clockwise
+				dx, dy = h-1-y, x
+			case 7: // Transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // Needs turning counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,145 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage(w, h int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// A JPEG with an EXIF segment holding just an orientation tag
+func jpegWithOrientation(t *testing.T, img image.Image, orientation uint16) []byte {
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry, orientationTag)
+	binary.BigEndian.PutUint16(entry[2:], 3) // SHORT
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(append(tiff, entry...), 0, 0, 0, 0)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	jpg := buf.Bytes()
+	out := append([]byte{}, jpg[:2]...)
+	out = append(append(out, app1...), segment...)
+	return append(out, jpg[2:]...)
+}
+
+func TestProcess(t *testing.T) {
+	t.Run("Avatars are cropped square in every size", func(t *testing.T) {
+		renditions, err := Process(encodePNG(t, testImage(800, 500, color.White)), Avatar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(renditions) != len(Avatar.Sizes) {
+			t.Fatalf("got %d renditions, want %d", len(renditions), len(Avatar.Sizes))
+		}
+		for i, r := range renditions {
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(r.Data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Avatar.Sizes[i].Width
+			if cfg.Width != want || cfg.Height != want || r.Width != want || r.Height != want {
+				t.Errorf("%s: got %dx%d, want %dx%d", r.Size, cfg.Width, cfg.Height, want, want)
+			}
+			if r.ContentType != "image/jpeg" {
+				t.Errorf("got %s for an opaque image, want image/jpeg", r.ContentType)
+			}
+		}
+	})
+
+	t.Run("Small images aren't scaled up", func(t *testing.T) {
+		renditions, err := Process(encodePNG(t, testImage(300, 100, color.Transparent)), Banner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := renditions[0]; r.Width != 300 || r.Height != 100 || r.ContentType != "image/png" {
+			t.Errorf("got %dx%d %s, want 300x100 image/png", r.Width, r.Height, r.ContentType)
+		}
+	})
+
+	t.Run("EXIF orientation is applied and stripped", func(t *testing.T) {
+		// Stored sideways: left half red, right half blue. Turned clockwise, red ends up on top
+		img := testImage(200, 100, color.NRGBA{0, 0, 255, 255})
+		for y := 0; y < 100; y++ {
+			for x := 0; x < 100; x++ {
+				img.Set(x, y, color.NRGBA{255, 0, 0, 255})
+			}
+		}
+		data := jpegWithOrientation(t, img, 6)
+		if exifOrientation(data) != 6 {
+			t.Fatalf("got orientation %d, want 6", exifOrientation(data))
+		}
+
+		renditions, err := Process(data, Kind{Aspect: 0.5, Sizes: []Size{{"large", 100}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := renditions[0]
+		if r.Width != 100 || r.Height != 200 {
+			t.Fatalf("got %dx%d, want 100x200", r.Width, r.Height)
+		}
+		if bytes.Contains(r.Data, []byte("Exif")) {
+			t.Error("got EXIF data in the rendition")
+		}
+		out, err := jpeg.Decode(bytes.NewReader(r.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if red, _, blue, _ := out.At(50, 20).RGBA(); red < blue {
+			t.Error("got blue on top, want the image turned clockwise")
+		}
+	})
+
+	t.Run("Content is sniffed", func(t *testing.T) {
+		if _, err := Process([]byte("<svg onload=alert(1)></svg>"), Avatar); err != ErrUnsupportedType {
+			t.Errorf("got %v, want %v", err, ErrUnsupportedType)
+		}
+		// Looks like a PNG but isn't one
+		if _, err := Process([]byte("\x89PNG\r\n\x1a\nbleh"), Avatar); err != ErrInvalidImage {
+			t.Errorf("got %v, want %v", err, ErrInvalidImage)
+		}
+	})
+
+	t.Run("Huge dimensions are rejected before decoding", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		if err := gif.Encode(buf, testImage(16, 16, color.White), nil); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		// Logical screen size lives right after the signature
+		binary.LittleEndian.PutUint16(data[6:], 65535)
+		binary.LittleEndian.PutUint16(data[8:], 65535)
+		if _, err := Process(data, Avatar); err != ErrDimensions {
+			t.Errorf("got %v, want %v", err, ErrDimensions)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Marks the ledger entries migration 3 booked
+const ledgerBackfill = 3
+
+// Migrations of the ledger collection
+var ledgerMigrations = []Migration{
+	{
+		// Booked without a fee, like the SQL backfill. The entries are marked so Down can take
+		// back just these, whatever was posted to the ledger since stays
+		Version:     3,
+		Description: "Book recorded payments and withdrawals to the ledger",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			ledger := db.Collection("ledger")
+			book := func(txnID string, entries ...bson.M) error {
+				n, err := ledger.CountDocuments(ctx, bson.M{"txnId": txnID})
+				if err != nil || n > 0 {
+					return err
+				}
+				docs := make([]interface{}, len(entries))
+				for i, e := range entries {
+					e["txnId"] = txnID
+					docs[i] = e
+				}
+				_, err = ledger.InsertMany(ctx, docs)
+				return err
+			}
+			entry := func(account string, doc bson.M, kind, amount string, at interface{}) bson.M {
+				return bson.M{"account": account, "creatorId": doc["creatorId"], "kind": kind, "chain": doc["chain"],
+					"token": doc["token"], "amount": amount, "tierId": "", "at": at, "backfill": ledgerBackfill}
+			}
+
+			cur, err := db.Collection("payments").Find(ctx, bson.M{})
+			if err != nil {
+				return err
+			}
+			var payments []bson.M
+			if err := cur.All(ctx, &payments); err != nil {
+				return err
+			}
+			for _, p := range payments {
+				amount, _ := p["amount"].(string)
+				creator, _ := p["creatorId"].(string)
+				err := book(fmt.Sprintf("payment:%v", p["txHash"]),
+					entry("custody", p, "payment", amount, p["verifiedAt"]),
+					entry("creator:"+creator, p, "payment", "-"+amount, p["verifiedAt"]))
+				if err != nil {
+					return err
+				}
+			}
+
+			cur, err = db.Collection("withdrawals").Find(ctx, bson.M{"status": bson.M{"$ne": "failed"}})
+			if err != nil {
+				return err
+			}
+			var withdrawals []bson.M
+			if err := cur.All(ctx, &withdrawals); err != nil {
+				return err
+			}
+			for _, w := range withdrawals {
+				amount, _ := w["amount"].(string)
+				creator, _ := w["creatorId"].(string)
+				id, _ := w["_id"].(primitive.ObjectID)
+				err := book("withdrawal:"+id.Hex(),
+					entry("creator:"+creator, w, "withdrawal", amount, w["createdAt"]),
+					entry("custody", w, "withdrawal", "-"+amount, w["createdAt"]))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("ledger").DeleteMany(ctx, bson.M{"backfill": ledgerBackfill})
+			return err
+		},
+	},
+}
@@ -0,0 +1,231 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrLocked means another instance is running migrations right now
+var ErrLocked = errors.New("migrations are locked by another instance")
+
+// Migration is a single versioned change to the DB.
+// Versions have to be unique, they are applied in increasing order
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+	Down        func(ctx context.Context, db *mongo.Database) error
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d %s", m.Version, m.Description)
+}
+
+// Record is what gets stored for every applied migration
+type Record struct {
+	Version     int       `bson:"version"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// Store keeps track of applied migrations and hands out the lock
+type Store interface {
+	Lock(ctx context.Context, owner string, ttl time.Duration) error
+	// Refresh pushes the expiry of a lock we hold, ErrLocked if it's no longer ours
+	Refresh(ctx context.Context, owner string, ttl time.Duration) error
+	Unlock(ctx context.Context, owner string) error
+	Applied(ctx context.Context) ([]Record, error)
+	Insert(ctx context.Context, rec Record) error
+	Remove(ctx context.Context, version int) error
+}
+
+type Migrator struct {
+	DB         *mongo.Database
+	Store      Store
+	Migrations []Migration
+	// How long the lock is held before other instances may take it over,
+	// in case we die half way through. It's refreshed while migrations run
+	LockTTL time.Duration
+	// Only report what would be done
+	DryRun bool
+}
+
+// All is the list of migrations the koen migrate command runs. New ones go with the
+// migrations of the collection they change and take the next version number
+var All = concat(userMigrations, ledgerMigrations)
+
+func concat(lists ...[]Migration) []Migration {
+	var all []Migration
+	for _, l := range lists {
+		all = append(all, l...)
+	}
+	return all
+}
+
+func NewMigrator(db *mongo.Database) *Migrator {
+	return &Migrator{
+		DB:         db,
+		Store:      &MongoStore{Collection: db.Collection("migrations")},
+		Migrations: All,
+		LockTTL:    10 * time.Minute,
+	}
+}
+
+func (m *Migrator) sorted() ([]Migration, error) {
+	list := append([]Migration{}, m.Migrations...)
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	for i := 1; i < len(list); i++ {
+		if list[i].Version == list[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", list[i].Version)
+		}
+	}
+	return list, nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]Record, error) {
+	records, err := m.Store.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]Record, len(records))
+	for _, rec := range records {
+		applied[rec.Version] = rec
+	}
+	return applied, nil
+}
+
+// Pending lists migrations that have not been applied yet, oldest first
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	list, err := m.sorted()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, mig := range list {
+		if _, ok := applied[mig.Version]; !ok {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies pending migrations up to and including version 'to'.
+// A 'to' of 0 applies everything. Returns the migrations that were (or would be) run
+func (m *Migrator) Up(ctx context.Context, to int) ([]Migration, error) {
+	var done []Migration
+	err := m.withLock(ctx, func(ctx context.Context) error {
+		pending, err := m.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		for _, mig := range pending {
+			if to > 0 && mig.Version > to {
+				break
+			}
+			if !m.DryRun {
+				if err := mig.Up(ctx, m.DB); err != nil {
+					return fmt.Errorf("migration %s: %w", mig, err)
+				}
+				rec := Record{Version: mig.Version, Description: mig.Description, AppliedAt: time.Now().UTC()}
+				if err := m.Store.Insert(ctx, rec); err != nil {
+					return err
+				}
+			}
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the last 'steps' applied migrations, newest first
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := m.withLock(ctx, func(ctx context.Context) error {
+		list, err := m.sorted()
+		if err != nil {
+			return err
+		}
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for i := len(list) - 1; i >= 0 && len(done) < steps; i-- {
+			mig := list[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			if mig.Down == nil {
+				return fmt.Errorf("migration %s can't be reverted", mig)
+			}
+			if !m.DryRun {
+				if err := mig.Down(ctx, m.DB); err != nil {
+					return fmt.Errorf("migration %s: %w", mig, err)
+				}
+				if err := m.Store.Remove(ctx, mig.Version); err != nil {
+					return err
+				}
+			}
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Runs fn holding the lock. Losing the lock cancels the context passed to fn
+func (m *Migrator) withLock(ctx context.Context, fn func(ctx context.Context) error) error {
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+	if err := m.Store.Lock(ctx, owner, m.LockTTL); err != nil {
+		return err
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	lost := make(chan error, 1)
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		if m.LockTTL <= 0 {
+			return
+		}
+		// Well before it expires, so a slow refresh doesn't let another instance in
+		ticker := time.NewTicker(m.LockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lockCtx.Done():
+				return
+			case <-ticker.C:
+				if err := m.Store.Refresh(lockCtx, owner, m.LockTTL); err != nil && lockCtx.Err() == nil {
+					lost <- err
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	err := fn(lockCtx)
+	cancel()
+	<-refreshed
+	select {
+	case lostErr := <-lost:
+		return fmt.Errorf("lost the migration lock: %w", lostErr)
+	default:
+	}
+
+	if unlockErr := m.Store.Unlock(ctx, owner); err == nil {
+		err = unlockErr
+	}
+	return err
+}
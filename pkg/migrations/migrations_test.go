@@ -0,0 +1,261 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type memoryStore struct {
+	mu        sync.Mutex
+	owner     string
+	records   []Record
+	refreshes int
+}
+
+func (s *memoryStore) Lock(ctx context.Context, owner string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner != "" {
+		return ErrLocked
+	}
+	s.owner = owner
+	return nil
+}
+
+func (s *memoryStore) Refresh(ctx context.Context, owner string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner != owner {
+		return ErrLocked
+	}
+	s.refreshes++
+	return nil
+}
+
+func (s *memoryStore) Unlock(ctx context.Context, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.owner == owner {
+		s.owner = ""
+	}
+	return nil
+}
+
+func (s *memoryStore) Applied(ctx context.Context) ([]Record, error) {
+	return append([]Record{}, s.records...), nil
+}
+
+func (s *memoryStore) Insert(ctx context.Context, rec Record) error {
+	s.records = append(s.records, rec)
+	return nil
+}
+
+func (s *memoryStore) Remove(ctx context.Context, version int) error {
+	for i, rec := range s.records {
+		if rec.Version == version {
+			s.records = append(s.records[:i], s.records[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Migrations that log what they did instead of touching a DB
+func testMigrations(log *[]int) []Migration {
+	mig := func(v int) Migration {
+		return Migration{
+			Version:     v,
+			Description: "test",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				*log = append(*log, v)
+				return nil
+			},
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				*log = append(*log, -v)
+				return nil
+			},
+		}
+	}
+	// Deliberately out of order
+	return []Migration{mig(3), mig(1), mig(2)}
+}
+
+func versions(list []Migration) []int {
+	var v []int
+	for _, m := range list {
+		v = append(v, m.Version)
+	}
+	return v
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Up applies pending migrations in order", func(t *testing.T) {
+		var log []int
+		m := &Migrator{Store: &memoryStore{}, Migrations: testMigrations(&log)}
+
+		done, err := m.Up(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := versions(done), []int{1, 2}; !equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+
+		done, err = m.Up(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := versions(done), []int{3}; !equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := log, []int{1, 2, 3}; !equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Down reverts newest first", func(t *testing.T) {
+		var log []int
+		m := &Migrator{Store: &memoryStore{}, Migrations: testMigrations(&log)}
+		if _, err := m.Up(ctx, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		done, err := m.Down(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := versions(done), []int{3, 2}; !equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		pending, _ := m.Pending(ctx)
+		if got, want := versions(pending), []int{2, 3}; !equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Dry run doesn't apply anything", func(t *testing.T) {
+		var log []int
+		store := &memoryStore{}
+		m := &Migrator{Store: store, Migrations: testMigrations(&log), DryRun: true}
+
+		done, err := m.Up(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(done) != 3 || len(log) != 0 || len(store.records) != 0 {
+			t.Errorf("got done %v, log %v, records %v", versions(done), log, store.records)
+		}
+	})
+
+	t.Run("Locked store refuses to migrate", func(t *testing.T) {
+		var log []int
+		m := &Migrator{Store: &memoryStore{owner: "someone else"}, Migrations: testMigrations(&log)}
+
+		_, err := m.Up(ctx, 0)
+		if !errors.Is(err, ErrLocked) {
+			t.Errorf("got %v, want %v", err, ErrLocked)
+		}
+		if len(log) != 0 {
+			t.Errorf("migrations ran while locked: %v", log)
+		}
+	})
+
+	t.Run("Lock is refreshed while migrations run", func(t *testing.T) {
+		store := &memoryStore{}
+		m := &Migrator{Store: store, LockTTL: 30 * time.Millisecond, Migrations: []Migration{{
+			Version: 1,
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				time.Sleep(100 * time.Millisecond)
+				return nil
+			},
+		}}}
+
+		if _, err := m.Up(ctx, 0); err != nil {
+			t.Fatal(err)
+		}
+		if store.refreshes == 0 {
+			t.Error("got no refreshes, want the lock kept alive past its TTL")
+		}
+	})
+
+	t.Run("Losing the lock stops migrating", func(t *testing.T) {
+		store := &memoryStore{}
+		m := &Migrator{Store: store, LockTTL: 30 * time.Millisecond, Migrations: []Migration{{
+			Version: 1,
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				// Someone else takes over, as if our lock had expired
+				store.mu.Lock()
+				store.owner = "someone else"
+				store.mu.Unlock()
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		}}}
+
+		_, err := m.Up(ctx, 0)
+		if !errors.Is(err, ErrLocked) {
+			t.Errorf("got %v, want %v", err, ErrLocked)
+		}
+		if len(store.records) != 0 || store.owner != "someone else" {
+			t.Errorf("got records %v and owner %q, want nothing recorded and their lock left alone", store.records, store.owner)
+		}
+	})
+
+	t.Run("Failed migration isn't recorded", func(t *testing.T) {
+		store := &memoryStore{}
+		m := &Migrator{Store: store, Migrations: []Migration{{
+			Version: 1,
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				return errors.New("bleh")
+			},
+		}}}
+
+		if _, err := m.Up(ctx, 0); err == nil {
+			t.Fatal("want error, got nil")
+		}
+		if len(store.records) != 0 || store.owner != "" {
+			t.Errorf("got records %v and owner %q after failure", store.records, store.owner)
+		}
+	})
+
+	t.Run("Duplicate versions are rejected", func(t *testing.T) {
+		var log []int
+		list := append(testMigrations(&log), testMigrations(&log)[0])
+		m := &Migrator{Store: &memoryStore{}, Migrations: list}
+
+		if _, err := m.Up(ctx, 0); err == nil {
+			t.Fatal("want error, got nil")
+		}
+	})
+}
+
+func TestAllMigrations(t *testing.T) {
+	m := &Migrator{Migrations: All}
+	if _, err := m.sorted(); err != nil {
+		t.Error(err)
+	}
+	for _, mig := range All {
+		if mig.Up == nil || mig.Down == nil || mig.Description == "" {
+			t.Errorf("migration %d is incomplete", mig.Version)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package migrations
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The lock lives in the migrations collection next to the records
+const lockID = "lock"
+
+// MongoStore keeps applied migrations in a Mongo collection
+type MongoStore struct {
+	Collection *mongo.Collection
+}
+
+func (s *MongoStore) Lock(ctx context.Context, owner string, ttl time.Duration) error {
+	now := time.Now().UTC()
+	// Only matches a lock that has expired. If there is a live one the upsert
+	// tries to insert a second document with the same _id and fails
+	filter := bson.M{"_id": lockID, "expiresAt": bson.M{"$lt": now}}
+	update := bson.M{"$set": bson.M{"owner": owner, "lockedAt": now, "expiresAt": now.Add(ttl)}}
+	_, err := s.Collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrLocked
+	}
+	return err
+}
+
+func (s *MongoStore) Refresh(ctx context.Context, owner string, ttl time.Duration) error {
+	update := bson.M{"$set": bson.M{"expiresAt": time.Now().UTC().Add(ttl)}}
+	res, err := s.Collection.UpdateOne(ctx, bson.M{"_id": lockID, "owner": owner}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrLocked
+	}
+	return nil
+}
+
+func (s *MongoStore) Unlock(ctx context.Context, owner string) error {
+	_, err := s.Collection.DeleteOne(ctx, bson.M{"_id": lockID, "owner": owner})
+	return err
+}
+
+func (s *MongoStore) Applied(ctx context.Context) ([]Record, error) {
+	cur, err := s.Collection.Find(ctx, bson.M{"version": bson.M{"$exists": true}},
+		options.Find().SetSort(bson.M{"version": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	if err := cur.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (s *MongoStore) Insert(ctx context.Context, rec Record) error {
+	_, err := s.Collection.InsertOne(ctx, rec)
+	return err
+}
+
+func (s *MongoStore) Remove(ctx context.Context, version int) error {
+	_, err := s.Collection.DeleteOne(ctx, bson.M{"version": version})
+	return err
+}
@@ -0,0 +1,66 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migrations of the users collection
+var userMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "Backfill users createdAt from their ObjectID",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("users").UpdateMany(ctx,
+				bson.M{"createdAt": bson.M{"$exists": false}},
+				mongo.Pipeline{{{Key: "$set", Value: bson.M{"createdAt": bson.M{"$toDate": "$_id"}}}}},
+			)
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("users").UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"createdAt": ""}})
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "Backfill users updatedAt from createdAt",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("users").UpdateMany(ctx,
+				bson.M{"updatedAt": bson.M{"$exists": false}},
+				mongo.Pipeline{{{Key: "$set", Value: bson.M{"updatedAt": "$createdAt"}}}},
+			)
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("users").UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"updatedAt": ""}})
+			return err
+		},
+	},
+	{
+		// Searches fetch candidates with regexes now, the text index only slowed down writes
+		Version:     4,
+		Description: "Drop the users search_text index",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("users").Indexes().DropOne(ctx, "search_text")
+			var cmdErr mongo.CommandError
+			// Never built, or no users at all yet
+			if errors.As(err, &cmdErr) && (cmdErr.Name == "IndexNotFound" || cmdErr.Name == "NamespaceNotFound") {
+				return nil
+			}
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "pageName", Value: "text"}, {Key: "name", Value: "text"}, {Key: "categories", Value: "text"}, {Key: "bio", Value: "text"}},
+				Options: options.Index().SetName("search_text").
+					SetWeights(bson.M{"pageName": 10, "name": 10, "categories": 5, "bio": 1}),
+			})
+			return err
+		},
+	},
+}
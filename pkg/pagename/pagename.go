@@ -0,0 +1,139 @@
+package pagename
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	MinLength = 3
+	MaxLength = 30
+)
+
+var (
+	ErrLength     = fmt.Errorf("page name must be %d to %d characters long", MinLength, MaxLength)
+	ErrCharset    = errors.New("page name can only contain letters a-z, digits, '-' and '_', and must start and end with a letter or digit")
+	ErrReserved   = errors.New("page name is reserved")
+	ErrConfusable = errors.New("page name contains characters that look like other letters")
+)
+
+var validName = regexp.MustCompile(`^[a-z0-9]([a-z0-9_-]*[a-z0-9])?$`)
+
+// Normalize is applied before validating and storing a page name.
+// NFKC folds compatibility forms like fullwidth letters into plain ones
+func Normalize(name string) string {
+	return strings.ToLower(norm.NFKC.String(strings.TrimSpace(name)))
+}
+
+// Validate checks an already normalized page name
+func Validate(name string) error {
+	if n := utf8.RuneCountInString(name); n < MinLength || n > MaxLength {
+		return ErrLength
+	}
+	if lookalike, ok := asciiLookalike(name); ok {
+		return fmt.Errorf("%w, did you mean %q?", ErrConfusable, lookalike)
+	}
+	if !validName.MatchString(name) || strings.Contains(name, "--") || strings.Contains(name, "__") {
+		return ErrCharset
+	}
+	if IsReserved(name) {
+		return ErrReserved
+	}
+	return nil
+}
+
+// Non-latin letters that are commonly used to impersonate latin ones
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p',
+	'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd',
+	'ԛ': 'q', 'ԝ': 'w', 'ү': 'y', 'һ': 'h',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x',
+	// Latin extensions
+	'ı': 'i', 'ɡ': 'g', 'ℓ': 'l',
+}
+
+// If name uses confusable letters, returns what it's pretending to be
+func asciiLookalike(name string) (string, bool) {
+	found := false
+	mapped := strings.Map(func(r rune) rune {
+		if ascii, ok := confusables[r]; ok {
+			found = true
+			return ascii
+		}
+		return r
+	}, name)
+	return mapped, found
+}
+
+// Skeleton maps characters that are easily mistaken for each other to one of them,
+// so "adm1n" and "admin" end up the same
+func Skeleton(name string) string {
+	name, _ = asciiLookalike(name)
+	name = strings.NewReplacer("rn", "m", "vv", "w", "_", "-").Replace(name)
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '0':
+			return 'o'
+		case '1', 'i':
+			return 'l'
+		case '5':
+			return 's'
+		}
+		return r
+	}, name)
+}
+
+var suggestionSuffixes = []string{"hq", "-official", "-studio", "-art", "-music", "-tv"}
+
+// Every candidate checked is a lookup, and anyone can ask for suggestions.
+// Suggest gives up after checking this many
+const MaxSuggestionChecks = 10
+
+// Suggest comes up with up to n valid alternatives for a name that's taken.
+// isTaken is asked about every candidate before it is suggested, at most MaxSuggestionChecks times
+func Suggest(name string, n int, isTaken func(string) (bool, error)) ([]string, error) {
+	base := strings.Trim(name, "-_")
+	var candidates []string
+	for _, suffix := range suggestionSuffixes {
+		candidates = append(candidates, truncate(base, MaxLength-len(suffix))+suffix)
+	}
+	for i := 1; i <= MaxSuggestionChecks; i++ {
+		suffix := fmt.Sprint(i)
+		candidates = append(candidates, truncate(base, MaxLength-len(suffix))+suffix)
+	}
+
+	suggestions := []string{}
+	checks := 0
+	for _, c := range candidates {
+		if len(suggestions) >= n || checks >= MaxSuggestionChecks {
+			break
+		}
+		if Validate(c) != nil {
+			continue
+		}
+		checks++
+		taken, err := isTaken(c)
+		if err != nil {
+			return nil, err
+		}
+		if !taken {
+			suggestions = append(suggestions, c)
+		}
+	}
+	return suggestions, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.TrimRight(s[:n], "-_")
+}
@@ -0,0 +1,90 @@
+package pagename
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	cases := map[string]string{
+		"  Koen ":  "koen",
+		"ｋｏｅｎ":     "koen",
+		"KOEN_San": "koen_san",
+	}
+	for in, want := range cases {
+		if got := Normalize(in); got != want {
+			t.Errorf("Normalize(%q) got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		want error
+	}{
+		{"koen-san", nil},
+		{"dropcoin_fan99", nil},
+		{"ab", ErrLength},
+		{strings.Repeat("a", 500), ErrLength},
+		{"-koen", ErrCharset},
+		{"koen--san", ErrCharset},
+		{"koen san", ErrCharset},
+		{"koen🚀", ErrCharset},
+		{"api", ErrReserved},
+		{"admin", ErrReserved},
+		{"adm1n", ErrReserved},
+		{"supp0rt", ErrReserved},
+		// Cyrillic 'о' and 'е'
+		{"kоеn-san", ErrConfusable},
+	}
+	for _, c := range cases {
+		got := Validate(c.name)
+		if !errors.Is(got, c.want) {
+			t.Errorf("Validate(%q) got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestConfusableSuggestsLookalike(t *testing.T) {
+	err := Validate("pаypal")
+	if err == nil || !strings.Contains(err.Error(), `"paypal"`) {
+		t.Errorf("got %v, want it to mention paypal", err)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	taken := map[string]bool{"koenhq": true, "koen-official": true}
+	got, err := Suggest("koen", 3, func(name string) (bool, error) {
+		return taken[name], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %v, want 3 suggestions", got)
+	}
+	for _, name := range got {
+		if taken[name] || Validate(name) != nil {
+			t.Errorf("got unusable suggestion %q", name)
+		}
+	}
+
+	checks := 0
+	got, _ = Suggest("koen", 3, func(string) (bool, error) {
+		checks++
+		return true, nil
+	})
+	if len(got) != 0 || checks != MaxSuggestionChecks {
+		t.Errorf("got %v after %d checks, want nothing after %d", got, checks, MaxSuggestionChecks)
+	}
+
+	long := strings.Repeat("a", MaxLength)
+	got, _ = Suggest(long, 2, func(string) (bool, error) { return false, nil })
+	for _, name := range got {
+		if len(name) > MaxLength {
+			t.Errorf("suggestion %q is too long", name)
+		}
+	}
+}
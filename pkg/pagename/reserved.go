@@ -0,0 +1,29 @@
+package pagename
+
+// Page names live next to our own routes and brand, so these can't be claimed.
+// Compared by skeleton, which also rules out lookalikes such as "adm1n"
+var reserved = []string{
+	// Routes and files served by the web app
+	"about", "account", "api", "app", "assets", "auth", "blog", "callback", "checkout",
+	"dashboard", "docs", "explore", "favicon", "feed", "help", "home", "index", "login",
+	"logout", "me", "new", "notifications", "pagenames", "pages", "payments", "posts",
+	"privacy", "profile", "register", "search", "settings", "signin", "signup", "static",
+	"status", "terms", "tiers", "users", "wallet", "www",
+	// Staff and brand
+	"admin", "administrator", "contact", "dropcoin", "koen", "mod", "moderator", "official",
+	"root", "security", "staff", "support", "system", "team",
+	// Values that tend to show up by accident
+	"null", "undefined", "none", "nil", "test",
+}
+
+var reservedSkeletons = func() map[string]bool {
+	m := make(map[string]bool, len(reserved))
+	for _, name := range reserved {
+		m[Skeleton(name)] = true
+	}
+	return m
+}()
+
+func IsReserved(name string) bool {
+	return reservedSkeletons[Skeleton(name)]
+}
@@ -0,0 +1,37 @@
+package pagination
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoQuery builds the filter and find options for a page of documents sorted on
+// timeField and then _id. It fetches one extra document, pass the keys to Trim
+func MongoQuery(p Params, timeField string) (bson.M, *options.FindOptions, error) {
+	dir, cmp := 1, "$gt"
+	if p.Desc {
+		dir, cmp = -1, "$lt"
+	}
+
+	filter := bson.M{}
+	if p.After != nil {
+		// No ID means starting at a point in time, the zero ObjectID sorts before any other
+		id := primitive.NilObjectID
+		if p.After.ID != "" {
+			var err error
+			if id, err = primitive.ObjectIDFromHex(p.After.ID); err != nil {
+				return nil, nil, ErrInvalidCursor
+			}
+		}
+		filter["$or"] = bson.A{
+			bson.M{timeField: bson.M{cmp: p.After.Time}},
+			bson.M{timeField: p.After.Time, "_id": bson.M{cmp: id}},
+		}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: timeField, Value: dir}, {Key: "_id", Value: dir}}).
+		SetLimit(int64(p.Limit + 1))
+	return filter, opts, nil
+}
@@ -0,0 +1,182 @@
+package pagination
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/utils"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Key is the position of an item in a list.
+// Lists are sorted by time first, ID breaks ties so the order is always stable
+type Key struct {
+	Time time.Time `json:"t"`
+	ID   string    `json:"id"`
+}
+
+// Before reports whether k sorts before other in ascending order
+func (k Key) Before(other Key) bool {
+	if !k.Time.Equal(other.Time) {
+		return k.Time.Before(other.Time)
+	}
+	return k.ID < other.ID
+}
+
+// Params describes which page to fetch
+type Params struct {
+	Limit int
+	// Only items after this one, nil for the first page.
+	// A key without an ID starts right at its time
+	After *Key
+	// Newest first
+	Desc bool
+}
+
+// Signer turns keys into opaque cursors and back.
+// Cursors are signed, so clients can't forge positions or peek at other fields
+type Signer struct {
+	Secret       []byte
+	DefaultLimit int
+	MaxLimit     int
+}
+
+func NewSigner(c config.PaginationConfig) Signer {
+	return Signer{Secret: []byte(c.CursorSecret), DefaultLimit: c.DefaultLimit, MaxLimit: c.MaxLimit}
+}
+
+func (s Signer) mac(payload string) string {
+	h := hmac.New(sha256.New, s.Secret)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (s Signer) Encode(k Key) string {
+	dat, _ := json.Marshal(k)
+	payload := base64.RawURLEncoding.EncodeToString(dat)
+	return payload + "." + s.mac(payload)
+}
+
+func (s Signer) Decode(cursor string) (Key, error) {
+	parts := strings.Split(cursor, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.mac(parts[0]))) {
+		return Key{}, ErrInvalidCursor
+	}
+	dat, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Key{}, ErrInvalidCursor
+	}
+	var k Key
+	if err := json.Unmarshal(dat, &k); err != nil {
+		return Key{}, ErrInvalidCursor
+	}
+	return k, nil
+}
+
+// FromRequest reads the 'limit' and 'cursor' query parameters.
+// Limits above MaxLimit are capped rather than rejected
+func (s Signer) FromRequest(r *http.Request) (Params, error) {
+	p := Params{Limit: s.DefaultLimit}
+	query := r.URL.Query()
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return Params{}, errors.New("limit must be a positive number")
+		}
+		p.Limit = n
+	}
+	if s.MaxLimit > 0 && p.Limit > s.MaxLimit {
+		p.Limit = s.MaxLimit
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		k, err := s.Decode(cursor)
+		if err != nil {
+			return Params{}, err
+		}
+		p.After = &k
+	}
+	return p, nil
+}
+
+// Page is what list endpoints respond with
+type Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// Respond writes a page of items, with a Link header pointing at the next page if there is one
+func (s Signer) Respond(items interface{}, next *Key) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := Page{Items: items}
+		if next != nil {
+			page.NextCursor = s.Encode(*next)
+			w.Header().Set("Link", `<`+nextURL(r, page.NextCursor)+`>; rel="next"`)
+		}
+		utils.RespondWithJSON(page, http.StatusOK)(w, r)
+	}
+}
+
+func nextURL(r *http.Request, cursor string) string {
+	u := url.URL{Path: r.URL.Path}
+	query := r.URL.Query()
+	query.Set("cursor", cursor)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Trim cuts a result fetched with Limit+1 items down to Limit,
+// returning the key to continue from if there were more
+func Trim(keys []Key, p Params) (n int, next *Key) {
+	if len(keys) <= p.Limit {
+		return len(keys), nil
+	}
+	last := keys[p.Limit-1]
+	return p.Limit, &last
+}
+
+// Paginate picks a page out of items held in memory.
+// Returns indexes into keys in page order, and the key to continue from
+func Paginate(keys []Key, p Params) (page []int, next *Key) {
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if p.Desc {
+			return keys[order[j]].Before(keys[order[i]])
+		}
+		return keys[order[i]].Before(keys[order[j]])
+	})
+
+	var pageKeys []Key
+	for _, i := range order {
+		if p.After != nil {
+			if !p.Desc && !p.After.Before(keys[i]) {
+				continue
+			}
+			if p.Desc && !keys[i].Before(*p.After) {
+				continue
+			}
+		}
+		page = append(page, i)
+		pageKeys = append(pageKeys, keys[i])
+		if len(page) > p.Limit {
+			break
+		}
+	}
+	n, next := Trim(pageKeys, p)
+	return page[:n], next
+}
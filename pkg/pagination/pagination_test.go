@@ -0,0 +1,137 @@
+package pagination
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var signer = Signer{Secret: []byte("test"), DefaultLimit: 2, MaxLimit: 3}
+
+func TestCursors(t *testing.T) {
+	key := Key{Time: time.Date(2021, 8, 1, 10, 0, 0, 123, time.UTC), ID: "60f5"}
+
+	t.Run("Round trip", func(t *testing.T) {
+		got, err := signer.Decode(signer.Encode(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Time.Equal(key.Time) || got.ID != key.ID {
+			t.Errorf("got %v, want %v", got, key)
+		}
+	})
+
+	t.Run("Tampered cursors are rejected", func(t *testing.T) {
+		cursor := signer.Encode(key)
+		other := Signer{Secret: []byte("other")}.Encode(Key{ID: "bleh"})
+		for _, c := range []string{"bleh", cursor + "x", strings.Split(other, ".")[0] + "." + strings.Split(cursor, ".")[1], other} {
+			if _, err := signer.Decode(c); err != ErrInvalidCursor {
+				t.Errorf("got %v for %q, want %v", err, c, ErrInvalidCursor)
+			}
+		}
+	})
+}
+
+func TestFromRequest(t *testing.T) {
+	cases := []struct {
+		query     string
+		wantLimit int
+		wantErr   bool
+	}{
+		{"", 2, false},
+		{"limit=1", 1, false},
+		{"limit=500", 3, false},
+		{"limit=0", 0, true},
+		{"limit=bleh", 0, true},
+		{"cursor=bleh", 0, true},
+	}
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "/supporters?"+c.query, nil)
+		p, err := signer.FromRequest(r)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%q: got error %v", c.query, err)
+			continue
+		}
+		if p.Limit != c.wantLimit {
+			t.Errorf("%q: got limit %d, want %d", c.query, p.Limit, c.wantLimit)
+		}
+	}
+}
+
+func TestRespond(t *testing.T) {
+	next := Key{Time: time.Now().UTC(), ID: "1"}
+	r, _ := http.NewRequest("GET", "/supporters?limit=2", nil)
+	rr := httptest.NewRecorder()
+	signer.Respond([]string{"a", "b"}, &next).ServeHTTP(rr, r)
+
+	var page struct {
+		Items      []string `json:"items"`
+		NextCursor string   `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.NextCursor == "" || len(page.Items) != 2 {
+		t.Fatalf("got %+v", page)
+	}
+	link := rr.Header().Get("Link")
+	if !strings.HasPrefix(link, "</supporters?") || !strings.Contains(link, "limit=2") || !strings.HasSuffix(link, `>; rel="next"`) {
+		t.Errorf("got Link %q", link)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	base := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	// Two items share a timestamp, the ID has to keep them in order
+	keys := []Key{
+		{Time: base.Add(2 * time.Second), ID: "c"},
+		{Time: base, ID: "a"},
+		{Time: base.Add(time.Second), ID: "b2"},
+		{Time: base.Add(time.Second), ID: "b1"},
+		{Time: base.Add(3 * time.Second), ID: "d"},
+	}
+
+	walk := func(desc bool) string {
+		var seen []string
+		p := Params{Limit: 2, Desc: desc}
+		for i := 0; i < 10; i++ {
+			page, next := Paginate(keys, p)
+			for _, idx := range page {
+				seen = append(seen, keys[idx].ID)
+			}
+			if next == nil {
+				break
+			}
+			p.After = next
+		}
+		return fmt.Sprint(seen)
+	}
+
+	if got, want := walk(false), "[a b1 b2 c d]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := walk(true), "[d c b2 b1 a]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestMongoQuery(t *testing.T) {
+	filter, _, err := MongoQuery(Params{Limit: 2}, "createdAt")
+	if err != nil || len(filter) != 0 {
+		t.Errorf("got %v %v, want an empty filter on the first page", filter, err)
+	}
+
+	filter, _, err = MongoQuery(Params{Limit: 2, After: &Key{Time: time.Now()}}, "createdAt")
+	if err != nil || filter["$or"] == nil {
+		t.Errorf("got %v %v, want a filter starting at a time", filter, err)
+	}
+
+	_, _, err = MongoQuery(Params{Limit: 2, After: &Key{ID: "bleh"}}, "createdAt")
+	if err != ErrInvalidCursor {
+		t.Errorf("got %v, want %v", err, ErrInvalidCursor)
+	}
+}
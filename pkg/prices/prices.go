@@ -0,0 +1,188 @@
+// Package prices converts token amounts to fiat currencies, so creators see what they
+// earned in money they think in
+package prices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/ttlcache"
+)
+
+// Prices younger than this are the current price, older ones are looked up by day
+const recent = time.Hour
+
+var (
+	ErrUnknownToken = errors.New("no price for the token")
+	ErrNoRate       = errors.New("no price in the currency")
+)
+
+// Feed quotes the price of one token in a currency as a decimal string.
+// A zero day asks for the current price, otherwise the price on that day (UTC)
+type Feed interface {
+	Rate(ctx context.Context, symbol, currency string, day time.Time) (string, error)
+}
+
+// StaticFeed has fixed prices by token symbol and then currency, whatever the day.
+// For tests and running without a price provider
+type StaticFeed map[string]map[string]string
+
+func (f StaticFeed) Rate(ctx context.Context, symbol, currency string, day time.Time) (string, error) {
+	rates, ok := f[symbol]
+	if !ok {
+		return "", ErrUnknownToken
+	}
+	rate, ok := rates[currency]
+	if !ok {
+		return "", ErrNoRate
+	}
+	return rate, nil
+}
+
+// CoinGecko's IDs of the tokens we take, prices are the same whatever chain they're on
+var coinIDs = map[string]string{
+	"ETH":   "ethereum",
+	"MATIC": "matic-network",
+	"USDC":  "usd-coin",
+	"USDT":  "tether",
+	"DAI":   "dai",
+}
+
+// HTTPFeed gets prices from a CoinGecko compatible API
+type HTTPFeed struct {
+	// Like https://api.coingecko.com/api/v3
+	URL string
+	// Sent for the paid plans, the public API goes without
+	APIKey string
+	Client *http.Client
+}
+
+func NewHTTPFeed(c config.PricesConfig) *HTTPFeed {
+	return &HTTPFeed{URL: strings.TrimSuffix(c.URL, "/"), APIKey: string(c.APIKey), Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (f *HTTPFeed) get(ctx context.Context, path string, query url.Values, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", f.URL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if f.APIKey != "" {
+		req.Header.Set("x-cg-pro-api-key", f.APIKey)
+	}
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("price feed returned %s", resp.Status)
+	}
+	// Prices stay decimal strings, floats would round them
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	return dec.Decode(result)
+}
+
+func (f *HTTPFeed) Rate(ctx context.Context, symbol, currency string, day time.Time) (string, error) {
+	id, ok := coinIDs[symbol]
+	if !ok {
+		return "", ErrUnknownToken
+	}
+	currency = strings.ToLower(currency)
+	var prices map[string]json.Number
+	if day.IsZero() {
+		var result map[string]map[string]json.Number
+		err := f.get(ctx, "/simple/price", url.Values{"ids": {id}, "vs_currencies": {currency}}, &result)
+		if err != nil {
+			return "", err
+		}
+		prices = result[id]
+	} else {
+		var result struct {
+			MarketData struct {
+				CurrentPrice map[string]json.Number `json:"current_price"`
+			} `json:"market_data"`
+		}
+		query := url.Values{"date": {day.UTC().Format("02-01-2006")}, "localization": {"false"}}
+		if err := f.get(ctx, "/coins/"+id+"/history", query, &result); err != nil {
+			return "", err
+		}
+		prices = result.MarketData.CurrentPrice
+	}
+	rate, ok := prices[currency]
+	if !ok {
+		return "", ErrNoRate
+	}
+	return rate.String(), nil
+}
+
+// Service asks a feed for prices and caches them. Current prices for a while,
+// past ones don't change so they're kept until the cache fills up
+type Service struct {
+	Feed Feed
+	// How long a current price is used, zero always asks the feed
+	CacheTTL time.Duration
+
+	cache ttlcache.Cache
+}
+
+func New(feed Feed, c config.PricesConfig) *Service {
+	return &Service{Feed: feed, CacheTTL: c.CacheTTL}
+}
+
+// Rate is the price of one symbol in currency at the time
+func (s *Service) Rate(ctx context.Context, symbol, currency string, at time.Time) (string, error) {
+	now := time.Now()
+	day, ttl := time.Time{}, s.CacheTTL
+	if at.Before(now.Add(-recent)) {
+		y, m, d := at.UTC().Date()
+		// Never expires, a day in the past has one price
+		day, ttl = time.Date(y, m, d, 0, 0, 0, 0, time.UTC), 100*365*24*time.Hour
+	}
+	key := symbol + "/" + currency + "/" + day.Format("2006-01-02")
+	if rate, ok := s.cache.Get(key); ok {
+		return rate.(string), nil
+	}
+
+	rate, err := s.Feed.Rate(ctx, symbol, currency, day)
+	if err != nil {
+		return "", err
+	}
+	// Anything we can't do sums with is as good as no price
+	if _, ok := new(big.Rat).SetString(rate); !ok {
+		return "", fmt.Errorf("price feed returned %q for %s", rate, symbol)
+	}
+	s.cache.Set(key, rate, ttl)
+	return rate, nil
+}
+
+// Value is a decimal amount of a token at a rate, nil if either doesn't parse
+func Value(amount, rate string) *big.Rat {
+	a, ok := new(big.Rat).SetString(amount)
+	if !ok {
+		return nil
+	}
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok {
+		return nil
+	}
+	return a.Mul(a, r)
+}
+
+// Format rounds a fiat amount to cents
+func Format(value *big.Rat) string {
+	return value.FloatString(2)
+}
@@ -0,0 +1,102 @@
+package prices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPFeed(t *testing.T) {
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.URL.Path+"?"+r.URL.RawQuery+" "+r.Header.Get("x-cg-pro-api-key"))
+		switch r.URL.Path {
+		case "/simple/price":
+			fmt.Fprint(w, `{"matic-network": {"usd": 0.000012345678901234567}}`)
+		case "/coins/usd-coin/history":
+			fmt.Fprint(w, `{"id": "usd-coin", "market_data": {"current_price": {"eur": 0.92, "usd": 1.001}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	feed := &HTTPFeed{URL: server.URL, APIKey: "key"}
+	ctx := context.Background()
+
+	t.Run("Current prices keep every digit", func(t *testing.T) {
+		rate, err := feed.Rate(ctx, "MATIC", "USD", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rate != "0.000012345678901234567" {
+			t.Errorf("got %s, want 0.000012345678901234567", rate)
+		}
+		if want := "/simple/price?ids=matic-network&vs_currencies=usd key"; got[len(got)-1] != want {
+			t.Errorf("got %s, want %s", got[len(got)-1], want)
+		}
+	})
+
+	t.Run("Past prices by day", func(t *testing.T) {
+		rate, err := feed.Rate(ctx, "USDC", "EUR", time.Date(2021, 1, 31, 0, 0, 0, 0, time.UTC))
+		if err != nil || rate != "0.92" {
+			t.Errorf("got %s, %v, want 0.92", rate, err)
+		}
+		if want := "/coins/usd-coin/history?date=31-01-2021&localization=false key"; got[len(got)-1] != want {
+			t.Errorf("got %s, want %s", got[len(got)-1], want)
+		}
+	})
+
+	t.Run("Missing prices", func(t *testing.T) {
+		if _, err := feed.Rate(ctx, "DOGE", "USD", time.Time{}); !errors.Is(err, ErrUnknownToken) {
+			t.Errorf("got %v, want %v", err, ErrUnknownToken)
+		}
+		if _, err := feed.Rate(ctx, "MATIC", "EUR", time.Time{}); !errors.Is(err, ErrNoRate) {
+			t.Errorf("got %v, want %v", err, ErrNoRate)
+		}
+		if _, err := feed.Rate(ctx, "ETH", "USD", time.Time{}); err == nil {
+			t.Error("got nil, want the feed's 404")
+		}
+	})
+}
+
+type countingFeed struct {
+	StaticFeed
+	days []time.Time
+}
+
+func (f *countingFeed) Rate(ctx context.Context, symbol, currency string, day time.Time) (string, error) {
+	f.days = append(f.days, day)
+	return f.StaticFeed.Rate(ctx, symbol, currency, day)
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	feed := &countingFeed{StaticFeed: StaticFeed{"USDC": {"USD": "1"}, "ETH": {"USD": "bleh"}}}
+	s := &Service{Feed: feed, CacheTTL: time.Minute}
+	now := time.Now()
+	past := time.Date(2021, 1, 31, 18, 0, 0, 0, time.UTC)
+
+	for _, at := range []time.Time{now, now.Add(-time.Minute), past, past.Add(-time.Hour)} {
+		if rate, err := s.Rate(ctx, "USDC", "USD", at); err != nil || rate != "1" {
+			t.Errorf("got %s, %v, want 1", rate, err)
+		}
+	}
+	want := []time.Time{{}, time.Date(2021, 1, 31, 0, 0, 0, 0, time.UTC)}
+	if len(feed.days) != len(want) || !feed.days[0].Equal(want[0]) || !feed.days[1].Equal(want[1]) {
+		t.Errorf("got %v from the feed, want the current price and the day's once each", feed.days)
+	}
+	if _, err := s.Rate(ctx, "ETH", "USD", now); err == nil {
+		t.Error("got nil, want an error for a price that isn't a number")
+	}
+
+	if v := Value("-9.5", "0.92"); v == nil || Format(v) != "-8.74" {
+		t.Errorf("got %v, want -8.74", v)
+	}
+	if v := Value("1", ""); v != nil {
+		t.Errorf("got %v, want nil without a rate", v)
+	}
+}
@@ -0,0 +1,237 @@
+// Package signer keeps the hot wallet's keys and pays withdrawals out of it.
+// Deposit addresses stay watch-only (see hdwallet), the keys here are only for the
+// hot wallet operators top up, so a leaked server can't lose more than what's in it
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/config"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+)
+
+// Gas of a plain transfer of the chain's own currency
+const transferGas = 21000
+
+var (
+	ErrNoKey            = errors.New("no key for the address in the keystore")
+	ErrKeyExists        = errors.New("the keystore already has a key for the address")
+	ErrUnsupportedChain = errors.New("no node to broadcast on the chain")
+	// The node couldn't be reached or didn't answer, the transaction may be out there anyway
+	ErrMaybeSent = errors.New("transaction may have been broadcast")
+)
+
+// transfer(address,uint256)
+var transferSelector = []byte{0xa9, 0x05, 0x9c, 0xbb}
+
+// Keystore is a directory of keystore V3 files, one per address and all encrypted
+// with the same key encryption key. It's the format geth and MetaMask import
+type Keystore struct {
+	Dir string
+	KEK string
+	// Scrypt parameters new keys are encrypted with, tests use keystore.LightScryptN
+	ScryptN int
+	ScryptP int
+}
+
+func NewKeystore(c config.WithdrawalsConfig) *Keystore {
+	return &Keystore{Dir: c.KeystoreDir, KEK: string(c.KEK), ScryptN: keystore.StandardScryptN, ScryptP: keystore.StandardScryptP}
+}
+
+func (ks *Keystore) path(address common.Address) string {
+	return filepath.Join(ks.Dir, strings.ToLower(address.Hex()[2:])+".json")
+}
+
+// Generate makes a new key and stores it
+func (ks *Keystore) Generate() (common.Address, error) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return common.Address{}, err
+	}
+	return ks.Import(key)
+}
+
+// Import stores an existing key. Keys are never overwritten
+func (ks *Keystore) Import(priv *ecdsa.PrivateKey) (common.Address, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return common.Address{}, err
+	}
+	key := &keystore.Key{Id: id, Address: crypto.PubkeyToAddress(priv.PublicKey), PrivateKey: priv}
+	blob, err := keystore.EncryptKey(key, ks.KEK, ks.ScryptN, ks.ScryptP)
+	if err != nil {
+		return common.Address{}, err
+	}
+	if err := os.MkdirAll(ks.Dir, 0700); err != nil {
+		return common.Address{}, err
+	}
+	// Written next to where it goes and linked into place, so a crash never leaves half
+	// a key behind and a key that's already there is left alone
+	tmp, err := ioutil.TempFile(ks.Dir, ".key-*")
+	if err != nil {
+		return common.Address{}, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(blob); err != nil {
+		tmp.Close()
+		return common.Address{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return common.Address{}, err
+	}
+	if err := os.Link(tmp.Name(), ks.path(key.Address)); err != nil {
+		if os.IsExist(err) {
+			return common.Address{}, ErrKeyExists
+		}
+		return common.Address{}, err
+	}
+	return key.Address, nil
+}
+
+func (ks *Keystore) key(address common.Address) (*ecdsa.PrivateKey, error) {
+	blob, err := ioutil.ReadFile(ks.path(address))
+	if os.IsNotExist(err) {
+		return nil, ErrNoKey
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := keystore.DecryptKey(blob, ks.KEK)
+	if err != nil {
+		return nil, err
+	}
+	if key.Address != address {
+		return nil, fmt.Errorf("keystore file for %s holds the key of %s", address.Hex(), key.Address.Hex())
+	}
+	return key.PrivateKey, nil
+}
+
+// Check makes sure there's a key for address and the KEK decrypts it
+func (ks *Keystore) Check(address common.Address) error {
+	_, err := ks.key(address)
+	return err
+}
+
+// Broadcaster is what the signer needs from a node, *ethrpc.HTTPClient has it all
+type Broadcaster interface {
+	PendingNonce(ctx context.Context, account common.Address) (uint64, error)
+	BaseFee(ctx context.Context) (*big.Int, error)
+	SuggestGasTipCap(ctx context.Context) (*big.Int, error)
+	EstimateGas(ctx context.Context, msg ethrpc.CallMsg) (uint64, error)
+	SendRawTransaction(ctx context.Context, raw []byte) (common.Hash, error)
+}
+
+// Transfer is a payout from the hot wallet
+type Transfer struct {
+	Chain chain.Chain
+	Token chain.Token
+	To    common.Address
+	// In the token's base units
+	Amount *big.Int
+}
+
+// Sent is what went out for a transfer
+type Sent struct {
+	Hash  common.Hash
+	Nonce uint64
+}
+
+// Signer signs transfers with the hot wallet's key and broadcasts them
+type Signer struct {
+	Keys *Keystore
+	// The hot wallet
+	From common.Address
+	// By chain name
+	Nodes map[string]Broadcaster
+
+	// Nonces come from the node's pending count, sends are one at a time so two
+	// withdrawals never pick the same one
+	mu sync.Mutex
+}
+
+func New(keys *Keystore, from common.Address, nodes map[string]Broadcaster) *Signer {
+	return &Signer{Keys: keys, From: from, Nodes: nodes}
+}
+
+// Send signs an EIP-1559 transaction for t and broadcasts it
+func (s *Signer) Send(ctx context.Context, t Transfer) (Sent, error) {
+	node, ok := s.Nodes[t.Chain.Name]
+	if !ok {
+		return Sent{}, ErrUnsupportedChain
+	}
+	key, err := s.Keys.key(s.From)
+	if err != nil {
+		return Sent{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	to, value, data := t.To, t.Amount, []byte(nil)
+	if !t.Token.Native() {
+		to, value = common.HexToAddress(t.Token.Contract), new(big.Int)
+		data = append(append([]byte{}, transferSelector...), common.LeftPadBytes(t.To.Bytes(), 32)...)
+		data = append(data, common.LeftPadBytes(t.Amount.Bytes(), 32)...)
+	}
+	gas := uint64(transferGas)
+	if data != nil {
+		if gas, err = node.EstimateGas(ctx, ethrpc.CallMsg{From: s.From, To: to, Data: data}); err != nil {
+			return Sent{}, err
+		}
+	}
+	nonce, err := node.PendingNonce(ctx, s.From)
+	if err != nil {
+		return Sent{}, err
+	}
+	baseFee, err := node.BaseFee(ctx)
+	if err != nil {
+		return Sent{}, err
+	}
+	tip, err := node.SuggestGasTipCap(ctx)
+	if err != nil {
+		return Sent{}, err
+	}
+	// Room for the base fee to double before the transaction stops being minable
+	feeCap := new(big.Int).Add(new(big.Int).Mul(baseFee, big.NewInt(2)), tip)
+
+	chainID := big.NewInt(t.Chain.ID)
+	tx, err := types.SignNewTx(key, types.NewLondonSigner(chainID), &types.DynamicFeeTx{
+		ChainID:   chainID,
+		Nonce:     nonce,
+		GasTipCap: tip,
+		GasFeeCap: feeCap,
+		Gas:       gas,
+		To:        &to,
+		Value:     value,
+		Data:      data,
+	})
+	if err != nil {
+		return Sent{}, err
+	}
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return Sent{}, err
+	}
+	sent := Sent{Hash: tx.Hash(), Nonce: nonce}
+	if _, err := node.SendRawTransaction(ctx, raw); err != nil {
+		var rejected *ethrpc.Error
+		if errors.As(err, &rejected) {
+			return Sent{}, err
+		}
+		return sent, fmt.Errorf("%w: %v", ErrMaybeSent, err)
+	}
+	return sent, nil
+}
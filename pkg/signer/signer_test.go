@@ -0,0 +1,156 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc/ethrpctest"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func testKeystore(t *testing.T) *Keystore {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &Keystore{Dir: dir, KEK: "correct horse battery staple", ScryptN: keystore.LightScryptN, ScryptP: keystore.LightScryptP}
+}
+
+func TestSelector(t *testing.T) {
+	if want := crypto.Keccak256([]byte("transfer(address,uint256)"))[:4]; !bytes.Equal(transferSelector, want) {
+		t.Errorf("got %x, want %x", transferSelector, want)
+	}
+}
+
+func TestKeystore(t *testing.T) {
+	ks := testKeystore(t)
+	priv, _ := crypto.GenerateKey()
+	address, err := ks.Import(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := crypto.PubkeyToAddress(priv.PublicKey); address != want {
+		t.Errorf("got %v, want %v", address.Hex(), want.Hex())
+	}
+
+	t.Run("Keys are encrypted V3 files only we can read", func(t *testing.T) {
+		info, err := os.Stat(ks.path(address))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("got mode %v, want 0600", info.Mode().Perm())
+		}
+		blob, _ := ioutil.ReadFile(ks.path(address))
+		if bytes.Contains(blob, []byte(common.Bytes2Hex(crypto.FromECDSA(priv)))) {
+			t.Error("got the private key in the clear")
+		}
+		got, err := ks.key(address)
+		if err != nil || !bytes.Equal(crypto.FromECDSA(got), crypto.FromECDSA(priv)) {
+			t.Errorf("got %v, want the imported key back", err)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		if _, err := ks.Import(priv); err != ErrKeyExists {
+			t.Errorf("got %v, want %v", err, ErrKeyExists)
+		}
+		if _, err := ks.key(common.HexToAddress("0x1111111111111111111111111111111111111111")); err != ErrNoKey {
+			t.Errorf("got %v, want %v", err, ErrNoKey)
+		}
+		wrong := *ks
+		wrong.KEK = "wrong"
+		if _, err := wrong.key(address); err != keystore.ErrDecrypt {
+			t.Errorf("got %v, want %v", err, keystore.ErrDecrypt)
+		}
+		if files, _ := filepath.Glob(filepath.Join(ks.Dir, ".key-*")); len(files) != 0 {
+			t.Errorf("got %v, want no temporary files left", files)
+		}
+	})
+}
+
+func TestSend(t *testing.T) {
+	node := ethrpctest.NewNode(100)
+	server := httptest.NewServer(node)
+	defer server.Close()
+	ks := testKeystore(t)
+	from, err := ks.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(ks, from, map[string]Broadcaster{"polygon": &ethrpc.HTTPClient{URL: server.URL}})
+	ctx := context.Background()
+	polygon, _ := chain.Lookup("polygon")
+	matic, _ := polygon.Token("MATIC")
+	usdc, _ := polygon.Token("USDC")
+	creator := common.HexToAddress("0x1111111111111111111111111111111111111111")
+
+	for i, token := range []chain.Token{matic, usdc} {
+		sent, err := s.Send(ctx, Transfer{Chain: polygon, Token: token, To: creator, Amount: big.NewInt(5000)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent.Nonce != uint64(i) || len(node.Sent) != i+1 || node.Sent[i].Hash() != sent.Hash {
+			t.Fatalf("got %+v, want nonce %d broadcast", sent, i)
+		}
+	}
+
+	t.Run("EIP-1559 transactions from the hot wallet", func(t *testing.T) {
+		for _, tx := range node.Sent {
+			signer, err := types.Sender(types.NewLondonSigner(big.NewInt(137)), tx)
+			if err != nil || signer != from {
+				t.Errorf("got %v %v, want signed by %v", signer.Hex(), err, from.Hex())
+			}
+			if tx.Type() != types.DynamicFeeTxType || tx.ChainId().Int64() != 137 {
+				t.Errorf("got type %d on chain %v, want an EIP-1559 one on Polygon", tx.Type(), tx.ChainId())
+			}
+			// Twice the fake node's base fee plus its tip
+			if want := big.NewInt(90e9); tx.GasFeeCap().Cmp(want) != 0 || tx.GasTipCap().Cmp(big.NewInt(30e9)) != 0 {
+				t.Errorf("got fee cap %v tip %v, want %v", tx.GasFeeCap(), tx.GasTipCap(), want)
+			}
+		}
+	})
+
+	t.Run("Native transfers pay the creator", func(t *testing.T) {
+		tx := node.Sent[0]
+		if *tx.To() != creator || tx.Value().Int64() != 5000 || tx.Gas() != transferGas || len(tx.Data()) != 0 {
+			t.Errorf("got to %v value %v gas %d, want %d to the creator", tx.To().Hex(), tx.Value(), tx.Gas(), 5000)
+		}
+	})
+
+	t.Run("Token transfers call the contract", func(t *testing.T) {
+		tx := node.Sent[1]
+		want := append(append([]byte{}, transferSelector...), common.LeftPadBytes(creator.Bytes(), 32)...)
+		want = append(want, common.LeftPadBytes(big.NewInt(5000).Bytes(), 32)...)
+		if *tx.To() != common.HexToAddress(usdc.Contract) || tx.Value().Sign() != 0 || !bytes.Equal(tx.Data(), want) {
+			t.Errorf("got to %v data %x, want %x to the contract", tx.To().Hex(), tx.Data(), want)
+		}
+		if tx.Gas() != 65000 {
+			t.Errorf("got gas %d, want the estimate", tx.Gas())
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		ethereum, _ := chain.Lookup("ethereum")
+		eth, _ := ethereum.Token("ETH")
+		if _, err := s.Send(ctx, Transfer{Chain: ethereum, Token: eth, To: creator, Amount: big.NewInt(1)}); err != ErrUnsupportedChain {
+			t.Errorf("got %v, want %v", err, ErrUnsupportedChain)
+		}
+		other := New(ks, creator, s.Nodes)
+		if _, err := other.Send(ctx, Transfer{Chain: polygon, Token: matic, To: creator, Amount: big.NewInt(1)}); err != ErrNoKey {
+			t.Errorf("got %v, want %v", err, ErrNoKey)
+		}
+	})
+}
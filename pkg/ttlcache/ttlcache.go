@@ -0,0 +1,72 @@
+// Package ttlcache keeps answers from slow or rate limited backends around for a while.
+// It's bounded, so a flood of distinct keys can't make it grow without end
+package ttlcache
+
+import (
+	"sync"
+	"time"
+)
+
+// Entries are swept once there are this many
+const MaxEntries = 10000
+
+type entry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// Cache is safe to use from several goroutines. The zero value is an empty cache
+type Cache struct {
+	mu      sync.Mutex
+	entries map[interface{}]entry
+}
+
+// Get returns what's kept for key, if it hasn't expired yet
+func (c *Cache) Get(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !time.Now().Before(e.expires) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Set keeps value for key for ttl. Zero or less doesn't keep it at all
+func (c *Cache) Set(key, value interface{}, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[interface{}]entry{}
+	}
+	if len(c.entries) >= MaxEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	// Still full of fresh entries, start over rather than grow without bound
+	if len(c.entries) >= MaxEntries {
+		c.entries = map[interface{}]entry{}
+	}
+	c.entries[key] = entry{value: value, expires: now.Add(ttl)}
+}
+
+// Len is how many entries are kept, expired ones included until they're swept
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Clear forgets everything
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
@@ -0,0 +1,75 @@
+package ttlcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+
+	t.Run("Values are kept until they expire", func(t *testing.T) {
+		var c Cache
+		c.Set("a", 1, time.Hour)
+		c.Set("b", 2, time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+
+		if got, ok := c.Get("a"); !ok || got != 1 {
+			t.Errorf("got %v %v, want 1", got, ok)
+		}
+		if got, ok := c.Get("b"); ok {
+			t.Errorf("got %v, want it expired", got)
+		}
+		if got, ok := c.Get("c"); ok {
+			t.Errorf("got %v, want nothing for an unknown key", got)
+		}
+	})
+
+	t.Run("No TTL keeps nothing", func(t *testing.T) {
+		var c Cache
+		c.Set("a", 1, 0)
+		c.Set("b", 2, -time.Second)
+
+		if n := c.Len(); n != 0 {
+			t.Errorf("got %v entries, want none", n)
+		}
+	})
+
+	t.Run("Expired entries are swept once full", func(t *testing.T) {
+		var c Cache
+		for i := 0; i < MaxEntries-1; i++ {
+			c.Set(i, i, time.Millisecond)
+		}
+		c.Set("fresh", 1, time.Hour)
+		time.Sleep(5 * time.Millisecond)
+		c.Set("new", 2, time.Hour)
+
+		if n := c.Len(); n != 2 {
+			t.Errorf("got %v entries, want the 2 fresh ones", n)
+		}
+	})
+
+	t.Run("Starts over when full of fresh entries", func(t *testing.T) {
+		var c Cache
+		for i := 0; i < MaxEntries; i++ {
+			c.Set(i, i, time.Hour)
+		}
+		c.Set("new", 1, time.Hour)
+
+		if n := c.Len(); n != 1 {
+			t.Errorf("got %v entries, want only the new one", n)
+		}
+		if got, ok := c.Get("new"); !ok || got != 1 {
+			t.Errorf("got %v %v, want 1", got, ok)
+		}
+	})
+
+	t.Run("Clear forgets everything", func(t *testing.T) {
+		var c Cache
+		c.Set("a", 1, time.Hour)
+		c.Clear()
+
+		if _, ok := c.Get("a"); ok {
+			t.Error("got a value, want it gone")
+		}
+	})
+}
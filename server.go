@@ -1,20 +1,45 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/cryptopatron/koen-backend/pkg/auth"
+	"github.com/cryptopatron/koen-backend/pkg/blob"
+	"github.com/cryptopatron/koen-backend/pkg/chain"
+	"github.com/cryptopatron/koen-backend/pkg/config"
 	"github.com/cryptopatron/koen-backend/pkg/db"
+	"github.com/cryptopatron/koen-backend/pkg/ens"
+	"github.com/cryptopatron/koen-backend/pkg/ethrpc"
+	"github.com/cryptopatron/koen-backend/pkg/gating"
+	"github.com/cryptopatron/koen-backend/pkg/hdwallet"
+	"github.com/cryptopatron/koen-backend/pkg/media"
+	"github.com/cryptopatron/koen-backend/pkg/pagination"
+	"github.com/cryptopatron/koen-backend/pkg/prices"
+	"github.com/cryptopatron/koen-backend/pkg/signer"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
 const API_PREFIX = "/api/v1"
 
-func setupRoutes(conn db.DBConn) (fn func(r chi.Router)) {
+func setupRoutes(conn db.DBConn, store blob.Store, cfg config.Config) (fn func(r chi.Router)) {
+	signer := pagination.NewSigner(cfg.Pagination)
+	maxUploadSize := cfg.Media.MaxUploadSize
+	nodes := newNodes(cfg.Chains)
+	checker := newGateChecker(nodes, cfg.Gating)
+	deposits, err := hdwallet.NewDeposits(string(cfg.Wallets.XPub))
+	if err != nil {
+		log.Fatalf("wallets.xpub: %v", err)
+	}
+	withdrawals := newSigner(cfg)
+	rates := newPrices(cfg.Prices)
+	names := newENS(nodes, cfg.ENS)
 	return func(r chi.Router) {
 
 		r.Post("/auth/wallet", auth.HandleWalletAuthentication())
@@ -23,48 +48,133 @@ func setupRoutes(conn db.DBConn) (fn func(r chi.Router)) {
 		r.Group(func(r chi.Router) {
 			// Setup auth middleware
 			r.Use(auth.HandleJWT)
-			r.Post("/users/create", db.HandleCreateUser(conn))
+			r.Post("/users/create", db.HandleCreateUser(conn, deposits, names))
 			r.Post("/users/get", db.HandleGetUser(conn))
+			r.Post("/users/pageName", db.HandleChangePageName(conn))
+			r.Patch("/users/me", db.HandleUpdateProfile(conn))
+			r.Delete("/users/me", db.HandleDeleteAccount(conn))
+			r.Get("/users/me/export", db.HandleExportData(conn))
+			r.Get("/users/me/tiers", db.HandleListMyTiers(conn))
+			r.Post("/users/me/tiers", db.HandleCreateTier(conn))
+			r.Patch("/users/me/tiers/{id}", func(w http.ResponseWriter, r *http.Request) {
+				db.HandleUpdateTier(conn, chi.URLParam(r, "id")).ServeHTTP(w, r)
+			})
+			r.Delete("/users/me/tiers/{id}", func(w http.ResponseWriter, r *http.Request) {
+				db.HandleDeleteTier(conn, chi.URLParam(r, "id")).ServeHTTP(w, r)
+			})
+			r.Get("/users/me/subscriptions", db.HandleListMySubscriptions(conn))
+			r.Post("/users/me/subscriptions", db.HandleSubscribe(conn))
+			r.Delete("/users/me/subscriptions/{id}", func(w http.ResponseWriter, r *http.Request) {
+				db.HandleCancelSubscription(conn, chi.URLParam(r, "id")).ServeHTTP(w, r)
+			})
+			r.Get("/users/me/posts", db.HandleListMyPosts(conn, signer))
+			r.Post("/users/me/posts", db.HandleCreatePost(conn))
+			r.Patch("/users/me/posts/{id}", func(w http.ResponseWriter, r *http.Request) {
+				db.HandleUpdatePost(conn, chi.URLParam(r, "id")).ServeHTTP(w, r)
+			})
+			r.Delete("/users/me/posts/{id}", func(w http.ResponseWriter, r *http.Request) {
+				db.HandleDeletePost(conn, chi.URLParam(r, "id")).ServeHTTP(w, r)
+			})
+			// Uploads are multipart, so these need the token in the Authorization header
+			r.Post("/users/me/avatar", db.HandleUploadImage(conn, store, media.Avatar, maxUploadSize))
+			r.Post("/users/me/banner", db.HandleUploadImage(conn, store, media.Banner, maxUploadSize))
+			r.Post("/payments/verify", db.HandleVerifyPayment(conn, nodes, rates))
+			r.Get("/creators/me/earnings", db.HandleEarnings(conn, rates))
+			r.Get("/creators/me/statements/{month}", func(w http.ResponseWriter, r *http.Request) {
+				db.HandleStatement(conn, chi.URLParam(r, "month")).ServeHTTP(w, r)
+			})
+			if withdrawals != nil {
+				r.Get("/users/me/withdrawals", db.HandleListMyWithdrawals(conn))
+				r.Post("/users/me/withdrawals", db.HandleRequestWithdrawal(conn, withdrawals, cfg.Withdrawals))
+			}
 		})
 
 		// Public routes
 		r.Get("/users/pageName/{pageName}", func(w http.ResponseWriter, r *http.Request) {
 			if pageName := chi.URLParam(r, "pageName"); pageName != "" {
-				db.GetUser(conn, map[string]string{"pageName": pageName}).ServeHTTP(w, r)
+				db.GetUser(conn, pageName).ServeHTTP(w, r)
 			}
 		})
+		r.Get("/users/search", db.HandleSearchCreators(conn, signer))
+		r.Get("/pageNames/{name}/available", func(w http.ResponseWriter, r *http.Request) {
+			db.HandlePageNameAvailable(conn, chi.URLParam(r, "name")).ServeHTTP(w, r)
+		})
+
+		// Public, but patrons signed in see more of them
+		r.Group(func(r chi.Router) {
+			r.Use(auth.OptionalJWT)
+			r.Get("/users/pageName/{pageName}/posts", func(w http.ResponseWriter, r *http.Request) {
+				db.HandleCreatorFeed(conn, checker, signer, chi.URLParam(r, "pageName")).ServeHTTP(w, r)
+			})
+			r.Get("/posts/{id}", func(w http.ResponseWriter, r *http.Request) {
+				db.HandleGetPost(conn, checker, chi.URLParam(r, "id")).ServeHTTP(w, r)
+			})
+			// Files of gated posts are only handed out to the ones who can see them
+			postGate := checker.Require(func(r *http.Request) (*gating.Rule, error) {
+				return db.PostGate(conn, r, chi.URLParam(r, "id"))
+			})
+			r.With(postGate).Get("/posts/{id}/attachments", func(w http.ResponseWriter, r *http.Request) {
+				db.HandleGetPostAttachments(conn, checker, chi.URLParam(r, "id")).ServeHTTP(w, r)
+			})
+		})
 	}
 }
 
 func main() {
-	servePath := flag.String("servePath", "../front-end/dist/dropcoin/", "Path to serve static files from")
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keystore" {
+		if err := runKeystore(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "indexer" {
+		if err := runIndexer(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Loaded %s config:\n%s", cfg.Env, cfg)
+	auth.Configure(cfg.Auth)
+	db.ConfigurePageNames(cfg.PageNames)
+	db.ConfigureAccounts(cfg.Accounts)
+	db.ConfigureSubscriptions(cfg.Subscriptions)
+	db.ConfigureEarnings(cfg.Earnings)
 
 	router := chi.NewRouter()
 	router.Use(middleware.Logger)
 
-	// Setup file serving from web app
-	setupFileServer(router, *servePath)
-
-	ver := os.Getenv("VERSION")
-	dbName := "koen"
-	if ver == "" || ver == "test" {
-		dbName = "koen_test"
+	// Uploads kept on disk are served by us, before the web app claims every path
+	store := newBlobStore(cfg.Media)
+	if cfg.Media.Storage == config.BlobLocal {
+		setupMediaServer(router, cfg.Media)
 	}
 
+	// Setup file serving from web app
+	setupFileServer(router, cfg.ServePath)
+
 	// Connect to DB
-	var conn db.DBConn = &db.MongoInstance{Database: dbName, Collection: "users"}
+	conn := newDBConn(cfg)
 	conn.Open()
 	defer conn.Close()
+	go db.RunAccountPurger(context.Background(), conn, store, cfg.Accounts)
+	go db.RunSubscriptionScheduler(context.Background(), conn, cfg.Subscriptions)
 
 	// TODO: Write tests for server endpoints
 	// Setup REST API endpoints
-	router.Route(API_PREFIX, setupRoutes(conn))
+	router.Route(API_PREFIX, setupRoutes(conn, store, cfg))
 	// Our application will run on port 8080. Here we declare the port and pass in our router.
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8008"
-	}
+	port := cfg.Port
 	http.ListenAndServe(":"+port, router)
 	fmt.Printf("Running GO backend on port %s", port)
 }
@@ -85,3 +195,121 @@ func setupFileServer(router *chi.Mux, root string) {
 		}
 	})
 }
+
+// Serves the local blob store's directory, without listing what's in it
+func setupMediaServer(router *chi.Mux, cfg config.MediaConfig) {
+	base := strings.TrimSuffix(cfg.BaseURL, "/")
+	if !strings.HasPrefix(base, "/") {
+		// Served from somewhere else
+		return
+	}
+	fs := http.StripPrefix(base, http.FileServer(http.Dir(cfg.Dir)))
+	router.Get(base+"/*", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		fs.ServeHTTP(w, r)
+	})
+}
+
+// Picks where uploads are stored
+func newBlobStore(cfg config.MediaConfig) blob.Store {
+	if cfg.Storage == config.BlobS3 {
+		return &blob.S3Store{
+			Endpoint:  cfg.S3.Endpoint,
+			Region:    cfg.S3.Region,
+			Bucket:    cfg.S3.Bucket,
+			AccessKey: cfg.S3.AccessKey,
+			SecretKey: string(cfg.S3.SecretKey),
+			PublicURL: cfg.S3.PublicURL,
+		}
+	}
+	return &blob.LocalStore{Dir: cfg.Dir, BaseURL: cfg.BaseURL}
+}
+
+// Nodes for the chains we have an RPC endpoint for, payments on others can't be verified
+func newNodes(cfg config.ChainsConfig) map[string]db.Node {
+	nodes := map[string]db.Node{}
+	for _, c := range chain.Chains {
+		chainCfg, ok := cfg.ByName(c.Name)
+		if !ok || chainCfg.RPCURL == "" {
+			continue
+		}
+		nodes[c.Name] = db.Node{
+			Client:        &ethrpc.HTTPClient{URL: string(chainCfg.RPCURL)},
+			Confirmations: uint64(chainCfg.Confirmations),
+		}
+	}
+	return nodes
+}
+
+// Token-gated posts are checked against the same nodes payments are verified with
+func newGateChecker(nodes map[string]db.Node, cfg config.GatingConfig) *gating.Checker {
+	clients := map[string]ethrpc.Client{}
+	for name, node := range nodes {
+		clients[name] = node.Client
+	}
+	return gating.NewChecker(clients, cfg)
+}
+
+// ENS lives on Ethereum, wallet users go without names unless there's a node for it
+func newENS(nodes map[string]db.Node, cfg config.ENSConfig) *ens.Resolver {
+	node, ok := nodes["ethereum"]
+	if !ok {
+		return nil
+	}
+	return ens.New(node.Client, cfg)
+}
+
+// Amounts are only shown in tokens without a price feed
+func newPrices(cfg config.PricesConfig) *prices.Service {
+	if cfg.URL == "" {
+		return nil
+	}
+	return prices.New(prices.NewHTTPFeed(cfg), cfg)
+}
+
+// Withdrawals are off without a keystore. The hot wallet's key is checked up front,
+// so a wrong KEK shows up on startup and not on the first withdrawal
+func newSigner(cfg config.Config) *signer.Signer {
+	if cfg.Withdrawals.KeystoreDir == "" {
+		return nil
+	}
+	keys := signer.NewKeystore(cfg.Withdrawals)
+	hot := common.HexToAddress(cfg.Withdrawals.HotWallet)
+	if err := keys.Check(hot); err != nil {
+		log.Fatalf("withdrawals.hotWallet: %v", err)
+	}
+	nodes := map[string]signer.Broadcaster{}
+	for _, c := range chain.Chains {
+		if chainCfg, ok := cfg.Chains.ByName(c.Name); ok && chainCfg.RPCURL != "" {
+			nodes[c.Name] = &ethrpc.HTTPClient{URL: string(chainCfg.RPCURL)}
+		}
+	}
+	return signer.New(keys, hot, nodes)
+}
+
+// Picks the data layer implementation for the configured storage
+func newDBConn(cfg config.Config) db.DBConn {
+	switch cfg.Storage {
+	case config.StorageSQLite, config.StoragePostgres:
+		driver := db.SQLite
+		if cfg.Storage == config.StoragePostgres {
+			driver = db.Postgres
+		}
+		return &db.SQLInstance{
+			Driver:         driver,
+			DSN:            string(cfg.SQL.DSN),
+			ConnectTimeout: cfg.SQL.ConnectTimeout,
+			Timeout:        cfg.SQL.Timeout,
+		}
+	default:
+		return &db.MongoInstance{
+			URI:            string(cfg.Mongo.URI),
+			Database:       cfg.Mongo.Database,
+			ConnectTimeout: cfg.Mongo.ConnectTimeout,
+			Timeout:        cfg.Mongo.Timeout,
+		}
+	}
+}